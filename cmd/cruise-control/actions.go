@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Action is an action a filter runs on the packets it matched. The actions of a filter run in order,
+// until an action does not pipe the packets to the next one.
+type Action struct {
+	// Kind is "mirred", "skbedit", "connmark", "pedit", "csum" or "gact"
+	Kind string
+	// Device is the device mirred redirects the packets to, or copies them to with Mirror. The
+	// packets enter the egress of the device, or its ingress with Ingress.
+	Device  string `json:",omitempty"`
+	Mirror  bool   `json:",omitempty"`
+	Ingress bool   `json:",omitempty"`
+	// Priority is the class skbedit sets as the priority of the packets, eg. "1:21". HTB and HFSC
+	// qdiscs classify packets into the class of their priority.
+	Priority string `json:",omitempty"`
+	// Mark is the firewall mark skbedit sets on the bits of Mask, all bits by default
+	Mark *uint32 `json:",omitempty"`
+	Mask *uint32 `json:",omitempty"`
+	// Zone is the conntrack zone connmark restores the mark of the connection of the packets from
+	Zone uint16 `json:",omitempty"`
+	// DSCP is the code point pedit writes in the IPv4 or IPv6 header, the filter must match either
+	// protocol. The checksum of IPv4 headers is updated by a csum action that follows pedit.
+	DSCP *uint8 `json:",omitempty"`
+	// Control is what happens after the action: "pipe" to the next action, "ok", "continue",
+	// "drop", "reclassify" or "stolen". It is "pipe" by default, or "stolen" for redirects.
+	Control string `json:",omitempty"`
+}
+
+// actionControls maps the control names of the `tc` command-line tool on their values
+var actionControls = map[string]uint32{
+	"ok": tc.ActOk, "pass": tc.ActOk,
+	"continue":   actUnspec,
+	"drop":       tc.ActShot,
+	"shot":       tc.ActShot,
+	"pipe":       tc.ActPipe,
+	"reclassify": tc.ActReclassify,
+	"stolen":     tc.ActStolen,
+}
+
+// controlName is the name of a control value as used in the config
+func controlName(control uint32) string {
+	for _, name := range []string{"ok", "continue", "drop", "pipe", "reclassify", "stolen"} {
+		if actionControls[name] == control {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", int32(control))
+}
+
+// defaultControl is the control of an action without one
+func (a Action) defaultControl() uint32 {
+	if a.Kind == "mirred" && !a.Mirror {
+		return tc.ActStolen
+	}
+	return tc.ActPipe
+}
+
+// control returns the value of the control of the action
+func (a Action) control() (uint32, error) {
+	if a.Control == "" {
+		return a.defaultControl(), nil
+	}
+	control, ok := actionControls[a.Control]
+	if !ok {
+		return 0, fmt.Errorf("unknown control %q", a.Control)
+	}
+	return control, nil
+}
+
+// validate checks the parameters of an action
+func (a Action) validate() error {
+	if _, err := a.control(); err != nil {
+		return err
+	}
+	switch a.Kind {
+	case "mirred":
+		if a.Device == "" {
+			return errors.New("mirred needs a device")
+		}
+	case "skbedit":
+		if a.Priority == "" && a.Mark == nil {
+			return errors.New("skbedit needs a priority or a mark")
+		}
+		if a.Priority != "" {
+			if _, err := StrHandle(a.Priority); err != nil {
+				return fmt.Errorf("invalid priority %q", a.Priority)
+			}
+		}
+		if a.Mask != nil && a.Mark == nil {
+			return errors.New("skbedit mask without mark")
+		}
+	case "pedit":
+		if a.DSCP == nil {
+			return errors.New("pedit needs a DSCP")
+		}
+		if *a.DSCP > 63 {
+			return fmt.Errorf("DSCP %d is larger than 63", *a.DSCP)
+		}
+	case "connmark", "csum", "gact":
+	default:
+		return fmt.Errorf("unknown action %q", a.Kind)
+	}
+	return nil
+}
+
+// String describes the action in the notation of the `tc` command-line tool, eg. "mirred egress
+// redirect dev ifb0". The control is only shown when it is not the default.
+func (a Action) String() string {
+	var parts []string
+	switch a.Kind {
+	case "mirred":
+		direction, mode := "egress", "redirect"
+		if a.Ingress {
+			direction = "ingress"
+		}
+		if a.Mirror {
+			mode = "mirror"
+		}
+		parts = append(parts, "mirred", direction, mode, "dev", a.Device)
+	case "skbedit":
+		parts = append(parts, "skbedit")
+		if h, err := StrHandle(a.Priority); err == nil && a.Priority != "" {
+			parts = append(parts, "priority", FmtHandle(h))
+		}
+		if a.Mark != nil {
+			mask := uint32(0xffffffff)
+			if a.Mask != nil {
+				mask = *a.Mask
+			}
+			parts = append(parts, fmt.Sprintf("mark 0x%x/0x%x", *a.Mark, mask))
+		}
+	case "connmark":
+		parts = append(parts, "connmark")
+		if a.Zone != 0 {
+			parts = append(parts, fmt.Sprintf("zone %d", a.Zone))
+		}
+	case "pedit":
+		parts = append(parts, "pedit")
+		if a.DSCP != nil {
+			parts = append(parts, fmt.Sprintf("dscp %d", *a.DSCP))
+		}
+	default:
+		parts = append(parts, a.Kind)
+	}
+	if control, err := a.control(); err != nil || control != a.defaultControl() {
+		parts = append(parts, controlName(control))
+	}
+	return strings.Join(parts, " ")
+}
+
+// actionsLabel describes a list of actions
+func actionsLabel(actions []Action) string {
+	labels := make([]string, len(actions))
+	for i, a := range actions {
+		labels[i] = a.String()
+	}
+	return strings.Join(labels, " ")
+}
+
+// equalActions reports whether the live actions l are the desired actions d
+func equalActions(d, l []Action) bool {
+	return actionsLabel(d) == actionsLabel(l)
+}
+
+// applyActions checks the actions of the filters of the config. The actions are added to the nodes
+// of the filters by NodesFromConfig.
+func (conf *TcConfig) applyActions() error {
+	var names []string
+	for name := range conf.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, ok := conf.Filters[name]
+		if !ok {
+			return fmt.Errorf("actions of %s: filter does not exist", name)
+		}
+		switch f.Kind {
+		case "u32", "fw", "matchall", "flower":
+		default:
+			return fmt.Errorf("actions of %s: %s filters do not support actions", name, f.Kind)
+		}
+		for i, a := range conf.Actions[name] {
+			if err := a.validate(); err != nil {
+				return fmt.Errorf("actions of %s: action %d: %v", name, i+1, err)
+			}
+			if a.Kind == "pedit" {
+				if _, err := ipProtocol(f); err != nil {
+					return fmt.Errorf("actions of %s: %v", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ipProtocol returns the IP protocol of the packets a filter matches, ETH_P_IP or ETH_P_IPV6. The
+// protocol of VLAN filters is the one after their tag.
+func ipProtocol(obj tc.Object) (uint16, error) {
+	_, protocol := splitInfo(obj.Info)
+	if protocol == unix.ETH_P_8021Q && obj.Flower != nil && obj.Flower.KeyVlanEthType != nil {
+		protocol = *obj.Flower.KeyVlanEthType
+	}
+	if protocol != unix.ETH_P_IP && protocol != unix.ETH_P_IPV6 {
+		return 0, fmt.Errorf("pedit needs a filter of the ip or ipv6 protocol, not 0x%04x", protocol)
+	}
+	return protocol, nil
+}
+
+// filterActions returns the actions of a filter node, the actions of its object followed by the
+// actions of the node. Police actions are left out, they are compared on their own.
+func filterActions(n *Node) []Action {
+	var actions []Action
+	attr := n.Object.Attribute
+	var list *[]*tc.Action
+	switch {
+	case attr.U32 != nil:
+		list = attr.U32.Actions
+	case attr.Fw != nil:
+		list = attr.Fw.Actions
+	case attr.Matchall != nil:
+		list = attr.Matchall.Actions
+	case attr.Flower != nil:
+		list = attr.Flower.Actions
+	case attr.BPF != nil && attr.BPF.Action != nil:
+		list = &[]*tc.Action{attr.BPF.Action}
+	}
+	if list != nil {
+		for _, a := range *list {
+			if a.Kind != "police" {
+				actions = append(actions, actionFromTc(a))
+			}
+		}
+	}
+	return append(actions, n.Actions...)
+}
+
+// actionFromTc converts an action of github.com/florianl/go-tc
+func actionFromTc(a *tc.Action) Action {
+	action := Action{Kind: a.Kind}
+	control := uint32(tc.ActPipe)
+	switch {
+	case a.Mirred != nil && a.Mirred.Parms != nil:
+		p := a.Mirred.Parms
+		control = p.Action
+		action.Device = deviceName(p.IfIndex)
+		action.Ingress = p.Eaction == tcaIngressRedir || p.Eaction == tcaIngressMirror
+		action.Mirror = p.Eaction == tcaEgressMirror || p.Eaction == tcaIngressMirror
+	case a.SkbEdit != nil:
+		if a.SkbEdit.Parms != nil {
+			control = a.SkbEdit.Parms.Action
+		}
+		if a.SkbEdit.Priority != nil {
+			action.Priority = FmtHandle(*a.SkbEdit.Priority)
+		}
+		action.Mark, action.Mask = a.SkbEdit.Mark, a.SkbEdit.Mask
+	case a.ConnMark != nil && a.ConnMark.Parms != nil:
+		control, action.Zone = a.ConnMark.Parms.Action, a.ConnMark.Parms.Zone
+	case a.CSum != nil && a.CSum.Parms != nil:
+		control = a.CSum.Parms.Action
+	case a.Gact != nil && a.Gact.Parms != nil:
+		control = a.Gact.Parms.Action
+	}
+	if control != action.defaultControl() {
+		action.Control = controlName(control)
+	}
+	return action
+}
+
+// deviceName returns the name of a device, or its index when it does not exist
+func deviceName(ifindex uint32) string {
+	if interf, err := net.InterfaceByIndex(int(ifindex)); err == nil {
+		return interf.Name
+	}
+	return fmt.Sprintf("%d", ifindex)
+}
+
+// Attributes and parameters of actions, from include/uapi/linux/tc_act. go-tc neither encodes nor
+// decodes pedit actions, so filters with pedit actions are encoded and decoded here.
+const (
+	tcaActIndex       = 3
+	tcaEgressMirror   = 2
+	tcaIngressRedir   = 3
+	tcaIngressMirror  = 4
+	tcaMirredParms    = 2
+	tcaSkbeditParms   = 2
+	tcaSkbeditPrio    = 3
+	tcaSkbeditMark    = 5
+	tcaSkbeditMask    = 8
+	tcaConnmarkParms  = 1
+	tcaPeditParms     = 2
+	tcaCsumParms      = 1
+	tcaGactParms      = 2
+	tcaCsumUpdateIPv4 = 1
+	// tcGenSize is the size of tc_gen, the parameters all actions start with
+	tcGenSize = 20
+	// peditKeySize is the size of struct tc_pedit_key
+	peditKeySize = 24
+)
+
+// actionParms is the attribute of the parameters of each kind of action, which start with tc_gen
+var actionParms = map[string]uint16{
+	"mirred": tcaMirredParms, "skbedit": tcaSkbeditParms, "connmark": tcaConnmarkParms,
+	"pedit": tcaPeditParms, "csum": tcaCsumParms, "gact": tcaGactParms,
+}
+
+// dscpKey returns the mask and value of the pedit key that writes dscp in the first word of the
+// IPv4 or IPv6 header, which holds the TOS or the traffic class. The ECN bits are kept.
+func dscpKey(protocol uint16, dscp uint8) (mask, val uint32) {
+	shift := uint32(18)
+	if protocol == unix.ETH_P_IPV6 {
+		shift = 22
+	}
+	return ^(uint32(0x3f) << shift), uint32(dscp) << shift
+}
+
+// tcGen encodes tc_gen with the control of an action
+func tcGen(control uint32, size int) []byte {
+	b := make([]byte, size)
+	nlenc.NativeEndian().PutUint32(b[8:], control)
+	return b
+}
+
+// marshalActions encodes actions for filters of protocol. The pedit action of an IPv4 filter is
+// followed by a csum action with the control of the pedit action.
+func marshalActions(actions []Action, protocol uint16) func(*netlink.AttributeEncoder) error {
+	return func(ae *netlink.AttributeEncoder) error {
+		index := uint16(0)
+		add := func(kind string, options func(*netlink.AttributeEncoder) error) {
+			index++
+			ae.Nested(index, func(ae *netlink.AttributeEncoder) error {
+				ae.String(tcaActKind, kind)
+				ae.Nested(tcaActOptions, options)
+				return nil
+			})
+		}
+		for _, a := range actions {
+			control, err := a.control()
+			if err != nil {
+				return err
+			}
+			switch a.Kind {
+			case "mirred":
+				dev, err := net.InterfaceByName(a.Device)
+				if err != nil {
+					return fmt.Errorf("mirred: %v", err)
+				}
+				eaction := map[[2]bool]uint32{
+					{false, false}: tcaEgressRedir, {false, true}: tcaEgressMirror,
+					{true, false}: tcaIngressRedir, {true, true}: tcaIngressMirror,
+				}[[2]bool{a.Ingress, a.Mirror}]
+				parms := tcGen(control, tcGenSize+8)
+				nlenc.NativeEndian().PutUint32(parms[tcGenSize:], eaction)
+				nlenc.NativeEndian().PutUint32(parms[tcGenSize+4:], uint32(dev.Index))
+				add(a.Kind, func(ae *netlink.AttributeEncoder) error {
+					ae.Bytes(tcaMirredParms, parms)
+					return nil
+				})
+			case "skbedit":
+				add(a.Kind, func(ae *netlink.AttributeEncoder) error {
+					ae.Bytes(tcaSkbeditParms, tcGen(control, tcGenSize))
+					if a.Priority != "" {
+						h, err := StrHandle(a.Priority)
+						if err != nil {
+							return fmt.Errorf("skbedit: invalid priority %q", a.Priority)
+						}
+						ae.Uint32(tcaSkbeditPrio, h)
+					}
+					if a.Mark != nil {
+						ae.Uint32(tcaSkbeditMark, *a.Mark)
+					}
+					if a.Mask != nil {
+						ae.Uint32(tcaSkbeditMask, *a.Mask)
+					}
+					return nil
+				})
+			case "connmark":
+				// struct tc_connmark is padded to 24 bytes
+				parms := tcGen(control, tcGenSize+4)
+				nlenc.NativeEndian().PutUint16(parms[tcGenSize:], a.Zone)
+				add(a.Kind, func(ae *netlink.AttributeEncoder) error {
+					ae.Bytes(tcaConnmarkParms, parms)
+					return nil
+				})
+			case "pedit":
+				if a.DSCP == nil || protocol != unix.ETH_P_IP && protocol != unix.ETH_P_IPV6 {
+					return errors.New("pedit needs a DSCP and a filter of the ip or ipv6 protocol")
+				}
+				peditControl := control
+				if protocol == unix.ETH_P_IP {
+					peditControl = tc.ActPipe
+				}
+				// struct tc_pedit_sel with a single key on the first word of the network header
+				mask, val := dscpKey(protocol, *a.DSCP)
+				parms := tcGen(peditControl, tcGenSize+4+peditKeySize)
+				parms[tcGenSize] = 1
+				nlenc.NativeEndian().PutUint32(parms[tcGenSize+4:], htonl(mask))
+				nlenc.NativeEndian().PutUint32(parms[tcGenSize+8:], htonl(val))
+				add(a.Kind, func(ae *netlink.AttributeEncoder) error {
+					ae.Bytes(tcaPeditParms, parms)
+					return nil
+				})
+				if protocol == unix.ETH_P_IP {
+					add("csum", marshalCsum(control))
+				}
+			case "csum":
+				add(a.Kind, marshalCsum(control))
+			case "gact":
+				add(a.Kind, func(ae *netlink.AttributeEncoder) error {
+					ae.Bytes(tcaGactParms, tcGen(control, tcGenSize))
+					return nil
+				})
+			default:
+				return fmt.Errorf("can not encode %s action", a.Kind)
+			}
+		}
+		return nil
+	}
+}
+
+// marshalCsum encodes a csum action that updates the checksum of the IPv4 header
+func marshalCsum(control uint32) func(*netlink.AttributeEncoder) error {
+	return func(ae *netlink.AttributeEncoder) error {
+		parms := tcGen(control, tcGenSize+4)
+		nlenc.NativeEndian().PutUint32(parms[tcGenSize:], tcaCsumUpdateIPv4)
+		ae.Bytes(tcaCsumParms, parms)
+		return nil
+	}
+}
+
+// unmarshalActions decodes the actions of a filter of protocol. A pedit action that writes the DSCP
+// of an IPv4 header and the csum action after it are one action.
+func unmarshalActions(ad *netlink.AttributeDecoder, protocol uint16) []Action {
+	var actions []Action
+	for ad.Next() {
+		ad.Nested(func(ad *netlink.AttributeDecoder) error {
+			var kind string
+			var options []byte
+			for ad.Next() {
+				switch ad.Type() {
+				case tcaActKind:
+					kind = ad.String()
+				case tcaActOptions:
+					options = ad.Bytes()
+				}
+			}
+			actions = append(actions, unmarshalAction(kind, options, protocol))
+			return nil
+		})
+	}
+	for i := 0; i+1 < len(actions); i++ {
+		if a := actions[i]; a.Kind == "pedit" && a.DSCP != nil && protocol == unix.ETH_P_IP && a.Control == "" &&
+			actions[i+1].Kind == "csum" {
+			a.Control = actions[i+1].Control
+			actions = append(append(actions[:i], a), actions[i+2:]...)
+		}
+	}
+	return actions
+}
+
+// unmarshalAction decodes the options of an action. Parameters that are not modelled leave the
+// action without them, so it differs from the desired action.
+func unmarshalAction(kind string, options []byte, protocol uint16) Action {
+	a := Action{Kind: kind}
+	control := uint32(tc.ActPipe)
+	ad, err := netlink.NewAttributeDecoder(options)
+	if err != nil {
+		return a
+	}
+	for ad.Next() {
+		data := ad.Bytes()
+		if ad.Type() == actionParms[kind] && len(data) >= tcGenSize {
+			control = nlenc.NativeEndian().Uint32(data[8:])
+		}
+		switch {
+		case kind == "mirred" && ad.Type() == tcaMirredParms && len(data) >= tcGenSize+8:
+			eaction := nlenc.NativeEndian().Uint32(data[tcGenSize:])
+			a.Device = deviceName(nlenc.NativeEndian().Uint32(data[tcGenSize+4:]))
+			a.Ingress = eaction == tcaIngressRedir || eaction == tcaIngressMirror
+			a.Mirror = eaction == tcaEgressMirror || eaction == tcaIngressMirror
+		case kind == "skbedit" && ad.Type() == tcaSkbeditPrio:
+			a.Priority = FmtHandle(ad.Uint32())
+		case kind == "skbedit" && ad.Type() == tcaSkbeditMark:
+			mark := ad.Uint32()
+			a.Mark = &mark
+		case kind == "skbedit" && ad.Type() == tcaSkbeditMask:
+			mask := ad.Uint32()
+			a.Mask = &mask
+		case kind == "connmark" && ad.Type() == tcaConnmarkParms && len(data) >= tcGenSize+2:
+			a.Zone = nlenc.NativeEndian().Uint16(data[tcGenSize:])
+		case kind == "pedit" && ad.Type() == tcaPeditParms && len(data) == tcGenSize+4+peditKeySize && data[tcGenSize] == 1:
+			key := data[tcGenSize+4:]
+			mask, val := ntohl(nlenc.NativeEndian().Uint32(key)), ntohl(nlenc.NativeEndian().Uint32(key[4:]))
+			dscp := uint8(val>>18) & 0x3f
+			if protocol == unix.ETH_P_IPV6 {
+				dscp = uint8(val>>22) & 0x3f
+			}
+			// the offset, at, offmask and shift of the key are 0
+			wantMask, wantVal := dscpKey(protocol, dscp)
+			if mask == wantMask && val == wantVal && string(key[8:]) == string(make([]byte, 16)) {
+				a.DSCP = &dscp
+			}
+		case kind == "csum" && ad.Type() == tcaCsumParms && len(data) >= tcGenSize+4:
+			if flags := nlenc.NativeEndian().Uint32(data[tcGenSize:]); flags != tcaCsumUpdateIPv4 {
+				a.Kind = fmt.Sprintf("csum 0x%x", flags)
+			}
+		}
+	}
+	if control != a.defaultControl() {
+		a.Control = controlName(control)
+	}
+	return a
+}
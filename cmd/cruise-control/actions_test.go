@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+func TestTrafficFileActions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "actions.json")
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 2}, Gbit, 100*Mbit, SimpleProfile{})
+	conf.Filters = map[string]tc.Object{}
+	conf.Flows = map[string]FlowRule{
+		"voip": {FlowMatch: FlowMatch{Proto: "udp", DstPort: "5060"}, Class: "prio"},
+	}
+	ef, mark := uint8(46), uint32(0x10)
+	conf.Actions = map[string][]Action{
+		"voip/0": {{Kind: "pedit", DSCP: &ef}, {Kind: "mirred", Device: "lo", Mirror: true}},
+		"voip/1": {{Kind: "skbedit", Mark: &mark}, {Kind: "connmark", Control: "ok"}},
+	}
+	if err := conf.generateTrafficFile(file); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseTrafficFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, filters := NodesFromConfig(parsed)
+	labels := map[string]string{}
+	for _, f := range filters {
+		labels[f.Name] = filterLabel(f)
+	}
+	if label := labels["voip/0"]; !strings.HasSuffix(label, "dst_port 5060 pedit dscp 46 mirred egress mirror dev lo") {
+		t.Errorf("unexpected IPv4 filter %q", label)
+	}
+	if label := labels["voip/1"]; !strings.HasSuffix(label, "skbedit mark 0x10/0xffffffff connmark ok") {
+		t.Errorf("unexpected IPv6 filter %q", label)
+	}
+
+	for _, c := range []struct {
+		actions map[string][]Action
+		problem string
+	}{
+		{map[string][]Action{"sip": {{Kind: "gact"}}}, "actions of sip: filter does not exist"},
+		{map[string][]Action{"voip/0": {{Kind: "nat"}}}, `action 1: unknown action "nat"`},
+		{map[string][]Action{"voip/0": {{Kind: "gact", Control: "accept"}}}, `unknown control "accept"`},
+		{map[string][]Action{"voip/0": {{Kind: "mirred"}}}, "mirred needs a device"},
+		{map[string][]Action{"voip/1": {{Kind: "skbedit", Priority: "x"}}}, `invalid priority "x"`},
+		{map[string][]Action{"voip/1": {{Kind: "pedit"}}}, "pedit needs a DSCP"},
+	} {
+		conf.Actions = c.actions
+		conf.generateTrafficFile(file)
+		if _, err := parseTrafficFile(file); err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("expected %q, got %v", c.problem, err)
+		}
+	}
+
+	// pedit rewrites the header of a single IP protocol
+	all := conf.Filters
+	all["any"] = tc.Object{
+		Msg:       tc.Msg{Info: core.BuildHandle(1, uint32(htons(unix.ETH_P_ALL)))},
+		Attribute: tc.Attribute{Kind: "matchall", Matchall: &tc.Matchall{}},
+	}
+	conf.Flows, conf.Actions = nil, map[string][]Action{"any": {{Kind: "pedit", DSCP: &ef}}}
+	conf.generateTrafficFile(file)
+	if _, err := parseTrafficFile(file); err == nil || !strings.Contains(err.Error(), "pedit needs a filter of the ip or ipv6 protocol") {
+		t.Errorf("expected the pedit action of all protocols to be refused, got %v", err)
+	}
+}
+
+func TestFilterActionsRoundTrip(t *testing.T) {
+	ef, cs1 := uint8(46), uint8(8)
+	mark, mask := uint32(0x100), uint32(0xff00)
+	filters, _, err := flowerFilters(FlowMatch{Dst: "10.0.0.0/8", Proto: "tcp", DstPort: "443"}, 2, core.BuildHandle(1, 0),
+		core.BuildHandle(1, 0x21), true, flowPrioBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flower := NewNodeWithObject("filter", filters[0])
+	flower.Actions = []Action{{Kind: "pedit", DSCP: &ef, Control: "ok"}}
+
+	host, _ := ParseHostMatch("2001:db8::1")
+	u32, err := hostFilter(tc.Object{Msg: tc.Msg{Ifindex: 2, Handle: core.BuildHandle(1, 0)}}, host, false, core.BuildHandle(1, 0x22), 0x100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6 := NewNodeWithObject("filter", u32)
+	v6.Actions = []Action{
+		{Kind: "pedit", DSCP: &cs1},
+		{Kind: "skbedit", Priority: "1:22", Mark: &mark, Mask: &mask},
+		{Kind: "connmark", Zone: 3},
+		{Kind: "mirred", Device: "lo", Ingress: true},
+	}
+
+	for _, d := range []*Node{flower, v6} {
+		protocol, err := ipProtocol(d.Object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := marshalFilter(d.Object, nil, marshalActions(filterActions(d), protocol))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := unmarshalFilter(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameFilter(d, l) || !equalFilter(d, l) {
+			t.Errorf("expected the decoded filter to equal %s, got %s", filterLabel(d), filterLabel(l))
+		}
+	}
+	// the skbedit action of the flow and the csum action after the pedit action of IPv4
+	if label := filterLabel(flower); !strings.HasSuffix(label, "skbedit priority 1:21 pedit dscp 46 ok") {
+		t.Errorf("unexpected label %q", label)
+	}
+	data, _ := marshalFilter(flower.Object, nil, marshalActions(filterActions(flower), unix.ETH_P_IP))
+	if live, _ := unmarshalFilter(data); len(live.Actions) != 2 {
+		t.Errorf("expected the csum action to be part of pedit, got %s", actionsLabel(live.Actions))
+	}
+	if target, ok := filterTarget(flower); !ok || target != core.BuildHandle(1, 0x21) {
+		t.Errorf("expected the skbedit priority to be the target, got %s", FmtHandle(target))
+	}
+
+	// pedit of IPv4 keeps the ECN bits of the TOS and rewrites the DSCP
+	mask4, val4 := dscpKey(unix.ETH_P_IP, ef)
+	if word := uint32(0x45000100)&mask4 ^ val4; word != 0x45b80100 {
+		t.Errorf("unexpected first word 0x%08x", word)
+	}
+	mask6, val6 := dscpKey(unix.ETH_P_IPV6, cs1)
+	if word := uint32(0x60312345)&mask6 ^ val6; word != 0x62312345 {
+		t.Errorf("unexpected first word 0x%08x", word)
+	}
+
+	// bpf filters are not encoded here
+	if _, err := marshalFilter(tc.Object{Attribute: tc.Attribute{Kind: "bpf", BPF: &tc.Bpf{}}}, nil, marshalActions(nil, 0)); err == nil {
+		t.Error("expected the bpf filter to be refused")
+	}
+	if _, err := marshalFilter(flower.Object, nil, marshalActions(flower.Actions, unix.ETH_P_ALL)); err == nil {
+		t.Error("expected the pedit action of all protocols to be refused")
+	}
+}
+
+func TestEqualActions(t *testing.T) {
+	ef := uint8(46)
+	desired := NewNodeWithObject("filter", tc.Object{
+		Msg:       tc.Msg{Info: core.BuildHandle(1, uint32(htons(unix.ETH_P_IP)))},
+		Attribute: tc.Attribute{Kind: "matchall", Matchall: &tc.Matchall{}},
+	})
+	desired.Actions = []Action{{Kind: "mirred", Device: "lo"}, {Kind: "pedit", DSCP: &ef}}
+	live := func(actions ...Action) *Node {
+		n := *desired
+		n.Actions = actions
+		return &n
+	}
+	other := uint8(10)
+	for _, c := range []struct {
+		live  *Node
+		equal bool
+	}{
+		{live(Action{Kind: "mirred", Device: "lo", Control: "stolen"}, Action{Kind: "pedit", DSCP: &ef, Control: "pipe"}), true},
+		{live(Action{Kind: "mirred", Device: "lo", Mirror: true}, Action{Kind: "pedit", DSCP: &ef}), false},
+		{live(Action{Kind: "mirred", Device: "lo"}, Action{Kind: "pedit", DSCP: &other}), false},
+		{live(Action{Kind: "mirred", Device: "lo"}), false},
+		{live(Action{Kind: "pedit", DSCP: &ef}, Action{Kind: "mirred", Device: "lo"}), false},
+	} {
+		if changed := changedFilters([]*Node{desired}, []*Node{c.live}); (len(changed) == 0) != c.equal {
+			t.Errorf("expected %s to equal %s: %v", actionsLabel(c.live.Actions), actionsLabel(desired.Actions), c.equal)
+		}
+	}
+
+	// the actions of go-tc objects equal the same actions of nodes
+	priority := core.BuildHandle(1, 0x21)
+	actions := []*tc.Action{{Kind: "skbedit", SkbEdit: &tc.SkbEdit{Parms: &tc.SkbEditParms{Action: tc.ActPipe}, Priority: &priority}}}
+	obj := desired.Object
+	obj.Matchall = &tc.Matchall{Actions: &actions}
+	goTc := NewNodeWithObject("filter", obj)
+	if !equalActions(filterActions(goTc), []Action{{Kind: "skbedit", Priority: "1:21"}}) {
+		t.Errorf("unexpected actions %s", actionsLabel(filterActions(goTc)))
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+// classifierPrioBase is the priority of the first bpf filter of the classifiers without priority,
+// they come after the flower filters of the flows
+const classifierPrioBase = 0xa000
+
+// clsactHandle is the handle of the clsact qdisc, its filters are attached to the ingress and egress
+// hooks
+var (
+	clsactHandle  = core.BuildHandle(0xFFFF, 0)
+	clsactIngress = core.BuildHandle(0xFFFF, 0xFFF2)
+	clsactEgress  = core.BuildHandle(0xFFFF, 0xFFF3)
+)
+
+// Classifier attaches a BPF program of an ELF object as bpf filter
+type Classifier struct {
+	// Object is the path of the ELF object, relative to the traffic file
+	Object string
+	// Section is the ELF section of the program
+	Section string
+	// DirectAction lets the program return the action for the packet instead of a class, eg. on a
+	// clsact hook
+	DirectAction bool `json:",omitempty"`
+	// Class is the name of the class of the packets the program returns -1 for
+	Class string `json:",omitempty"`
+	// Prio is the priority of the filter. Classifiers without priority get one after the other,
+	// ordered by name.
+	Prio uint16 `json:",omitempty"`
+	// Parent is the handle of the qdisc the filter is attached to, the root qdisc by default. The
+	// ingress and egress hooks of clsact are ffff:fff2 and ffff:fff3.
+	Parent string `json:",omitempty"`
+}
+
+// applyClassifiers adds the bpf filters of the classifiers of the config. The objects are read to
+// compute the tags of the programs, so changed programs are replaced.
+func (conf *TcConfig) applyClassifiers(dir string) error {
+	if len(conf.Classifiers) == 0 {
+		return nil
+	}
+	if conf.Filters == nil {
+		conf.Filters = make(map[string]tc.Object)
+	}
+	_, root, hasRoot := conf.rootQdisc()
+	var names []string
+	for name := range conf.Classifiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prio := uint16(classifierPrioBase)
+	for _, name := range names {
+		c := conf.Classifiers[name]
+		var class *uint32
+		if c.Class != "" {
+			cl, ok := conf.Classes[c.Class]
+			if !ok {
+				return fmt.Errorf("classifier %s: class %q does not exist", name, c.Class)
+			}
+			class = &cl.Handle
+		}
+		parent := root.Handle
+		if c.Parent != "" {
+			h, err := StrHandle(c.Parent)
+			if err != nil {
+				return fmt.Errorf("classifier %s: invalid parent %q", name, c.Parent)
+			}
+			parent = h
+		} else if !hasRoot {
+			return fmt.Errorf("classifier %s: no root qdisc to attach the filter to", name)
+		}
+		if isClsactHook(parent) && !c.DirectAction {
+			return fmt.Errorf("classifier %s: programs on clsact hooks need direct action", name)
+		}
+		object := c.Object
+		if !filepath.IsAbs(object) {
+			object = filepath.Join(dir, object)
+		}
+		p := c.Prio
+		if p == 0 {
+			p = prio
+			prio++
+		}
+		f, err := bpfFilter(object, c.Section, root.Ifindex, parent, class, c.DirectAction, p)
+		if err != nil {
+			return fmt.Errorf("classifier %s: %v", name, err)
+		}
+		conf.Filters[name] = f
+	}
+	return nil
+}
+
+// bpfFilter returns a bpf filter for the program in a section of an ELF object. The filter is named
+// after the object and section like tc does, eg. "/etc/cruise-control/games.o:[classifier]", and
+// holds the tags of the program (see bpfProgram.tags). The program is loaded when the filter is
+// applied.
+func bpfFilter(object, section string, ifindex, parent uint32, class *uint32, directAction bool, prio uint16) (tc.Object, error) {
+	object, err := filepath.Abs(object)
+	if err != nil {
+		return tc.Object{}, err
+	}
+	p, err := readBPFProgram(object, section)
+	if err != nil {
+		return tc.Object{}, err
+	}
+	name, tags := bpfName(object, section), p.tags()
+	bpf := &tc.Bpf{Name: &name, Tag: &tags, ClassID: class}
+	if directAction {
+		flags := uint32(tc.BpfActDirect)
+		bpf.Flags = &flags
+	}
+	return tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: ifindex,
+			Parent:  parent,
+			Handle:  1,
+			Info:    core.BuildHandle(uint32(prio), uint32(htons(unix.ETH_P_ALL))),
+		},
+		Attribute: tc.Attribute{Kind: "bpf", BPF: bpf},
+	}, nil
+}
+
+// bpfName names a program after its object and section
+func bpfName(object, section string) string {
+	return fmt.Sprintf("%s:[%s]", object, section)
+}
+
+// splitBPFName splits the name of a program in its object and section
+func splitBPFName(name string) (object, section string, ok bool) {
+	i := strings.LastIndex(name, ":[")
+	if i < 0 || !strings.HasSuffix(name, "]") {
+		return "", "", false
+	}
+	return name[:i], name[i+2 : len(name)-1], true
+}
+
+// loadBPFFilter loads the program of a bpf filter and returns its file descriptor. The program has
+// to match the tag of the filter.
+func loadBPFFilter(f *tc.Bpf) (int, error) {
+	if f.Name == nil {
+		return -1, errors.New("the filter has no program")
+	}
+	object, section, ok := splitBPFName(*f.Name)
+	if !ok {
+		return -1, fmt.Errorf("invalid program %q", *f.Name)
+	}
+	p, err := readBPFProgram(object, section)
+	if err != nil {
+		return -1, err
+	}
+	if f.Tag != nil && !bytes.Equal(p.tags(), *f.Tag) {
+		return -1, fmt.Errorf("%s changed since the traffic file was read, reload the config", *f.Name)
+	}
+	return p.load()
+}
+
+// equalBPF reports whether the live bpf filter l runs the program of the desired filter d in the
+// same mode
+func equalBPF(d, l *tc.Bpf) bool {
+	if l == nil {
+		return false
+	}
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	tag := func(b *[]byte) []byte {
+		if b == nil {
+			return nil
+		}
+		return *b
+	}
+	flags := func(f *uint32) uint32 {
+		if f == nil {
+			return 0
+		}
+		return *f & tc.BpfActDirect
+	}
+	return str(d.Name) == str(l.Name) && matchTag(tag(d.Tag), tag(l.Tag)) && flags(d.Flags) == flags(l.Flags)
+}
+
+// bpfLabel describes the program of a bpf filter
+func bpfLabel(f *tc.Bpf) string {
+	var parts []string
+	if f.Name != nil {
+		parts = append(parts, filepath.Base(*f.Name))
+	}
+	if f.Flags != nil && *f.Flags&tc.BpfActDirect != 0 {
+		parts = append(parts, "direct-action")
+	}
+	if f.Tag != nil {
+		var tags []string
+		for tag := *f.Tag; len(tag) >= bpfTagSize; tag = tag[bpfTagSize:] {
+			tags = append(tags, fmt.Sprintf("%x", tag[:bpfTagSize]))
+		}
+		parts = append(parts, "tag "+strings.Join(tags, "/"))
+	}
+	return strings.Join(parts, " ")
+}
+
+// isClsactHook reports whether a parent is the ingress or egress hook of a clsact qdisc
+func isClsactHook(parent uint32) bool {
+	return parent == clsactIngress || parent == clsactEgress
+}
+
+// attachClsact adds a clsact qdisc to the interface when one of the filters is attached to one of
+// its hooks. The qdisc has no parameters and can not be replaced, an existing one is kept.
+func attachClsact(rtnl *tc.Tc, ifindex uint32, filters []*Node) error {
+	for _, f := range filters {
+		if !isClsactHook(f.Object.Parent) {
+			continue
+		}
+		clsact := tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: ifindex,
+				Handle:  clsactHandle,
+				Parent:  tc.HandleIngress,
+			},
+			Attribute: tc.Attribute{Kind: "clsact"},
+		}
+		if err := rtnl.Qdisc().Add(&clsact); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("could not add clsact qdisc to %d: %v", ifindex, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Constants of the instructions from include/uapi/linux/bpf.h
+const (
+	bpfInsnSize = 8
+	// bpfLdImm64 is BPF_LD | BPF_IMM | BPF_DW, which spans two instructions
+	bpfLdImm64     = 0x18
+	bpfPseudoMapFD = 1
+	bpfObjNameLen  = 16
+	bpfTagSize     = 8
+)
+
+// bpfMapDef is the struct bpf_map_def of the maps section of libbpf and iproute2
+type bpfMapDef struct {
+	Type, KeySize, ValueSize, MaxEntries, Flags uint32
+}
+
+// bpfProgram is a program of an ELF object with the maps it uses
+type bpfProgram struct {
+	name    string
+	insns   []byte
+	license string
+	maps    []bpfMapDef
+	// relocs maps the index of the instructions that load a map to the map
+	relocs map[int]int
+}
+
+// readBPFProgram reads the program of a section of an ELF object. Only maps of the legacy maps
+// section are relocated, programs with BTF maps, global data or calls to other functions are
+// refused.
+func readBPFProgram(object, section string) (*bpfProgram, error) {
+	f, err := elf.Open(object)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_BPF || f.Class != elf.ELFCLASS64 || f.Data != elf.ELFDATA2LSB {
+		return nil, fmt.Errorf("%s is not a little endian BPF object", object)
+	}
+	var sec *elf.Section
+	index := -1
+	var programs []string
+	for i, s := range f.Sections {
+		if s.Type != elf.SHT_PROGBITS || s.Flags&elf.SHF_EXECINSTR == 0 || s.Size == 0 {
+			continue
+		}
+		programs = append(programs, s.Name)
+		if s.Name == section {
+			sec, index = s, i
+		}
+	}
+	if sec == nil {
+		return nil, fmt.Errorf("%s has no program in section %q, the programs are in %s", object, section, strings.Join(programs, ", "))
+	}
+	p := &bpfProgram{relocs: make(map[int]int)}
+	if p.insns, err = sec.Data(); err != nil {
+		return nil, err
+	}
+	if license := f.Section("license"); license != nil {
+		data, err := license.Data()
+		if err != nil {
+			return nil, err
+		}
+		p.license = strings.TrimRight(string(data), "\x00")
+	}
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, err
+	}
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && int(s.Section) == index && s.Value == 0 {
+			p.name = s.Name
+		}
+	}
+
+	maps := f.Section("maps")
+	var mapData []byte
+	if maps != nil {
+		if mapData, err = maps.Data(); err != nil {
+			return nil, err
+		}
+	}
+	offsets := make(map[uint64]int)
+	for _, rel := range f.Sections {
+		if rel.Type != elf.SHT_REL || int(rel.Info) != index {
+			continue
+		}
+		data, err := rel.Data()
+		if err != nil {
+			return nil, err
+		}
+		for off := 0; off+16 <= len(data); off += 16 {
+			insn := int(binary.LittleEndian.Uint64(data[off:]) / bpfInsnSize)
+			sym := int(elf.R_SYM64(binary.LittleEndian.Uint64(data[off+8:])))
+			if sym == 0 || sym > len(symbols) {
+				return nil, fmt.Errorf("%s: instruction %d refers to an unknown symbol", object, insn)
+			}
+			s := symbols[sym-1]
+			if maps == nil || int(s.Section) >= len(f.Sections) || f.Sections[s.Section] != maps {
+				return nil, fmt.Errorf("%s: instruction %d refers to %s, only maps of the maps section are supported", object, insn, s.Name)
+			}
+			if (insn+2)*bpfInsnSize > len(p.insns) || p.insns[insn*bpfInsnSize] != bpfLdImm64 {
+				return nil, fmt.Errorf("%s: instruction %d does not load map %s", object, insn, s.Name)
+			}
+			m, ok := offsets[s.Value]
+			if !ok {
+				if s.Value+20 > uint64(len(mapData)) {
+					return nil, fmt.Errorf("%s: map %s is not a struct bpf_map_def", object, s.Name)
+				}
+				def := mapData[s.Value:]
+				m = len(p.maps)
+				offsets[s.Value] = m
+				p.maps = append(p.maps, bpfMapDef{
+					Type:       binary.LittleEndian.Uint32(def),
+					KeySize:    binary.LittleEndian.Uint32(def[4:]),
+					ValueSize:  binary.LittleEndian.Uint32(def[8:]),
+					MaxEntries: binary.LittleEndian.Uint32(def[12:]),
+					Flags:      binary.LittleEndian.Uint32(def[16:]),
+				})
+			}
+			p.relocs[insn] = m
+		}
+	}
+	return p, nil
+}
+
+// instructions returns the instructions of the program with the maps relocated to the file
+// descriptors fds, or 0 without file descriptors
+func (p *bpfProgram) instructions(fds []int) []byte {
+	insns := append([]byte(nil), p.insns...)
+	for i, m := range p.relocs {
+		insn := insns[i*bpfInsnSize:]
+		insn[1] = insn[1]&0x0f | bpfPseudoMapFD<<4
+		fd := uint32(0)
+		if fds != nil {
+			fd = uint32(fds[m])
+		}
+		binary.LittleEndian.PutUint32(insn[4:], fd)
+		binary.LittleEndian.PutUint32(insn[bpfInsnSize+4:], 0)
+	}
+	return insns
+}
+
+// tags returns the tags the kernel computes for the program, the first 8 bytes of the SHA-1 of the
+// instructions without the file descriptors of the maps, followed by those of the SHA-256 newer
+// kernels use
+func (p *bpfProgram) tags() []byte {
+	insns := p.instructions(nil)
+	sha1Sum, sha256Sum := sha1.Sum(insns), sha256.Sum256(insns)
+	return append(sha1Sum[:bpfTagSize:bpfTagSize], sha256Sum[:bpfTagSize]...)
+}
+
+// matchTag reports whether the tag of a live program is one of the tags of a desired program
+func matchTag(tags, live []byte) bool {
+	for len(tags) >= bpfTagSize {
+		if bytes.Equal(tags[:bpfTagSize], live) {
+			return true
+		}
+		tags = tags[bpfTagSize:]
+	}
+	return len(tags) == 0 && len(live) == 0
+}
+
+// bpfProgLoadAttr is the start of union bpf_attr for BPF_PROG_LOAD
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [bpfObjNameLen]byte
+}
+
+// load creates the maps of the program and loads it as classifier. The maps are only referenced by
+// the program, so they live as long as the filter does.
+func (p *bpfProgram) load() (int, error) {
+	fds := make([]int, len(p.maps))
+	defer func() {
+		for _, fd := range fds {
+			if fd > 0 {
+				unix.Close(fd)
+			}
+		}
+	}()
+	for i := range p.maps {
+		fd, err := bpfSyscall(unix.BPF_MAP_CREATE, unsafe.Pointer(&p.maps[i]), unsafe.Sizeof(p.maps[i]))
+		if err != nil {
+			return -1, fmt.Errorf("could not create map %d: %v", i, err)
+		}
+		fds[i] = fd
+	}
+	insns := p.instructions(fds)
+	license := append([]byte(p.license), 0)
+	attr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		insnCnt:  uint32(len(insns) / bpfInsnSize),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	for i := 0; i < len(p.name) && i < len(attr.progName)-1; i++ {
+		if c := p.name[i]; c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			attr.progName[i] = c
+		}
+	}
+	fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		runtime.KeepAlive(insns)
+		runtime.KeepAlive(license)
+		return fd, nil
+	}
+	// load the program again with the log of the verifier, which explains why it was refused
+	log := make([]byte, 64*1024)
+	attr.logLevel, attr.logSize = 1, uint32(len(log))
+	attr.logBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+	if fd, err := bpfSyscall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err == nil {
+		return fd, nil
+	}
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if end := bytes.IndexByte(log, 0); end > 0 {
+		return -1, fmt.Errorf("could not load %s: %v: %s", p.name, err, strings.TrimSpace(string(log[:end])))
+	}
+	return -1, fmt.Errorf("could not load %s: %v", p.name, err)
+}
+
+// bpfSyscall runs a command of the bpf syscall and returns the file descriptor it created
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
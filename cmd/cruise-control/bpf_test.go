@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadBPFProgram(t *testing.T) {
+	p, err := readBPFProgram("testdata/classifier.o", "classifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name != "classify" || p.license != "GPL" || len(p.insns) != 14*bpfInsnSize {
+		t.Errorf("unexpected program %s with license %q and %d instructions", p.name, p.license, len(p.insns)/bpfInsnSize)
+	}
+	if len(p.maps) != 1 || p.maps[0] != (bpfMapDef{Type: unix.BPF_MAP_TYPE_ARRAY, KeySize: 4, ValueSize: 8, MaxEntries: 1}) {
+		t.Errorf("unexpected maps %+v", p.maps)
+	}
+	if m, ok := p.relocs[4]; !ok || m != 0 || len(p.relocs) != 1 {
+		t.Errorf("expected instruction 4 to load the map, got %v", p.relocs)
+	}
+	insns := p.instructions([]int{7})
+	if insns[4*bpfInsnSize+1] != bpfPseudoMapFD<<4|1 || insns[4*bpfInsnSize+4] != 7 {
+		t.Errorf("expected the map to be relocated to fd 7, got % x", insns[4*bpfInsnSize:6*bpfInsnSize])
+	}
+	if !bytes.Equal(p.tags(), p.tags()) || bytes.Equal(p.tags(), (&bpfProgram{insns: p.insns}).tags()) {
+		t.Error("expected the tag to cover the relocation of the map")
+	}
+
+	action, err := readBPFProgram("testdata/classifier.o", "action")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action.name != "prioritize" || len(action.maps) != 0 || bytes.Equal(action.tags(), p.tags()) {
+		t.Errorf("unexpected program %s with %d maps", action.name, len(action.maps))
+	}
+
+	if _, err := readBPFProgram("testdata/classifier.o", "ingress"); err == nil || !strings.Contains(err.Error(), "the programs are in classifier, action") {
+		t.Errorf("expected the programs to be listed, got %v", err)
+	}
+	if _, err := readBPFProgram("testdata/classifier.ll", "classifier"); err == nil {
+		t.Error("expected a file that is not an ELF object to be refused")
+	}
+}
+
+// bpfProgInfo is the start of struct bpf_prog_info
+type bpfProgInfo struct {
+	progType, id uint32
+	tag          [8]byte
+}
+
+func TestLoadBPFProgram(t *testing.T) {
+	for _, section := range []string{"classifier", "action"} {
+		p, err := readBPFProgram("testdata/classifier.o", section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := p.load()
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOSYS) {
+			t.Skipf("can not load BPF programs: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fd)
+
+		// the tag of the kernel has to be one of the tags of the program, as it is compared with the
+		// tags of the desired filter
+		var info bpfProgInfo
+		attr := struct {
+			fd, len uint32
+			info    uint64
+		}{uint32(fd), uint32(unsafe.Sizeof(info)), uint64(uintptr(unsafe.Pointer(&info)))}
+		if _, err := bpfSyscall(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+			t.Fatal(err)
+		}
+		if info.progType != unix.BPF_PROG_TYPE_SCHED_CLS || !matchTag(p.tags(), info.tag[:]) {
+			t.Errorf("%s: expected tags %x, the kernel computed %x", section, p.tags(), info.tag)
+		}
+	}
+}
+
+func TestTrafficFileClassifiers(t *testing.T) {
+	object, err := filepath.Abs("testdata/classifier.o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "bpf.json")
+	if err := os.Symlink(object, filepath.Join(dir, "classifier.o")); err != nil {
+		t.Fatal(err)
+	}
+	conf := TcConfig{
+		Qdiscs: map[string]tc.Object{"root": {
+			Msg:       tc.Msg{Handle: core.BuildHandle(1, 0), Parent: tc.HandleRoot},
+			Attribute: tc.Attribute{Kind: "hfsc", HfscQOpt: &tc.HfscQOpt{DefCls: 2}},
+		}},
+		Classes: map[string]tc.Object{"games": {
+			Msg:       tc.Msg{Handle: core.BuildHandle(1, 2), Parent: core.BuildHandle(1, 0)},
+			Attribute: tc.Attribute{Kind: "hfsc"},
+		}},
+		Classifiers: map[string]Classifier{
+			"games": {Object: "classifier.o", Section: "classifier", Class: "games"},
+			"prio":  {Object: object, Section: "action", DirectAction: true, Parent: "ffff:fff3", Prio: 1},
+		},
+	}
+	if err := conf.generateTrafficFile(file); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseTrafficFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	games, prio := parsed.Filters["games"], parsed.Filters["prio"]
+	if p, proto := splitInfo(games.Info); p != classifierPrioBase || proto != unix.ETH_P_ALL || games.Parent != core.BuildHandle(1, 0) {
+		t.Errorf("unexpected games filter prio %d protocol 0x%x parent %s", p, proto, FmtHandle(games.Parent))
+	}
+	if *games.BPF.Name != filepath.Join(dir, "classifier.o")+":[classifier]" || *games.BPF.ClassID != core.BuildHandle(1, 2) || games.BPF.Flags != nil {
+		t.Errorf("unexpected games program %s", bpfLabel(games.BPF))
+	}
+	if p, _ := splitInfo(prio.Info); p != 1 || prio.Parent != clsactEgress || *prio.BPF.Flags != tc.BpfActDirect || prio.BPF.ClassID != nil {
+		t.Errorf("unexpected prio filter %s", bpfLabel(prio.BPF))
+	}
+	if label := filterLabel(NewNodeWithObject("filter", prio)); !strings.HasPrefix(label, "bpf prio 1 classifier.o:[action] direct-action tag ") {
+		t.Errorf("unexpected label %q", label)
+	}
+
+	for _, c := range []struct {
+		classifier Classifier
+		problem    string
+	}{
+		{Classifier{Object: "classifier.o", Section: "classifier", Class: "bulk"}, `class "bulk" does not exist`},
+		{Classifier{Object: "classifier.o", Section: "action", Parent: "ffff:fff2"}, "need direct action"},
+		{Classifier{Object: "missing.o", Section: "classifier"}, "no such file"},
+	} {
+		conf.Classifiers = map[string]Classifier{"broken": c.classifier}
+		conf.generateTrafficFile(file)
+		if _, err := parseTrafficFile(file); err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("expected %q, got %v", c.problem, err)
+		}
+	}
+}
+
+func TestTcScriptBPF(t *testing.T) {
+	configs, err := ParseTcScript(strings.NewReader(`
+tc qdisc add dev eth0 root handle 1: hfsc default 22
+tc qdisc add dev eth0 clsact
+tc filter add dev eth0 parent 1: prio 5 bpf obj testdata/classifier.o classid 1:21
+tc filter add dev eth0 egress prio 1 bpf da obj testdata/classifier.o sec action
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	if len(conf.Qdiscs) != 1 || len(conf.Filters) != 2 {
+		t.Fatalf("expected the clsact qdisc to be left out, got %d qdiscs and %d filters", len(conf.Qdiscs), len(conf.Filters))
+	}
+	for _, f := range conf.Filters {
+		object, section, _ := splitBPFName(*f.BPF.Name)
+		switch p, _ := splitInfo(f.Info); p {
+		case 5:
+			if section != "classifier" || *f.BPF.ClassID != core.BuildHandle(1, 0x21) || f.Parent != core.BuildHandle(1, 0) {
+				t.Errorf("unexpected classifier %s", bpfLabel(f.BPF))
+			}
+		case 1:
+			if section != "action" || *f.BPF.Flags != tc.BpfActDirect || f.Parent != clsactEgress || !filepath.IsAbs(object) {
+				t.Errorf("unexpected action %s", bpfLabel(f.BPF))
+			}
+		}
+	}
+
+	for _, stmt := range []string{
+		"bpf bytecode '1,6 0 0 4294967295'",
+		"bpf obj testdata/classifier.o sec ingress",
+	} {
+		if _, err := ParseTcScript(strings.NewReader("tc filter add dev eth0 parent 1: " + stmt)); err == nil {
+			t.Errorf("expected %q to be rejected", stmt)
+		}
+	}
+}
+
+func TestEqualBPF(t *testing.T) {
+	f, err := bpfFilter("testdata/classifier.o", "classifier", 2, core.BuildHandle(1, 0), nil, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := f.BPF
+	// the kernel reports the id of the program next to its name and the tag of its hash function
+	live := *desired
+	id := uint32(42)
+	live.ID = &id
+	for _, tag := range [][]byte{(*desired.Tag)[:bpfTagSize], (*desired.Tag)[bpfTagSize:]} {
+		live.Tag = &tag
+		if !equalBPF(desired, &live) {
+			t.Errorf("expected the live program with tag %x to equal the desired program", tag)
+		}
+	}
+	action, err := bpfFilter("testdata/classifier.o", "action", 2, core.BuildHandle(1, 0), nil, true, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct := live
+	direct.Flags = action.BPF.Flags
+	changed := live
+	tag := (*action.BPF.Tag)[bpfTagSize:]
+	changed.Tag = &tag
+	for _, l := range []*tc.Bpf{&direct, &changed, nil} {
+		if equalBPF(desired, l) {
+			t.Errorf("expected %+v to differ from the desired program", l)
+		}
+	}
+	if name, _, _ := splitBPFName(*desired.Name); !filepath.IsAbs(name) {
+		t.Errorf("expected an absolute path, got %s", name)
+	}
+}
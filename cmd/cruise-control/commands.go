@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// importCommand converts a `tc` shell script into a traffic file that can be used with the
+// "traffic" profile
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dev := fs.String("dev", "", "device to import, required when the script configures multiple devices")
+	out := fs.String("o", "", "traffic file to write, defaults to stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: cruise-control import [-dev device] [-o traffic.json] script.sh\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("import requires a single script")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	configs, err := ParseTcScript(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+
+	var devs []string
+	for d := range configs {
+		devs = append(devs, d)
+	}
+	sort.Strings(devs)
+	if *dev == "" {
+		if len(devs) != 1 {
+			return fmt.Errorf("script configures devices %v, select one with -dev", devs)
+		}
+		*dev = devs[0]
+	}
+	tcConf, ok := configs[*dev]
+	if !ok {
+		return fmt.Errorf("script does not configure device %s, it configures %v", *dev, devs)
+	}
+
+	nodes, _ := NodesFromConfig(tcConf)
+	result := ComposeTree(nodes)
+	if result.Tree == nil {
+		return fmt.Errorf("script does not configure a root qdisc on %s", *dev)
+	}
+	for _, problem := range result.Problems() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", problem)
+	}
+
+	if *out != "" {
+		return tcConf.generateTrafficFile(*out)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tcConf)
+}
+
+// treeCommand renders the desired or live tree of an interface
+func treeCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tree", flag.ExitOnError)
+	opts := TreeOptions{}
+	fs.StringVar(&opts.Interface, "interface", "", "interface to render the tree of")
+	fs.StringVar(&opts.Profile, "profile", "simple", "profile of the desired tree")
+	fs.Func("up", "upload speed of the desired tree, in Mbit or with a unit (2.5gbit)", func(s string) (err error) {
+		opts.Speed, err = parseSpeed(s)
+		return err
+	})
+	fs.StringVar(&opts.Source, "source", "desired", "tree to render, desired or live")
+	fs.StringVar(&opts.Format, "format", "ascii", fmt.Sprintf("output format, one of %v", RenderFormats))
+	fs.BoolVar(&opts.Drift, "drift", false, "highlight the differences between the desired and live tree")
+	fs.Parse(args)
+	if opts.Interface == "" {
+		fs.Usage()
+		return fmt.Errorf("tree requires an interface")
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return WriteTree(ctx, conf, opts, os.Stdout)
+}
+
+// planCommand shows the changes applying a profile would make to an interface
+func planCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	opts := TreeOptions{}
+	fs.StringVar(&opts.Interface, "interface", "", "interface to plan the changes of")
+	fs.StringVar(&opts.Profile, "profile", "simple", "profile to apply")
+	fs.Func("up", "upload speed, in Mbit or with a unit (2.5gbit)", func(s string) (err error) {
+		opts.Speed, err = parseSpeed(s)
+		return err
+	})
+	fs.Parse(args)
+	if opts.Interface == "" {
+		fs.Usage()
+		return fmt.Errorf("plan requires an interface")
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	plan, err := PlanFor(ctx, conf, opts)
+	if err != nil {
+		return err
+	}
+	return plan.Write(os.Stdout)
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
 	"github.com/florianl/go-tc"
 )
 
@@ -8,43 +15,101 @@ type TcConfig struct {
 	Qdiscs  map[string]tc.Object
 	Classes map[string]tc.Object
 	Filters map[string]tc.Object
+	// Curves replace the service curves of the HFSC classes with the same name
+	Curves map[string]ClassCurves `json:",omitempty"`
+	// Flows classify traffic into the classes with flower filters
+	Flows map[string]FlowRule `json:",omitempty"`
+	// FlowerExtra holds the IPv6 addresses and connection tracking state of the flower filters with
+	// the same name, which go-tc can not hold
+	FlowerExtra map[string]FlowerExtra `json:",omitempty"`
+	// Classifiers classify traffic with BPF programs of ELF objects
+	Classifiers map[string]Classifier `json:",omitempty"`
+	// Actions are run by the filters with the same name after their own actions, eg. to mirror
+	// traffic or rewrite its DSCP
+	Actions map[string][]Action `json:",omitempty"`
+	// DSCP rewrites the DSCP of the packets that leave through the classes with the same name, eg.
+	// "ef" or "cs1"
+	DSCP map[string]string `json:",omitempty"`
+	// Netem sets the link conditions of the netem qdiscs with the same name, eg.
+	// "delay 100ms 10ms loss gemodel 1% 10%"
+	Netem map[string]Netem `json:",omitempty"`
+	// Red sets the options of the red and choke qdiscs with the same name, eg.
+	// "red limit 400000 avpkt 1000 bandwidth 10Mbit ecn"
+	Red map[string]Red `json:",omitempty"`
 }
 
-// Parse the generated traffic file JSON back into a config file
-// func parseTrafficFile(file string) (TcConfig, error) {
-// 	inp := TcConfig{}
-// 	dat, err := ioutil.ReadFile(file)
-// 	if err != nil {
-// 		return inp, err
-// 	}
-// 	json.Unmarshal(dat, &inp)
-// 	return inp, nil
-// }
+// parseTrafficFile parses a traffic file into a config. Traffic files are either the JSON rendering
+// of a TcConfig or a `tc` shell script (see ParseTcScript) that configures a single device.
+func parseTrafficFile(file string) (TcConfig, error) {
+	inp := TcConfig{}
+	if filepath.Ext(file) != ".json" {
+		f, err := os.Open(file)
+		if err != nil {
+			return inp, err
+		}
+		defer f.Close()
+		configs, err := ParseTcScript(f)
+		if err != nil {
+			return inp, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(configs) != 1 {
+			return inp, fmt.Errorf("%s: traffic file configures %d devices, expected 1", file, len(configs))
+		}
+		for _, conf := range configs {
+			inp = conf
+		}
+		return inp, nil
+	}
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return inp, err
+	}
+	if err := json.Unmarshal(dat, &inp); err != nil {
+		return inp, err
+	}
+	if err := inp.applyCurves(); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := inp.applyNetem(); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := inp.applyRed(); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := inp.applyFlows(); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := inp.applyClassifiers(filepath.Dir(file)); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := inp.applyActions(); err != nil {
+		return inp, fmt.Errorf("%s: %v", file, err)
+	}
+	return inp, nil
+}
 
-// update the config struct with the intended interface
-// func (tc *TcConfig) updateInterface(interf net.Interface) error {
-// 	for _, qd := range tc.Qdiscs {
-// 		qd.Msg.Ifindex = uint32(interf.Index)
-// 	}
-// 	for _, cl := range tc.Qdiscs {
-// 		cl.Msg.Ifindex = uint32(interf.Index)
-// 	}
-// 	for _, fl := range tc.Qdiscs {
-// 		fl.Msg.Ifindex = uint32(interf.Index)
-// 	}
-// 	return nil
-// }
+// updateInterface updates the config struct with the intended interface
+func (tc *TcConfig) updateInterface(interf net.Interface) {
+	for name, qd := range tc.Qdiscs {
+		qd.Msg.Ifindex = uint32(interf.Index)
+		tc.Qdiscs[name] = qd
+	}
+	for name, cl := range tc.Classes {
+		cl.Msg.Ifindex = uint32(interf.Index)
+		tc.Classes[name] = cl
+	}
+	for name, fl := range tc.Filters {
+		fl.Msg.Ifindex = uint32(interf.Index)
+		tc.Filters[name] = fl
+	}
+}
 
-// Generate a traffic file from the current TcConfig
-// func (tc *TcConfig) generateTrafficFile(file string) error {
-// 	// render the config to the JSON file
-// 	rawConf, err := json.Marshal(tc)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	err = ioutil.WriteFile(file, rawConf, 0644)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
+// generateTrafficFile generates a traffic file from the current TcConfig
+func (tc *TcConfig) generateTrafficFile(file string) error {
+	// render the config to the JSON file
+	rawConf, err := json.MarshalIndent(tc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, rawConf, 0644)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/florianl/go-tc"
+)
+
+// Curve is an HFSC service curve with a slope of M1 for the first D and a slope of M2 afterwards.
+// In the config, the traffic file and the API it is written in the notation of the `tc`
+// command-line tool, either as "m1 10mbit d 20ms m2 5mbit" or as the latency target
+// "umax 1500b dmax 10ms rate 2mbit".
+type Curve struct {
+	M1 Rate
+	D  time.Duration
+	M2 Rate
+	// Target is the latency target the curve is built from, if any
+	Target LatencyTarget
+}
+
+// LatencyTarget asks HFSC to send a packet of Umax bytes within Dmax, while the class gets a
+// sustained Rate
+type LatencyTarget struct {
+	Umax uint32
+	Dmax time.Duration
+	Rate Rate
+}
+
+// CurveForLatency builds the two piece service curve that meets the latency target, the same way
+// the `tc` command-line tool does. When sending Umax at Rate is too slow to meet Dmax, the curve is
+// concave: it starts with a steeper slope for Dmax. Otherwise it is convex: the service is delayed
+// as long as the target allows, which leaves room for classes with tighter latency targets.
+func CurveForLatency(target LatencyTarget) Curve {
+	c := Curve{M2: target.Rate, Target: target}
+	if target.Rate == 0 || target.Dmax == 0 {
+		return c
+	}
+	bytes := float64(target.Rate.BytesPerSecond())
+	usec := float64(target.Dmax.Microseconds())
+	if m1 := math.Ceil(1e6 * float64(target.Umax) / usec); m1 > bytes {
+		c.M1 = RateFromBytes(uint64(m1))
+		c.D = target.Dmax
+		return c
+	}
+	c.D = time.Duration(math.Ceil(usec-1e6*float64(target.Umax)/bytes)) * time.Microsecond
+	return c
+}
+
+// IsZero reports whether the curve is unset
+func (c Curve) IsZero() bool {
+	return c == Curve{}
+}
+
+func (c Curve) String() string {
+	switch {
+	case c.Target != (LatencyTarget{}):
+		if c.Target.Dmax == 0 {
+			return "rate " + c.Target.Rate.String()
+		}
+		return fmt.Sprintf("umax %db dmax %s rate %s", c.Target.Umax, c.Target.Dmax, c.Target.Rate)
+	case c.M1 == 0 && c.D == 0:
+		return "m2 " + c.M2.String()
+	}
+	return fmt.Sprintf("m1 %s d %s m2 %s", c.M1, c.D, c.M2)
+}
+
+// Explain describes the shape of the curve and, for curves built from a latency target, how the
+// target led to that shape
+func (c Curve) Explain() string {
+	t := c.Target
+	if t != (LatencyTarget{}) {
+		if t.Dmax == 0 || t.Rate == 0 {
+			return fmt.Sprintf("%s: linear curve without latency target", c)
+		}
+		xmit := time.Duration(float64(t.Umax) * 8 / float64(t.Rate) * float64(time.Second)).Round(time.Microsecond)
+		if c.M1 > c.M2 {
+			return fmt.Sprintf("%s: %db takes %s at %s, which misses dmax, so the curve is concave with m1 %s for %s and m2 %s afterwards",
+				c, t.Umax, xmit, t.Rate, c.M1, c.D, c.M2)
+		}
+		return fmt.Sprintf("%s: %db takes %s at %s, which meets dmax, so the curve is convex and delays the service by up to %s before m2 %s",
+			c, t.Umax, xmit, t.Rate, c.D, c.M2)
+	}
+	switch {
+	case c.D == 0 || c.M1 == c.M2:
+		return fmt.Sprintf("%s: linear curve", c)
+	case c.M1 > c.M2:
+		burst := uint64(float64(c.M1.BytesPerSecond()) * c.D.Seconds())
+		return fmt.Sprintf("%s: concave curve, bursts of %db are served within %s", c, burst, c.D)
+	}
+	return fmt.Sprintf("%s: convex curve, the service is delayed by up to %s", c, c.D)
+}
+
+// MarshalText renders the curve in the notation of the `tc` command-line tool
+func (c Curve) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses a curve in the notation of the `tc` command-line tool
+func (c *Curve) UnmarshalText(text []byte) error {
+	args := &tcArgs{args: strings.Fields(string(text))}
+	curve, err := parseServiceCurve(args, "curve")
+	if err != nil {
+		return err
+	}
+	if extra := args.peek(); extra != "" {
+		return fmt.Errorf("curve: unexpected %q", extra)
+	}
+	*c = curve
+	return nil
+}
+
+// ClassCurves are the service curves of an HFSC class. Keeping them next to the TC objects allows
+// them to be written as latency targets in traffic files and to be explained in plans.
+type ClassCurves struct {
+	SC *Curve `json:",omitempty"`
+	RT *Curve `json:",omitempty"`
+	LS *Curve `json:",omitempty"`
+	UL *Curve `json:",omitempty"`
+}
+
+// apply sets the curves on an HFSC class, unset curves are left alone
+func (cc ClassCurves) apply(hfsc *tc.Hfsc) {
+	if c := cc.SC; c != nil {
+		SetSC(hfsc, c.M1, c.D, c.M2)
+	}
+	if c := cc.RT; c != nil {
+		SetRT(hfsc, c.M1, c.D, c.M2)
+	}
+	if c := cc.LS; c != nil {
+		SetLS(hfsc, c.M1, c.D, c.M2)
+	}
+	if c := cc.UL; c != nil {
+		SetUL(hfsc, c.M1, c.D, c.M2)
+	}
+}
+
+// notes explains every curve of the class
+func (cc ClassCurves) notes() []string {
+	var notes []string
+	for _, c := range []struct {
+		name  string
+		curve *Curve
+	}{{"sc", cc.SC}, {"rt", cc.RT}, {"ls", cc.LS}, {"ul", cc.UL}} {
+		if c.curve != nil && !c.curve.IsZero() {
+			notes = append(notes, c.name+" "+c.curve.Explain())
+		}
+	}
+	return notes
+}
+
+// setCurves sets the curves of the HFSC class name and keeps them, so they can be explained later
+func (conf *TcConfig) setCurves(name string, curves ClassCurves) {
+	if conf.Curves == nil {
+		conf.Curves = make(map[string]ClassCurves)
+	}
+	conf.Curves[name] = curves
+	curves.apply(conf.Classes[name].Hfsc)
+}
+
+// applyCurves sets the curves of the config on their classes, replacing the curves of the TC
+// objects
+func (conf *TcConfig) applyCurves() error {
+	for name, curves := range conf.Curves {
+		class, ok := conf.Classes[name]
+		if !ok {
+			return fmt.Errorf("curves for unknown class %q", name)
+		}
+		if class.Hfsc == nil {
+			if class.Kind != "" && class.Kind != "hfsc" {
+				return fmt.Errorf("class %q is a %s class, curves require an hfsc class", name, class.Kind)
+			}
+			class.Kind = "hfsc"
+			class.Hfsc = &tc.Hfsc{}
+			conf.Classes[name] = class
+		}
+		curves.apply(class.Hfsc)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+// DriftStatus describes how a node of the desired tree differs from the node in the live tree
+type DriftStatus string
+
+const (
+	// DriftMissing marks a desired node that is not configured on the system
+	DriftMissing DriftStatus = "missing"
+	// DriftChanged marks a node that is configured with different properties than desired
+	DriftChanged DriftStatus = "changed"
+	// DriftExtra marks a node that is configured on the system, but is not desired
+	DriftExtra DriftStatus = "extra"
+)
+
+// nodeKey identifies a node in a tree by its type and handle
+func nodeKey(n *Node) string {
+	return n.Type + " " + FmtHandle(n.Object.Handle)
+}
+
+// Walk calls fn for every node in the tree, parents before their children
+func (tr *Node) Walk(fn func(n *Node, depth int)) {
+	tr.walk(fn, 0)
+}
+
+func (tr *Node) walk(fn func(n *Node, depth int), depth int) {
+	fn(tr, depth)
+	for _, child := range tr.Children {
+		child.walk(fn, depth+1)
+	}
+}
+
+// DiffTrees compares the desired tree with the live tree. It returns the drift status of every node
+// that differs between both trees, keyed by nodeKey. Nodes that are equal are not part of the
+// result. Either tree can be nil.
+func DiffTrees(desired, live *Node) map[string]DriftStatus {
+	drift := make(map[string]DriftStatus)
+	liveNodes := make(map[string]*Node)
+	if live != nil {
+		live.Walk(func(n *Node, _ int) {
+			liveNodes[nodeKey(n)] = n
+		})
+	}
+	desiredNodes := make(map[string]*Node)
+	if desired != nil {
+		desired.Walk(func(n *Node, _ int) {
+			key := nodeKey(n)
+			desiredNodes[key] = n
+			peer, ok := liveNodes[key]
+			switch {
+			case !ok:
+				drift[key] = DriftMissing
+			case !n.equalNode(*peer):
+				drift[key] = DriftChanged
+			}
+		})
+	}
+	for key := range liveNodes {
+		if _, ok := desiredNodes[key]; !ok {
+			drift[key] = DriftExtra
+		}
+	}
+	return drift
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+// remarkPrio is the priority of the filter that rewrites the DSCP of the IPv4 packets of the default
+// class, the IPv6 filter follows it. They come after all other filters, including the ones that get
+// their priority from the kernel.
+const remarkPrio = 0xfffe
+
+// remarkProtocols are the protocols whose DSCP is rewritten, with the suffix of their filters
+var remarkProtocols = []struct {
+	suffix   string
+	protocol uint16
+}{{"ip", unix.ETH_P_IP}, {"ipv6", unix.ETH_P_IPV6}}
+
+// applyDSCP rewrites the DSCP of the packets that leave through the classes in conf.DSCP and their
+// host classes. The filters that classify into such a class get a pedit action. pedit rewrites
+// the header of a single IP protocol, so filters of all protocols are split into an ip and an ipv6
+// filter, which only works for filters that get their priority from the kernel. The packets that
+// end up in the default class without a filter are rewritten by a catch-all filter per protocol.
+func (conf *TcConfig) applyDSCP() error {
+	if len(conf.DSCP) == 0 {
+		return nil
+	}
+	byHandle := make(map[uint32]uint8)
+	for name, v := range conf.DSCP {
+		class, ok := conf.Classes[name]
+		if !ok {
+			return fmt.Errorf("dscp of %s: class does not exist", name)
+		}
+		dscp, err := parseDSCP(v)
+		if err != nil {
+			return fmt.Errorf("dscp of %s: %v", name, err)
+		}
+		byHandle[class.Handle] = dscp
+	}
+	parents := make(map[uint32]uint32)
+	for _, c := range conf.Classes {
+		parents[c.Handle] = c.Parent
+	}
+	// classDSCP returns the DSCP of a class, or of the closest parent class with one
+	classDSCP := func(handle uint32) (uint8, bool) {
+		for seen := 0; seen <= len(parents); seen++ {
+			if dscp, ok := byHandle[handle]; ok {
+				return dscp, true
+			}
+			parent, ok := parents[handle]
+			if !ok {
+				break
+			}
+			handle = parent
+		}
+		return 0, false
+	}
+
+	names := make([]string, 0, len(conf.Filters))
+	for name := range conf.Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if conf.Actions == nil {
+		conf.Actions = make(map[string][]Action)
+	}
+	for _, name := range names {
+		f := conf.Filters[name]
+		target, ok := filterTarget(&Node{Type: "filter", Object: f, Actions: conf.Actions[name]})
+		if !ok {
+			continue
+		}
+		dscp, ok := classDSCP(target)
+		if !ok {
+			continue
+		}
+		if f.Kind != "u32" && f.Kind != "fw" && f.Kind != "matchall" && f.Kind != "flower" {
+			return fmt.Errorf("filter %s classifies into a class with a dscp, but %s filters do not support actions", name, f.Kind)
+		}
+		pedit := Action{Kind: "pedit", DSCP: &dscp}
+		if _, err := ipProtocol(f); err == nil {
+			conf.Actions[name] = append(conf.Actions[name], pedit)
+			continue
+		}
+		prio, protocol := splitInfo(f.Info)
+		if protocol != unix.ETH_P_ALL || prio != 0 {
+			return fmt.Errorf("filter %s of protocol 0x%04x and prio %d classifies into a class with a dscp, only ip and ipv6 filters or filters of all protocols without prio rewrite the dscp", name, protocol, prio)
+		}
+		actions := conf.Actions[name]
+		delete(conf.Filters, name)
+		delete(conf.Actions, name)
+		for _, p := range remarkProtocols {
+			split := f
+			split.Info = core.BuildHandle(0, uint32(htons(p.protocol)))
+			key := name + "/" + p.suffix
+			conf.Filters[key] = split
+			conf.Actions[key] = append(append([]Action(nil), actions...), pedit)
+		}
+	}
+
+	_, root, ok := conf.rootQdisc()
+	if !ok {
+		return nil
+	}
+	defName, ok := conf.defaultClass(root)
+	if !ok {
+		return nil
+	}
+	def := conf.Classes[defName].Handle
+	dscp, ok := classDSCP(def)
+	if !ok {
+		return nil
+	}
+	for i, p := range remarkProtocols {
+		class := def
+		key := "default/" + p.suffix
+		conf.Filters[key] = tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: root.Ifindex,
+				Parent:  root.Handle,
+				Handle:  1,
+				Info:    core.BuildHandle(uint32(remarkPrio+i), uint32(htons(p.protocol))),
+			},
+			Attribute: tc.Attribute{
+				Kind: "u32",
+				U32: &tc.U32{
+					ClassID: &class,
+					// a single key without mask matches every packet
+					Sel: &tc.U32Sel{Flags: u32Terminal, NKeys: 1, Keys: []tc.U32Key{{}}},
+				},
+			},
+		}
+		conf.Actions[key] = []Action{{Kind: "pedit", DSCP: &dscp}}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+func TestSimpleProfileDSCP(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	conf := Config{Simple: SimpleProfile{
+		Prio: SimpleClass{DSCP: "ef", Match: []FlowMatch{{Proto: "udp", DstPort: "3074"}}},
+		Low:  SimpleClass{DSCP: "cs1"},
+	}}
+	stream := HostPolicy{Name: "stream", Match: mustHostMatch(t, "192.168.1.10"), Class: "low"}
+	conf.Hosts = []HostPolicy{stream}
+	tcConf, err := createQoS(context.Background(), conf, "simple", interf, Gbit, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, filters := NodesFromConfig(tcConf)
+	labels := map[string]string{}
+	for _, f := range filters {
+		labels[f.Name] = filterLabel(f)
+	}
+	for name, suffix := range map[string]string{
+		// the mark filters of all protocols are split, pedit rewrites the header of one protocol
+		"prio/ip":        "mark 0x1/0xf pedit dscp 46",
+		"prio/ipv6":      "mark 0x1/0xf pedit dscp 46",
+		"low/ip":         "mark 0x3/0xf pedit dscp 8",
+		"low/ipv6":       "mark 0x3/0xf pedit dscp 8",
+		"normal":         "mark 0x2/0xf",
+		"prio/match0/0":  "dst_port 3074 pedit dscp 46",
+		"prio/match0/1":  "dst_port 3074 pedit dscp 46",
+		"low/stream/src": "1 keys pedit dscp 8",
+		"low/stream/dst": "1 keys pedit dscp 8",
+	} {
+		if label, ok := labels[name]; !ok || !strings.HasSuffix(label, suffix) {
+			t.Errorf("expected filter %s to end in %q, got %q", name, suffix, label)
+		}
+	}
+	for _, name := range []string{"prio", "low", "default/ip"} {
+		if _, ok := labels[name]; ok {
+			t.Errorf("unexpected filter %s", name)
+		}
+	}
+	if _, protocol := splitInfo(tcConf.Filters["low/ipv6"].Info); protocol != unix.ETH_P_IPV6 {
+		t.Errorf("expected the ipv6 filter of low, got protocol 0x%04x", protocol)
+	}
+
+	// the packets of the default class without filter are rewritten by a catch-all filter, which
+	// comes after all other filters
+	conf.Simple.Normal.DSCP = "af21"
+	tcConf, err = createQoS(context.Background(), conf, "simple", interf, Gbit, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := tcConf.Filters["default/ipv6"]
+	if prio, protocol := splitInfo(def.Info); prio != 0xffff || protocol != unix.ETH_P_IPV6 || *def.U32.ClassID != core.BuildHandle(1, 0x22) {
+		t.Errorf("unexpected catch-all filter prio %d protocol 0x%04x class %s", prio, protocol, FmtHandle(*def.U32.ClassID))
+	}
+	n := NewNodeWithObject("filter", def)
+	n.Actions = tcConf.Actions["default/ipv6"]
+	data, err := marshalFilter(def, nil, marshalActions(filterActions(n), unix.ETH_P_IPV6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live, err := unmarshalFilter(data); err != nil || !equalFilter(n, live) {
+		t.Errorf("expected the catch-all filter to read back equal, got %v", err)
+	}
+
+	// the ingress of an interface is not rewritten
+	params := conf.Simple.withDefaults()
+	params.ingress = true
+	if ingress := createQoSSimple(context.Background(), interf, Gbit, 100*Mbit, params); len(ingress.DSCP) != 0 {
+		t.Errorf("expected no dscp on ingress, got %v", ingress.DSCP)
+	}
+
+	// filters of all protocols with a priority can not be split
+	conf.Hosts = []HostPolicy{{Name: "crew", Match: mustHostMatch(t, "aa:bb:cc:dd:ee:ff"), Class: "low"}}
+	if _, err := createQoS(context.Background(), conf, "simple", interf, Gbit, 100*Mbit); err == nil || !strings.Contains(err.Error(), "filter low/crew/dst of protocol 0x0003") {
+		t.Errorf("expected the MAC filter to be refused, got %v", err)
+	}
+	conf.Hosts = nil
+	conf.Simple.Low.DSCP = "cs9"
+	if _, err := createQoS(context.Background(), conf, "simple", interf, Gbit, 100*Mbit); err == nil || !strings.Contains(err.Error(), `low: invalid DSCP "cs9"`) {
+		t.Errorf("expected the DSCP to be refused, got %v", err)
+	}
+}
+
+func TestPlanFilters(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	conf := Config{Simple: SimpleProfile{Prio: SimpleClass{DSCP: "ef"}}}
+	desired, filters, err := DesiredTree(context.Background(), conf, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, liveFilters, err := DesiredTree(context.Background(), Config{}, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := BuildPlan(desired.Tree, live.Tree)
+	plan.Filters = filterSteps(filters, liveFilters)
+	var b bytes.Buffer
+	if err := plan.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	// the ip and ipv6 filters of prio replace the filter of all protocols
+	for line, count := range map[string]int{
+		"+ add u32 prio 0 mark 0x1/0xf pedit dscp 46\n": 2,
+		"- delete u32 prio 0 mark 0x1/0xf\n":            1,
+	} {
+		if strings.Count(b.String(), line) != count {
+			t.Errorf("expected the plan to contain %q %d times, got:\n%s", line, count, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "no changes") {
+		t.Errorf("expected the filters to be changed, got:\n%s", b.String())
+	}
+
+	plan.Filters = filterSteps(filters, filters)
+	b.Reset()
+	plan.Write(&b)
+	if !strings.HasPrefix(b.String(), "no changes") {
+		t.Errorf("expected no changes, got:\n%s", b.String())
+	}
+}
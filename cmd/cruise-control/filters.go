@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of filters, from include/uapi/linux/rtnetlink.h and pkt_cls.h. go-tc can not encode
+// the rate tables of police actions and does not know pedit actions, so the filters with those
+// actions are encoded and decoded here.
+const (
+	tcaKind              = 1
+	tcaOptions           = 2
+	tcaActKind           = 1
+	tcaActOptions        = 2
+	tcaMatchallClassID   = 1
+	tcaMatchallAct       = 2
+	tcaMatchallFlags     = 3
+	tcaU32ClassID        = 1
+	tcaU32Hash           = 2
+	tcaU32Link           = 3
+	tcaU32Divisor        = 4
+	tcaU32Sel            = 5
+	tcaU32Act            = 7
+	tcaU32Mark           = 10
+	tcaU32Flags          = 11
+	tcaFwClassID         = 1
+	tcaFwAct             = 4
+	tcaFwMask            = 5
+	tcaFlowerClassID     = 1
+	tcaFlowerAct         = 3
+	tcaFlowerEthType     = 8
+	tcaFlowerIPProto     = 9
+	tcaFlowerIPv4Src     = 10
+	tcaFlowerIPv4SrcMask = 11
+	tcaFlowerIPv4Dst     = 12
+	tcaFlowerIPv4DstMask = 13
+	tcaFlowerIPv6Src     = 14
+	tcaFlowerIPv6SrcMask = 15
+	tcaFlowerIPv6Dst     = 16
+	tcaFlowerIPv6DstMask = 17
+	tcaFlowerTCPSrc      = 18
+	tcaFlowerTCPDst      = 19
+	tcaFlowerUDPSrc      = 20
+	tcaFlowerUDPDst      = 21
+	tcaFlowerFlags       = 22
+	tcaFlowerVlanID      = 23
+	tcaFlowerVlanEthType = 25
+	tcaFlowerTCPSrcMask  = 35
+	tcaFlowerTCPDstMask  = 36
+	tcaFlowerUDPSrcMask  = 37
+	tcaFlowerUDPDstMask  = 38
+	tcaFlowerIPTOS       = 73
+	tcaFlowerIPTOSMask   = 74
+	tcaFlowerCtState     = 91
+	tcaFlowerCtStateMask = 92
+	tcmsgSize            = 20
+	u32SelHeaderSize     = 16
+	u32KeySize           = 16
+	tcaU32MarkSize       = 12
+)
+
+// u32SelHeader is struct tc_u32_sel without its keys
+type u32SelHeader struct {
+	Flags, Offshift, NKeys, _ uint8
+	OffMask, Off              uint16
+	Offoff, Hoff              int16
+	Hmask                     uint32
+}
+
+// marshalTcmsg encodes the tcmsg of a filter
+func marshalTcmsg(msg tc.Msg) []byte {
+	b := make([]byte, tcmsgSize)
+	b[0] = uint8(msg.Family)
+	nlenc.NativeEndian().PutUint32(b[4:], msg.Ifindex)
+	nlenc.NativeEndian().PutUint32(b[8:], msg.Handle)
+	nlenc.NativeEndian().PutUint32(b[12:], msg.Parent)
+	nlenc.NativeEndian().PutUint32(b[16:], msg.Info)
+	return b
+}
+
+// marshalFilter encodes the tcmsg and the attributes of a u32, fw, matchall or flower filter with
+// the actions encoded by actions. Flower filters are limited to the keys of the flows, extra holds
+// the keys go-tc can not hold.
+func marshalFilter(obj tc.Object, extra *FlowerExtra, actions func(*netlink.AttributeEncoder) error) ([]byte, error) {
+	u32 := func(ae *netlink.AttributeEncoder, typ uint16, v *uint32) {
+		if v != nil {
+			ae.Uint32(typ, *v)
+		}
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.String(tcaKind, obj.Kind)
+	ae.Nested(tcaOptions, func(ae *netlink.AttributeEncoder) error {
+		switch {
+		case obj.Kind == "matchall" && obj.Matchall != nil:
+			u32(ae, tcaMatchallClassID, obj.Matchall.ClassID)
+			u32(ae, tcaMatchallFlags, obj.Matchall.Flags)
+			ae.Nested(tcaMatchallAct, actions)
+		case obj.Kind == "u32" && obj.U32 != nil:
+			f := obj.U32
+			u32(ae, tcaU32ClassID, f.ClassID)
+			u32(ae, tcaU32Hash, f.Hash)
+			u32(ae, tcaU32Link, f.Link)
+			if sel := f.Sel; sel != nil {
+				var b bytes.Buffer
+				binary.Write(&b, nlenc.NativeEndian(), u32SelHeader{
+					Flags: sel.Flags, Offshift: sel.Offshift, NKeys: uint8(len(sel.Keys)),
+					OffMask: htons(sel.OffMask), Off: sel.Off, Offoff: int16(sel.Offoff), Hoff: int16(sel.Hoff),
+					Hmask: htonl(sel.Hmask),
+				})
+				binary.Write(&b, nlenc.NativeEndian(), sel.Keys)
+				ae.Bytes(tcaU32Sel, b.Bytes())
+			}
+			if mark := f.Mark; mark != nil {
+				b := make([]byte, tcaU32MarkSize)
+				nlenc.NativeEndian().PutUint32(b, mark.Val)
+				nlenc.NativeEndian().PutUint32(b[4:], mark.Mask)
+				ae.Bytes(tcaU32Mark, b)
+			}
+			u32(ae, tcaU32Flags, f.Flags)
+			ae.Nested(tcaU32Act, actions)
+		case obj.Kind == "fw" && obj.Fw != nil:
+			u32(ae, tcaFwClassID, obj.Fw.ClassID)
+			u32(ae, tcaFwMask, obj.Fw.Mask)
+			ae.Nested(tcaFwAct, actions)
+		case obj.Kind == "flower" && obj.Flower != nil:
+			if err := marshalFlower(ae, obj.Flower, extra); err != nil {
+				return err
+			}
+			ae.Nested(tcaFlowerAct, actions)
+		default:
+			return fmt.Errorf("can not encode the actions of %s filters", obj.Kind)
+		}
+		return nil
+	})
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(marshalTcmsg(obj.Msg), attrs...), nil
+}
+
+// flowerKeys returns the keys of a flower filter that are encoded here, the keys of the flows
+func flowerKeys(f *tc.Flower) tc.Flower {
+	return tc.Flower{
+		ClassID: f.ClassID, Flags: f.Flags, Actions: f.Actions,
+		KeyEthType: f.KeyEthType, KeyIPProto: f.KeyIPProto, KeyVlanID: f.KeyVlanID, KeyVlanEthType: f.KeyVlanEthType,
+		KeyIPv4Src: f.KeyIPv4Src, KeyIPv4SrcMask: f.KeyIPv4SrcMask, KeyIPv4Dst: f.KeyIPv4Dst, KeyIPv4DstMask: f.KeyIPv4DstMask,
+		KeyTCPSrc: f.KeyTCPSrc, KeyTCPSrcMask: f.KeyTCPSrcMask, KeyTCPDst: f.KeyTCPDst, KeyTCPDstMask: f.KeyTCPDstMask,
+		KeyUDPSrc: f.KeyUDPSrc, KeyUDPSrcMask: f.KeyUDPSrcMask, KeyUDPDst: f.KeyUDPDst, KeyUDPDstMask: f.KeyUDPDstMask,
+		KeyIPTOS: f.KeyIPTOS, KeyIPTOSMask: f.KeyIPTOSMask,
+	}
+}
+
+// marshalFlower encodes the keys of a flower filter and the keys go-tc can not hold. The ethernet
+// types and ports are in network byte order.
+func marshalFlower(ae *netlink.AttributeEncoder, f *tc.Flower, extra *FlowerExtra) error {
+	if !reflect.DeepEqual(flowerKeys(f), *f) {
+		return errors.New("can not encode the keys of the flower filter")
+	}
+	be16 := func(typ uint16, v *uint16) {
+		if v != nil {
+			b := make([]byte, 2)
+			binary.BigEndian.PutUint16(b, *v)
+			ae.Bytes(typ, b)
+		}
+	}
+	u8 := func(typ uint16, v *uint8) {
+		if v != nil {
+			ae.Uint8(typ, *v)
+		}
+	}
+	ip := func(typ uint16, v *net.IP) {
+		if v != nil {
+			ae.Bytes(typ, v.To4())
+		}
+	}
+	if f.ClassID != nil {
+		ae.Uint32(tcaFlowerClassID, *f.ClassID)
+	}
+	if f.Flags != nil {
+		ae.Uint32(tcaFlowerFlags, *f.Flags)
+	}
+	be16(tcaFlowerEthType, f.KeyEthType)
+	u8(tcaFlowerIPProto, f.KeyIPProto)
+	if f.KeyVlanID != nil {
+		ae.Uint16(tcaFlowerVlanID, *f.KeyVlanID)
+	}
+	be16(tcaFlowerVlanEthType, f.KeyVlanEthType)
+	ip(tcaFlowerIPv4Src, f.KeyIPv4Src)
+	ip(tcaFlowerIPv4SrcMask, f.KeyIPv4SrcMask)
+	ip(tcaFlowerIPv4Dst, f.KeyIPv4Dst)
+	ip(tcaFlowerIPv4DstMask, f.KeyIPv4DstMask)
+	be16(tcaFlowerTCPSrc, f.KeyTCPSrc)
+	be16(tcaFlowerTCPSrcMask, f.KeyTCPSrcMask)
+	be16(tcaFlowerTCPDst, f.KeyTCPDst)
+	be16(tcaFlowerTCPDstMask, f.KeyTCPDstMask)
+	be16(tcaFlowerUDPSrc, f.KeyUDPSrc)
+	be16(tcaFlowerUDPSrcMask, f.KeyUDPSrcMask)
+	be16(tcaFlowerUDPDst, f.KeyUDPDst)
+	be16(tcaFlowerUDPDstMask, f.KeyUDPDstMask)
+	u8(tcaFlowerIPTOS, f.KeyIPTOS)
+	u8(tcaFlowerIPTOSMask, f.KeyIPTOSMask)
+	if extra == nil {
+		return nil
+	}
+	for _, key := range []struct {
+		prefix    string
+		typ, mask uint16
+	}{{extra.IPv6Src, tcaFlowerIPv6Src, tcaFlowerIPv6SrcMask}, {extra.IPv6Dst, tcaFlowerIPv6Dst, tcaFlowerIPv6DstMask}} {
+		if key.prefix == "" {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(key.prefix)
+		if err != nil || prefix.IP.To4() != nil {
+			return fmt.Errorf("invalid IPv6 prefix %q", key.prefix)
+		}
+		ae.Bytes(key.typ, prefix.IP.To16())
+		ae.Bytes(key.mask, prefix.Mask)
+	}
+	if extra.CtStateMask != 0 {
+		ae.Uint16(tcaFlowerCtState, extra.CtState)
+		ae.Uint16(tcaFlowerCtStateMask, extra.CtStateMask)
+	}
+	return nil
+}
+
+// replaceFilter adds a filter with police or pedit actions or replaces it. The actions of the node
+// follow the actions of its object. A matchall filter can not be changed, so it is deleted first.
+func replaceFilter(n *Node) error {
+	obj := n.Object
+	var data []byte
+	var err error
+	if policeOf(obj) != nil {
+		if len(n.Actions) > 0 {
+			return errors.New("police actions can not be combined with other actions")
+		}
+		data, err = marshalPoliceFilter(obj)
+	} else {
+		protocol, _ := ipProtocol(obj)
+		data, err = marshalFilter(obj, n.FlowerExtra, marshalActions(filterActions(n), protocol))
+	}
+	if err != nil {
+		return err
+	}
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+	if obj.Kind == "matchall" {
+		// the priority and protocol identify the filter, without a handle the whole priority is deleted
+		msg := obj.Msg
+		msg.Handle = 0
+		if err := deleteFilter(conn, msg, obj.Kind); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWTFILTER,
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Replace,
+		},
+		Data: data,
+	})
+	return err
+}
+
+// deleteFilter deletes a filter. Only the message and the kind are needed to find the filter, the
+// attributes of live filters can not always be encoded again.
+func deleteFilter(conn *netlink.Conn, msg tc.Msg, kind string) error {
+	if conn == nil {
+		c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+		if err != nil {
+			return fmt.Errorf("could not open rtnetlink socket: %v", err)
+		}
+		defer c.Close()
+		conn = c
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.String(tcaKind, kind)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_DELTFILTER, Flags: netlink.Request | netlink.Acknowledge},
+		Data:   append(marshalTcmsg(msg), attrs...),
+	})
+	return err
+}
+
+// getFilterNodes reads the filters of a parent without go-tc, which fails on the whole dump when a
+// filter has an action it does not know. The filters of kinds that are not decoded here are read
+// with go-tc per priority and protocol.
+func getFilterNodes(tcnl *tc.Tc, ifindex, parent uint32) ([]*Node, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_GETTFILTER, Flags: netlink.Request | netlink.Dump},
+		Data:   marshalTcmsg(tc.Msg{Family: unix.AF_UNSPEC, Ifindex: ifindex, Parent: parent}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*Node
+	read := map[uint32]bool{}
+	for _, msg := range msgs {
+		n, err := unmarshalFilter(msg.Data)
+		if err == nil {
+			nodes = append(nodes, n)
+			continue
+		}
+		if n == nil {
+			return nil, err
+		}
+		// the priority and protocol in the info of the request select the filters of the dump
+		if read[n.Object.Info] {
+			continue
+		}
+		read[n.Object.Info] = true
+		filters, err := tcnl.Filter().Get(&n.Object.Msg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filterLabel(n), err)
+		}
+		for _, f := range filters {
+			nodes = append(nodes, NewNodeWithObject("filter", f))
+		}
+	}
+	return nodes, nil
+}
+
+// unmarshalFilter decodes a filter of a dump. For kinds that are not decoded here, it returns the
+// node with the message of the filter and an error.
+func unmarshalFilter(data []byte) (*Node, error) {
+	if len(data) < tcmsgSize {
+		return nil, errors.New("filter message too short")
+	}
+	obj := tc.Object{Msg: tc.Msg{
+		Family:  uint32(data[0]),
+		Ifindex: nlenc.NativeEndian().Uint32(data[4:]),
+		Handle:  nlenc.NativeEndian().Uint32(data[8:]),
+		Parent:  nlenc.NativeEndian().Uint32(data[12:]),
+		Info:    nlenc.NativeEndian().Uint32(data[16:]),
+	}}
+	n := NewNodeWithObject("filter", obj)
+	ad, err := netlink.NewAttributeDecoder(data[tcmsgSize:])
+	if err != nil {
+		return nil, err
+	}
+	var options []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaKind:
+			n.Object.Kind = ad.String()
+		case tcaOptions:
+			options = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	switch n.Object.Kind {
+	case "u32", "fw", "matchall", "flower":
+	default:
+		// the message of the dump holds the protocol in network byte order and the priority
+		n.Object.Msg = tc.Msg{Family: unix.AF_UNSPEC, Ifindex: obj.Ifindex, Parent: obj.Parent, Info: obj.Info}
+		return n, fmt.Errorf("can not decode %s filters", n.Object.Kind)
+	}
+	if options == nil {
+		return n, nil
+	}
+	ad, err = netlink.NewAttributeDecoder(options)
+	if err != nil {
+		return nil, err
+	}
+	_, protocol := splitInfo(obj.Info)
+	var actions []byte
+	u32 := func() *uint32 {
+		v := ad.Uint32()
+		return &v
+	}
+	switch n.Object.Kind {
+	case "matchall":
+		f := &tc.Matchall{}
+		for ad.Next() {
+			switch ad.Type() {
+			case tcaMatchallClassID:
+				f.ClassID = u32()
+			case tcaMatchallFlags:
+				f.Flags = u32()
+			case tcaMatchallAct:
+				actions = ad.Bytes()
+			}
+		}
+		n.Object.Matchall = f
+	case "u32":
+		f := &tc.U32{}
+		for ad.Next() {
+			switch ad.Type() {
+			case tcaU32ClassID:
+				f.ClassID = u32()
+			case tcaU32Hash:
+				f.Hash = u32()
+			case tcaU32Link:
+				f.Link = u32()
+			case tcaU32Divisor:
+				f.Divisor = u32()
+			case tcaU32Sel:
+				f.Sel = unmarshalU32Sel(ad.Bytes())
+			case tcaU32Mark:
+				if b := ad.Bytes(); len(b) >= tcaU32MarkSize {
+					f.Mark = &tc.U32Mark{
+						Val:     nlenc.NativeEndian().Uint32(b),
+						Mask:    nlenc.NativeEndian().Uint32(b[4:]),
+						Success: nlenc.NativeEndian().Uint32(b[8:]),
+					}
+				}
+			case tcaU32Flags:
+				f.Flags = u32()
+			case tcaU32Act:
+				actions = ad.Bytes()
+			}
+		}
+		n.Object.U32 = f
+	case "fw":
+		f := &tc.Fw{}
+		for ad.Next() {
+			switch ad.Type() {
+			case tcaFwClassID:
+				f.ClassID = u32()
+			case tcaFwMask:
+				f.Mask = u32()
+			case tcaFwAct:
+				actions = ad.Bytes()
+			}
+		}
+		n.Object.Fw = f
+	case "flower":
+		f, vlanEthType := &tc.Flower{}, uint16(0)
+		var extra FlowerExtra
+		actions = unmarshalFlower(ad, f, &extra)
+		if extra != (FlowerExtra{}) {
+			n.FlowerExtra = &extra
+		}
+		if f.KeyVlanEthType != nil {
+			vlanEthType = htons(*f.KeyVlanEthType)
+		}
+		if protocol == unix.ETH_P_8021Q && vlanEthType != 0 {
+			protocol = vlanEthType
+		}
+		n.Object.Flower = f
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	if actions != nil {
+		ad, err := netlink.NewAttributeDecoder(actions)
+		if err != nil {
+			return nil, err
+		}
+		n.Actions = unmarshalActions(ad, protocol)
+	}
+	return n, nil
+}
+
+// unmarshalU32Sel decodes struct tc_u32_sel with its keys
+func unmarshalU32Sel(b []byte) *tc.U32Sel {
+	var h u32SelHeader
+	if len(b) < u32SelHeaderSize || binary.Read(bytes.NewReader(b), nlenc.NativeEndian(), &h) != nil {
+		return nil
+	}
+	sel := &tc.U32Sel{
+		Flags: h.Flags, Offshift: h.Offshift, NKeys: h.NKeys, OffMask: htons(h.OffMask), Off: h.Off,
+		Offoff: uint16(h.Offoff), Hoff: uint16(h.Hoff), Hmask: ntohl(h.Hmask),
+	}
+	for i := 0; i < int(h.NKeys) && u32SelHeaderSize+(i+1)*u32KeySize <= len(b); i++ {
+		var key tc.U32Key
+		binary.Read(bytes.NewReader(b[u32SelHeaderSize+i*u32KeySize:]), nlenc.NativeEndian(), &key)
+		sel.Keys = append(sel.Keys, key)
+	}
+	return sel
+}
+
+// unmarshalFlower decodes the keys of a flower filter like go-tc, which decodes the ethernet types and
+// ports in host byte order, and the keys go-tc can not hold into extra. It returns the encoded
+// actions.
+func unmarshalFlower(ad *netlink.AttributeDecoder, f *tc.Flower, extra *FlowerExtra) (actions []byte) {
+	u16 := func() *uint16 {
+		v := ad.Uint16()
+		return &v
+	}
+	u8 := func() *uint8 {
+		v := ad.Uint8()
+		return &v
+	}
+	ip := func() *net.IP {
+		v := net.IP(ad.Bytes())
+		return &v
+	}
+	var src, dst net.IPNet
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaFlowerClassID:
+			v := ad.Uint32()
+			f.ClassID = &v
+		case tcaFlowerFlags:
+			v := ad.Uint32()
+			f.Flags = &v
+		case tcaFlowerAct:
+			actions = ad.Bytes()
+		case tcaFlowerEthType:
+			f.KeyEthType = u16()
+		case tcaFlowerIPProto:
+			f.KeyIPProto = u8()
+		case tcaFlowerVlanID:
+			f.KeyVlanID = u16()
+		case tcaFlowerVlanEthType:
+			f.KeyVlanEthType = u16()
+		case tcaFlowerIPv4Src:
+			f.KeyIPv4Src = ip()
+		case tcaFlowerIPv4SrcMask:
+			f.KeyIPv4SrcMask = ip()
+		case tcaFlowerIPv4Dst:
+			f.KeyIPv4Dst = ip()
+		case tcaFlowerIPv4DstMask:
+			f.KeyIPv4DstMask = ip()
+		case tcaFlowerTCPSrc:
+			f.KeyTCPSrc = u16()
+		case tcaFlowerTCPSrcMask:
+			f.KeyTCPSrcMask = u16()
+		case tcaFlowerTCPDst:
+			f.KeyTCPDst = u16()
+		case tcaFlowerTCPDstMask:
+			f.KeyTCPDstMask = u16()
+		case tcaFlowerUDPSrc:
+			f.KeyUDPSrc = u16()
+		case tcaFlowerUDPSrcMask:
+			f.KeyUDPSrcMask = u16()
+		case tcaFlowerUDPDst:
+			f.KeyUDPDst = u16()
+		case tcaFlowerUDPDstMask:
+			f.KeyUDPDstMask = u16()
+		case tcaFlowerIPTOS:
+			f.KeyIPTOS = u8()
+		case tcaFlowerIPTOSMask:
+			f.KeyIPTOSMask = u8()
+		case tcaFlowerIPv6Src:
+			src.IP = ad.Bytes()
+		case tcaFlowerIPv6SrcMask:
+			src.Mask = ad.Bytes()
+		case tcaFlowerIPv6Dst:
+			dst.IP = ad.Bytes()
+		case tcaFlowerIPv6DstMask:
+			dst.Mask = ad.Bytes()
+		case tcaFlowerCtState:
+			extra.CtState = *u16()
+		case tcaFlowerCtStateMask:
+			extra.CtStateMask = *u16()
+		}
+	}
+	for _, key := range []struct {
+		prefix *net.IPNet
+		s      *string
+	}{{&src, &extra.IPv6Src}, {&dst, &extra.IPv6Dst}} {
+		if key.prefix.IP == nil {
+			continue
+		}
+		if key.prefix.Mask == nil {
+			key.prefix.Mask = net.CIDRMask(128, 128)
+		}
+		*key.s = key.prefix.String()
+	}
+	return actions
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+// flowPrioBase is the priority of the first flower filter of the flows without priority. The flows
+// come after the filters of hosts and before the filters that get their priority from the kernel.
+const flowPrioBase = 0x8100
+
+// FlowMatch matches traffic on its headers with flower filters. Empty fields match everything.
+type FlowMatch struct {
+	// Src and Dst are an IPv4 or IPv6 address or prefix, eg. "192.168.1.0/24" or "2001:db8::/64"
+	Src string `json:",omitempty"`
+	Dst string `json:",omitempty"`
+	// Proto is tcp, udp, icmp, icmpv6 or an IP protocol number
+	Proto string `json:",omitempty"`
+	// SrcPort and DstPort are a TCP or UDP port or a range of ports, eg. "27000-27050"
+	SrcPort string `json:",omitempty"`
+	DstPort string `json:",omitempty"`
+	// VLAN is the VLAN ID of tagged traffic
+	VLAN uint16 `json:",omitempty"`
+	// DSCP is a DSCP value or class name, eg. "ef", "af41" or "cs1"
+	DSCP string `json:",omitempty"`
+	// CtState is the connection tracking state, eg. "+trk+est", of the flags trk, new, est, rel, rpl
+	// and inv
+	CtState string `json:",omitempty"`
+}
+
+// FlowerExtra holds the keys of a flower filter that github.com/florianl/go-tc has no fields for,
+// they are encoded by marshalFlower
+type FlowerExtra struct {
+	// IPv6Src and IPv6Dst are IPv6 prefixes, eg. "2001:db8::/64"
+	IPv6Src string `json:",omitempty"`
+	IPv6Dst string `json:",omitempty"`
+	// CtState are the connection tracking flags of CtStateMask that are set
+	CtState     uint16 `json:",omitempty"`
+	CtStateMask uint16 `json:",omitempty"`
+}
+
+// Connection tracking flags of flower filters, TCA_FLOWER_KEY_CT_FLAGS_* from pkt_cls.h
+const (
+	ctStateNew         = 1 << 0
+	ctStateEstablished = 1 << 1
+	ctStateRelated     = 1 << 2
+	ctStateTracked     = 1 << 3
+	ctStateInvalid     = 1 << 4
+	ctStateReply       = 1 << 5
+)
+
+// ctStateFlags are the connection tracking flags by their name in the `tc` command-line tool, in
+// its order
+var ctStateFlags = []struct {
+	name string
+	flag uint16
+}{
+	{"trk", ctStateTracked}, {"new", ctStateNew}, {"est", ctStateEstablished},
+	{"rel", ctStateRelated}, {"rpl", ctStateReply}, {"inv", ctStateInvalid},
+}
+
+// parseCtState parses a connection tracking state like "+trk+est-rel" into the flags that are set
+// and the flags that are matched. Like the kernel it refuses states no packet can have.
+func parseCtState(s string) (state, mask uint16, err error) {
+	rest := s
+	for rest != "" {
+		if rest[0] != '+' && rest[0] != '-' {
+			return 0, 0, fmt.Errorf("invalid ct_state %q, expected flags like +trk+est", s)
+		}
+		end := strings.IndexAny(rest[1:], "+-") + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		found := false
+		for _, f := range ctStateFlags {
+			if f.name == rest[1:end] {
+				found = true
+				mask |= f.flag
+				if rest[0] == '+' {
+					state |= f.flag
+				}
+			}
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("invalid ct_state %q, unknown flag %q", s, rest[1:end])
+		}
+		rest = rest[end:]
+	}
+	switch {
+	case state != 0 && state&ctStateTracked == 0:
+		err = fmt.Errorf("invalid ct_state %q, the flags require +trk", s)
+	case state&ctStateNew != 0 && state&(ctStateEstablished|ctStateReply) != 0:
+		err = fmt.Errorf("invalid ct_state %q, new connections are not established or replies", s)
+	case state&ctStateInvalid != 0 && state&^(ctStateTracked|ctStateInvalid) != 0:
+		err = fmt.Errorf("invalid ct_state %q, invalid connections have no other flags", s)
+	}
+	return state, mask, err
+}
+
+// ctStateLabel renders a connection tracking state like the `tc` command-line tool
+func ctStateLabel(state, mask uint16) string {
+	var label string
+	for _, f := range ctStateFlags {
+		switch {
+		case mask&f.flag == 0:
+		case state&f.flag != 0:
+			label += "+" + f.name
+		default:
+			label += "-" + f.name
+		}
+	}
+	return label
+}
+
+// FlowRule classifies the traffic of a match into a class of a traffic file
+type FlowRule struct {
+	FlowMatch `mapstructure:",squash"`
+	// Class is the name of the class the traffic is classified into
+	Class string `json:",omitempty"`
+	// Priority sets the priority of the packets to the handle of a class with skbedit instead of
+	// classifying them, eg. "1:21" on the clsact egress hook in front of the root qdisc
+	Priority string `json:",omitempty"`
+	// Prio is the priority of the first filter of the rule. Rules without priority get one after
+	// the other, ordered by name.
+	Prio uint16 `json:",omitempty"`
+	// Parent is the handle of the qdisc the filters are attached to, the root qdisc by default
+	Parent string `json:",omitempty"`
+}
+
+// portPrefix is a port and mask, ranges of ports are matched with a prefix per power of two
+type portPrefix struct {
+	port, mask uint16
+}
+
+// parsePortRange parses a port or a range of ports and splits it into prefixes
+func parsePortRange(s string) ([]portPrefix, error) {
+	if s == "" {
+		return []portPrefix{{}}, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", s)
+	}
+	hi := lo
+	if len(parts) == 2 {
+		if hi, err = strconv.ParseUint(parts[1], 10, 16); err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	var prefixes []portPrefix
+	for lo <= hi {
+		size := uint64(1)
+		for lo%(size*2) == 0 && lo+size*2-1 <= hi && size < 1<<16 {
+			size *= 2
+		}
+		prefixes = append(prefixes, portPrefix{uint16(lo), uint16(0xffff &^ (size - 1))})
+		lo += size
+	}
+	return prefixes, nil
+}
+
+// ipProtocols are the IP protocols flows can be matched on by name
+var ipProtocols = map[string]uint8{
+	"icmp":   unix.IPPROTO_ICMP,
+	"tcp":    unix.IPPROTO_TCP,
+	"udp":    unix.IPPROTO_UDP,
+	"gre":    unix.IPPROTO_GRE,
+	"esp":    unix.IPPROTO_ESP,
+	"icmpv6": unix.IPPROTO_ICMPV6,
+}
+
+// dscpClasses are the names of the DSCP values
+var dscpClasses = map[string]uint8{
+	"be": 0, "cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+// parseDSCP parses a DSCP value or class name
+func parseDSCP(s string) (uint8, error) {
+	if v, ok := dscpClasses[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q, expected a value up to 63 or a class name like ef or af41", s)
+	}
+	return uint8(v), nil
+}
+
+// flowKeys holds the parsed keys of a match
+type flowKeys struct {
+	src, dst         *net.IPNet
+	proto            *uint8
+	srcPort, dstPort []portPrefix
+	dscp             *uint8
+	vlan             uint16
+	// ctState and ctStateMask are the connection tracking flags
+	ctState, ctStateMask uint16
+	// protocols are the ethernet protocols of the filters
+	protocols []uint16
+}
+
+// keys parses and checks the match
+func (m FlowMatch) keys() (flowKeys, error) {
+	var k flowKeys
+	for _, addr := range []struct {
+		s   string
+		net **net.IPNet
+	}{{m.Src, &k.src}, {m.Dst, &k.dst}} {
+		if addr.s == "" {
+			continue
+		}
+		match, err := ParseHostMatch(addr.s)
+		if err != nil || match.Net == nil {
+			return k, fmt.Errorf("invalid address %q, expected an IP address or prefix", addr.s)
+		}
+		*addr.net = match.Net
+	}
+	if m.Proto != "" {
+		proto, ok := ipProtocols[strings.ToLower(m.Proto)]
+		if !ok {
+			p, err := strconv.ParseUint(m.Proto, 0, 8)
+			if err != nil {
+				return k, fmt.Errorf("unknown IP protocol %q", m.Proto)
+			}
+			proto = uint8(p)
+		}
+		k.proto = &proto
+	}
+	var err error
+	if k.srcPort, err = parsePortRange(m.SrcPort); err != nil {
+		return k, err
+	}
+	if k.dstPort, err = parsePortRange(m.DstPort); err != nil {
+		return k, err
+	}
+	if (m.SrcPort != "" || m.DstPort != "") && (k.proto == nil || (*k.proto != unix.IPPROTO_TCP && *k.proto != unix.IPPROTO_UDP)) {
+		return k, errors.New("ports require the tcp or udp protocol")
+	}
+	if m.DSCP != "" {
+		dscp, err := parseDSCP(m.DSCP)
+		if err != nil {
+			return k, err
+		}
+		k.dscp = &dscp
+	}
+	if m.VLAN > 0xfff {
+		return k, fmt.Errorf("invalid VLAN ID %d", m.VLAN)
+	}
+	k.vlan = m.VLAN
+	if m.CtState != "" {
+		if k.ctState, k.ctStateMask, err = parseCtState(m.CtState); err != nil {
+			return k, err
+		}
+	}
+
+	ipv4 := k.proto != nil && *k.proto == unix.IPPROTO_ICMP
+	ipv6 := k.proto != nil && *k.proto == unix.IPPROTO_ICMPV6
+	for _, addr := range []*net.IPNet{k.src, k.dst} {
+		ipv4 = ipv4 || (addr != nil && len(addr.IP) == net.IPv4len)
+		ipv6 = ipv6 || (addr != nil && len(addr.IP) == net.IPv6len)
+	}
+	switch {
+	case ipv4 && ipv6:
+		return k, errors.New("the match mixes IPv4 and IPv6 addresses or protocols")
+	case ipv4:
+		k.protocols = []uint16{unix.ETH_P_IP}
+	case ipv6:
+		k.protocols = []uint16{unix.ETH_P_IPV6}
+	case k.proto != nil || k.dscp != nil:
+		k.protocols = []uint16{unix.ETH_P_IP, unix.ETH_P_IPV6}
+	default:
+		k.protocols = []uint16{unix.ETH_P_ALL}
+	}
+	return k, nil
+}
+
+// flowerFilters returns the flower filters of a match attached to parent, one for every ethernet
+// protocol and every combination of the prefixes of the port ranges. The filters classify into
+// class, or set the priority of the packets to class with skbedit when priority is set. They get
+// consecutive priorities starting at prio. The keys go-tc can not hold are the same for all
+// filters, they are nil when the match has none.
+func flowerFilters(m FlowMatch, ifindex, parent, class uint32, priority bool, prio uint16) ([]tc.Object, *FlowerExtra, error) {
+	k, err := m.keys()
+	if err != nil {
+		return nil, nil, err
+	}
+	var filters []tc.Object
+	for _, protocol := range k.protocols {
+		for _, src := range k.srcPort {
+			for _, dst := range k.dstPort {
+				if int(prio)+len(filters) > 0xffff {
+					return nil, nil, errors.New("the filters of the flow exceed the highest priority")
+				}
+				flower := k.flower(protocol, src, dst)
+				ethProtocol := protocol
+				if k.vlan != 0 {
+					ethProtocol = unix.ETH_P_8021Q
+				}
+				if priority {
+					p := class
+					flower.Actions = &[]*tc.Action{{
+						Kind:    "skbedit",
+						SkbEdit: &tc.SkbEdit{Parms: &tc.SkbEditParms{Action: tc.ActPipe}, Priority: &p},
+					}}
+				} else {
+					c := class
+					flower.ClassID = &c
+				}
+				filters = append(filters, tc.Object{
+					Msg: tc.Msg{
+						Family:  unix.AF_UNSPEC,
+						Ifindex: ifindex,
+						Parent:  parent,
+						Handle:  1,
+						Info:    core.BuildHandle(uint32(prio)+uint32(len(filters)), uint32(htons(ethProtocol))),
+					},
+					Attribute: tc.Attribute{Kind: "flower", Flower: flower},
+				})
+			}
+		}
+	}
+	return filters, k.extra(), nil
+}
+
+// extra returns the keys of a match that go-tc can not hold, nil when there are none
+func (k flowKeys) extra() *FlowerExtra {
+	var e FlowerExtra
+	if k.src != nil && len(k.src.IP) == net.IPv6len {
+		e.IPv6Src = k.src.String()
+	}
+	if k.dst != nil && len(k.dst.IP) == net.IPv6len {
+		e.IPv6Dst = k.dst.String()
+	}
+	e.CtState, e.CtStateMask = k.ctState, k.ctStateMask
+	if e == (FlowerExtra{}) {
+		return nil
+	}
+	return &e
+}
+
+// flower returns the keys of a filter for an ethernet protocol and a port prefix
+func (k flowKeys) flower(protocol uint16, src, dst portPrefix) *tc.Flower {
+	f := &tc.Flower{}
+	if protocol == unix.ETH_P_ALL {
+		if k.vlan != 0 {
+			f.KeyEthType = uint16Ptr(unix.ETH_P_8021Q)
+			f.KeyVlanID = uint16Ptr(k.vlan)
+		}
+		return f
+	}
+	if k.vlan != 0 {
+		f.KeyEthType = uint16Ptr(unix.ETH_P_8021Q)
+		f.KeyVlanID = uint16Ptr(k.vlan)
+		f.KeyVlanEthType = uint16Ptr(protocol)
+	} else {
+		f.KeyEthType = uint16Ptr(protocol)
+	}
+	if k.src != nil && len(k.src.IP) == net.IPv4len {
+		ip, mask := k.src.IP, net.IP(k.src.Mask)
+		f.KeyIPv4Src, f.KeyIPv4SrcMask = &ip, &mask
+	}
+	if k.dst != nil && len(k.dst.IP) == net.IPv4len {
+		ip, mask := k.dst.IP, net.IP(k.dst.Mask)
+		f.KeyIPv4Dst, f.KeyIPv4DstMask = &ip, &mask
+	}
+	if k.dscp != nil {
+		f.KeyIPTOS = uint8Ptr(*k.dscp << 2)
+		f.KeyIPTOSMask = uint8Ptr(0xfc)
+	}
+	if k.proto == nil {
+		return f
+	}
+	f.KeyIPProto = uint8Ptr(*k.proto)
+	switch *k.proto {
+	case unix.IPPROTO_TCP:
+		if src.mask != 0 {
+			f.KeyTCPSrc, f.KeyTCPSrcMask = uint16Ptr(src.port), uint16Ptr(src.mask)
+		}
+		if dst.mask != 0 {
+			f.KeyTCPDst, f.KeyTCPDstMask = uint16Ptr(dst.port), uint16Ptr(dst.mask)
+		}
+	case unix.IPPROTO_UDP:
+		if src.mask != 0 {
+			f.KeyUDPSrc, f.KeyUDPSrcMask = uint16Ptr(src.port), uint16Ptr(src.mask)
+		}
+		if dst.mask != 0 {
+			f.KeyUDPDst, f.KeyUDPDstMask = uint16Ptr(dst.port), uint16Ptr(dst.mask)
+		}
+	}
+	return f
+}
+
+func uint8Ptr(v uint8) *uint8 {
+	return &v
+}
+
+func uint16Ptr(v uint16) *uint16 {
+	return &v
+}
+
+func uint32Ptr(v uint32) *uint32 {
+	return &v
+}
+
+// setFlowerExtra sets the keys go-tc can not hold of the flower filter with the name
+func (conf *TcConfig) setFlowerExtra(name string, extra FlowerExtra) {
+	if conf.FlowerExtra == nil {
+		conf.FlowerExtra = make(map[string]FlowerExtra)
+	}
+	conf.FlowerExtra[name] = extra
+}
+
+// applyFlows adds the flower filters of the flows of the config. The filters of a rule are named
+// after the rule, numbered when a rule results in more than one filter.
+func (conf *TcConfig) applyFlows() error {
+	if len(conf.Flows) == 0 {
+		return nil
+	}
+	if conf.Filters == nil {
+		conf.Filters = make(map[string]tc.Object)
+	}
+	_, root, hasRoot := conf.rootQdisc()
+	var names []string
+	for name := range conf.Flows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	prio := uint16(flowPrioBase)
+	for _, name := range names {
+		rule := conf.Flows[name]
+		var class uint32
+		switch {
+		case rule.Class != "" && rule.Priority != "":
+			return fmt.Errorf("flow %s: set either a class or a priority", name)
+		case rule.Class != "":
+			c, ok := conf.Classes[rule.Class]
+			if !ok {
+				return fmt.Errorf("flow %s: class %q does not exist", name, rule.Class)
+			}
+			class = c.Handle
+		case rule.Priority != "":
+			h, err := StrHandle(rule.Priority)
+			if err != nil {
+				return fmt.Errorf("flow %s: invalid priority %q", name, rule.Priority)
+			}
+			class = h
+		default:
+			return fmt.Errorf("flow %s: no class or priority", name)
+		}
+		parent := root.Handle
+		if rule.Parent != "" {
+			h, err := StrHandle(rule.Parent)
+			if err != nil {
+				return fmt.Errorf("flow %s: invalid parent %q", name, rule.Parent)
+			}
+			parent = h
+		} else if !hasRoot {
+			return fmt.Errorf("flow %s: no root qdisc to attach the filters to", name)
+		}
+		first := prio
+		if rule.Prio != 0 {
+			first = rule.Prio
+		}
+		filters, extra, err := flowerFilters(rule.FlowMatch, root.Ifindex, parent, class, rule.Priority != "", first)
+		if err != nil {
+			return fmt.Errorf("flow %s: %v", name, err)
+		}
+		for i, f := range filters {
+			key := name
+			if len(filters) > 1 {
+				key = fmt.Sprintf("%s/%d", name, i)
+			}
+			conf.Filters[key] = f
+			if extra != nil {
+				conf.setFlowerExtra(key, *extra)
+			}
+		}
+		if rule.Prio == 0 {
+			prio += uint16(len(filters))
+		}
+	}
+	return nil
+}
+
+// flowerKey holds the keys of a flower filter, so desired and live filters can be compared. Masks of
+// keys without mask are full.
+type flowerKey struct {
+	classID                      uint32
+	ethType, vlanID, vlanEthType uint16
+	ipProto                      uint8
+	src, srcMask, dst, dstMask   string
+	tcpSrc, tcpSrcMask           uint16
+	tcpDst, tcpDstMask           uint16
+	udpSrc, udpSrcMask           uint16
+	udpDst, udpDstMask           uint16
+	tos, tosMask                 uint8
+	hasClassID, isSet            bool
+}
+
+// keyOf returns the keys of a flower filter. github.com/florianl/go-tc encodes the ethernet types and
+// ports in network byte order but decodes them in host byte order, so they are swapped for the live
+// filters read from the kernel.
+func flowerKeyOf(f *tc.Flower, live bool) flowerKey {
+	k := flowerKey{isSet: f != nil}
+	if f == nil {
+		return k
+	}
+	be := func(v *uint16) uint16 {
+		if v == nil {
+			return 0
+		}
+		if live {
+			return htons(*v)
+		}
+		return *v
+	}
+	masked := func(val, mask *uint16) (uint16, uint16) {
+		if val == nil {
+			return 0, 0
+		}
+		if mask == nil {
+			return be(val), 0xffff
+		}
+		return be(val), be(mask)
+	}
+	ip := func(val, mask *net.IP) (string, string) {
+		if val == nil {
+			return "", ""
+		}
+		if mask == nil {
+			return val.String(), net.IP(net.CIDRMask(32, 32)).String()
+		}
+		return val.String(), mask.String()
+	}
+	if f.ClassID != nil {
+		k.classID, k.hasClassID = *f.ClassID, true
+	}
+	k.ethType, k.vlanEthType = be(f.KeyEthType), be(f.KeyVlanEthType)
+	if f.KeyVlanID != nil {
+		k.vlanID = *f.KeyVlanID
+	}
+	if f.KeyIPProto != nil {
+		k.ipProto = *f.KeyIPProto
+	}
+	k.src, k.srcMask = ip(f.KeyIPv4Src, f.KeyIPv4SrcMask)
+	k.dst, k.dstMask = ip(f.KeyIPv4Dst, f.KeyIPv4DstMask)
+	k.tcpSrc, k.tcpSrcMask = masked(f.KeyTCPSrc, f.KeyTCPSrcMask)
+	k.tcpDst, k.tcpDstMask = masked(f.KeyTCPDst, f.KeyTCPDstMask)
+	k.udpSrc, k.udpSrcMask = masked(f.KeyUDPSrc, f.KeyUDPSrcMask)
+	k.udpDst, k.udpDstMask = masked(f.KeyUDPDst, f.KeyUDPDstMask)
+	if f.KeyIPTOS != nil {
+		k.tos, k.tosMask = *f.KeyIPTOS, 0xff
+		if f.KeyIPTOSMask != nil {
+			k.tosMask = *f.KeyIPTOSMask
+		}
+	}
+	return k
+}
+
+// equalFlower reports whether the live flower filter l has the keys and class of the desired
+// filter d
+func equalFlower(d, l *tc.Flower) bool {
+	return flowerKeyOf(d, false) == flowerKeyOf(l, true)
+}
+
+// flowerExtraOf returns the keys go-tc can not hold of the flower filter of a node
+func flowerExtraOf(n *Node) FlowerExtra {
+	if n.FlowerExtra == nil {
+		return FlowerExtra{}
+	}
+	return *n.FlowerExtra
+}
+
+// label describes the keys like flowerLabel
+func (e FlowerExtra) label() string {
+	var parts []string
+	if e.IPv6Src != "" {
+		parts = append(parts, "src_ip "+e.IPv6Src)
+	}
+	if e.IPv6Dst != "" {
+		parts = append(parts, "dst_ip "+e.IPv6Dst)
+	}
+	if e.CtStateMask != 0 {
+		parts = append(parts, "ct_state "+ctStateLabel(e.CtState, e.CtStateMask))
+	}
+	return strings.Join(parts, " ")
+}
+
+// flowerLabel describes the keys of a flower filter
+func flowerLabel(f *tc.Flower) string {
+	k := flowerKeyOf(f, false)
+	var parts []string
+	if k.vlanID != 0 {
+		parts = append(parts, fmt.Sprintf("vlan_id %d", k.vlanID))
+	}
+	for _, addr := range []struct{ name, ip, mask string }{{"src_ip", k.src, k.srcMask}, {"dst_ip", k.dst, k.dstMask}} {
+		if addr.ip != "" {
+			ones, _ := net.IPMask(net.ParseIP(addr.mask).To4()).Size()
+			parts = append(parts, fmt.Sprintf("%s %s/%d", addr.name, addr.ip, ones))
+		}
+	}
+	if f.KeyIPProto != nil {
+		parts = append(parts, fmt.Sprintf("ip_proto %d", k.ipProto))
+	}
+	for _, port := range []struct {
+		name       string
+		port, mask uint16
+	}{{"src_port", k.tcpSrc | k.udpSrc, k.tcpSrcMask | k.udpSrcMask}, {"dst_port", k.tcpDst | k.udpDst, k.tcpDstMask | k.udpDstMask}} {
+		switch port.mask {
+		case 0:
+		case 0xffff:
+			parts = append(parts, fmt.Sprintf("%s %d", port.name, port.port))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %d-%d", port.name, port.port, port.port|^port.mask))
+		}
+	}
+	if f.KeyIPTOS != nil {
+		parts = append(parts, fmt.Sprintf("dscp %d", k.tos>>2))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseFlowerOptions parses the handle and options of a flower filter in the notation of the `tc`
+// command-line tool. Port ranges are not supported, they need a filter per prefix. It returns the
+// keys go-tc can not hold, nil when there are none.
+func parseFlowerOptions(args *tcArgs, obj *tc.Object, handle string) (*FlowerExtra, error) {
+	if handle != "" {
+		h, err := strconv.ParseUint(handle, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flower handle %q", handle)
+		}
+		obj.Handle = uint32(h)
+	}
+	_, protocol := splitInfo(obj.Info)
+	var m FlowMatch
+	var classID *uint32
+	var priority *uint32
+	var flags uint32
+	var err error
+	for err == nil {
+		arg, ok := args.next()
+		if !ok {
+			break
+		}
+		var val string
+		switch arg {
+		case "classid", "flowid":
+			if val, err = args.value(arg); err == nil {
+				var h uint32
+				h, err = StrHandle(val)
+				classID = &h
+			}
+		case "src_ip":
+			m.Src, err = args.value(arg)
+		case "dst_ip":
+			m.Dst, err = args.value(arg)
+		case "ip_proto":
+			m.Proto, err = args.value(arg)
+		case "src_port", "dst_port":
+			if val, err = args.value(arg); err == nil && strings.Contains(val, "-") {
+				err = fmt.Errorf("port range %q is not supported, use a flow in a traffic file", val)
+			}
+			if arg == "src_port" {
+				m.SrcPort = val
+			} else {
+				m.DstPort = val
+			}
+		case "vlan_id":
+			var id uint64
+			id, err = parseUintArg(args, arg, 0, 12)
+			m.VLAN = uint16(id)
+		case "ip_tos":
+			if val, err = args.value(arg); err == nil {
+				parts := strings.SplitN(val, "/", 2)
+				var tos uint64
+				if tos, err = strconv.ParseUint(parts[0], 0, 8); err == nil && (len(parts) != 2 || parts[1] != "0xfc") {
+					err = fmt.Errorf("ip_tos %q: only the DSCP bits (mask 0xfc) can be matched", val)
+				}
+				m.DSCP = strconv.FormatUint(tos>>2, 10)
+			}
+		case "ct_state":
+			m.CtState, err = args.value(arg)
+		case "skip_hw":
+			flags |= 1
+		case "skip_sw":
+			flags |= 2
+		case "action":
+			// only the skbedit priority action is supported
+			var kind, opt string
+			if kind, err = args.value(arg); err == nil && kind == "skbedit" {
+				if opt, err = args.value(kind); err == nil && opt == "priority" {
+					if val, err = args.value(opt); err == nil {
+						var h uint32
+						h, err = StrHandle(val)
+						priority = &h
+					}
+					break
+				}
+			}
+			if err == nil {
+				err = fmt.Errorf("unsupported flower action %q", kind)
+			}
+		default:
+			err = unsupportedOption(obj.Kind, arg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, err := m.keys()
+	if err != nil {
+		return nil, err
+	}
+	ethProtocol := protocol
+	switch {
+	case m.VLAN != 0 && protocol != unix.ETH_P_8021Q:
+		return nil, errors.New("vlan_id requires protocol 802.1q")
+	case m.VLAN != 0:
+		// the keys after the VLAN tag are matched for IPv4, unless they only apply to IPv6
+		ethProtocol = k.protocols[0]
+	case k.protocols[0] != unix.ETH_P_ALL:
+		found := false
+		for _, p := range k.protocols {
+			found = found || p == protocol
+		}
+		if !found {
+			return nil, fmt.Errorf("the keys of the flower filter do not match protocol 0x%04x", protocol)
+		}
+	}
+	flower := k.flower(ethProtocol, k.srcPort[0], k.dstPort[0])
+	flower.ClassID = classID
+	if priority != nil {
+		flower.Actions = &[]*tc.Action{{
+			Kind:    "skbedit",
+			SkbEdit: &tc.SkbEdit{Parms: &tc.SkbEditParms{Action: tc.ActPipe}, Priority: priority},
+		}}
+	}
+	if flags != 0 {
+		flower.Flags = &flags
+	}
+	obj.Flower = flower
+	return k.extra(), nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		ports    string
+		prefixes string
+	}{
+		{"443", "443/ffff"},
+		{"27000-27050", "27000/fff8 27008/ffe0 27040/fff8 27048/fffe 27050/ffff"},
+		{"1024-65535", "1024/fc00 2048/f800 4096/f000 8192/e000 16384/c000 32768/8000"},
+		{"0-65535", "0/0"},
+	} {
+		prefixes, err := parsePortRange(c.ports)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, fmt.Sprintf("%d/%x", p.port, p.mask))
+		}
+		if strings.Join(got, " ") != c.prefixes {
+			t.Errorf("%s: expected %s, got %s", c.ports, c.prefixes, strings.Join(got, " "))
+		}
+	}
+	for _, ports := range []string{"http", "70000", "443-80"} {
+		if _, err := parsePortRange(ports); err == nil {
+			t.Errorf("expected %q to be rejected", ports)
+		}
+	}
+}
+
+func TestFlowerFilters(t *testing.T) {
+	class := core.BuildHandle(1, 0x21)
+	filters, _, err := flowerFilters(FlowMatch{Proto: "udp", DstPort: "3074-3075", DSCP: "ef"}, 2, core.BuildHandle(1, 0), class, false, flowPrioBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IPv4 and IPv6 with a single prefix for the ports
+	if len(filters) != 2 {
+		t.Fatalf("expected 2 filters, got %d", len(filters))
+	}
+	for i, protocol := range []uint16{unix.ETH_P_IP, unix.ETH_P_IPV6} {
+		f := filters[i]
+		prio, proto := splitInfo(f.Info)
+		if prio != flowPrioBase+uint16(i) || proto != protocol || *f.Flower.KeyEthType != protocol || *f.Flower.ClassID != class {
+			t.Errorf("unexpected filter %d: prio %d protocol 0x%x", i, prio, proto)
+		}
+		if *f.Flower.KeyIPProto != unix.IPPROTO_UDP || *f.Flower.KeyUDPDst != 3074 || *f.Flower.KeyUDPDstMask != 0xfffe || *f.Flower.KeyIPTOS != 0xb8 || *f.Flower.KeyIPTOSMask != 0xfc {
+			t.Errorf("unexpected keys %s", flowerLabel(f.Flower))
+		}
+	}
+	if label := filterLabel(NewNodeWithObject("filter", filters[0])); label != fmt.Sprintf("flower prio %d ip_proto 17 dst_port 3074-3075 dscp 46", flowPrioBase) {
+		t.Errorf("unexpected label %q", label)
+	}
+
+	filters, _, err = flowerFilters(FlowMatch{Src: "192.168.1.0/24", VLAN: 10}, 2, core.BuildHandle(1, 0), class, true, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filters[0].Flower
+	if _, proto := splitInfo(filters[0].Info); len(filters) != 1 || proto != unix.ETH_P_8021Q || *f.KeyEthType != unix.ETH_P_8021Q || *f.KeyVlanEthType != unix.ETH_P_IP || *f.KeyVlanID != 10 {
+		t.Errorf("expected a VLAN filter, got %+v", f)
+	}
+	if f.KeyIPv4Src.String() != "192.168.1.0" || f.KeyIPv4SrcMask.String() != "255.255.255.0" || f.ClassID != nil || *(*f.Actions)[0].SkbEdit.Priority != class {
+		t.Errorf("expected the prefix and the skbedit action, got %s", flowerLabel(f))
+	}
+
+	for _, c := range []struct {
+		match   FlowMatch
+		problem string
+	}{
+		{FlowMatch{CtState: "+est"}, "the flags require +trk"},
+		{FlowMatch{CtState: "+trk+new+est"}, "new connections are not established"},
+		{FlowMatch{CtState: "+trk+syn"}, `unknown flag "syn"`},
+		{FlowMatch{Src: "2001:db8::/64", Dst: "10.0.0.1"}, "mixes IPv4 and IPv6"},
+		{FlowMatch{Src: "2001:db8::/64", Proto: "icmp"}, "mixes IPv4 and IPv6"},
+		{FlowMatch{DstPort: "443"}, "ports require the tcp or udp protocol"},
+		{FlowMatch{Proto: "quic"}, "unknown IP protocol"},
+		{FlowMatch{DSCP: "af51"}, "invalid DSCP"},
+	} {
+		if _, _, err := flowerFilters(c.match, 2, 0, class, false, 1); err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("%+v: expected %q, got %v", c.match, c.problem, err)
+		}
+	}
+}
+
+// liveFlower returns the flower filter as github.com/florianl/go-tc reads it back from the kernel
+func liveFlower(f tc.Flower) *tc.Flower {
+	swap := func(v *uint16) *uint16 {
+		if v == nil {
+			return nil
+		}
+		s := htons(*v)
+		return &s
+	}
+	f.KeyEthType, f.KeyVlanEthType = swap(f.KeyEthType), swap(f.KeyVlanEthType)
+	f.KeyTCPDst, f.KeyTCPDstMask = swap(f.KeyTCPDst), swap(f.KeyTCPDstMask)
+	f.KeyUDPDst, f.KeyUDPDstMask = swap(f.KeyUDPDst), swap(f.KeyUDPDstMask)
+	if f.KeyIPv4Src != nil && f.KeyIPv4SrcMask == nil {
+		mask := net.IP(net.CIDRMask(32, 32))
+		f.KeyIPv4SrcMask = &mask
+	}
+	flags := uint32(0)
+	f.Flags = &flags
+	return &f
+}
+
+func TestEqualFlower(t *testing.T) {
+	filters, _, err := flowerFilters(FlowMatch{Src: "10.0.0.1", Proto: "tcp", DstPort: "443"}, 2, core.BuildHandle(1, 0), core.BuildHandle(1, 0x21), false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := filters[0].Flower
+	if !equalFlower(desired, liveFlower(*desired)) {
+		t.Error("expected the live filter to equal the desired filter")
+	}
+	// the kernel reports the full mask of keys without mask
+	noMask := *desired
+	noMask.KeyTCPDstMask = nil
+	if !equalFlower(&noMask, liveFlower(*desired)) {
+		t.Error("expected a key without mask to equal a full mask")
+	}
+
+	other := *desired
+	port := uint16(8443)
+	other.KeyTCPDst = &port
+	class := core.BuildHandle(1, 0x22)
+	moved := *desired
+	moved.ClassID = &class
+	for _, live := range []*tc.Flower{liveFlower(other), liveFlower(moved), liveFlower(tc.Flower{ClassID: desired.ClassID})} {
+		if equalFlower(desired, live) {
+			t.Errorf("expected %s to differ from %s", flowerLabel(live), flowerLabel(desired))
+		}
+	}
+}
+
+func TestTrafficFileFlows(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "flows.json")
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 2}, Gbit, 100*Mbit, SimpleProfile{})
+	conf.Filters = map[string]tc.Object{}
+	conf.Flows = map[string]FlowRule{
+		"games":  {FlowMatch: FlowMatch{Proto: "udp", DstPort: "27000-27050"}, Class: "prio"},
+		"backup": {FlowMatch: FlowMatch{Dst: "10.0.0.2", Proto: "tcp", DstPort: "22"}, Class: "low"},
+		"voip":   {FlowMatch: FlowMatch{DSCP: "ef"}, Priority: "1:21", Prio: 5, Parent: "ffff:fff3"},
+	}
+	if err := conf.generateTrafficFile(file); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseTrafficFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// backup comes first by name, games has 5 prefixes for IPv4 and IPv6
+	if len(parsed.Filters) != 13 {
+		t.Fatalf("expected 13 filters, got %d", len(parsed.Filters))
+	}
+	if prio, _ := splitInfo(parsed.Filters["backup"].Info); prio != flowPrioBase || *parsed.Filters["backup"].Flower.ClassID != core.BuildHandle(1, 0x23) {
+		t.Errorf("unexpected backup filter prio %d", prio)
+	}
+	if prio, _ := splitInfo(parsed.Filters["games/9"].Info); prio != flowPrioBase+10 {
+		t.Errorf("expected the games filters to follow the backup filter, got prio %d", prio)
+	}
+	voip := parsed.Filters["voip/1"]
+	if prio, proto := splitInfo(voip.Info); prio != 6 || proto != unix.ETH_P_IPV6 || voip.Parent != core.BuildHandle(0xffff, 0xfff3) {
+		t.Errorf("unexpected voip filter prio %d protocol 0x%x parent %s", prio, proto, FmtHandle(voip.Parent))
+	}
+
+	nodes, filters := NodesFromConfig(parsed)
+	if errs := ValidateTree(ComposeTree(nodes).Tree, filters); len(errs) > 0 {
+		t.Errorf("invalid tree: %v", errs)
+	}
+
+	conf.Flows = map[string]FlowRule{"bulk": {FlowMatch: FlowMatch{Proto: "tcp"}, Class: "bulk"}}
+	conf.generateTrafficFile(file)
+	if _, err := parseTrafficFile(file); err == nil || !strings.Contains(err.Error(), `flow bulk: class "bulk" does not exist`) {
+		t.Errorf("expected the unknown class to be reported, got %v", err)
+	}
+}
+
+func TestFlowerExtra(t *testing.T) {
+	class := core.BuildHandle(1, 0x21)
+	filters, extra, err := flowerFilters(FlowMatch{Src: "2001:db8::1/64", Proto: "tcp", DstPort: "443", CtState: "+trk+est-rel"}, 2, core.BuildHandle(1, 0), class, false, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FlowerExtra{IPv6Src: "2001:db8::/64", CtState: ctStateTracked | ctStateEstablished, CtStateMask: ctStateTracked | ctStateEstablished | ctStateRelated}
+	if _, proto := splitInfo(filters[0].Info); len(filters) != 1 || proto != unix.ETH_P_IPV6 || filters[0].Flower.KeyIPv4Src != nil || extra == nil || *extra != expected {
+		t.Fatalf("expected an IPv6 filter with the prefix and connection tracking state, got %d filters and %+v", len(filters), extra)
+	}
+	desired := NewNodeWithObject("filter", filters[0])
+	desired.FlowerExtra = extra
+	if label := filterLabel(desired); label != "flower prio 1 ip_proto 6 dst_port 443 src_ip 2001:db8::/64 ct_state +trk+est-rel" {
+		t.Errorf("unexpected label %q", label)
+	}
+
+	// the keys go-tc can not hold are encoded and read back
+	data, err := marshalFilter(desired.Object, desired.FlowerExtra, marshalActions(nil, unix.ETH_P_IPV6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := unmarshalFilter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.FlowerExtra == nil || *live.FlowerExtra != expected || !equalFilter(desired, live) {
+		t.Errorf("expected the live filter to equal the desired filter, got %+v", live.FlowerExtra)
+	}
+	live.FlowerExtra.CtState = ctStateTracked | ctStateRelated
+	if equalFilter(desired, live) {
+		t.Error("expected a changed connection tracking state to differ")
+	}
+	live.FlowerExtra = nil
+	if equalFilter(desired, live) {
+		t.Error("expected a filter without the keys to differ")
+	}
+
+	configs, err := ParseTcScript(strings.NewReader(`
+tc qdisc add dev eth0 root handle 1: hfsc default 21
+tc filter add dev eth0 parent 1: protocol ipv6 prio 3 flower dst_ip 2001:db8::/32 ct_state +trk+new classid 1:21
+tc filter add dev eth0 parent 1: protocol ip prio 4 flower ct_state -trk classid 1:21
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	if len(conf.FlowerExtra) != 2 {
+		t.Fatalf("expected the keys of both filters, got %+v", conf.FlowerExtra)
+	}
+	for name, f := range conf.Filters {
+		prio, _ := splitInfo(f.Info)
+		e := conf.FlowerExtra[name]
+		if prio == 3 && (e.IPv6Dst != "2001:db8::/32" || e.CtState != ctStateTracked|ctStateNew || f.Flower.KeyIPv4Dst != nil) {
+			t.Errorf("unexpected keys of the IPv6 filter %+v", e)
+		}
+		if prio == 4 && (e.CtState != 0 || e.CtStateMask != ctStateTracked) {
+			t.Errorf("unexpected keys of the untracked filter %+v", e)
+		}
+	}
+	if _, err := ParseTcScript(strings.NewReader("tc filter add dev eth0 parent 1: protocol ip prio 1 flower src_ip 2001:db8::1 classid 1:21")); err == nil {
+		t.Error("expected an IPv6 address in an ip filter to be rejected")
+	}
+}
+
+func TestTcScriptFlower(t *testing.T) {
+	configs, err := ParseTcScript(strings.NewReader(`
+tc qdisc add dev eth0 root handle 1: hfsc default 22
+tc filter add dev eth0 parent 1: protocol ip prio 10 flower ip_proto tcp dst_ip 10.0.0.0/8 dst_port 443 classid 1:21
+tc filter add dev eth0 parent 1: protocol 802.1q prio 11 flower vlan_id 5 ip_tos 0xb8/0xfc skip_hw action skbedit priority 1:22
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var https, vlan *tc.Flower
+	for _, f := range configs["eth0"].Filters {
+		if prio, _ := splitInfo(f.Info); prio == 10 {
+			https = f.Flower
+		} else {
+			vlan = f.Flower
+		}
+	}
+	if https == nil || *https.KeyTCPDst != 443 || https.KeyIPv4Dst.String() != "10.0.0.0" || *https.ClassID != core.BuildHandle(1, 0x21) || *https.KeyEthType != unix.ETH_P_IP {
+		t.Errorf("unexpected https filter %s", flowerLabel(https))
+	}
+	if vlan == nil || *vlan.KeyVlanID != 5 || *vlan.KeyVlanEthType != unix.ETH_P_IP || *vlan.KeyIPTOS != 0xb8 || *vlan.Flags != 1 || *(*vlan.Actions)[0].SkbEdit.Priority != core.BuildHandle(1, 0x22) {
+		t.Errorf("unexpected vlan filter %s", flowerLabel(vlan))
+	}
+
+	for _, stmt := range []string{
+		"flower ip_proto tcp dst_port 1000-2000 classid 1:21",
+		"flower ct_state trk classid 1:21",
+		"flower vlan_id 5 classid 1:21",
+		"flower ip_proto tcp action mirred egress redirect dev ifb0",
+	} {
+		if _, err := ParseTcScript(strings.NewReader("tc filter add dev eth0 parent 1: protocol ip prio 1 " + stmt)); err == nil {
+			t.Errorf("expected %q to be rejected", stmt)
+		}
+	}
+}
+
+func TestSimpleProfileMatch(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[[simple.prio.match]]
+proto = "udp"
+dstPort = "3074"
+
+[[simple.low.match]]
+src = "192.168.1.20"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Simple.withDefaults().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tcConf := createQoSSimple(context.Background(), net.Interface{Index: 2}, Gbit, 100*Mbit, conf.Simple)
+	prio, low := tcConf.Filters["prio/match0/1"], tcConf.Filters["low/match0/0"]
+	if prio.Flower == nil || *prio.Flower.KeyUDPDst != 3074 || *prio.Flower.ClassID != tcConf.Classes["prio"].Handle {
+		t.Errorf("expected the IPv6 filter of the prio match, got %+v", prio.Flower)
+	}
+	if p, _ := splitInfo(low.Info); low.Flower == nil || p != flowPrioBase+2 || *low.Flower.ClassID != tcConf.Classes["low"].Handle {
+		t.Errorf("expected the low match after the prio match, got prio %d", p)
+	}
+
+	conf.Simple.Low.Match[0].Src = "lan"
+	if err := conf.Simple.withDefaults().Validate(); err == nil || !strings.Contains(err.Error(), "low: match 1: invalid address") {
+		t.Errorf("expected the invalid match to be reported, got %v", err)
+	}
+}
+
+func TestChangedFlowerFilters(t *testing.T) {
+	filters, _, err := flowerFilters(FlowMatch{Proto: "tcp", DstPort: "443"}, 2, core.BuildHandle(1, 0), core.BuildHandle(1, 0x21), false, flowPrioBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := NewNodeWithObject("filter", filters[0])
+	live := filters[0]
+	live.Flower = liveFlower(*filters[0].Flower)
+	if changed := changedFilters([]*Node{desired}, []*Node{NewNodeWithObject("filter", live)}); len(changed) != 0 {
+		t.Errorf("expected no changes, got %d", len(changed))
+	}
+	port := uint16(8443)
+	moved := *filters[0].Flower
+	moved.KeyTCPDst = &port
+	live.Flower = liveFlower(moved)
+	if changed := changedFilters([]*Node{desired}, []*Node{NewNodeWithObject("filter", live)}); len(changed) != 1 {
+		t.Errorf("expected the port change to be reported, got %d changes", len(changed))
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
@@ -16,10 +18,17 @@ func StrHandle(handle string) (uint32, error) {
 		return tc.HandleRoot, nil
 	}
 	handleParts := strings.Split(handle, ":")
+	if len(handleParts) != 2 {
+		return 0, fmt.Errorf("handle %q is not of the form major:minor", handle)
+	}
 	handleMaj, err := strconv.ParseInt(handleParts[0], 16, 32)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse the major part of the handle: %s", err)
 	}
+	// `tc` allows the minor part to be omitted for qdisc handles (eg. "1:")
+	if handleParts[1] == "" {
+		return core.BuildHandle(uint32(handleMaj), 0), nil
+	}
 	handleMin, err := strconv.ParseInt(handleParts[1], 16, 32)
 	if err != nil {
 		return 0, fmt.Errorf("failed to parse the minor part of the handle: %s", err)
@@ -27,41 +36,87 @@ func StrHandle(handle string) (uint32, error) {
 	return core.BuildHandle(uint32(handleMaj), uint32(handleMin)), nil
 }
 
+// FmtHandle is the inverse of StrHandle, it renders a handle in the human readable major:minor
+// format used by the `tc` command-line tool
+func FmtHandle(handle uint32) string {
+	if handle == tc.HandleRoot {
+		return "root"
+	}
+	maj, min := core.SplitHandle(handle)
+	return fmt.Sprintf("%x:%x", maj, min)
+}
+
+// ticksPerUsec is the amount of psched ticks in a microsecond, as reported by /proc/net/psched on
+// any kernel with high resolution timers
+const ticksPerUsec = 15.625
+
+// xmitTime calculates the time it takes to transmit size bytes at rate in psched ticks. This is used
+// by HTB and police to express their burst buffers.
+func xmitTime(rate Rate, size uint32) uint32 {
+	if rate == 0 {
+		return 0
+	}
+	usec := 1e6 * float64(size) / float64(rate.BytesPerSecond())
+	return uint32(math.Ceil(usec * ticksPerUsec))
+}
+
 // SetSC implements the SC from the `tc` CLI. This function behaves the same as if one would set the
-// USC through the `tc` command-line tool. This means bandwidth (m1 and m2) is specified in bits and
-// the delay in ms.
-func SetSC(hfsc *tc.Hfsc, m1 uint32, d uint32, m2 uint32) {
-	hfsc.Rsc.M1 = m1
-	hfsc.Rsc.D = d
-	hfsc.Rsc.M2 = m2
-	hfsc.Fsc.M1 = m1
-	hfsc.Fsc.D = d
-	hfsc.Fsc.M2 = m2
+// SC through the `tc` command-line tool: it sets both the real-time and the link-share curve. The
+// curve has a slope of m1 for the first d and a slope of m2 afterwards.
+func SetSC(hfsc *tc.Hfsc, m1 Rate, d time.Duration, m2 Rate) {
+	SetRT(hfsc, m1, d, m2)
+	SetLS(hfsc, m1, d, m2)
 }
 
 // SetUL implements the UL from the `tc` CLI. This function behaves the same as if one would set the
-// USC through the `tc` command-line tool. This means bandwidth (m1 and m2) is specified in bits and
-// the delay in ms.
-func SetUL(hfsc *tc.Hfsc, m1 uint32, d uint32, m2 uint32) {
-	hfsc.Usc.M1 = m1
-	hfsc.Usc.D = d
-	hfsc.Usc.M2 = m2
+// USC through the `tc` command-line tool.
+func SetUL(hfsc *tc.Hfsc, m1 Rate, d time.Duration, m2 Rate) {
+	hfsc.Usc = serviceCurve(m1, d, m2)
 }
 
 // SetLS implements the LS from the `tc` CLI. This function behaves the same as if one would set the
-// USC through the `tc` command-line tool. This means bandwidth (m1 and m2) is specified in bits and
-// the delay in ms.
-func SetLS(hfsc *tc.Hfsc, m1 uint32, d uint32, m2 uint32) {
-	hfsc.Fsc.M1 = m1
-	hfsc.Fsc.D = d
-	hfsc.Fsc.M2 = m2
+// FSC through the `tc` command-line tool.
+func SetLS(hfsc *tc.Hfsc, m1 Rate, d time.Duration, m2 Rate) {
+	hfsc.Fsc = serviceCurve(m1, d, m2)
 }
 
 // SetRT implements the RT from the `tc` CLI. This function behaves the same as if one would set the
-// RSC through the `tc` command-line tool. This means bandwidth (m1 and m2) is specified in bits and
-// the delay in ms.
-func SetRT(hfsc *tc.Hfsc, m1 uint32, d uint32, m2 uint32) {
-	hfsc.Rsc.M1 = m1
-	hfsc.Rsc.D = d
-	hfsc.Rsc.M2 = m2
+// RSC through the `tc` command-line tool.
+func SetRT(hfsc *tc.Hfsc, m1 Rate, d time.Duration, m2 Rate) {
+	hfsc.Rsc = serviceCurve(m1, d, m2)
+}
+
+// serviceCurve converts a curve to the kernel representation, which has the slopes in bytes per
+// second and the delay in microseconds
+func serviceCurve(m1 Rate, d time.Duration, m2 Rate) *tc.ServiceCurve {
+	return &tc.ServiceCurve{
+		M1: m1.hfsc(),
+		D:  uint32(d.Microseconds()),
+		M2: m2.hfsc(),
+	}
+}
+
+// FmtRate renders a rate in bytes per second, as used by the kernel, the same way the `tc`
+// command-line tool does
+func FmtRate(rate uint64) string {
+	return RateFromBytes(rate).String()
+}
+
+// FmtTime renders a time in microseconds the same way the `tc` command-line tool does
+func FmtTime(usec uint32) string {
+	switch {
+	case usec >= 1e6 && usec%1e3 == 0:
+		return strconv.FormatFloat(float64(usec)/1e6, 'f', -1, 64) + "s"
+	case usec >= 1e3:
+		return strconv.FormatFloat(float64(usec)/1e3, 'f', -1, 64) + "ms"
+	}
+	return strconv.FormatUint(uint64(usec), 10) + "us"
+}
+
+// FmtSC renders a service curve in the m1/d/m2 notation of the `tc` command-line tool
+func FmtSC(sc tc.ServiceCurve) string {
+	if sc.M1 == 0 && sc.D == 0 {
+		return "m2 " + FmtRate(uint64(sc.M2))
+	}
+	return fmt.Sprintf("m1 %s d %s m2 %s", FmtRate(uint64(sc.M1)), FmtTime(sc.D), FmtRate(uint64(sc.M2)))
 }
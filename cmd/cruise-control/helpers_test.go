@@ -20,6 +20,8 @@ func TestStrHandle(t *testing.T) {
 		{"handle 0:1", "0:1", 1, true},
 		{"handle 0:ffff", "0:ffff", 65535, true},
 		{"handle ffff:0", "ffff:0", 4294901760, true},
+		{"handle 1:", "1:", 65536, true},
+		{"handle 1", "1", 0, false},
 		{"handle help", "help", 0, false},
 		{"handle interface", "interface", 0, false},
 	}
@@ -36,3 +38,30 @@ func TestStrHandle(t *testing.T) {
 		})
 	}
 }
+
+func TestFmtHandle(t *testing.T) {
+	for _, handle := range []string{"root", "0:1", "1:0", "1:21", "ffff:0"} {
+		h, err := StrHandle(handle)
+		if err != nil {
+			t.Fatalf("failed to parse handle %s: %v", handle, err)
+		}
+		if got := FmtHandle(h); got != handle {
+			t.Errorf("expected handle %s to be formatted as %s, got %s", handle, handle, got)
+		}
+	}
+}
+
+func TestFmtRate(t *testing.T) {
+	tests := map[uint64]string{
+		0:          "0bit",
+		125:        "1Kbit",
+		12500000:   "100Mbit",
+		312500000:  "2.5Gbit",
+		3125000000: "25Gbit",
+	}
+	for rate, want := range tests {
+		if got := FmtRate(rate); got != want {
+			t.Errorf("expected %d bytes per second to be formatted as %s, got %s", rate, want, got)
+		}
+	}
+}
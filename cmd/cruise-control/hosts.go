@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+	"within.website/ln/opname"
+)
+
+// HostMatch is the address a host is recognized by: an IPv4 or IPv6 address, a CIDR or a MAC
+// address
+type HostMatch struct {
+	text string
+	Net  *net.IPNet
+	MAC  net.HardwareAddr
+}
+
+// ParseHostMatch parses an IP address, a CIDR or a MAC address
+func ParseHostMatch(s string) (HostMatch, error) {
+	m := HostMatch{text: s}
+	if mac, err := net.ParseMAC(s); err == nil && len(mac) == 6 {
+		m.MAC = mac
+		return m, nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return m, fmt.Errorf("invalid host %q, expected an IP address, a CIDR or a MAC address", s)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		m.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return m, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return m, fmt.Errorf("invalid host %q, expected an IP address, a CIDR or a MAC address", s)
+	}
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		ones, _ := ipnet.Mask.Size()
+		ipnet = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, 32)}
+	}
+	m.Net = ipnet
+	return m, nil
+}
+
+// String returns the address as it was written
+func (m HostMatch) String() string {
+	return m.text
+}
+
+// IsZero reports whether no address was set
+func (m HostMatch) IsZero() bool {
+	return m.Net == nil && m.MAC == nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (m HostMatch) MarshalText() ([]byte, error) {
+	return []byte(m.text), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (m *HostMatch) UnmarshalText(text []byte) error {
+	match, err := ParseHostMatch(string(text))
+	if err != nil {
+		return err
+	}
+	*m = match
+	return nil
+}
+
+// HostPolicy guarantees and limits the bandwidth of a host. The host gets its own class under a
+// class of the profile, with the leaf qdisc of that class.
+type HostPolicy struct {
+	Name  string
+	Match HostMatch
+	// MinRate is the rate the host is guaranteed, MaxRate the rate it is limited to
+	MinRate Rate
+	MaxRate Rate
+	// Class is the name of the class of the profile the host is added under, eg. "normal". The
+	// default class of the root qdisc by default.
+	Class string
+	// Interfaces limits the policy to these configured interfaces
+	Interfaces []string `json:",omitempty"`
+}
+
+// validateHosts checks the policies of a host table
+func validateHosts(hosts []HostPolicy) error {
+	var problems []string
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		switch {
+		case h.Name == "":
+			problems = append(problems, fmt.Sprintf("host %s has no name", h.Match))
+			continue
+		case seen[h.Name]:
+			problems = append(problems, fmt.Sprintf("%s: configured more than once", h.Name))
+		case h.Match.IsZero():
+			problems = append(problems, fmt.Sprintf("%s: no address to match", h.Name))
+		case h.MaxRate != 0 && h.MinRate > h.MaxRate:
+			problems = append(problems, fmt.Sprintf("%s: min rate %s exceeds max rate %s", h.Name, h.MinRate, h.MaxRate))
+		}
+		seen[h.Name] = true
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid hosts: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// hostsFor returns the hosts that apply to a configured interface
+func (c Config) hostsFor(name string) []HostPolicy {
+	var hosts []HostPolicy
+	for _, h := range c.Hosts {
+		if len(h.Interfaces) == 0 {
+			hosts = append(hosts, h)
+			continue
+		}
+		for _, interf := range h.Interfaces {
+			if interf == name {
+				hosts = append(hosts, h)
+				break
+			}
+		}
+	}
+	return hosts
+}
+
+// withHosts returns the config with hosts added to its host table, they replace the hosts of the
+// config with the same name
+func (c Config) withHosts(hosts map[string]HostPolicy) Config {
+	if len(hosts) == 0 {
+		return c
+	}
+	var table []HostPolicy
+	for _, h := range c.Hosts {
+		if _, ok := hosts[h.Name]; !ok {
+			table = append(table, h)
+		}
+	}
+	var names []string
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table = append(table, hosts[name])
+	}
+	c.Hosts = table
+	return c
+}
+
+const (
+	// hostMinorBase is the first minor of the classes added for hosts, their leaf qdiscs use the minor
+	// as major. A class gets a minor from the hash of its name, so it keeps its handle when other
+	// hosts are added or removed.
+	hostMinorBase = 0x4000
+	hostMinors    = 0x4000
+	// hostPrioBase is the priority of the filters of the first host. The filters of hosts come before
+	// the filters that get their priority from the kernel, which starts at 0xc000.
+	hostPrioBase = 0x100
+)
+
+// allocateMinor returns a free minor for the class with key
+func allocateMinor(key string, used map[uint32]bool) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	id := h.Sum32() % hostMinors
+	for used[hostMinorBase+id] {
+		id = (id + 1) % hostMinors
+	}
+	used[hostMinorBase+id] = true
+	return hostMinorBase + id
+}
+
+// addHosts adds a class for every host under the class of its policy. A class that gets hosts
+// becomes an inner class: its leaf qdisc moves to a new "rest" class, which takes over the filters
+// and the default class that pointed at it. The filters of a host match its address as source and
+// as destination, so they classify both directions.
+func (conf *TcConfig) addHosts(hosts []HostPolicy) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	rootName, root, ok := conf.rootQdisc()
+	if !ok {
+		return errors.New("hosts require a root qdisc")
+	}
+	byClass := make(map[string][]HostPolicy)
+	for _, h := range hosts {
+		class := h.Class
+		if class == "" {
+			var ok bool
+			if class, ok = conf.defaultClass(root); !ok {
+				return fmt.Errorf("host %s has no class and the profile has no default class", h.Name)
+			}
+		}
+		if _, ok := conf.Classes[class]; !ok {
+			return fmt.Errorf("host %s: class %q does not exist in the profile", h.Name, class)
+		}
+		byClass[class] = append(byClass[class], h)
+	}
+	var classes []string
+	for class := range byClass {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	used := make(map[uint32]bool)
+	for _, q := range conf.Qdiscs {
+		maj, _ := core.SplitHandle(q.Handle)
+		used[maj] = true
+	}
+	for _, c := range conf.Classes {
+		_, min := core.SplitHandle(c.Handle)
+		used[min] = true
+	}
+	for _, class := range classes {
+		hosts := byClass[class]
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+		if err := conf.addHostClasses(class, hosts, &root, used); err != nil {
+			return err
+		}
+	}
+	// the default class may have moved to a rest class
+	conf.Qdiscs[rootName] = root
+	return nil
+}
+
+// addHostClasses adds the classes of the hosts under the class name
+func (conf *TcConfig) addHostClasses(name string, hosts []HostPolicy, root *tc.Object, used map[uint32]bool) error {
+	parent := conf.Classes[name]
+	if parent.Hfsc == nil && parent.Htb == nil {
+		return fmt.Errorf("class %q is a %s class, hosts require an hfsc or htb class", name, parent.Kind)
+	}
+	major, parentMinor := core.SplitHandle(parent.Handle)
+	leafName, leaf, ok := conf.leafQdisc(parent.Handle)
+	if !ok {
+		return fmt.Errorf("class %q has no leaf qdisc to give to its hosts", name)
+	}
+	delete(conf.Qdiscs, leafName)
+	netem, isNetem := conf.Netem[leafName]
+	delete(conf.Netem, leafName)
+	red, isRed := conf.Red[leafName]
+	delete(conf.Red, leafName)
+
+	newClass := func(key string, minor uint32, attr tc.Attribute) uint32 {
+		handle := core.BuildHandle(major, minor)
+		conf.Classes[key] = tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: parent.Ifindex,
+				Handle:  handle,
+				Parent:  parent.Handle,
+			},
+			Attribute: attr,
+		}
+		conf.Qdiscs[key] = tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: parent.Ifindex,
+				Handle:  core.BuildHandle(minor, 0),
+				Parent:  handle,
+			},
+			Attribute: leaf.Attribute,
+		}
+		if isNetem {
+			conf.Netem[key] = netem
+		}
+		if isRed {
+			conf.Red[key] = red
+		}
+		return handle
+	}
+
+	// the traffic of the class that is not from or to a host goes to the rest class
+	restMinor := allocateMinor(name+"/rest", used)
+	rest := newClass(name+"/rest", restMinor, hostClassAttribute(parent.Attribute, 0, 0, len(hosts)))
+	for key, f := range conf.Filters {
+		conf.Filters[key] = retargetFilter(f, parent.Handle, rest)
+	}
+	switch {
+	case root.HfscQOpt != nil && uint32(root.HfscQOpt.DefCls) == parentMinor:
+		opt := *root.HfscQOpt
+		opt.DefCls = uint16(restMinor)
+		root.HfscQOpt = &opt
+	case root.Htb != nil && root.Htb.Init != nil && root.Htb.Init.Defcls == parentMinor:
+		htb, init := *root.Htb, *root.Htb.Init
+		init.Defcls = restMinor
+		htb.Init = &init
+		root.Htb = &htb
+	}
+
+	for _, h := range hosts {
+		key := name + "/" + h.Name
+		minor := allocateMinor(key, used)
+		attr := hostClassAttribute(parent.Attribute, h.MinRate, h.MaxRate, len(hosts))
+		if attr.Hfsc != nil && *attr.Hfsc.Fsc == (tc.ServiceCurve{}) {
+			return fmt.Errorf("host %s: class %q has no rate to share with its hosts, set a min rate", h.Name, name)
+		}
+		handle := newClass(key, minor, attr)
+		prio := hostPrioBase + 2*(minor-hostMinorBase)
+		for i, dst := range []bool{false, true} {
+			filter, err := hostFilter(*root, h.Match, dst, handle, prio+uint32(i))
+			if err != nil {
+				return fmt.Errorf("host %s: %v", h.Name, err)
+			}
+			direction := "src"
+			if dst {
+				direction = "dst"
+			}
+			conf.Filters[key+"/"+direction] = filter
+		}
+	}
+	return nil
+}
+
+// rootQdisc returns the qdisc attached to the root of the device
+func (conf *TcConfig) rootQdisc() (string, tc.Object, bool) {
+	for name, q := range conf.Qdiscs {
+		if q.Parent == tc.HandleRoot {
+			return name, q, true
+		}
+	}
+	return "", tc.Object{}, false
+}
+
+// defaultClass returns the name of the default class of the root qdisc
+func (conf *TcConfig) defaultClass(root tc.Object) (string, bool) {
+	var defcls uint32
+	switch {
+	case root.HfscQOpt != nil:
+		defcls = uint32(root.HfscQOpt.DefCls)
+	case root.Htb != nil && root.Htb.Init != nil:
+		defcls = root.Htb.Init.Defcls
+	}
+	if defcls == 0 {
+		return "", false
+	}
+	maj, _ := core.SplitHandle(root.Handle)
+	handle := core.BuildHandle(maj, defcls)
+	for name, c := range conf.Classes {
+		if c.Handle == handle {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// leafQdisc returns the qdisc attached to a class
+func (conf *TcConfig) leafQdisc(class uint32) (string, tc.Object, bool) {
+	for name, q := range conf.Qdiscs {
+		if q.Parent == class {
+			return name, q, true
+		}
+	}
+	return "", tc.Object{}, false
+}
+
+// hostClassAttribute derives the class of a host from the class it is added under. HFSC hosts are
+// guaranteed their min rate as real-time curve and share the link with the other classes like the
+// parent class does, unless their min rate is higher. HTB hosts without min rate share the rate of
+// the parent class with the other hosts and the rest class. Without min and max rate, the class
+// gets the curves or rates of the parent, which is what the rest class uses.
+func hostClassAttribute(parent tc.Attribute, min, max Rate, hosts int) tc.Attribute {
+	attr := tc.Attribute{Kind: parent.Kind}
+	if parent.Hfsc != nil {
+		hfsc := &tc.Hfsc{Rsc: &tc.ServiceCurve{}, Fsc: &tc.ServiceCurve{}, Usc: &tc.ServiceCurve{}}
+		if parent.Hfsc.Fsc != nil {
+			*hfsc.Fsc = *parent.Hfsc.Fsc
+		}
+		if min == 0 && max == 0 {
+			if parent.Hfsc.Rsc != nil {
+				*hfsc.Rsc = *parent.Hfsc.Rsc
+			}
+			attr.Hfsc = hfsc
+			return attr
+		}
+		if min != 0 {
+			SetRT(hfsc, 0, 0, min)
+			if hfsc.Fsc.M2 < min.hfsc() {
+				SetLS(hfsc, 0, 0, min)
+			}
+		}
+		if max != 0 {
+			SetUL(hfsc, 0, 0, max)
+			if hfsc.Fsc.M2 > max.hfsc() {
+				SetLS(hfsc, 0, 0, max)
+			}
+		}
+		attr.Hfsc = hfsc
+		return attr
+	}
+
+	parms := parent.Htb.Parms
+	var rate, ceil Rate
+	var prio uint32
+	if parms != nil {
+		rate, ceil, prio = htbRate(parms.Rate.Rate, parent.Htb.Rate64), htbRate(parms.Ceil.Rate, parent.Htb.Ceil64), parms.Prio
+	}
+	if min == 0 {
+		min = rate / Rate(hosts+1)
+	}
+	if max == 0 {
+		max = ceil
+	}
+	if max < min {
+		max = min
+	}
+	attr.Htb = newHtbClass(min, max, 0, 0, prio)
+	return attr
+}
+
+// htbRate converts the rate of an HTB class in bytes per second back to a rate
+func htbRate(rate uint32, rate64 *uint64) Rate {
+	if rate64 != nil {
+		return RateFromBytes(*rate64)
+	}
+	return RateFromBytes(uint64(rate))
+}
+
+// retargetFilter points a filter that classifies into class from to class to
+func retargetFilter(f tc.Object, from, to uint32) tc.Object {
+	switch {
+	case f.U32 != nil && f.U32.ClassID != nil && *f.U32.ClassID == from:
+		u32 := *f.U32
+		u32.ClassID = &to
+		f.U32 = &u32
+	case f.Fw != nil && f.Fw.ClassID != nil && *f.Fw.ClassID == from:
+		fw := *f.Fw
+		fw.ClassID = &to
+		f.Fw = &fw
+	case f.Flower != nil && f.Flower.ClassID != nil && *f.Flower.ClassID == from:
+		flower := *f.Flower
+		flower.ClassID = &to
+		f.Flower = &flower
+	case f.BPF != nil && f.BPF.ClassID != nil && *f.BPF.ClassID == from:
+		bpf := *f.BPF
+		bpf.ClassID = &to
+		f.BPF = &bpf
+	}
+	return f
+}
+
+// hostFilter returns a u32 filter that classifies the traffic from a host, or to a host when dst is
+// set. MAC addresses are matched in the ethernet header, in front of the network header.
+func hostFilter(root tc.Object, match HostMatch, dst bool, class uint32, prio uint32) (tc.Object, error) {
+	sel := &tc.U32Sel{Flags: u32Terminal}
+	protocol := uint16(unix.ETH_P_ALL)
+	switch {
+	case match.MAC != nil:
+		off := int32(-8)
+		if dst {
+			off = -14
+		}
+		for i := 0; i < 6; i += 2 {
+			val := uint32(binary.BigEndian.Uint16(match.MAC[i:]))
+			if err := packU32Key(sel, val, 0xffff, 16, off+int32(i)); err != nil {
+				return tc.Object{}, err
+			}
+		}
+	case match.Net.IP.To4() != nil && len(match.Net.IP) == net.IPv4len:
+		protocol = unix.ETH_P_IP
+		off := int32(12)
+		if dst {
+			off = 16
+		}
+		val, mask := binary.BigEndian.Uint32(match.Net.IP), binary.BigEndian.Uint32(match.Net.Mask)
+		if err := packU32Key(sel, val, mask, 32, off); err != nil {
+			return tc.Object{}, err
+		}
+	default:
+		protocol = unix.ETH_P_IPV6
+		off := int32(8)
+		if dst {
+			off = 24
+		}
+		ip, mask := match.Net.IP.To16(), net.IP(match.Net.Mask).To16()
+		for i := 0; i < net.IPv6len; i += 4 {
+			m := binary.BigEndian.Uint32(mask[i:])
+			if m == 0 {
+				continue
+			}
+			if err := packU32Key(sel, binary.BigEndian.Uint32(ip[i:]), m, 32, off+int32(i)); err != nil {
+				return tc.Object{}, err
+			}
+		}
+	}
+	sel.NKeys = uint8(len(sel.Keys))
+	return tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: root.Ifindex,
+			Parent:  root.Handle,
+			Handle:  1,
+			Info:    core.BuildHandle(prio, uint32(htons(protocol))),
+		},
+		Attribute: tc.Attribute{
+			Kind: "u32",
+			U32: &tc.U32{
+				ClassID: &class,
+				Sel:     sel,
+			},
+		},
+	}, nil
+}
+
+// SetHost adds a host to the host table or replaces the host with the same name. The interfaces are
+// reconciled with the new table, only the classes and filters of the host change.
+func (r *Reloader) SetHost(ctx context.Context, host HostPolicy) (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := r.apiHosts()
+	hosts[host.Name] = host
+	return r.setHosts(ctx, hosts)
+}
+
+// RemoveHost removes a host that was added through the API
+func (r *Reloader) RemoveHost(ctx context.Context, name string) (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts := r.apiHosts()
+	if _, ok := hosts[name]; !ok {
+		return ReloadResult{}, errHostNotFound
+	}
+	delete(hosts, name)
+	return r.setHosts(ctx, hosts)
+}
+
+var errHostNotFound = errors.New("host was not added through the API")
+
+// apiHosts returns a copy of the hosts added through the API
+func (r *Reloader) apiHosts() map[string]HostPolicy {
+	r.confMu.RLock()
+	defer r.confMu.RUnlock()
+	hosts := make(map[string]HostPolicy, len(r.hosts))
+	for name, h := range r.hosts {
+		hosts[name] = h
+	}
+	return hosts
+}
+
+// hostTable returns the discovered hosts and the hosts added through the API
+func (r *Reloader) hostTable() map[string]HostPolicy {
+	r.confMu.RLock()
+	defer r.confMu.RUnlock()
+	return mergeHosts(r.discovered, r.hosts)
+}
+
+// setHosts validates the config with the hosts and activates them. The caller must hold mu.
+func (r *Reloader) setHosts(ctx context.Context, hosts map[string]HostPolicy) (ReloadResult, error) {
+	conf := r.active()
+	r.confMu.RLock()
+	table := mergeHosts(r.discovered, hosts)
+	r.confMu.RUnlock()
+	if err := r.validate(ctx, conf.withHosts(table)); err != nil {
+		return ReloadResult{}, err
+	}
+	r.confMu.Lock()
+	r.hosts = hosts
+	r.confMu.Unlock()
+	return r.activate(ctx, conf, "hosts"), nil
+}
+
+// HostsHandler lists the host table. A POST adds or replaces the host in the JSON body, a DELETE
+// removes the host with the name in the query.
+func HostsHandler(r *Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx := opname.With(context.Background(), "HostsHandler")
+		var result interface{}
+		switch req.Method {
+		case http.MethodGet:
+			hosts := r.Config().Hosts
+			if hosts == nil {
+				hosts = []HostPolicy{}
+			}
+			result = hosts
+		case http.MethodPost:
+			var host HostPolicy
+			if err := json.NewDecoder(req.Body).Decode(&host); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateHosts([]HostPolicy{host}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err := r.SetHost(ctx, host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			result = res
+		case http.MethodDelete:
+			res, err := r.RemoveHost(ctx, req.URL.Query().Get("name"))
+			switch {
+			case errors.Is(err, errHostNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			result = res
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/spf13/viper"
+)
+
+func TestParseHostMatch(t *testing.T) {
+	for _, s := range []string{"192.168.1.10", "10.0.0.0/8", "2001:db8::1", "2001:db8::/32", "aa:bb:cc:dd:ee:ff"} {
+		if _, err := ParseHostMatch(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "stream-pc", "10.0.0.0/33", "aa:bb:cc"} {
+		if _, err := ParseHostMatch(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+// hostTree composes the simple profile with hosts
+func hostTree(t *testing.T, hosts []HostPolicy) (TcConfig, *Node, []*Node) {
+	t.Helper()
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, SimpleProfile{Latency: true})
+	if err := conf.addHosts(hosts); err != nil {
+		t.Fatal(err)
+	}
+	nodes, filters := NodesFromConfig(conf)
+	result := ComposeTree(nodes)
+	if problems := result.Problems(); len(problems) > 0 {
+		t.Fatalf("tree could not be composed: %v", problems)
+	}
+	if errs := ValidateTree(result.Tree, filters); len(errs) > 0 {
+		t.Fatalf("invalid tree: %v", errs)
+	}
+	return conf, result.Tree, filters
+}
+
+func TestAddHosts(t *testing.T) {
+	stream := HostPolicy{Name: "stream", Match: mustHostMatch(t, "192.168.1.10"), MinRate: 20 * Mbit, MaxRate: 50 * Mbit, Class: "prio"}
+	crew := HostPolicy{Name: "crew", Match: mustHostMatch(t, "aa:bb:cc:dd:ee:ff"), MaxRate: 5 * Mbit}
+	conf, _, _ := hostTree(t, []HostPolicy{stream, crew})
+
+	// the leaf qdisc of prio moves to the rest class, which takes over the filter of prio
+	prio, rest := conf.Classes["prio"], conf.Classes["prio/rest"]
+	if _, ok := conf.Qdiscs["prio"]; ok {
+		t.Error("expected prio to lose its leaf qdisc")
+	}
+	if rest.Parent != prio.Handle || conf.Qdiscs["prio/rest"].Parent != rest.Handle || *rest.Hfsc.Rsc != *prio.Hfsc.Rsc {
+		t.Errorf("expected a rest class with the curves of prio, got %+v", rest)
+	}
+	if *conf.Filters["prio"].U32.ClassID != rest.Handle {
+		t.Errorf("expected the prio filter to classify into the rest class, got %s", FmtHandle(*conf.Filters["prio"].U32.ClassID))
+	}
+
+	s := conf.Classes["prio/stream"]
+	if s.Parent != prio.Handle || *s.Hfsc.Rsc != (tc.ServiceCurve{M2: 2500000}) || *s.Hfsc.Usc != (tc.ServiceCurve{M2: 6250000}) || conf.Qdiscs["prio/stream"].Kind != "fq_codel" {
+		t.Errorf("unexpected class of the stream host %+v", s.Hfsc)
+	}
+	src, dst := conf.Filters["prio/stream/src"], conf.Filters["prio/stream/dst"]
+	if *src.U32.ClassID != s.Handle || src.U32.Sel.Keys[0].Off != 12 || dst.U32.Sel.Keys[0].Off != 16 || src.Info == dst.Info {
+		t.Errorf("expected filters on the source and destination address, got %+v %+v", src.U32.Sel, dst.U32.Sel)
+	}
+	if prio, protocol := core.SplitHandle(src.Info); prio < hostPrioBase || protocol != uint32(htons(0x0800)) {
+		t.Errorf("expected an IPv4 filter before the profile filters, got prio %d protocol %x", prio, protocol)
+	}
+
+	// hosts without class are added under the default class, which moves to the rest class
+	c := conf.Classes["normal/crew"]
+	if c.Parent != conf.Classes["normal"].Handle || c.Hfsc.Usc.M2 != 625000 || c.Hfsc.Fsc.M2 != 625000 {
+		t.Errorf("unexpected class of the crew host %+v", c.Hfsc)
+	}
+	_, restMinor := core.SplitHandle(conf.Classes["normal/rest"].Handle)
+	if uint32(conf.Qdiscs["root"].HfscQOpt.DefCls) != restMinor {
+		t.Errorf("expected the default class to move to the rest class, got %x", conf.Qdiscs["root"].HfscQOpt.DefCls)
+	}
+	if keys := conf.Filters["normal/crew/src"].U32.Sel.Keys; len(keys) != 2 || keys[0].Off != uint32(0xfffffff8) {
+		t.Errorf("expected the MAC address to be matched in the ethernet header, got %+v", keys)
+	}
+
+	// the classes of hosts keep their handle when other hosts are added
+	more, _, _ := hostTree(t, []HostPolicy{stream, crew, {Name: "v6", Match: mustHostMatch(t, "2001:db8::/64"), Class: "prio", MinRate: Mbit}})
+	if more.Classes["prio/stream"].Handle != s.Handle || more.Classes["normal/crew"].Handle != c.Handle {
+		t.Error("expected the handles of the hosts to be stable")
+	}
+	if keys := more.Filters["prio/v6/dst"].U32.Sel.Keys; len(keys) != 2 || keys[0].Off != 24 {
+		t.Errorf("expected the IPv6 prefix to be matched in 2 words, got %+v", keys)
+	}
+
+	bad := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, SimpleProfile{})
+	if err := bad.addHosts([]HostPolicy{{Name: "x", Match: stream.Match, Class: "bulk"}}); err == nil || !strings.Contains(err.Error(), `class "bulk" does not exist`) {
+		t.Errorf("expected an unknown class to fail, got %v", err)
+	}
+}
+
+func TestAddHostsHtb(t *testing.T) {
+	configs, err := ParseTcScript(strings.NewReader(`
+tc qdisc add dev eth0 root handle 1: htb default 10
+tc class add dev eth0 parent 1: classid 1:10 htb rate 60mbit ceil 100mbit prio 1
+tc qdisc add dev eth0 parent 1:10 handle 10: sfq
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	err = conf.addHosts([]HostPolicy{
+		{Name: "a", Match: mustHostMatch(t, "10.0.0.1"), MinRate: 10 * Mbit},
+		{Name: "b", Match: mustHostMatch(t, "10.0.0.2"), MaxRate: 20 * Mbit},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, b tc.Object
+	for name, c := range conf.Classes {
+		switch {
+		case strings.HasSuffix(name, "/a"):
+			a = c
+		case strings.HasSuffix(name, "/b"):
+			b = c
+		}
+	}
+	if a.Htb == nil || b.Htb == nil {
+		t.Fatalf("expected htb classes for the hosts, got %+v", conf.Classes)
+	}
+	// b shares the rate of the class with the other hosts and the rest class
+	if a.Htb.Parms.Rate.Rate != 1250000 || a.Htb.Parms.Ceil.Rate != 12500000 || b.Htb.Parms.Rate.Rate != 2500000 || b.Htb.Parms.Ceil.Rate != 2500000 {
+		t.Errorf("unexpected rates a %+v b %+v", a.Htb.Parms, b.Htb.Parms)
+	}
+	nodes, filters := NodesFromConfig(conf)
+	if errs := ValidateTree(ComposeTree(nodes).Tree, filters); len(errs) > 0 {
+		t.Errorf("invalid tree: %v", errs)
+	}
+}
+
+func TestHostsConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[[interfaces]]
+name = "eth0"
+uploadSpeed = "100mbit"
+
+[[interfaces]]
+name = "eth1"
+uploadSpeed = "100mbit"
+
+[[hosts]]
+name = "stream"
+match = "192.168.1.10"
+minRate = "20mbit"
+class = "prio"
+
+[[hosts]]
+name = "crew"
+match = "192.168.2.0/24"
+maxRate = "5mbit"
+interfaces = ["eth1"]
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Hosts) != 2 || conf.Hosts[0].MinRate != 20*Mbit || conf.Hosts[1].Match.Net == nil {
+		t.Fatalf("unexpected hosts %+v", conf.Hosts)
+	}
+	if eth0 := conf.Interfaces[0].config(conf).Hosts; len(eth0) != 1 || eth0[0].Name != "stream" {
+		t.Errorf("expected the crew host to apply to eth1 only, got %+v", eth0)
+	}
+	if err := validateConfig(context.Background(), conf); err != nil {
+		t.Errorf("expected the config to be valid, got %v", err)
+	}
+	conf.Hosts = append(conf.Hosts, HostPolicy{Name: "stream", Match: conf.Hosts[0].Match, MinRate: 2 * Mbit, MaxRate: Mbit})
+	if err := validateConfig(context.Background(), conf); err == nil || !strings.Contains(err.Error(), "stream: configured more than once") {
+		t.Errorf("expected the duplicate host to be reported, got %v", err)
+	}
+}
+
+func TestHostsHandler(t *testing.T) {
+	r := NewReloader(Config{Hosts: []HostPolicy{{Name: "stream", Match: mustHostMatch(t, "192.168.1.10")}}}, NewDriftMonitor())
+	var reconciled []Config
+	r.reconcile = func(ctx context.Context, conf Config) []InterfaceResult {
+		reconciled = append(reconciled, conf)
+		return nil
+	}
+	handler := HostsHandler(r)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/hosts", strings.NewReader(`{"name": "crew", "match": "aa:bb:cc:dd:ee:ff", "maxRate": "5mbit"}`)))
+	if rec.Code != http.StatusOK || len(reconciled) != 1 || len(reconciled[0].Hosts) != 2 {
+		t.Fatalf("expected the host to be added and reconciled, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/hosts", nil))
+	if !strings.Contains(rec.Body.String(), `"Match": "aa:bb:cc:dd:ee:ff"`) || !strings.Contains(rec.Body.String(), `"MaxRate": "5Mbit"`) {
+		t.Errorf("expected the host table, got %s", rec.Body.String())
+	}
+
+	// hosts are validated with the config
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/hosts", strings.NewReader(`{"name": "x", "match": "10.0.0.1", "minRate": "2mbit", "maxRate": "1mbit"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid host to be rejected, got %d", rec.Code)
+	}
+	r.validate = func(ctx context.Context, conf Config) error { return validateHosts([]HostPolicy{{}}) }
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/hosts", strings.NewReader(`{"name": "x", "match": "10.0.0.1"}`)))
+	if rec.Code != http.StatusUnprocessableEntity || len(r.Config().Hosts) != 2 {
+		t.Errorf("expected a host the config rejects to be refused, got %d", rec.Code)
+	}
+
+	// hosts added through the API are kept across reloads
+	r.validate = validateConfig
+	r.load = func() (Config, error) { return Config{}, nil }
+	if result := r.Reload(context.Background(), "config"); !result.Accepted || len(r.Config().Hosts) != 1 {
+		t.Errorf("expected the API host to survive the reload, got %+v", r.Config().Hosts)
+	}
+
+	// schedule transitions keep the API hosts apart from the config
+	r.Reschedule(context.Background())
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/hosts?name=crew", nil))
+	if rec.Code != http.StatusOK || len(r.Config().Hosts) != 0 {
+		t.Errorf("expected the host to be removed, got %d %+v", rec.Code, r.Config().Hosts)
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodDelete, "/hosts?name=stream", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected hosts of the config to be kept, got %d", rec.Code)
+	}
+}
+
+func mustHostMatch(t *testing.T, s string) HostMatch {
+	t.Helper()
+	m, err := ParseHostMatch(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
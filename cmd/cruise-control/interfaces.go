@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// Direction is the traffic of an interface that is shaped
+type Direction string
+
+const (
+	// Egress shapes the traffic sent on the interface with the upload speed
+	Egress Direction = "egress"
+	// Ingress shapes the traffic received on the interface with the download speed. It is
+	// redirected to an IFB device, as the kernel can only shape traffic that is sent.
+	Ingress Direction = "ingress"
+	// Both shapes the traffic in both directions
+	Both Direction = "both"
+)
+
+// UnmarshalText validates the direction when it is read from the config
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch direction := Direction(text); direction {
+	case "":
+		*d = Egress
+	case Egress, Ingress, Both:
+		*d = direction
+	default:
+		return fmt.Errorf("unknown direction %q, expected %q, %q or %q", text, Egress, Ingress, Both)
+	}
+	return nil
+}
+
+// InterfaceConfig is an interface the daemon shapes
+type InterfaceConfig struct {
+	Name    string
+	Profile string
+	// Direction is egress by default
+	Direction Direction
+	// IFB is the device ingress traffic is shaped on, "ifb-<name>" by default
+	IFB string
+	// IngressMode is how ingress traffic is limited, it is shaped on the IFB device by default
+	IngressMode IngressMode
+	// Police limits the ingress traffic of hosts and networks in the police mode, before the
+	// download speed limits all traffic
+	Police []Policer
+
+	DownloadSpeed Rate
+	UploadSpeed   Rate
+	// LinkSpeed, Overhead and TrafficFile override the ones of the config
+	LinkSpeed   Rate
+	Overhead    Overhead
+	TrafficFile string
+	// Drift overrides the drift policy of the config
+	Drift DriftPolicy
+	// Schedule switches the profile, speeds or parameters at set times
+	Schedule []ScheduleEntry
+
+	// simple holds the parameters of the simple profile set by the active schedule entry
+	simple *SimpleProfile
+}
+
+// ManagedInterfaces returns the interfaces of the config. A config without interfaces manages the
+// top level interface when it has an upload speed.
+func (c Config) ManagedInterfaces() []InterfaceConfig {
+	if len(c.Interfaces) > 0 || c.Interface == "" || c.UploadSpeed == 0 {
+		return c.Interfaces
+	}
+	return []InterfaceConfig{{
+		Name:          c.Interface,
+		DownloadSpeed: c.DownloadSpeed,
+		UploadSpeed:   c.UploadSpeed,
+	}}
+}
+
+// managedInterface returns the config of an interface that is shaped on egress
+func (c Config) managedInterface(name string) (InterfaceConfig, bool) {
+	for _, ic := range c.ManagedInterfaces() {
+		if ic.Name == name && ic.Direction != Ingress {
+			return ic, true
+		}
+	}
+	return InterfaceConfig{}, false
+}
+
+// config returns the config the trees of the interface are composed with, with the hosts that
+// apply to the interface
+func (ic InterfaceConfig) config(conf Config) Config {
+	if ic.LinkSpeed != 0 {
+		conf.LinkSpeed = ic.LinkSpeed
+	}
+	if ic.Overhead != (Overhead{}) {
+		conf.Overhead = ic.Overhead
+	}
+	if ic.TrafficFile != "" {
+		conf.TrafficFile = ic.TrafficFile
+	}
+	if ic.simple != nil {
+		conf.Simple = *ic.simple
+	}
+	conf.Hosts = conf.hostsFor(ic.Name)
+	return conf
+}
+
+// maxLinkSpeed is the highest link speed read from sysfs that is used, HFSC can not shape above
+// ~34.3Gbit
+const maxLinkSpeed = 34 * Gbit
+
+// linkSpeed returns the speed the interface class of an interface is limited to. It is the
+// configured link speed, or the speed the driver of the interface reports, or 1Gbit for virtual
+// interfaces like IFB devices, and at least the internet speed.
+func (c Config) linkSpeed(interf net.Interface, internet Rate) Rate {
+	speed := c.LinkSpeed
+	if speed == 0 {
+		speed = Gbit
+		data, err := os.ReadFile(filepath.Join("/sys/class/net", interf.Name, "speed"))
+		if mbit, perr := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && perr == nil && mbit > 0 {
+			speed = Rate(mbit) * Mbit
+		}
+		if speed > maxLinkSpeed {
+			speed = maxLinkSpeed
+		}
+	}
+	if speed < internet {
+		speed = internet
+	}
+	return speed
+}
+
+// ifbName is the name of the IFB device ingress traffic is redirected to. Interface names are
+// limited to 15 characters.
+func (ic InterfaceConfig) ifbName() string {
+	if ic.IFB != "" {
+		return ic.IFB
+	}
+	name := "ifb-" + ic.Name
+	if len(name) > unix.IFNAMSIZ-1 {
+		name = name[:unix.IFNAMSIZ-1]
+	}
+	return name
+}
+
+// shapedDevice is a device a tree is applied to for a configured interface
+type shapedDevice struct {
+	Direction Direction
+	Device    string
+	Profile   ManagedProfile
+}
+
+// devices returns the devices that are shaped for the interface
+func (ic InterfaceConfig) devices(conf Config) []shapedDevice {
+	profile := ManagedProfile{
+		Conf:    ic.config(conf),
+		Profile: ic.Profile,
+		Policy:  ic.Drift,
+	}
+	// policed ingress traffic is limited on the interface itself, next to the tree of its egress
+	police := ic.IngressMode == IngressPolice && ic.Direction != Egress
+	var devices []shapedDevice
+	if ic.Direction != Ingress {
+		egress, direction := profile, Egress
+		egress.Speed = ic.UploadSpeed
+		if police {
+			egress.Police, direction = ic.policers(), Both
+		}
+		devices = append(devices, shapedDevice{direction, ic.Name, egress})
+	}
+	switch {
+	case police && ic.Direction == Ingress:
+		ingress := profile
+		ingress.Police = ic.policers()
+		devices = append(devices, shapedDevice{Ingress, ic.Name, ingress})
+	case !police && (ic.Direction == Ingress || ic.Direction == Both):
+		ingress := profile
+		ingress.Speed, ingress.Ingress = ic.DownloadSpeed, ic.Name
+		devices = append(devices, shapedDevice{Ingress, ic.ifbName(), ingress})
+	}
+	return devices
+}
+
+// InterfaceResult is the outcome of reconciling a direction of a configured interface
+type InterfaceResult struct {
+	Interface string
+	Direction Direction
+	Device    string
+	// Changes is the plan that was applied to the device
+	Changes []string `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// ReconcileInterfaces applies the profiles of all configured interfaces and hands them to the
+// monitor. An interface that fails does not affect the others, the monitor applies its profile
+// when it comes up.
+func ReconcileInterfaces(ctx context.Context, conf Config, monitor *DriftMonitor) []InterfaceResult {
+	ctx = opname.With(ctx, "ReconcileInterfaces")
+	var results []InterfaceResult
+	for _, ic := range conf.ManagedInterfaces() {
+		for _, dev := range ic.devices(conf) {
+			result := InterfaceResult{Interface: ic.Name, Direction: dev.Direction, Device: dev.Device}
+			f := ln.F{"interface": ic.Name, "direction": dev.Direction, "device": dev.Device}
+			changes, err := reconcileDevice(ctx, dev, monitor)
+			result.Changes = changes
+			if err != nil {
+				result.Error = err.Error()
+				ln.Error(ctx, err, f)
+			} else {
+				ln.Log(ctx, f, ln.Info("applied the %s profile", dev.Profile.Profile))
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// reconcileDevice applies the profile of a device and returns the changes it planned
+func reconcileDevice(ctx context.Context, dev shapedDevice, monitor *DriftMonitor) ([]string, error) {
+	if dev.Profile.Speed == 0 && len(dev.Profile.Police) == 0 {
+		return nil, fmt.Errorf("no %s speed configured", dev.Direction)
+	}
+	var interf *net.Interface
+	var err error
+	if dev.Profile.Ingress != "" {
+		interf, err = ensureIFB(dev.Device)
+	} else {
+		interf, err = net.InterfaceByName(dev.Device)
+	}
+	if err != nil {
+		// the monitor applies the profile once the interface appears
+		monitor.Manage(net.Interface{Name: dev.Device}, dev.Profile, nil, nil)
+		return nil, err
+	}
+
+	rtnl, err := OpenTc()
+	if err != nil {
+		return nil, err
+	}
+	defer rtnl.Close()
+	var changes []string
+	if tree, filters, err := dev.Profile.desired(ctx, *interf); err == nil {
+		live, liveFilters := LiveTree(rtnl, *interf)
+		live, liveFilters = policedOnly(tree, live, liveFilters)
+		_, changes = driftChanges(tree, filters, live, liveFilters)
+	}
+	tree, filters, err := applyProfile(ctx, rtnl, *interf, dev.Profile)
+	monitor.Manage(*interf, dev.Profile, tree, filters)
+	return changes, err
+}
+
+// applyProfile composes the desired tree of a profile for an interface and applies it. Ingress
+// traffic of the source interface is redirected to the interface first.
+func applyProfile(ctx context.Context, rtnl *tc.Tc, interf net.Interface, profile ManagedProfile) (*Node, []*Node, error) {
+	tree, filters, err := profile.desired(ctx, interf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile.Ingress != "" {
+		src, err := net.InterfaceByName(profile.Ingress)
+		if err != nil {
+			return tree, filters, err
+		}
+		if err := redirectIngress(rtnl, *src, interf); err != nil {
+			return tree, filters, err
+		}
+	}
+	return tree, filters, applyTree(ctx, rtnl, interf, tree, filters)
+}
+
+// redirectIngress attaches an ingress qdisc to src with a filter that redirects all traffic to
+// the egress of dst
+func redirectIngress(rtnl *tc.Tc, src, dst net.Interface) error {
+	ingress := tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(src.Index),
+			Handle:  ingressHandle,
+			Parent:  tc.HandleIngress,
+		},
+		Attribute: tc.Attribute{
+			Kind: "ingress",
+		},
+	}
+	if err := rtnl.Qdisc().Replace(&ingress); err != nil {
+		return fmt.Errorf("could not add ingress qdisc to %s: %v", src.Name, err)
+	}
+
+	redirect := tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(src.Index),
+			Handle:  1,
+			Parent:  ingressHandle,
+			Info:    core.BuildHandle(1, 0x0300),
+		},
+		Attribute: tc.Attribute{
+			Kind: "matchall",
+			Matchall: &tc.Matchall{
+				Actions: &[]*tc.Action{{
+					Kind: "mirred",
+					Mirred: &tc.Mirred{
+						Parms: &tc.MirredParam{
+							Action:  tc.ActStolen,
+							Eaction: tcaEgressRedir,
+							IfIndex: uint32(dst.Index),
+						},
+					},
+				}},
+			},
+		},
+	}
+	if err := rtnl.Filter().Replace(&redirect); err != nil {
+		return fmt.Errorf("could not redirect the ingress of %s to %s: %v", src.Name, dst.Name, err)
+	}
+	return nil
+}
+
+// ingressHandle is the handle of the ingress qdisc, ffff:
+var ingressHandle = core.BuildHandle(0xFFFF, 0)
+
+// tcaEgressRedir is TCA_EGRESS_REDIR from include/uapi/linux/tc_act/tc_mirred.h
+const tcaEgressRedir = 1
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestInterfacesConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+drift = "alert"
+
+[[interfaces]]
+name = "eth0"
+uploadSpeed = "100mbit"
+linkSpeed = "10gbit"
+drift = "reconcile"
+
+[[interfaces]]
+name = "pppoe-wan-uplink"
+profile = "lanparty"
+direction = "both"
+downloadSpeed = "500mbit"
+uploadSpeed = "50mbit"
+overhead = { preset = "pppoe-ptm" }
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	interfaces := conf.ManagedInterfaces()
+	if len(interfaces) != 2 {
+		t.Fatalf("expected 2 interfaces, got %+v", interfaces)
+	}
+
+	eth0 := interfaces[0].devices(conf)
+	if len(eth0) != 1 || eth0[0].Direction != Egress || eth0[0].Device != "eth0" || eth0[0].Profile.Speed != 100*Mbit || eth0[0].Profile.Policy != DriftReconcile {
+		t.Errorf("unexpected devices of eth0 %+v", eth0)
+	}
+	if speed := eth0[0].Profile.Conf.linkSpeed(net.Interface{Name: "eth0"}, 100*Mbit); speed != 10*Gbit {
+		t.Errorf("expected the configured link speed of eth0, got %s", speed)
+	}
+
+	ppp := interfaces[1].devices(conf)
+	if len(ppp) != 2 {
+		t.Fatalf("expected egress and ingress devices, got %+v", ppp)
+	}
+	if ppp[0].Device != "pppoe-wan-uplink" || ppp[0].Profile.Speed != 50*Mbit || ppp[0].Profile.Profile != "lanparty" {
+		t.Errorf("unexpected egress device %+v", ppp[0])
+	}
+	// the name of the IFB device is truncated to the 15 characters the kernel allows
+	if ppp[1].Device != "ifb-pppoe-wan-u" || ppp[1].Profile.Speed != 500*Mbit || ppp[1].Profile.Ingress != "pppoe-wan-uplink" {
+		t.Errorf("unexpected ingress device %+v", ppp[1])
+	}
+	if ppp[1].Profile.Conf.Overhead.Preset != "pppoe-ptm" || conf.Overhead.Preset != "" {
+		t.Errorf("expected the overhead to apply to the interface only, got %+v", ppp[1].Profile.Conf.Overhead)
+	}
+
+	v.Set("interfaces", []map[string]interface{}{{"name": "eth0", "direction": "sideways"}})
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err == nil {
+		t.Error("expected an unknown direction to fail")
+	}
+}
+
+func TestLinkSpeed(t *testing.T) {
+	interf := net.Interface{Name: "cc-nonexistent"}
+	for _, c := range []struct {
+		conf             Config
+		internet, expect Rate
+	}{
+		{Config{}, 100 * Mbit, Gbit},
+		{Config{}, 10 * Gbit, 10 * Gbit},
+		{Config{LinkSpeed: 25 * Gbit}, 10 * Gbit, 25 * Gbit},
+		{Config{LinkSpeed: 100 * Mbit}, 200 * Mbit, 200 * Mbit},
+	} {
+		if speed := c.conf.linkSpeed(interf, c.internet); speed != c.expect {
+			t.Errorf("expected a link speed of %s with %s internet and %s configured, got %s", c.expect, c.internet, c.conf.LinkSpeed, speed)
+		}
+	}
+}
+
+func TestLegacyInterface(t *testing.T) {
+	conf := Config{Interface: "test-01", DownloadSpeed: 500 * Mbit, UploadSpeed: 100 * Mbit}
+	interfaces := conf.ManagedInterfaces()
+	if len(interfaces) != 1 || interfaces[0].Name != "test-01" || interfaces[0].UploadSpeed != 100*Mbit {
+		t.Errorf("expected the top level interface to be managed, got %+v", interfaces)
+	}
+	if ic, ok := conf.managedInterface("test-01"); !ok || ic.UploadSpeed != 100*Mbit {
+		t.Errorf("expected test-01 to be configured, got %+v", ic)
+	}
+	conf.UploadSpeed = 0
+	if interfaces := conf.ManagedInterfaces(); len(interfaces) != 0 {
+		t.Errorf("expected an interface without speed not to be managed, got %+v", interfaces)
+	}
+}
+
+func TestReconcileIsolatesFailures(t *testing.T) {
+	m := NewDriftMonitor()
+	conf := Config{Interfaces: []InterfaceConfig{
+		{Name: "missing0", UploadSpeed: 10 * Mbit},
+		{Name: "missing1"},
+	}}
+	results := ReconcileInterfaces(context.Background(), conf, m)
+	if len(results) != 2 || results[0].Error == "" || !strings.Contains(results[1].Error, "no egress speed") {
+		t.Errorf("expected both interfaces to fail on their own, got %+v", results)
+	}
+	// the missing interface is applied when it appears
+	var reapplied []string
+	m.reapply = func(ctx context.Context, name string, ifindex int) {
+		reapplied = append(reapplied, name)
+	}
+	m.linkChanged(context.Background(), LinkEvent{Index: 12, Name: "missing0", Up: true})
+	if len(reapplied) != 1 || reapplied[0] != "missing0" {
+		t.Errorf("expected missing0 to be applied when it comes up, got %v", reapplied)
+	}
+}
+
+func TestLinkChangedIngressSource(t *testing.T) {
+	m := NewDriftMonitor()
+	var reapplied []int
+	m.reapply = func(ctx context.Context, name string, ifindex int) {
+		reapplied = append(reapplied, ifindex)
+	}
+	ifb := net.Interface{Index: 20, Name: "ifb-ppp0", Flags: net.FlagUp}
+	m.Manage(ifb, ManagedProfile{Ingress: "ppp0"}, NewNode("qdisc"), nil)
+
+	// the redirect on the source is set up again when it is re-created
+	m.linkChanged(context.Background(), LinkEvent{Index: 7, Name: "ppp0", Deleted: true})
+	m.linkChanged(context.Background(), LinkEvent{Index: 8, Name: "ppp0", Up: true})
+	if len(reapplied) != 1 || reapplied[0] != 20 {
+		t.Errorf("expected the IFB device to be applied again, got %v", reapplied)
+	}
+}
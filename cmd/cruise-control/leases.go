@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// discoveryInterval is how often the leases are read when the config does not set an interval
+const discoveryInterval = 30 * time.Second
+
+// Discovery adds the hosts of DHCP leases and the neighbor table of the kernel to the host table.
+// Every host that matches a group gets a host policy with the rates of the group.
+type Discovery struct {
+	Leases []LeaseFile
+	// Neighbors adds the hosts in the neighbor table, eg. hosts with a static address
+	Neighbors bool
+	// Interval is how often the leases and the neighbor table are read
+	Interval time.Duration
+	// Groups are matched in order, the first group that matches a host applies
+	Groups []HostGroup
+}
+
+// LeaseFile is a lease file of a DHCP server
+type LeaseFile struct {
+	Path string
+	// Format is dnsmasq, dhcpd (ISC dhcpd) or kea (Kea memfile CSV)
+	Format string
+}
+
+// HostGroup maps the discovered hosts that match all of its criteria to a policy
+type HostGroup struct {
+	Name string
+	// Hostname is a shell pattern, eg. "tv-*", matched case insensitive
+	Hostname string
+	// Vendor is the prefix of the MAC address, eg. "b8:27:eb"
+	Vendor MACPrefix
+	// Subnet is the network the address of the host is in
+	Subnet HostMatch
+
+	MinRate    Rate
+	MaxRate    Rate
+	Class      string
+	Interfaces []string `json:",omitempty"`
+}
+
+// MACPrefix is the first bytes of a MAC address, the OUI of the vendor
+type MACPrefix []byte
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (p *MACPrefix) UnmarshalText(text []byte) error {
+	s := strings.NewReplacer(":", "", "-", "", ".", "").Replace(string(text))
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) == 0 || len(b) > 6 {
+		return fmt.Errorf("invalid MAC prefix %q", text)
+	}
+	*p = b
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (p MACPrefix) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p MACPrefix) String() string {
+	var parts []string
+	for _, b := range p {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// lease is a host discovered in a lease file or the neighbor table
+type lease struct {
+	IP       net.IP
+	MAC      net.HardwareAddr
+	Hostname string
+	// Expires is zero for leases that do not expire and neighbors
+	Expires time.Time
+}
+
+// matches reports whether the host matches all criteria of the group
+func (g HostGroup) matches(l lease) bool {
+	if g.Hostname != "" {
+		ok, _ := path.Match(strings.ToLower(g.Hostname), strings.ToLower(l.Hostname))
+		if !ok {
+			return false
+		}
+	}
+	if len(g.Vendor) > 0 && (len(l.MAC) < len(g.Vendor) || !strings.HasPrefix(string(l.MAC), string(g.Vendor))) {
+		return false
+	}
+	if g.Subnet.Net != nil && !g.Subnet.Net.Contains(l.IP) {
+		return false
+	}
+	return true
+}
+
+// validate checks the groups and lease files of the discovery
+func (d Discovery) validate() error {
+	var problems []string
+	for _, f := range d.Leases {
+		switch f.Format {
+		case "dnsmasq", "dhcpd", "kea":
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown lease format %q, expected dnsmasq, dhcpd or kea", f.Path, f.Format))
+		}
+	}
+	seen := make(map[string]bool)
+	for _, g := range d.Groups {
+		switch {
+		case g.Name == "":
+			problems = append(problems, "host group without name")
+			continue
+		case seen[g.Name]:
+			problems = append(problems, fmt.Sprintf("%s: configured more than once", g.Name))
+		case g.Hostname == "" && len(g.Vendor) == 0 && g.Subnet.IsZero():
+			problems = append(problems, fmt.Sprintf("%s: no hostname, vendor or subnet to match", g.Name))
+		case g.Subnet.MAC != nil:
+			problems = append(problems, fmt.Sprintf("%s: subnet %s is not a network", g.Name, g.Subnet))
+		case g.MaxRate != 0 && g.MinRate > g.MaxRate:
+			problems = append(problems, fmt.Sprintf("%s: min rate %s exceeds max rate %s", g.Name, g.MinRate, g.MaxRate))
+		}
+		if _, err := path.Match(g.Hostname, ""); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid hostname pattern %q", g.Name, g.Hostname))
+		}
+		seen[g.Name] = true
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid discovery: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// enabled reports whether hosts are discovered
+func (d Discovery) enabled() bool {
+	return len(d.Groups) > 0 && (len(d.Leases) > 0 || d.Neighbors)
+}
+
+// hosts reads the lease files and the neighbor table and returns the policies of the hosts that
+// match a group. Expired leases are left out. A lease and a neighbor with the same address are the
+// same host, the lease names it.
+func (d Discovery) hosts(now time.Time, neighbors func() ([]lease, error)) ([]HostPolicy, error) {
+	var leases []lease
+	for _, f := range d.Leases {
+		l, err := readLeases(f, now)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l...)
+	}
+	if d.Neighbors {
+		l, err := neighbors()
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l...)
+	}
+
+	byIP := make(map[string]lease)
+	for _, l := range leases {
+		if !l.Expires.IsZero() && !l.Expires.After(now) {
+			continue
+		}
+		if ip4 := l.IP.To4(); ip4 != nil {
+			l.IP = ip4
+		}
+		key := l.IP.String()
+		if known, ok := byIP[key]; ok {
+			if l.Hostname == "" {
+				l.Hostname = known.Hostname
+			}
+			if l.MAC == nil {
+				l.MAC = known.MAC
+			}
+		}
+		byIP[key] = l
+	}
+	var ips []string
+	for ip := range byIP {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	var hosts []HostPolicy
+	names := make(map[string]int)
+	for _, ip := range ips {
+		l := byIP[ip]
+		for _, g := range d.Groups {
+			if !g.matches(l) {
+				continue
+			}
+			bits := 8 * len(l.IP)
+			name := g.Name + "-" + hostLabel(l)
+			names[name]++
+			hosts = append(hosts, HostPolicy{
+				Name:       name,
+				Match:      HostMatch{text: ip, Net: &net.IPNet{IP: l.IP, Mask: net.CIDRMask(bits, bits)}},
+				MinRate:    g.MinRate,
+				MaxRate:    g.MaxRate,
+				Class:      g.Class,
+				Interfaces: g.Interfaces,
+			})
+			break
+		}
+	}
+	// hosts with more than one address get a policy per address
+	for i, h := range hosts {
+		if names[h.Name] > 1 {
+			hosts[i].Name += "-" + h.Match.String()
+		}
+	}
+	return hosts, nil
+}
+
+// hostLabel names a discovered host by its hostname, or its address when it has none
+func hostLabel(l lease) string {
+	if l.Hostname == "" {
+		return l.IP.String()
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, l.Hostname)
+}
+
+// readLeases reads the active leases of a lease file
+func readLeases(f LeaseFile, now time.Time) ([]lease, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var leases []lease
+	switch f.Format {
+	case "dnsmasq":
+		leases, err = parseDnsmasqLeases(file)
+	case "dhcpd":
+		leases, err = parseDhcpdLeases(file)
+	case "kea":
+		leases, err = parseKeaLeases(file)
+	default:
+		err = fmt.Errorf("unknown lease format %q", f.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Path, err)
+	}
+	return leases, nil
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file. IPv4 leases are "expiry mac ip hostname
+// client-id", the IPv6 leases after the "duid" line are "expiry iaid ip hostname duid". An expiry
+// of 0 never expires, a hostname of "*" is unknown.
+func parseDnsmasqLeases(r io.Reader) ([]lease, error) {
+	var leases []lease
+	v6 := false
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "duid" {
+			v6 = true
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields", n)
+		}
+		var l lease
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", n, fields[0])
+		}
+		if expiry != 0 {
+			l.Expires = time.Unix(expiry, 0)
+		}
+		if !v6 {
+			if l.MAC, err = net.ParseMAC(fields[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		if l.IP = net.ParseIP(fields[2]); l.IP == nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", n, fields[2])
+		}
+		if fields[3] != "*" {
+			l.Hostname = fields[3]
+		}
+		leases = append(leases, l)
+	}
+	return leases, scanner.Err()
+}
+
+// parseDhcpdLeases parses an ISC dhcpd lease file. The file is a journal: a lease replaces the
+// earlier leases of its address. Leases that are not active are left out.
+func parseDhcpdLeases(r io.Reader) ([]lease, error) {
+	tokens, err := dhcpdTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	byIP := make(map[string]lease)
+	var order []string
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] == "{" {
+			// skip the other blocks, eg. failover state
+			if i, err = skipBlock(tokens, i); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tokens[i] != "lease" || i+2 >= len(tokens) || tokens[i+2] != "{" {
+			continue
+		}
+		l := lease{IP: net.ParseIP(tokens[i+1])}
+		if l.IP == nil {
+			return nil, fmt.Errorf("invalid lease address %q", tokens[i+1])
+		}
+		active := true
+		i += 3
+		var stmt []string
+		for ; i < len(tokens) && tokens[i] != "}"; i++ {
+			switch tokens[i] {
+			case "{":
+				if i, err = skipBlock(tokens, i); err != nil {
+					return nil, err
+				}
+			case ";":
+				if err := l.dhcpdStatement(stmt, &active); err != nil {
+					return nil, fmt.Errorf("lease %s: %v", l.IP, err)
+				}
+				stmt = stmt[:0]
+			default:
+				stmt = append(stmt, tokens[i])
+			}
+		}
+		if i == len(tokens) {
+			return nil, fmt.Errorf("lease %s is not closed", l.IP)
+		}
+		key := l.IP.String()
+		if _, ok := byIP[key]; !ok {
+			order = append(order, key)
+		}
+		if !active {
+			delete(byIP, key)
+			continue
+		}
+		byIP[key] = l
+	}
+	var leases []lease
+	for _, key := range order {
+		if l, ok := byIP[key]; ok {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// dhcpdStatement applies a statement of a dhcpd lease
+func (l *lease) dhcpdStatement(stmt []string, active *bool) error {
+	if len(stmt) < 2 {
+		return nil
+	}
+	switch {
+	case stmt[0] == "ends":
+		switch {
+		case stmt[1] == "never":
+			l.Expires = time.Time{}
+		case stmt[1] == "epoch" && len(stmt) > 2:
+			sec, err := strconv.ParseInt(stmt[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid end %q", stmt[2])
+			}
+			l.Expires = time.Unix(sec, 0)
+		case len(stmt) == 4:
+			// the weekday is followed by the date and time in UTC
+			t, err := time.Parse("2006/01/02 15:04:05", stmt[2]+" "+stmt[3])
+			if err != nil {
+				return fmt.Errorf("invalid end %q", strings.Join(stmt[1:], " "))
+			}
+			l.Expires = t
+		default:
+			return fmt.Errorf("invalid end %q", strings.Join(stmt[1:], " "))
+		}
+	case stmt[0] == "binding" && len(stmt) == 3 && stmt[1] == "state":
+		*active = stmt[2] == "active"
+	case stmt[0] == "hardware" && len(stmt) == 3:
+		mac, err := net.ParseMAC(stmt[2])
+		if err != nil {
+			return err
+		}
+		l.MAC = mac
+	case stmt[0] == "client-hostname":
+		l.Hostname = stmt[1]
+	}
+	return nil
+}
+
+// dhcpdTokens splits a dhcpd lease file in words, quoted strings and the "{", "}" and ";"
+// separators. Comments are left out.
+func dhcpdTokens(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			var s strings.Builder
+			for i++; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				s.WriteByte(data[i])
+			}
+			if i == len(data) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, s.String())
+			i++
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n{};\"#", rune(data[i])) {
+				i++
+			}
+			tokens = append(tokens, string(data[start:i]))
+		}
+	}
+	return tokens, nil
+}
+
+// skipBlock returns the index of the "}" that closes the block opened at tokens[i]
+func skipBlock(tokens []string, i int) (int, error) {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return i, errors.New("block is not closed")
+}
+
+// parseKeaLeases parses a Kea memfile lease file, the CSV files of the IPv4 and IPv6 leases are
+// read by their header. A row replaces the earlier rows of its address, a row with a valid lifetime
+// of 0 deletes the lease.
+func parseKeaLeases(r io.Reader) ([]lease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"address", "expire", "valid_lifetime"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	byIP := make(map[string]lease)
+	var order []string
+	for n := 2; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		l := lease{IP: net.ParseIP(field(record, "address"))}
+		if l.IP == nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", n, field(record, "address"))
+		}
+		key := l.IP.String()
+		if _, ok := byIP[key]; !ok {
+			order = append(order, key)
+		}
+		// state 1 is declined, 2 is expired and reclaimed
+		if field(record, "valid_lifetime") == "0" || (field(record, "state") != "" && field(record, "state") != "0") {
+			delete(byIP, key)
+			continue
+		}
+		expire, err := strconv.ParseInt(field(record, "expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expire %q", n, field(record, "expire"))
+		}
+		l.Expires = time.Unix(expire, 0)
+		if mac, err := net.ParseMAC(field(record, "hwaddr")); err == nil {
+			l.MAC = mac
+		}
+		// commas in hostnames are escaped
+		l.Hostname = strings.TrimSuffix(strings.ReplaceAll(field(record, "hostname"), "&#x2c", ","), ".")
+		byIP[key] = l
+	}
+	var leases []lease
+	for _, key := range order {
+		if l, ok := byIP[key]; ok {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// neighborTable returns the reachable hosts in the neighbor table of the kernel
+func neighborTable() ([]lease, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETNEIGH,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: make([]byte, unix.SizeofNdMsg),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not dump the neighbor table: %v", err)
+	}
+	var leases []lease
+	for _, m := range msgs {
+		l, ok, err := parseNeighborMessage(m)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// parseNeighborMessage parses an RTM_NEWNEIGH message. Neighbors that are not resolved and
+// link-local and multicast addresses are left out.
+func parseNeighborMessage(m netlink.Message) (lease, bool, error) {
+	var l lease
+	if len(m.Data) < unix.SizeofNdMsg {
+		return l, false, errors.New("neighbor message too short")
+	}
+	state := nlenc.Uint16(m.Data[8:10])
+	if state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED|unix.NUD_NOARP) != 0 {
+		return l, false, nil
+	}
+	ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofNdMsg:])
+	if err != nil {
+		return l, false, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NDA_DST:
+			l.IP = net.IP(ad.Bytes())
+		case unix.NDA_LLADDR:
+			l.MAC = net.HardwareAddr(ad.Bytes())
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return l, false, err
+	}
+	if l.IP == nil || len(l.MAC) != 6 || l.IP.IsLinkLocalUnicast() || l.IP.IsMulticast() {
+		return l, false, nil
+	}
+	return l, true, nil
+}
+
+// Discover reads the leases and the neighbor table of the discovery in the config at its interval
+// until ctx is done
+func (r *Reloader) Discover(ctx context.Context) {
+	ctx = opname.With(ctx, "Discover")
+	go func() {
+		for {
+			r.Rediscover(ctx, time.Now())
+			interval := r.active().Discovery.Interval
+			if interval <= 0 {
+				interval = discoveryInterval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Rediscover updates the discovered hosts. When they changed and the config is valid with them,
+// the interfaces are reconciled. Hosts are only replaced when all lease files could be read.
+func (r *Reloader) Rediscover(ctx context.Context, now time.Time) (ReloadResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conf := r.active()
+
+	var hosts []HostPolicy
+	if conf.Discovery.enabled() {
+		var err error
+		if hosts, err = conf.Discovery.hosts(now, r.neighbors); err != nil {
+			ln.Error(ctx, err, ln.Info("could not discover the hosts, keeping the previous hosts"))
+			return ReloadResult{}, false
+		}
+	}
+	discovered := make(map[string]HostPolicy, len(hosts))
+	for _, h := range hosts {
+		discovered[h.Name] = h
+	}
+	r.confMu.RLock()
+	unchanged := len(discovered) == len(r.discovered) && (len(discovered) == 0 || reflect.DeepEqual(discovered, r.discovered))
+	r.confMu.RUnlock()
+	if unchanged {
+		return ReloadResult{}, false
+	}
+	if err := r.validate(ctx, conf.withHosts(mergeHosts(discovered, r.apiHosts()))); err != nil {
+		ln.Error(ctx, err, ln.Info("rejected the discovered hosts"))
+		return ReloadResult{}, false
+	}
+	ln.Log(ctx, ln.Info("discovered %d hosts", len(discovered)))
+	r.confMu.Lock()
+	r.discovered = discovered
+	r.confMu.Unlock()
+	return r.activate(ctx, conf, "leases"), true
+}
+
+// mergeHosts merges host tables, the hosts of later tables replace the hosts with the same name
+func mergeHosts(tables ...map[string]HostPolicy) map[string]HostPolicy {
+	hosts := make(map[string]HostPolicy)
+	for _, table := range tables {
+		for name, h := range table {
+			hosts[name] = h
+		}
+	}
+	return hosts
+}
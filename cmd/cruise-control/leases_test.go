@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+// leasesNow is the time the leases in testdata are read at, monday 2026-10-19 12:00 UTC
+var leasesNow = time.Unix(1792411200, 0)
+
+func TestReadLeases(t *testing.T) {
+	for _, c := range []struct {
+		file   LeaseFile
+		leases []string
+	}{
+		{LeaseFile{"testdata/dnsmasq.leases", "dnsmasq"}, []string{
+			"192.168.1.20 b8:27:eb:12:34:56 raspberrypi",
+			"192.168.1.21 aa:bb:cc:00:00:01 old-laptop",
+			"192.168.1.22 3c:22:fb:aa:bb:cc TV-Living",
+			"192.168.1.23 de:ad:be:ef:00:01 ",
+			"2001:db8::20  raspberrypi",
+		}},
+		// the later lease frees 192.168.2.12
+		{LeaseFile{"testdata/dhcpd.leases", "dhcpd"}, []string{
+			"192.168.2.10 3c:22:fb:01:02:03 tv-bedroom",
+			"192.168.2.11 00:11:22:33:44:11 phone",
+			"192.168.2.13 00:11:22:33:44:66 Work Laptop",
+		}},
+		// declined and deleted leases are left out
+		{LeaseFile{"testdata/kea-leases4.csv", "kea"}, []string{
+			"192.168.3.10 b8:27:eb:00:00:10 pi-kitchen",
+			"192.168.3.11 aa:aa:aa:00:00:11 guest,phone",
+		}},
+		{LeaseFile{"testdata/kea-leases6.csv", "kea"}, []string{
+			"2001:db8:3::10 b8:27:eb:00:00:10 pi-kitchen",
+		}},
+	} {
+		leases, err := readLeases(c.file, leasesNow)
+		if err != nil {
+			t.Errorf("%s: %v", c.file.Path, err)
+			continue
+		}
+		var got []string
+		for _, l := range leases {
+			got = append(got, l.IP.String()+" "+l.MAC.String()+" "+l.Hostname)
+		}
+		if strings.Join(got, "\n") != strings.Join(c.leases, "\n") {
+			t.Errorf("%s: unexpected leases\n%s", c.file.Path, strings.Join(got, "\n"))
+		}
+	}
+
+	dnsmasq, _ := readLeases(LeaseFile{"testdata/dnsmasq.leases", "dnsmasq"}, leasesNow)
+	if !dnsmasq[2].Expires.IsZero() || !dnsmasq[0].Expires.Equal(leasesNow.Add(time.Hour)) {
+		t.Errorf("unexpected expiry %s %s", dnsmasq[0].Expires, dnsmasq[2].Expires)
+	}
+	dhcpd, _ := readLeases(LeaseFile{"testdata/dhcpd.leases", "dhcpd"}, leasesNow)
+	if !dhcpd[0].Expires.Equal(leasesNow.Add(8*time.Hour)) || !dhcpd[2].Expires.Equal(leasesNow.Add(2*time.Hour)) {
+		t.Errorf("unexpected expiry %s %s", dhcpd[0].Expires, dhcpd[2].Expires)
+	}
+
+	if _, err := parseDnsmasqLeases(strings.NewReader("soon b8:27:eb:12:34:56 192.168.1.20 pi *\n")); err == nil {
+		t.Error("expected an invalid expiry to fail")
+	}
+	if _, err := parseDhcpdLeases(strings.NewReader("lease 192.168.2.10 {\n  ends 1 2026/10/19 20:00:00;\n")); err == nil {
+		t.Error("expected a lease that is not closed to fail")
+	}
+	if _, err := parseKeaLeases(strings.NewReader("address,hwaddr\n")); err == nil {
+		t.Error("expected a file without expire column to fail")
+	}
+}
+
+func neighborMessage(t *testing.T, state uint16, ip net.IP, mac string) netlink.Message {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(unix.NDA_DST, ip)
+	if mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ae.Bytes(unix.NDA_LLADDR, hw)
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, unix.SizeofNdMsg)
+	nlenc.PutUint16(data[8:10], state)
+	return netlink.Message{Header: netlink.Header{Type: unix.RTM_NEWNEIGH}, Data: append(data, attrs...)}
+}
+
+func TestParseNeighborMessage(t *testing.T) {
+	l, ok, err := parseNeighborMessage(neighborMessage(t, unix.NUD_REACHABLE, net.ParseIP("192.168.1.50").To4(), "b8:27:eb:00:00:50"))
+	if err != nil || !ok || !l.IP.Equal(net.ParseIP("192.168.1.50")) || l.MAC.String() != "b8:27:eb:00:00:50" {
+		t.Errorf("unexpected neighbor %+v %v (%v)", l, ok, err)
+	}
+	for _, m := range []netlink.Message{
+		neighborMessage(t, unix.NUD_FAILED, net.ParseIP("192.168.1.51").To4(), ""),
+		neighborMessage(t, unix.NUD_STALE, net.ParseIP("fe80::1"), "b8:27:eb:00:00:50"),
+		neighborMessage(t, unix.NUD_NOARP, net.ParseIP("ff02::1"), "33:33:00:00:00:01"),
+	} {
+		if l, ok, err := parseNeighborMessage(m); ok || err != nil {
+			t.Errorf("expected the neighbor to be left out, got %+v (%v)", l, err)
+		}
+	}
+	if _, _, err := parseNeighborMessage(netlink.Message{Data: []byte{0}}); err == nil {
+		t.Error("expected a short message to fail")
+	}
+}
+
+func testDiscovery(t *testing.T) Config {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[discovery]
+neighbors = true
+leases = [
+  { path = "testdata/dnsmasq.leases", format = "dnsmasq" },
+  { path = "testdata/dhcpd.leases", format = "dhcpd" },
+  { path = "testdata/kea-leases4.csv", format = "kea" },
+]
+
+[[discovery.groups]]
+name = "tv"
+hostname = "tv-*"
+maxRate = "10mbit"
+class = "low"
+
+[[discovery.groups]]
+name = "pi"
+vendor = "b8:27:eb"
+minRate = "5mbit"
+
+[[discovery.groups]]
+name = "guests"
+subnet = "192.168.3.0/24"
+maxRate = "2mbit"
+interfaces = ["eth1"]
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// testNeighbors is the neighbor table of the discovery tests
+func testNeighbors() ([]lease, error) {
+	pi, _ := net.ParseMAC("b8:27:eb:12:34:56")
+	tv, _ := net.ParseMAC("3c:22:fb:aa:bb:cc")
+	other, _ := net.ParseMAC("b8:27:eb:00:00:50")
+	return []lease{
+		{IP: net.ParseIP("2001:db8::20"), MAC: pi},
+		{IP: net.ParseIP("192.168.1.22"), MAC: tv},
+		{IP: net.ParseIP("192.168.1.50"), MAC: other},
+	}, nil
+}
+
+func TestDiscoveryHosts(t *testing.T) {
+	conf := testDiscovery(t)
+	if err := conf.Discovery.validate(); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := conf.Discovery.hosts(leasesNow, testNeighbors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range hosts {
+		got = append(got, h.Name+" "+h.Match.String()+" "+h.Class)
+	}
+	// the neighbor table adds the MAC address to the IPv6 lease of the pi and the hosts without lease
+	expected := []string{
+		"pi-raspberrypi-192.168.1.20 192.168.1.20 ",
+		"tv-tv-living 192.168.1.22 low",
+		"pi-192.168.1.50 192.168.1.50 ",
+		"tv-tv-bedroom 192.168.2.10 low",
+		"pi-pi-kitchen 192.168.3.10 ",
+		"guests-guest_phone 192.168.3.11 ",
+		"pi-raspberrypi-2001:db8::20 2001:db8::20 ",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected hosts\n%s", strings.Join(got, "\n"))
+	}
+	if hosts[5].MaxRate != 2*Mbit || len(hosts[5].Interfaces) != 1 || hosts[0].MinRate != 5*Mbit {
+		t.Errorf("expected the rates and interfaces of the groups, got %+v %+v", hosts[0], hosts[5])
+	}
+	if err := validateHosts(hosts); err != nil {
+		t.Error(err)
+	}
+
+	// the leases expire
+	hosts, _ = conf.Discovery.hosts(leasesNow.Add(9*time.Hour), testNeighbors)
+	if len(hosts) != 3 || hosts[0].Name != "tv-tv-living" {
+		t.Errorf("expected the expired leases to be left out, got %+v", hosts)
+	}
+
+	conf.Discovery.Leases = append(conf.Discovery.Leases, LeaseFile{"testdata/missing.leases", "dnsmasq"})
+	if _, err := conf.Discovery.hosts(leasesNow, testNeighbors); err == nil {
+		t.Error("expected a missing lease file to fail")
+	}
+	conf.Discovery.Leases[0].Format = "udhcpd"
+	conf.Discovery.Groups = append(conf.Discovery.Groups, HostGroup{Name: "all"}, HostGroup{Name: "tv", Hostname: "["})
+	err = conf.Discovery.validate()
+	for _, problem := range []string{`unknown lease format "udhcpd"`, "all: no hostname", "tv: configured more than once", `invalid hostname pattern "["`} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to be reported, got %v", problem, err)
+		}
+	}
+}
+
+func TestRediscover(t *testing.T) {
+	conf := testDiscovery(t)
+	r := NewReloader(conf, NewDriftMonitor())
+	r.neighbors = testNeighbors
+	var reconciled []Config
+	r.reconcile = func(ctx context.Context, conf Config) []InterfaceResult {
+		reconciled = append(reconciled, conf)
+		return nil
+	}
+	r.validate = func(ctx context.Context, conf Config) error { return nil }
+	ctx := context.Background()
+
+	if result, changed := r.Rediscover(ctx, leasesNow); !changed || result.Trigger != "leases" || len(reconciled) != 1 || len(reconciled[0].Hosts) != 7 {
+		t.Fatalf("expected the discovered hosts to be reconciled, got %+v", result)
+	}
+	if _, changed := r.Rediscover(ctx, leasesNow.Add(time.Minute)); changed || len(reconciled) != 1 {
+		t.Error("expected nothing to change")
+	}
+
+	// hosts added through the API replace discovered hosts with the same name
+	if _, err := r.SetHost(ctx, HostPolicy{Name: "tv-tv-living", Match: mustHostMatch(t, "192.168.1.22"), MaxRate: 20 * Mbit}); err != nil {
+		t.Fatal(err)
+	}
+	hosts := r.Config().Hosts
+	if len(hosts) != 7 || hosts[len(hosts)-1].Name != "tv-tv-living" || hosts[len(hosts)-1].MaxRate != 20*Mbit {
+		t.Errorf("expected the API host to replace the discovered host, got %+v", hosts)
+	}
+
+	// the expired leases are removed, unless the config rejects the new hosts
+	r.validate = func(ctx context.Context, conf Config) error { return errors.New("class low does not exist") }
+	if _, changed := r.Rediscover(ctx, leasesNow.Add(9*time.Hour)); changed || len(r.Config().Hosts) != 7 {
+		t.Error("expected the rejected hosts to keep the previous hosts")
+	}
+	r.validate = func(ctx context.Context, conf Config) error { return nil }
+	if _, changed := r.Rediscover(ctx, leasesNow.Add(9*time.Hour)); !changed || len(r.Config().Hosts) != 3 {
+		t.Errorf("expected the expired leases to be removed, got %+v", r.Config().Hosts)
+	}
+
+	// a lease file that can not be read keeps the previous hosts
+	r.conf.Discovery.Leases[0].Path = "testdata/missing.leases"
+	if _, changed := r.Rediscover(ctx, leasesNow); changed || len(r.Config().Hosts) != 3 {
+		t.Error("expected the previous hosts to be kept")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// LinkEvent is a change of a network interface reported by the kernel
+type LinkEvent struct {
+	Index int
+	Name  string
+	Up    bool
+	// Deleted is set when the interface disappeared
+	Deleted bool
+}
+
+// ifinfomsgLen is the length of the struct ifinfomsg that starts link messages
+const ifinfomsgLen = 16
+
+// parseLinkMessage parses an RTM_NEWLINK or RTM_DELLINK message
+func parseLinkMessage(m netlink.Message) (LinkEvent, error) {
+	var ev LinkEvent
+	switch m.Header.Type {
+	case unix.RTM_NEWLINK:
+	case unix.RTM_DELLINK:
+		ev.Deleted = true
+	default:
+		return ev, fmt.Errorf("unexpected message type %d", m.Header.Type)
+	}
+	if len(m.Data) < ifinfomsgLen {
+		return ev, errors.New("link message too short")
+	}
+	ev.Index = int(nlenc.Int32(m.Data[4:8]))
+	ev.Up = nlenc.Uint32(m.Data[8:12])&unix.IFF_UP != 0 && !ev.Deleted
+
+	ad, err := netlink.NewAttributeDecoder(m.Data[ifinfomsgLen:])
+	if err != nil {
+		return ev, err
+	}
+	for ad.Next() {
+		if ad.Type() == unix.IFLA_IFNAME {
+			ev.Name = ad.String()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return ev, err
+	}
+	if ev.Name == "" {
+		return ev, errors.New("link message without interface name")
+	}
+	return ev, nil
+}
+
+// WatchLinks calls fn for every link event until ctx is done
+func WatchLinks(ctx context.Context, fn func(LinkEvent)) error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{Groups: unix.RTMGRP_LINK})
+	if err != nil {
+		return fmt.Errorf("could not subscribe to link events: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		for {
+			msgs, err := conn.Receive()
+			if err != nil {
+				if linkReceiveError(ctx, err) {
+					return
+				}
+				continue
+			}
+			for _, m := range msgs {
+				if ev, err := parseLinkMessage(m); err == nil {
+					fn(ev)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// linkReceiveError logs an error receiving link events and reports whether to stop receiving, when
+// ctx is done or the socket is closed. After other errors, like the kernel dropping events because
+// they were not read fast enough, later events still arrive.
+func linkReceiveError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	ctx = opname.With(ctx, "WatchLinks")
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+		ln.Error(ctx, err, ln.Info("stopped receiving link events, re-created interfaces are no longer re-applied"))
+		return true
+	}
+	ln.Error(ctx, err, ln.Info("could not receive link events"))
+	return false
+}
+
+// ensureIFB returns the IFB device with name, it is created when it does not exist and brought up
+func ensureIFB(name string) (*net.Interface, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+
+	interf, err := net.InterfaceByName(name)
+	if err != nil {
+		ae := netlink.NewAttributeEncoder()
+		ae.String(unix.IFLA_IFNAME, name)
+		ae.Nested(unix.IFLA_LINKINFO, func(nae *netlink.AttributeEncoder) error {
+			nae.String(unix.IFLA_INFO_KIND, "ifb")
+			return nil
+		})
+		attrs, err := ae.Encode()
+		if err != nil {
+			return nil, err
+		}
+		req := netlink.Message{
+			Header: netlink.Header{
+				Type:  unix.RTM_NEWLINK,
+				Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Excl,
+			},
+			Data: append(make([]byte, ifinfomsgLen), attrs...),
+		}
+		if _, err := conn.Execute(req); err != nil {
+			return nil, fmt.Errorf("could not create IFB device %s: %v", name, err)
+		}
+		if interf, err = net.InterfaceByName(name); err != nil {
+			return nil, err
+		}
+	}
+	if interf.Flags&net.FlagUp != 0 {
+		return interf, nil
+	}
+
+	// ifinfomsg with the index, IFF_UP in the flags and the change mask
+	data := make([]byte, ifinfomsgLen)
+	nlenc.PutInt32(data[4:8], int32(interf.Index))
+	nlenc.PutUint32(data[8:12], unix.IFF_UP)
+	nlenc.PutUint32(data[12:16], unix.IFF_UP)
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWLINK,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	}
+	if _, err := conn.Execute(req); err != nil {
+		return nil, fmt.Errorf("could not bring IFB device %s up: %v", name, err)
+	}
+	return net.InterfaceByName(name)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+func linkMessage(t *testing.T, typ netlink.HeaderType, index int32, flags uint32, name string) netlink.Message {
+	t.Helper()
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, name)
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, ifinfomsgLen)
+	nlenc.PutInt32(data[4:8], index)
+	nlenc.PutUint32(data[8:12], flags)
+	return netlink.Message{Header: netlink.Header{Type: typ}, Data: append(data, attrs...)}
+}
+
+func TestParseLinkMessage(t *testing.T) {
+	ev, err := parseLinkMessage(linkMessage(t, unix.RTM_NEWLINK, 7, unix.IFF_UP|unix.IFF_RUNNING, "ppp0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev != (LinkEvent{Index: 7, Name: "ppp0", Up: true}) {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	ev, err = parseLinkMessage(linkMessage(t, unix.RTM_DELLINK, 7, unix.IFF_UP, "ppp0"))
+	if err != nil || ev != (LinkEvent{Index: 7, Name: "ppp0", Deleted: true}) {
+		t.Errorf("unexpected event %+v (%v)", ev, err)
+	}
+	if _, err := parseLinkMessage(netlink.Message{Header: netlink.Header{Type: unix.RTM_NEWLINK}, Data: []byte{0}}); err == nil {
+		t.Error("expected a short message to fail")
+	}
+}
+
+func TestLinkChanged(t *testing.T) {
+	m := NewDriftMonitor()
+	var reapplied []int
+	m.reapply = func(ctx context.Context, name string, ifindex int) {
+		reapplied = append(reapplied, ifindex)
+	}
+	m.Manage(net.Interface{Index: 7, Name: "ppp0", Flags: net.FlagUp}, ManagedProfile{}, NewNode("qdisc"), nil)
+
+	ctx := context.Background()
+	for _, ev := range []LinkEvent{
+		// unrelated interfaces and changes that keep the interface up are ignored
+		{Index: 2, Name: "eth0", Up: true},
+		{Index: 7, Name: "ppp0", Up: true},
+		// the interface is re-created with a new index and comes up later
+		{Index: 7, Name: "ppp0", Deleted: true},
+		{Index: 9, Name: "ppp0"},
+		{Index: 9, Name: "ppp0", Up: true},
+		{Index: 9, Name: "ppp0", Up: true},
+		// a link flap
+		{Index: 9, Name: "ppp0"},
+		{Index: 9, Name: "ppp0", Up: true},
+	} {
+		m.linkChanged(ctx, ev)
+	}
+	if len(reapplied) != 2 || reapplied[0] != 9 || reapplied[1] != 9 {
+		t.Errorf("expected the tree to be applied twice to index 9, got %v", reapplied)
+	}
+}
+
+func TestLinkReceiveError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, err := range []error{&netlink.OpError{Op: "receive", Err: unix.ENOBUFS}, &netlink.OpError{Op: "receive", Err: unix.EINTR}} {
+		if linkReceiveError(ctx, err) {
+			t.Errorf("expected to keep receiving after %v", err)
+		}
+	}
+	if !linkReceiveError(ctx, os.ErrClosed) {
+		t.Error("expected a closed socket to stop receiving")
+	}
+	cancel()
+	if !linkReceiveError(ctx, &netlink.OpError{Op: "receive", Err: unix.EAGAIN}) {
+		t.Error("expected to stop receiving when the context is done")
+	}
+}
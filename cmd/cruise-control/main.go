@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/florianl/go-tc"
-	"github.com/mdlayher/netlink"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 	"within.website/ln"
 	"within.website/ln/opname"
@@ -18,13 +22,39 @@ import (
 //go:generate go run ../gen/main.go ../gen/helpers.go
 // Config represents the config in struct shape
 type Config struct {
-	Interface string
-	Port      int
+	// Interface, DownloadSpeed and UploadSpeed configure a single interface, Interfaces configures
+	// any number of them
+	Interface  string
+	Interfaces []InterfaceConfig
+	Port       int
 
-	DownloadSpeed float64
-	UploadSpeed   float64
+	DownloadSpeed Rate
+	UploadSpeed   Rate
+	// LinkSpeed is the speed of the interface itself, which limits the interface class of the
+	// profiles. It is the speed the driver reports by default, see Config.linkSpeed.
+	LinkSpeed Rate
+	// Overhead is the per packet overhead of the link, see OverheadPresets
+	Overhead Overhead
+	// Simple holds the parameters of the simple profile
+	Simple SimpleProfile
+	// Lanparty holds the leaf qdiscs of the lanparty profile
+	Lanparty LanpartyProfile
+	// Netem holds the link conditions of the netem profile
+	Netem Netem
+	// Multiqueue holds the parameters of the multiqueue profile
+	Multiqueue MultiqueueProfile
 
 	TrafficFile string
+
+	// Hosts guarantees and limits the bandwidth of hosts, every host gets its own class
+	Hosts []HostPolicy
+	// Discovery adds the hosts of DHCP leases and the neighbor table to the host table
+	Discovery Discovery
+
+	// Drift is what the daemon does when the tc configuration of an interface it applied a profile
+	// to is changed by something else, DriftPolicies overrides it per interface
+	Drift         DriftPolicy
+	DriftPolicies map[string]DriftPolicy
 }
 
 // QdiscConfig represents the Qdisc config
@@ -55,113 +85,302 @@ func main() {
 	flag.Parse()
 
 	ctx := opname.With(context.Background(), "main")
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+	case "import":
+		if err := importCommand(flag.Args()[1:]); err != nil {
+			ln.FatalErr(ctx, err)
+		}
+		return
+	case "tree":
+		if err := treeCommand(ctx, flag.Args()[1:]); err != nil {
+			ln.FatalErr(ctx, err)
+		}
+		return
+	case "plan":
+		if err := planCommand(ctx, flag.Args()[1:]); err != nil {
+			ln.FatalErr(ctx, err)
+		}
+		return
+	case "simulate":
+		if err := simulateCommand(ctx, flag.Args()[1:]); err != nil {
+			ln.FatalErr(ctx, err)
+		}
+		return
+	default:
+		ln.FatalErr(ctx, fmt.Errorf("unknown command %q", cmd))
+	}
+
 	ln.Log(ctx, ln.Action("initializing cruise control"))
-	viper.SetConfigName("config")
-	viper.SetConfigType("toml")
-	viper.AddConfigPath("./")
-	if err := viper.ReadInConfig(); err != nil {
+	conf, err := loadConfig()
+	if err != nil {
 		ln.FatalErr(ctx, err)
 	}
-	conf := Config{}
-	viper.Unmarshal(&conf)
 
-	http.HandleFunc("/tc/apply", TCApplyHandler)
+	monitor := NewDriftMonitor()
+	if err := monitor.Run(ctx); err != nil {
+		ln.Error(ctx, err, ln.Info("drift of the managed interfaces will not be detected"))
+	}
+	reloader := NewReloader(conf, monitor)
+	reloader.Start(ctx)
+	if err := reloader.Watch(ctx); err != nil {
+		ln.Error(ctx, err, ln.Info("changes to the config will only be loaded on SIGHUP"))
+	}
+	reloader.Schedule(ctx)
+	reloader.Discover(ctx)
+
+	http.HandleFunc("/tc/apply", TCApplyHandler(reloader.Config, monitor))
+	http.HandleFunc("/tc/drift", TCDriftHandler(monitor))
+	http.HandleFunc("/tc/tree", TCTreeHandler(reloader.Config))
+	http.HandleFunc("/tc/plan", TCPlanHandler(reloader.Config))
+	http.HandleFunc("/config/reload", ReloadHandler(reloader))
+	http.HandleFunc("/schedule", ScheduleHandler(reloader.Config))
+	http.HandleFunc("/hosts", HostsHandler(reloader))
 	ln.Log(ctx, ln.Info("starting API on 0.0.0.0:%d", conf.Port))
 	ln.FatalErr(ctx, http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), nil))
 }
 
-func TCApplyHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := opname.With(context.Background(), "TCApplyHandler")
-	devName := r.URL.Query().Get("interface")
-	speed, err := strconv.Atoi(r.URL.Query().Get("up"))
-	if err != nil {
-		ln.FatalErr(ctx, err)
+// loadConfig reads config.toml from the working directory
+func loadConfig() (Config, error) {
+	conf := Config{}
+	viper.SetConfigName("config")
+	viper.SetConfigType("toml")
+	viper.AddConfigPath("./")
+	if err := viper.ReadInConfig(); err != nil {
+		return conf, err
 	}
-	ln.Log(ctx, ln.Info("interface: %s - speed: %d Mbps", devName, speed))
+	err := viper.Unmarshal(&conf, viper.DecodeHook(configDecodeHook))
+	return conf, err
+}
 
-	interf, err := net.InterfaceByName(devName)
-	tcConf := createQoSSimple(ctx, *interf, 1e9, speed)
+// configDecodeHook decodes rates, durations and curves written as strings in the config
+var configDecodeHook = mapstructure.ComposeDecodeHookFunc(
+	rateDecodeHook,
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.TextUnmarshallerHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+)
 
-	// construct the TC nodes from the config file
-	var nodes []*Node
-	for _, class := range tcConf.Classes {
-		n := NewNodeWithObject("class", class)
-		nodes = append(nodes, n)
+// rateDecodeHook allows rates in the config to be written with a unit ("500mbit"). Plain numbers
+// are rates in bits per second.
+func rateDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(Rate(0)) {
+		return data, nil
 	}
-	for _, qdisc := range tcConf.Qdiscs {
-		n := NewNodeWithObject("qdisc", qdisc)
-		nodes = append(nodes, n)
+	switch v := data.(type) {
+	case string:
+		return ParseRate(v)
+	case float64:
+		if v < 0 {
+			return nil, fmt.Errorf("invalid rate %v", v)
+		}
+		return Rate(v), nil
+	case int64:
+		if v < 0 {
+			return nil, fmt.Errorf("invalid rate %v", v)
+		}
+		return Rate(v), nil
 	}
+	return data, nil
+}
 
-	var filters []*Node
-	for _, filter := range tcConf.Filters {
-		n := NewNodeWithObject("filter", filter)
-		filters = append(filters, n)
+// parseSpeed parses the speed passed to the API and command-line. Plain numbers are interpreted as
+// Mbit for backwards compatibility, other speeds require a unit ("2.5gbit").
+func parseSpeed(s string) (Rate, error) {
+	if mbit, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return Rate(mbit) * Mbit, nil
 	}
+	return ParseRate(s)
+}
 
-	// construct the TC tree
-	tree, index := FindRootNode(nodes)
-	if tree == nil {
-		ln.FatalErr(ctx, err)
+// ParseQuery overrides the parameters of the simple, lanparty and multiqueue profile and the link
+// conditions of the netem profile with the query parameters of an API call
+func (c *Config) ParseQuery(query url.Values) error {
+	if err := c.Simple.ParseQuery(query); err != nil {
+		return err
 	}
-	nodes = append(nodes[:index], nodes[index+1:]...)
-	nodes = tree.ComposeChildren(nodes)
-	if len(nodes) == 0 {
-		ln.Log(ctx, ln.Info("all TC nodes parsed, tree constructed"))
-	} else {
-		ln.Log(ctx, ln.Info("there are leftover TC nodes: %d nodes left", len(nodes)))
+	if err := c.Lanparty.ParseQuery(query); err != nil {
+		return err
 	}
-
-	// open a go-tc socket
-	rtnl, err := tc.Open(&tc.Config{})
-	if err != nil {
-		ln.FatalErr(ctx, err)
-		return
-	}
-	err = rtnl.SetOption(netlink.ExtendedAcknowledge, true)
-	if err != nil {
-		ln.FatalErr(ctx, err)
-		return
+	if err := c.Multiqueue.ParseQuery(query); err != nil {
+		return err
 	}
-	defer func() {
-		if err := rtnl.Close(); err != nil {
-			ln.FatalErr(ctx, err)
+	return c.Netem.ParseQuery(query, "netem")
+}
+
+// TCTreeHandler renders the desired or live tree of an interface. The drift query parameter
+// highlights the differences between both.
+func TCTreeHandler(config func() Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := opname.With(context.Background(), "TCTreeHandler")
+		query := r.URL.Query()
+		conf := config()
+		if err := conf.ParseQuery(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	}()
-
-	// get the system tree and compare it to the current config. If there is a difference, we should
-	// reapply the tree so the config is matched
-	ln.Log(ctx, ln.Action("Fetching current TC state"))
-	systemNodes, systemFilters := GetInterfaceNodes(rtnl, uint32(interf.Index))
-	systemTree, index := FindRootNode(systemNodes)
-	systemNodes = append(systemNodes[:index], systemNodes[index+1:]...)
-	systemTree.ComposeChildren(systemNodes)
-
-	// check if the system is up to date or not
-	if !systemTree.CompareTree(*tree) {
-		ln.Log(ctx, ln.Info("updating the current interfaces qdiscs and classes"))
-		tree.ApplyNode(rtnl)
-	} else {
-		ln.Log(ctx, ln.Info("current interface is already up to date with the qdiscs and classes"))
-	}
+		opts := TreeOptions{
+			Interface: query.Get("interface"),
+			Profile:   query.Get("profile"),
+			Source:    query.Get("source"),
+			Format:    query.Get("format"),
+		}
+		if up := query.Get("up"); up != "" {
+			speed, err := parseSpeed(up)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid speed %q", up), http.StatusBadRequest)
+				return
+			}
+			opts.Speed = speed
+		}
+		opts.Drift, _ = strconv.ParseBool(query.Get("drift"))
 
-	test := make(map[uint32]struct{})
-	for _, t := range systemFilters {
-		if _, ok := test[t.Object.Handle]; ok {
-			continue
+		var b bytes.Buffer
+		if err := WriteTree(ctx, conf, opts, &b); err != nil {
+			ln.Error(ctx, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		test[t.Object.Handle] = struct{}{}
+		switch opts.Format {
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.Write(b.Bytes())
 	}
+}
 
-	ln.Log(ctx, ln.Action("Applying filters"))
-	for _, filt := range filters {
-		if _, k := test[filt.Object.Handle]; k {
-			fmt.Println("fitler found")
+// TCPlanHandler shows the changes applying a profile would make to an interface
+func TCPlanHandler(config func() Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := opname.With(context.Background(), "TCPlanHandler")
+		query := r.URL.Query()
+		conf := config()
+		if err := conf.ParseQuery(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		filt.ApplyNode(rtnl)
+		speed, err := parseSpeed(query.Get("up"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := TreeOptions{
+			Interface: query.Get("interface"),
+			Profile:   query.Get("profile"),
+			Speed:     speed,
+		}
+
+		plan, err := PlanFor(ctx, conf, opts)
+		if err != nil {
+			ln.Error(ctx, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		plan.Write(w)
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/text")
-	w.Write([]byte("Cruise control updated"))
+// TCApplyHandler applies the requested profile to an interface. The monitor watches the interface
+// for drift from the applied tree afterwards.
+func TCApplyHandler(config func() Config, monitor *DriftMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := opname.With(context.Background(), "TCApplyHandler")
+		devName := r.URL.Query().Get("interface")
+		profile := r.URL.Query().Get("profile")
+		conf := config()
+		if scheduled, err := conf.scheduled(time.Now()); err == nil {
+			conf = scheduled
+		}
+
+		// interfaces from the config default to the profile and upload speed of their active
+		// schedule entry or configuration
+		var speed Rate
+		ic, configured := conf.managedInterface(devName)
+		if configured {
+			conf, speed = ic.config(conf), ic.UploadSpeed
+			if profile == "" {
+				profile = ic.Profile
+			}
+		}
+		if up := r.URL.Query().Get("up"); up != "" || !configured {
+			var err error
+			if speed, err = parseSpeed(up); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ln.Log(ctx, ln.Info("interface: %s - speed: %s", devName, speed))
+
+		interf, err := net.InterfaceByName(devName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		noValidate, _ := strconv.ParseBool(r.URL.Query().Get("novalidate"))
+		if err := conf.ParseQuery(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// construct the TC tree from the profile
+		result, filters, err := DesiredTree(ctx, conf, profile, *interf, speed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tree := result.Tree
+		if problems := result.Problems(); len(problems) == 0 {
+			ln.Log(ctx, ln.Info("all TC nodes parsed, tree constructed"))
+		} else if !force {
+			ln.Log(ctx, ln.Info("refusing to apply a tree with %d composition problems", len(problems)))
+			http.Error(w, "tree could not be composed:\n"+strings.Join(problems, "\n"), http.StatusUnprocessableEntity)
+			return
+		} else {
+			ln.Log(ctx, ln.Info("forcing a tree with %d composition problems", len(problems)))
+		}
+
+		// refuse to apply a tree that the kernel would reject or that would not behave as intended
+		if errs := ValidateTree(tree, filters); len(errs) > 0 {
+			if !noValidate {
+				ln.Error(ctx, errs, ln.Info("refusing to apply an invalid tree"))
+				http.Error(w, "invalid tree:\n"+errs.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			ln.Error(ctx, errs, ln.Info("applying an invalid tree, validation is skipped"))
+		}
+
+		// open a go-tc socket
+		rtnl, err := OpenTc()
+		if err != nil {
+			ln.FatalErr(ctx, err)
+			return
+		}
+		defer func() {
+			if err := rtnl.Close(); err != nil {
+				ln.FatalErr(ctx, err)
+			}
+		}()
+
+		if err := applyTree(ctx, rtnl, *interf, tree, filters); err != nil {
+			ln.Error(ctx, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		monitor.Manage(*interf, ManagedProfile{
+			Conf:       conf,
+			Profile:    profile,
+			Speed:      speed,
+			Force:      force,
+			NoValidate: noValidate,
+			Policy:     ic.Drift,
+		}, tree, filters)
+
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/text")
+		w.Write([]byte("Cruise control updated"))
+	}
 }
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"golang.org/x/sys/unix"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// DriftPolicy is what the daemon does when the tc configuration of an interface it manages is
+// changed by something else
+type DriftPolicy string
+
+const (
+	// DriftAlert logs and records the drift, but leaves the interface alone
+	DriftAlert DriftPolicy = "alert"
+	// DriftReconcile applies the desired tree again
+	DriftReconcile DriftPolicy = "reconcile"
+)
+
+// UnmarshalText validates the policy when it is read from the config
+func (p *DriftPolicy) UnmarshalText(text []byte) error {
+	switch policy := DriftPolicy(text); policy {
+	case "":
+		*p = DriftAlert
+	case DriftAlert, DriftReconcile:
+		*p = policy
+	default:
+		return fmt.Errorf("unknown drift policy %q, expected %q or %q", text, DriftAlert, DriftReconcile)
+	}
+	return nil
+}
+
+// driftPolicy returns the drift policy of an interface
+func (c Config) driftPolicy(name string) DriftPolicy {
+	if policy, ok := c.DriftPolicies[name]; ok && policy != "" {
+		return policy
+	}
+	if c.Drift != "" {
+		return c.Drift
+	}
+	return DriftAlert
+}
+
+// DriftEvent records a difference between the live and the desired configuration of an interface
+type DriftEvent struct {
+	Time      time.Time
+	Interface string
+	Policy    DriftPolicy
+	// Changes are the steps that bring the interface back to the desired tree
+	Changes    []string
+	Reconciled bool
+	Error      string `json:",omitempty"`
+}
+
+// ManagedProfile is the profile the daemon applied to an interface, it is kept to compose the
+// desired tree again when the interface is re-created
+type ManagedProfile struct {
+	Conf    Config
+	Profile string
+	Speed   Rate
+	// Force applies trees that could not be composed completely
+	Force bool
+	// NoValidate applies trees that do not pass ValidateTree
+	NoValidate bool
+	// Policy overrides the drift policy of the config
+	Policy DriftPolicy
+	// Ingress is the interface whose ingress traffic is redirected to the interface the profile is
+	// applied to
+	Ingress string
+	// Police are the policers of the ingress traffic of the interface the profile is applied to. An
+	// interface without speed is only policed, its tree is left alone.
+	Police []Policer
+}
+
+// desired composes the desired tree and filters of the profile for an interface
+func (p ManagedProfile) desired(ctx context.Context, interf net.Interface) (*Node, []*Node, error) {
+	police, err := policeFilters(uint32(interf.Index), p.Police)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Speed == 0 && len(police) > 0 {
+		return nil, police, nil
+	}
+	conf := p.Conf
+	conf.Simple.ingress = p.Ingress != ""
+	result, filters, err := DesiredTree(ctx, conf, p.Profile, interf, p.Speed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if problems := result.Problems(); len(problems) > 0 && !p.Force {
+		return nil, nil, fmt.Errorf("tree could not be composed: %s", strings.Join(problems, ", "))
+	}
+	if errs := ValidateTree(result.Tree, filters); len(errs) > 0 && !p.NoValidate {
+		return nil, nil, errs
+	}
+	return result.Tree, append(filters, police...), nil
+}
+
+// managedInterface is an interface the daemon applied a tree to. Interfaces are tracked by name,
+// as they can be re-created with a different index.
+type managedInterface struct {
+	interf  net.Interface
+	profile ManagedProfile
+	tree    *Node
+	filters []*Node
+	policy  DriftPolicy
+	up      bool
+	// sourceUp and sourceIndex track the source interface of ingress traffic
+	sourceUp    bool
+	sourceIndex int
+
+	timer         *time.Timer
+	lastReconcile time.Time
+}
+
+// driftChanges lists the changes that bring the live configuration back to the desired tree and
+// filters
+func driftChanges(tree *Node, filters []*Node, live *Node, liveFilters []*Node) (Plan, []string) {
+	plan := BuildPlan(tree, live)
+	var changes []string
+	for _, step := range plan.Steps {
+		changes = append(changes, step.String())
+	}
+	for _, f := range missingFilters(filters, liveFilters) {
+		changes = append(changes, PlanStep{Action: PlanAdd, Node: f}.String())
+	}
+	for _, f := range changedFilters(filters, liveFilters) {
+		changes = append(changes, PlanStep{Action: PlanChange, Node: f}.String())
+	}
+	return plan, changes
+}
+
+// changedFilters returns the desired filters that are configured on the system, but match or
+// classify differently
+func changedFilters(desired, live []*Node) (changed []*Node) {
+	for _, d := range desired {
+		found, equal := false, false
+		for _, l := range live {
+			if sameFilter(d, l) {
+				found = true
+				equal = equal || equalFilter(d, l)
+			}
+		}
+		if found && !equal {
+			changed = append(changed, d)
+		}
+	}
+	return changed
+}
+
+// missingFilters returns the desired filters that are not configured on the system
+func missingFilters(desired, live []*Node) (missing []*Node) {
+	for _, d := range desired {
+		found := false
+		for _, l := range live {
+			if sameFilter(d, l) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, d)
+		}
+	}
+	return missing
+}
+
+const (
+	// driftSettle is how long the monitor waits for the notifications of an interface to settle
+	// before it compares the trees, applying a tree results in a burst of notifications
+	driftSettle = time.Second
+	// reconcileInterval limits how often an interface is reconciled, so the daemon does not fight
+	// another tool that keeps changing the interface
+	reconcileInterval = time.Minute
+	// maxDriftEvents is the amount of events the monitor remembers
+	maxDriftEvents = 100
+)
+
+// DriftMonitor subscribes to the tc notifications of the kernel and compares the interfaces it
+// manages with the trees that were applied to them
+type DriftMonitor struct {
+	mu      sync.Mutex
+	managed map[string]*managedInterface
+	events  []DriftEvent
+	settle  time.Duration
+
+	// check compares the live configuration of an interface with its desired tree
+	check func(ctx context.Context, name string)
+	// reapply applies the desired tree to an interface that came back up
+	reapply func(ctx context.Context, name string, ifindex int)
+}
+
+// NewDriftMonitor creates a monitor that does not manage any interfaces yet
+func NewDriftMonitor() *DriftMonitor {
+	m := &DriftMonitor{
+		managed: make(map[string]*managedInterface),
+		settle:  driftSettle,
+	}
+	m.check = m.verify
+	m.reapply = m.apply
+	return m
+}
+
+// Manage starts watching an interface for changes to the tree and filters of a profile that were
+// applied to it
+func (m *DriftMonitor) Manage(interf net.Interface, profile ManagedProfile, tree *Node, filters []*Node) {
+	managed := &managedInterface{
+		interf:  interf,
+		profile: profile,
+		tree:    tree,
+		filters: filters,
+		policy:  profile.Policy,
+		up:      interf.Flags&net.FlagUp != 0,
+	}
+	if managed.policy == "" {
+		managed.policy = profile.Conf.driftPolicy(interf.Name)
+	}
+	if profile.Ingress != "" {
+		if src, err := net.InterfaceByName(profile.Ingress); err == nil {
+			managed.sourceUp, managed.sourceIndex = src.Flags&net.FlagUp != 0, src.Index
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.managed[interf.Name]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	m.managed[interf.Name] = managed
+}
+
+// Run subscribes to the tc and link notifications of the kernel until ctx is done
+func (m *DriftMonitor) Run(ctx context.Context) error {
+	rtnl, err := OpenTc()
+	if err != nil {
+		return err
+	}
+	hook := func(action uint16, obj tc.Object) int {
+		switch action {
+		case unix.RTM_NEWQDISC, unix.RTM_DELQDISC, unix.RTM_NEWTCLASS, unix.RTM_DELTCLASS,
+			unix.RTM_NEWTFILTER, unix.RTM_DELTFILTER:
+			m.notify(ctx, int(obj.Ifindex))
+		}
+		return 0
+	}
+	errfn := func(err error) int {
+		return m.receiveError(ctx, err)
+	}
+	if err := rtnl.MonitorWithErrorFunc(ctx, 0, hook, errfn); err != nil {
+		rtnl.Close()
+		return fmt.Errorf("could not monitor tc notifications: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		rtnl.Close()
+	}()
+	return WatchLinks(ctx, func(ev LinkEvent) {
+		m.linkChanged(ctx, ev)
+	})
+}
+
+// receiveError handles an error receiving the tc notifications. The notifications are received
+// until ctx is done or the socket is closed. When the kernel dropped notifications because they
+// arrived faster than they were read, like when a large tree is applied, every managed interface is
+// checked.
+func (m *DriftMonitor) receiveError(ctx context.Context, err error) int {
+	if ctx.Err() != nil {
+		return 1
+	}
+	ctx = opname.With(ctx, "DriftMonitor")
+	if errors.Is(err, os.ErrClosed) || errors.Is(err, net.ErrClosed) {
+		ln.Error(ctx, err, ln.Info("stopped receiving tc notifications, drift is no longer detected"))
+		return 1
+	}
+	ln.Error(ctx, err, ln.Info("could not receive tc notifications"))
+	if errors.Is(err, unix.ENOBUFS) {
+		m.mu.Lock()
+		var indexes []int
+		for _, managed := range m.managed {
+			if managed.interf.Index != 0 {
+				indexes = append(indexes, managed.interf.Index)
+			}
+		}
+		m.mu.Unlock()
+		for _, index := range indexes {
+			m.notify(ctx, index)
+		}
+	}
+	return 0
+}
+
+// lookup returns the managed interface with an index, the caller must hold the lock
+func (m *DriftMonitor) lookup(ifindex int) (*managedInterface, bool) {
+	for _, managed := range m.managed {
+		if managed.interf.Index == ifindex {
+			return managed, true
+		}
+	}
+	return nil, false
+}
+
+// notify schedules a check of a managed interface once its notifications settled
+func (m *DriftMonitor) notify(ctx context.Context, ifindex int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed, ok := m.lookup(ifindex)
+	if !ok {
+		return
+	}
+	if managed.timer != nil {
+		managed.timer.Stop()
+	}
+	name := managed.interf.Name
+	managed.timer = time.AfterFunc(m.settle, func() {
+		m.check(ctx, name)
+	})
+}
+
+// linkChanged applies the desired tree again when a managed interface comes up. The qdiscs of an
+// interface are gone when it is re-created, which PPPoE, WireGuard and LTE interfaces often are, and
+// it can come back with a different index. The same goes for the redirect of ingress traffic on the
+// source interface of an IFB device.
+func (m *DriftMonitor) linkChanged(ctx context.Context, ev LinkEvent) {
+	type reapply struct {
+		name    string
+		ifindex int
+	}
+	var pending []reapply
+
+	m.mu.Lock()
+	for name, managed := range m.managed {
+		switch ev.Name {
+		case name:
+			wasUp, oldIndex := managed.up, managed.interf.Index
+			managed.up = ev.Up
+			if ev.Deleted {
+				if managed.timer != nil {
+					managed.timer.Stop()
+				}
+				managed.interf.Index = 0
+			} else {
+				managed.interf.Index = ev.Index
+			}
+			if ev.Up && (!wasUp || oldIndex != ev.Index) {
+				pending = append(pending, reapply{name, ev.Index})
+			}
+		case managed.profile.Ingress:
+			wasUp, oldIndex := managed.sourceUp, managed.sourceIndex
+			managed.sourceUp, managed.sourceIndex = ev.Up, ev.Index
+			if ev.Up && (!wasUp || oldIndex != ev.Index) && managed.interf.Index != 0 {
+				pending = append(pending, reapply{name, managed.interf.Index})
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, r := range pending {
+		m.reapply(ctx, r.name, r.ifindex)
+	}
+}
+
+// apply composes the desired tree for the current index of an interface and applies it
+func (m *DriftMonitor) apply(ctx context.Context, name string, ifindex int) {
+	m.mu.Lock()
+	managed, ok := m.managed[name]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	ctx = opname.With(ctx, "DriftMonitor")
+	f := ln.F{"interface": name, "index": ifindex}
+
+	interf, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		ln.Error(ctx, err, f)
+		return
+	}
+	rtnl, err := OpenTc()
+	if err != nil {
+		ln.Error(ctx, err, f)
+		return
+	}
+	defer rtnl.Close()
+	tree, filters, err := applyProfile(ctx, rtnl, *interf, managed.profile)
+	if err != nil {
+		ln.Error(ctx, err, f, ln.Info("could not apply the tree to the interface"))
+		return
+	}
+	ln.Log(ctx, f, ln.Info("applied the tree to the interface after it came up"))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	managed.interf, managed.tree, managed.filters = *interf, tree, filters
+}
+
+// verify compares the live configuration of an interface with its desired tree and handles the
+// drift according to the policy of the interface
+func (m *DriftMonitor) verify(ctx context.Context, name string) {
+	m.mu.Lock()
+	managed, ok := m.managed[name]
+	if !ok || managed.interf.Index == 0 || managed.tree == nil && len(managed.filters) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	interf, tree, filters := managed.interf, managed.tree, managed.filters
+	m.mu.Unlock()
+	ctx = opname.With(ctx, "DriftMonitor")
+	f := ln.F{"interface": name}
+
+	rtnl, err := OpenTc()
+	if err != nil {
+		ln.Error(ctx, err, f)
+		return
+	}
+	defer rtnl.Close()
+
+	live, liveFilters := LiveTree(rtnl, interf)
+	live, liveFilters = policedOnly(tree, live, liveFilters)
+	plan, changes := driftChanges(tree, filters, live, liveFilters)
+	if len(changes) == 0 {
+		return
+	}
+	event := DriftEvent{
+		Time:      time.Now(),
+		Interface: name,
+		Policy:    managed.policy,
+		Changes:   changes,
+	}
+	ln.Log(ctx, f, ln.Info("tc configuration drifted from the desired tree, %d changes", len(changes)))
+
+	switch {
+	case managed.policy != DriftReconcile:
+	case !m.mayReconcile(managed):
+		event.Error = fmt.Sprintf("reconciled less than %s ago, not reconciling again", reconcileInterval)
+		ln.Log(ctx, f, ln.Info("%s", event.Error))
+	default:
+		if err := applyPlan(rtnl, plan, live, filters, liveFilters); err != nil {
+			event.Error = err.Error()
+			ln.Error(ctx, err, f, ln.Info("could not reconcile the interface"))
+			break
+		}
+		event.Reconciled = true
+		ln.Log(ctx, f, ln.Info("reconciled the interface"))
+	}
+	m.record(event)
+}
+
+// mayReconcile reports whether an interface was not reconciled recently and marks it reconciled
+func (m *DriftMonitor) mayReconcile(managed *managedInterface) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(managed.lastReconcile) < reconcileInterval {
+		return false
+	}
+	managed.lastReconcile = time.Now()
+	return true
+}
+
+func (m *DriftMonitor) record(event DriftEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	if len(m.events) > maxDriftEvents {
+		m.events = m.events[len(m.events)-maxDriftEvents:]
+	}
+}
+
+// Events returns the drift events the monitor remembers, oldest first
+func (m *DriftMonitor) Events() []DriftEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DriftEvent(nil), m.events...)
+}
+
+// TCDriftHandler lists the drift events of the managed interfaces
+func TCDriftHandler(m *DriftMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		events := m.Events()
+		if name := r.URL.Query().Get("interface"); name != "" {
+			var filtered []DriftEvent
+			for _, event := range events {
+				if event.Interface == name {
+					filtered = append(filtered, event)
+				}
+			}
+			events = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(events)
+	}
+}
+
+// Forget stops watching an interface, its configuration is left alone
+func (m *DriftMonitor) Forget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if managed, ok := m.managed[name]; ok && managed.timer != nil {
+		managed.timer.Stop()
+	}
+	delete(m.managed, name)
+}
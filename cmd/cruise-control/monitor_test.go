@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDriftPolicy(t *testing.T) {
+	var p DriftPolicy
+	if err := p.UnmarshalText([]byte("reconcile")); err != nil || p != DriftReconcile {
+		t.Errorf("expected reconcile, got %q (%v)", p, err)
+	}
+	if err := p.UnmarshalText([]byte("repair")); err == nil {
+		t.Error("expected an unknown policy to fail")
+	}
+
+	conf := Config{DriftPolicies: map[string]DriftPolicy{"wg0": DriftReconcile}}
+	if conf.driftPolicy("wg0") != DriftReconcile || conf.driftPolicy("eth0") != DriftAlert {
+		t.Errorf("unexpected policies %q and %q", conf.driftPolicy("wg0"), conf.driftPolicy("eth0"))
+	}
+	conf.Drift = DriftReconcile
+	if conf.driftPolicy("eth0") != DriftReconcile {
+		t.Errorf("expected the default policy to apply, got %q", conf.driftPolicy("eth0"))
+	}
+}
+
+func TestDrift(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	desired, filters, err := DesiredTree(context.Background(), Config{}, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, liveFilters, err := DesiredTree(context.Background(), Config{}, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kernel leaves the curves without rate out of its dump
+	var classes []*tc.Hfsc
+	var dump func(n *Node)
+	dump = func(n *Node) {
+		if h := n.Object.Hfsc; h != nil {
+			curve := func(sc *tc.ServiceCurve) *tc.ServiceCurve {
+				if sc == nil || (sc.M1 == 0 && sc.M2 == 0) {
+					return nil
+				}
+				c := *sc
+				return &c
+			}
+			n.Object.Hfsc = &tc.Hfsc{Rsc: curve(h.Rsc), Fsc: curve(h.Fsc), Usc: curve(h.Usc)}
+			classes = append(classes, n.Object.Hfsc)
+		}
+		for _, c := range n.Children {
+			dump(c)
+		}
+	}
+	dump(live.Tree)
+	if len(classes) == 0 {
+		t.Fatal("expected the simple profile to have HFSC classes")
+	}
+	if _, changes := driftChanges(desired.Tree, filters, live.Tree, liveFilters); len(changes) != 0 {
+		t.Errorf("expected no drift, got %v", changes)
+	}
+
+	// someone changed the curve of a class
+	for _, h := range classes {
+		if h.Fsc != nil {
+			h.Fsc.M2 += 125000
+			break
+		}
+	}
+	if _, changes := driftChanges(desired.Tree, filters, live.Tree, liveFilters); len(changes) != 1 || !strings.HasPrefix(changes[0], "~ change hfsc class") {
+		t.Errorf("expected the changed class, got %v", changes)
+	}
+
+	// someone deleted the root qdisc
+	plan, changes := driftChanges(desired.Tree, filters, nil, nil)
+	if len(changes) == 0 || !strings.HasPrefix(changes[0], "+ add hfsc qdisc 1:0") {
+		t.Errorf("expected the root qdisc to be added, got %v", changes)
+	}
+	if len(plan.Steps) == 0 || plan.Desired != desired.Tree {
+		t.Errorf("expected a plan to add the desired tree, got %+v", plan)
+	}
+	if len(filters) > 0 && len(changes) != len(plan.Steps)+len(filters) {
+		t.Errorf("expected the missing filters to be listed, got %v", changes)
+	}
+}
+
+func TestDriftMonitorNotify(t *testing.T) {
+	m := NewDriftMonitor()
+	m.settle = 10 * time.Millisecond
+	var checks int32
+	m.check = func(ctx context.Context, name string) {
+		atomic.AddInt32(&checks, 1)
+	}
+	m.Manage(net.Interface{Index: 3, Name: "wg0"}, ManagedProfile{}, NewNode("qdisc"), nil)
+
+	// a burst of notifications results in a single check, other interfaces are ignored
+	for i := 0; i < 5; i++ {
+		m.notify(context.Background(), 3)
+		m.notify(context.Background(), 4)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Errorf("expected a single check, got %d", n)
+	}
+}
+
+func TestDriftMonitorReceiveError(t *testing.T) {
+	m := NewDriftMonitor()
+	m.settle = 10 * time.Millisecond
+	var checks int32
+	m.check = func(ctx context.Context, name string) {
+		atomic.AddInt32(&checks, 1)
+	}
+	m.Manage(net.Interface{Index: 3, Name: "wg0"}, ManagedProfile{}, NewNode("qdisc"), nil)
+	m.Manage(net.Interface{Index: 4, Name: "eth0"}, ManagedProfile{}, NewNode("qdisc"), nil)
+
+	// dropped notifications check every managed interface and the notifications are still received
+	ctx, cancel := context.WithCancel(context.Background())
+	if m.receiveError(ctx, &netlink.OpError{Op: "receive", Err: unix.ENOBUFS}) != 0 {
+		t.Error("expected to keep receiving after the kernel dropped notifications")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&checks); n != 2 {
+		t.Errorf("expected both interfaces to be checked, got %d checks", n)
+	}
+	if m.receiveError(ctx, &netlink.OpError{Op: "receive", Err: unix.EINTR}) != 0 {
+		t.Error("expected to keep receiving after an error")
+	}
+	if m.receiveError(ctx, os.ErrClosed) == 0 {
+		t.Error("expected a closed socket to stop receiving")
+	}
+	cancel()
+	if m.receiveError(ctx, &netlink.OpError{Op: "receive", Err: unix.EAGAIN}) == 0 {
+		t.Error("expected to stop receiving when the context is done")
+	}
+}
+
+func TestManagedProfileValidation(t *testing.T) {
+	// the default class of the root does not exist
+	file := filepath.Join(t.TempDir(), "traffic.sh")
+	script := "tc qdisc add dev eth0 root handle 1: hfsc default 30\ntc class add dev eth0 parent 1: classid 1:10 hfsc sc rate 10mbit\n"
+	if err := os.WriteFile(file, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	p := ManagedProfile{Conf: Config{TrafficFile: file}, Profile: "traffic", Speed: 100 * Mbit, Force: true}
+	if _, _, err := p.desired(context.Background(), interf); err == nil || !strings.Contains(err.Error(), "default class") {
+		t.Errorf("expected force to leave the validation alone, got %v", err)
+	}
+	p.NoValidate = true
+	if tree, _, err := p.desired(context.Background(), interf); err != nil || tree == nil {
+		t.Errorf("expected the invalid tree without validation, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"golang.org/x/sys/unix"
+)
+
+// MultiqueueProfile holds the parameters of the multiqueue profile. A single root qdisc serializes
+// all traffic of a NIC on its lock, the profile keeps a qdisc per TX queue instead.
+type MultiqueueProfile struct {
+	// Root is the root qdisc in the notation of the `tc` command-line tool, "mq" (the default) or
+	// eg. "mqprio num_tc 3 map 2 2 1 0 2 queues 1@0 1@1 2@2 hw 0" to map priorities to queues
+	Root string
+	// Queues is the number of TX queues, by default the TX queues of the interface
+	Queues int
+	// Leaf is the qdisc of every TX queue in the notation of the `tc` command-line tool, the
+	// default is fq_codel
+	Leaf string
+}
+
+// ParseQuery overrides the parameters of the profile with the query parameters of an API call, eg.
+// `multiqueue.root=mq&multiqueue.leaf=cake`
+func (p *MultiqueueProfile) ParseQuery(query url.Values) error {
+	for key, values := range query {
+		param := strings.TrimPrefix(key, "multiqueue.")
+		if param == key || len(values) == 0 {
+			continue
+		}
+		v := values[0]
+		var err error
+		switch param {
+		case "root":
+			p.Root = v
+		case "queues":
+			p.Queues, err = strconv.Atoi(v)
+		case "leaf":
+			p.Leaf = v
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", key, v, err)
+		}
+	}
+	return nil
+}
+
+// root returns the root qdisc of the profile
+func (p MultiqueueProfile) root() (tc.Attribute, error) {
+	args := &tcArgs{args: strings.Fields(p.Root)}
+	kind, ok := args.next()
+	if !ok {
+		kind = "mq"
+	}
+	attr := tc.Attribute{Kind: kind}
+	if !isMultiqueue(kind) {
+		return attr, fmt.Errorf("unsupported multiqueue root %q, expected mq or mqprio", kind)
+	}
+	return attr, parseQdiscOptions(args, &attr)
+}
+
+// isMultiqueue checks if a qdisc of kind attaches a qdisc to every TX queue of the device
+func isMultiqueue(kind string) bool {
+	return kind == "mq" || kind == "mqprio"
+}
+
+// isQueueClass checks if handle is a class of the multiqueue qdisc root. The kernel creates a
+// class per TX queue, and mqprio one per traffic class, which can not be changed. They are left
+// out of the trees, the qdiscs of the queues are the children of the root.
+func isQueueClass(handle, root uint32) bool {
+	maj, min := core.SplitHandle(handle)
+	rootMaj, _ := core.SplitHandle(root)
+	return maj == rootMaj && min != 0
+}
+
+// txQueues returns the number of TX queues of an interface
+func txQueues(interf net.Interface) (int, error) {
+	queues, _ := filepath.Glob(filepath.Join("/sys/class/net", interf.Name, "queues", "tx-*"))
+	if len(queues) == 0 {
+		return 0, fmt.Errorf("could not find the TX queues of %s in sysfs", interf.Name)
+	}
+	return len(queues), nil
+}
+
+// validateMqPrio checks that the traffic classes of mqprio map to the TX queues of the device.
+// Without offload, the kernel maps them itself and every class needs a range of queues.
+func validateMqPrio(opt *tc.MqPrioQopt, queues int) error {
+	if opt.Hw != 0 {
+		return nil
+	}
+	for i := 0; i < int(opt.NumTc); i++ {
+		count, offset := int(opt.Count[i]), int(opt.Offset[i])
+		if count == 0 || offset+count > queues {
+			return fmt.Errorf("traffic class %d of mqprio needs queues within the %d TX queues of the device, got %d@%d", i, queues, count, offset)
+		}
+	}
+	return nil
+}
+
+// createQoSMultiqueue keeps a multiqueue root qdisc and attaches the leaf qdisc to each TX queue.
+// The leafs are attached to the classes of the queues, 1:1 for tx-0, and get handle 101: for tx-0.
+func createQoSMultiqueue(interf net.Interface, queues int, params MultiqueueProfile) (TcConfig, error) {
+	if queues < 2 {
+		return TcConfig{}, fmt.Errorf("%s has %d TX queue, the multiqueue profile requires a multiqueue device", interf.Name, queues)
+	}
+	root, err := params.root()
+	if err != nil {
+		return TcConfig{}, err
+	}
+	if root.MqPrio != nil {
+		if err := validateMqPrio(root.MqPrio.Opt, queues); err != nil {
+			return TcConfig{}, err
+		}
+	}
+	leaf, err := leafQdisc(params.Leaf)
+	if err != nil {
+		return TcConfig{}, err
+	}
+
+	template := TcConfig{
+		Qdiscs:  make(map[string]tc.Object),
+		Classes: make(map[string]tc.Object),
+		Filters: make(map[string]tc.Object),
+	}
+	template.Qdiscs["root"] = tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(interf.Index),
+			Handle:  core.BuildHandle(0x1, 0x0),
+			Parent:  tc.HandleRoot,
+		},
+		Attribute: root,
+	}
+	for i := 0; i < queues; i++ {
+		template.Qdiscs[fmt.Sprintf("tx-%d", i)] = tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: uint32(interf.Index),
+				Handle:  core.BuildHandle(uint32(0x100+i+1), 0x0),
+				Parent:  core.BuildHandle(0x1, uint32(i+1)),
+			},
+			Attribute: leaf,
+		}
+		if red := leafRed(params.Leaf); red != nil {
+			template.setRed(fmt.Sprintf("tx-%d", i), *red)
+		}
+	}
+	return template, nil
+}
+
+// fmtMqPrio describes the traffic classes of mqprio in the notation of the `tc` command-line tool
+func fmtMqPrio(mqprio *tc.MqPrio) string {
+	opt := mqprio.Opt
+	if opt == nil {
+		return ""
+	}
+	prios := make([]string, len(opt.PrioTcMap))
+	for i, tc := range opt.PrioTcMap {
+		prios[i] = strconv.Itoa(int(tc))
+	}
+	s := fmt.Sprintf("num_tc %d map %s", opt.NumTc, strings.Join(prios, " "))
+	if opt.Hw == 0 {
+		var queues []string
+		for i := 0; i < int(opt.NumTc) && i < len(opt.Count); i++ {
+			queues = append(queues, fmt.Sprintf("%d@%d", opt.Count[i], opt.Offset[i]))
+		}
+		s += " queues " + strings.Join(queues, " ")
+	}
+	return fmt.Sprintf("%s hw %d", s, opt.Hw)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/mdlayher/netlink"
+)
+
+func TestMultiqueueProfile(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "cc-test0"}
+	conf := Config{Overhead: Overhead{Overhead: 18}}
+	query, _ := url.ParseQuery("multiqueue.queues=4&multiqueue.leaf=cake+rtt+50ms")
+	if err := conf.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := DesiredTree(context.Background(), conf, "multiqueue", interf, Gbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := result.Tree
+	if root.Object.Kind != "mq" || root.Object.Stab != nil || len(root.Children) != 4 {
+		t.Fatalf("expected a mq root with a qdisc per TX queue, got %s with %d children", nodeTitle(root), len(root.Children))
+	}
+	for _, leaf := range root.Children {
+		_, queue := core.SplitHandle(leaf.Object.Parent)
+		if leaf.Name != fmt.Sprintf("tx-%d", queue-1) || leaf.Object.Handle != core.BuildHandle(0x100+queue, 0) {
+			t.Errorf("expected the qdisc of queue 1:%d to be tx-%d, got %s", queue, queue-1, nodeTitle(leaf))
+		}
+		if leaf.Object.Kind != "cake" || *leaf.Object.Cake.Rtt != 50000 || leaf.Object.Stab == nil {
+			t.Errorf("expected %s to be a cake leaf with the size table, got %+v", leaf.Name, leaf.Object.Cake)
+		}
+	}
+	if errs := ValidateTree(root, nil); len(errs) > 0 {
+		t.Errorf("expected the tree to be valid, got %v", errs)
+	}
+
+	for root, problem := range map[string]string{
+		"hfsc":         "unsupported multiqueue root",
+		"mq quantum 1": "unsupported mq option",
+		"mqprio num_tc 2 map 0 0 1 1 queues 2@0 2@3 hw 0": "traffic class 1 of mqprio",
+		"mqprio num_tc 2 map 0 2":                         "maps to traffic class 2",
+	} {
+		conf.Multiqueue.Root = root
+		if _, err := createQoS(context.Background(), conf, "multiqueue", interf, Gbit, Gbit); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected root %q to fail with %q, got %v", root, problem, err)
+		}
+	}
+	conf.Multiqueue = MultiqueueProfile{Queues: 1}
+	if _, err := createQoS(context.Background(), conf, "multiqueue", interf, Gbit, Gbit); err == nil || !strings.Contains(err.Error(), "multiqueue device") {
+		t.Errorf("expected a single queue to fail, got %v", err)
+	}
+	conf.Multiqueue = MultiqueueProfile{}
+	if _, err := createQoS(context.Background(), conf, "multiqueue", interf, Gbit, Gbit); err == nil || !strings.Contains(err.Error(), "TX queues of cc-test0") {
+		t.Errorf("expected the queues of a missing interface to fail, got %v", err)
+	}
+}
+
+func TestComposeMultiqueue(t *testing.T) {
+	conf, err := createQoSMultiqueue(net.Interface{Index: 1}, 2, MultiqueueProfile{Root: "mqprio num_tc 2 map 0 0 1 1 queues 1@0 1@1 hw 0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ := NodesFromConfig(conf)
+	desired := ComposeTree(nodes)
+
+	// the kernel lists the classes of the queues and traffic classes with the root as their parent
+	var live []*Node
+	for _, minor := range []uint32{1, 2, 0xffe0, 0xffe1} {
+		live = append(live, NewNodeWithObject("class", tc.Object{Msg: tc.Msg{Ifindex: 1, Handle: core.BuildHandle(1, minor), Parent: tc.HandleRoot}, Attribute: tc.Attribute{Kind: "mqprio"}}))
+	}
+	for _, n := range nodes {
+		obj := n.Object
+		if obj.MqPrio != nil {
+			// the options of mqprio are read back without go-tc, as recent kernels report the
+			// traffic classes for frame preemption
+			options := append(marshalStruct(obj.MqPrio.Opt), 0, 0)
+			ae := netlink.NewAttributeEncoder()
+			ae.Nested(5, func(nae *netlink.AttributeEncoder) error {
+				nae.Uint32(1, 0)
+				return nil
+			})
+			entries, _ := ae.Encode()
+			data, err := marshalQdisc(obj, append(options, entries...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, err := unmarshalQdisc(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj = root.Object
+		}
+		live = append(live, NewNodeWithObject("qdisc", obj))
+	}
+	result := ComposeTree(live)
+	if problems := result.Problems(); len(problems) > 0 || len(result.Leftover) > 0 {
+		t.Fatalf("expected the classes of the queues to be left out, got %v and %d leftover nodes", problems, len(result.Leftover))
+	}
+	if drift := DiffTrees(desired.Tree, result.Tree); len(drift) > 0 {
+		t.Errorf("expected the live tree to equal the desired tree, got %v", drift)
+	}
+	if details := strings.Join(nodeDetails(result.Tree), ", "); details != "num_tc 2 map 0 0 1 1 0 0 0 0 0 0 0 0 0 0 0 0 queues 1@0 1@1 hw 0" {
+		t.Errorf("unexpected details %q", details)
+	}
+
+	result.Tree.Object.MqPrio.Opt.PrioTcMap[0] = 1
+	if result.Tree.equalNode(*desired.Tree) {
+		t.Errorf("expected a changed map to differ")
+	}
+}
+
+func TestTcScriptMultiqueue(t *testing.T) {
+	script := `
+tc qdisc replace dev eth0 root handle 1: mqprio num_tc 3 map 2 2 1 0 2 2 2 2 2 2 2 2 2 2 2 2 queues 1@0 1@1 2@2 hw 0
+tc qdisc replace dev eth0 parent 1:1 handle 101: sfq
+tc qdisc replace dev eth1 root handle 1: mq
+`
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := configs["eth0"].Qdiscs["1:0"].MqPrio.Opt
+	if opt.NumTc != 3 || opt.PrioTcMap[0] != 2 || opt.PrioTcMap[3] != 0 || opt.Count[2] != 2 || opt.Offset[2] != 2 || opt.Hw != 0 {
+		t.Errorf("unexpected mqprio options %+v", opt)
+	}
+	if kind := configs["eth1"].Qdiscs["1:0"].Kind; kind != "mq" {
+		t.Errorf("expected a mq root, got %q", kind)
+	}
+	nodes, _ := NodesFromConfig(configs["eth0"])
+	if tree := ComposeTree(nodes).Tree; len(tree.Children) != 1 {
+		t.Errorf("expected the sfq qdisc of the first queue under the root")
+	}
+}
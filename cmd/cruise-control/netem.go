@@ -0,0 +1,673 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/florianl/go-tc"
+)
+
+// Netem holds the conditions of a link that netem emulates, eg. the delay, loss and rate of a WAN
+// link. Percentages are between 0 and 100. It is written in the notation of the `tc` command-line
+// tool in traffic files and queries, eg. "delay 100ms 10ms distribution normal loss 1%".
+type Netem struct {
+	// Delay is added to every packet, Jitter varies it following the Distribution
+	Delay  time.Duration
+	Jitter time.Duration
+	// DelayCorrelation is how much the jitter of a packet depends on the one of the previous packet
+	DelayCorrelation float64
+	// Distribution of the jitter: "uniform" (the default), "normal", "pareto" or "paretonormal"
+	Distribution string
+	// Loss drops packets at random
+	Loss            float64
+	LossCorrelation float64
+	// GilbertElliott replaces the random loss with the bursts of loss of a Gilbert-Elliott model
+	GilbertElliott *GilbertElliott
+	// ECN marks the packets that are lost instead of dropping them, if they support ECN
+	ECN                  bool
+	Duplicate            float64
+	DuplicateCorrelation float64
+	// Reorder sends packets right away instead of delaying them. Every Gap packets are sent right
+	// away with this chance, 1 by default.
+	Reorder            float64
+	ReorderCorrelation float64
+	Gap                uint32
+	// Corrupt flips a random bit of packets
+	Corrupt            float64
+	CorruptCorrelation float64
+	// Rate limits the link, unlimited by default
+	Rate Rate
+	// Limit is the number of packets netem holds, 1000 by default
+	Limit uint32
+}
+
+// GilbertElliott is a loss model with a good and a bad state, which emulates the bursts of loss of
+// eg. a wireless link. Percentages are between 0 and 100.
+type GilbertElliott struct {
+	// P is the chance to go from the good to the bad state, R the chance to go back. R is 100 when
+	// unset, which makes the bursts a single packet long on average.
+	P float64
+	R float64
+	// BadLoss is the loss in the bad state, 100 when unset, GoodLoss the loss in the good state
+	BadLoss  float64
+	GoodLoss float64
+}
+
+// GEModel is struct tc_netem_gemodel from include/uapi/linux/pkt_sched.h. go-tc does not know the
+// loss models of netem, so they are kept next to the qdisc. H is the chance to not lose a packet in
+// the bad state.
+type GEModel struct {
+	P  uint32
+	R  uint32
+	H  uint32
+	K1 uint32
+}
+
+// netemDistributions are the distributions of the jitter, see netemTable
+var netemDistributions = []string{"uniform", "normal", "pareto", "paretonormal"}
+
+// netemLimit is the number of packets netem holds by default, as the `tc` command-line tool sets it
+const netemLimit = 1000
+
+// withDefaults fills in the defaults of the `tc` command-line tool
+func (n Netem) withDefaults() Netem {
+	if n.Limit == 0 {
+		n.Limit = netemLimit
+	}
+	if n.Reorder > 0 && n.Gap == 0 {
+		n.Gap = 1
+	}
+	return n
+}
+
+// Validate checks the link conditions
+func (n Netem) Validate() error {
+	var problems []string
+	if n.Delay < 0 || n.Jitter < 0 {
+		problems = append(problems, "delay and jitter must not be negative")
+	}
+	if n.Distribution != "" && n.Distribution != "uniform" && n.Jitter == 0 {
+		problems = append(problems, fmt.Sprintf("a %s distribution requires jitter", n.Distribution))
+	}
+	if n.Distribution != "" && netemTable(n.Distribution) == nil {
+		problems = append(problems, fmt.Sprintf("unknown distribution %q, expected one of %v", n.Distribution, netemDistributions))
+	}
+	if n.Reorder > 0 && n.Delay == 0 {
+		problems = append(problems, "reordering requires a delay")
+	}
+	if n.GilbertElliott != nil && n.Loss > 0 {
+		problems = append(problems, "random loss can not be combined with a gilbert-elliott model")
+	}
+	type percentage struct {
+		name  string
+		value float64
+	}
+	percentages := []percentage{
+		{"delay correlation", n.DelayCorrelation}, {"loss", n.Loss}, {"loss correlation", n.LossCorrelation},
+		{"duplicate", n.Duplicate}, {"duplicate correlation", n.DuplicateCorrelation},
+		{"reorder", n.Reorder}, {"reorder correlation", n.ReorderCorrelation},
+		{"corrupt", n.Corrupt}, {"corrupt correlation", n.CorruptCorrelation},
+	}
+	if ge := n.GilbertElliott; ge != nil {
+		percentages = append(percentages, percentage{"gemodel p", ge.P}, percentage{"gemodel r", ge.R},
+			percentage{"gemodel bad loss", ge.BadLoss}, percentage{"gemodel good loss", ge.GoodLoss})
+	}
+	for _, p := range percentages {
+		if p.value < 0 || p.value > 100 || math.IsNaN(p.value) {
+			problems = append(problems, fmt.Sprintf("%s %v%% is not between 0 and 100", p.name, p.value))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid netem: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// netemPercent scales a percentage to the 32 bit probabilities of netem
+func netemPercent(p float64) uint32 {
+	return uint32(math.Round(p / 100 * math.MaxUint32))
+}
+
+// percentOf is the percentage of a 32 bit probability of netem, rounded to 4 decimals
+func percentOf(v uint32) float64 {
+	return math.Round(float64(v)/math.MaxUint32*100*1e4) / 1e4
+}
+
+// netemTicks converts a delay to the ticks of the 32 bit fields of netem, the 64 bit attributes
+// hold the delay in nanoseconds
+func netemTicks(d time.Duration) uint32 {
+	ticks := uint64(d) >> 6
+	if ticks > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(ticks)
+}
+
+// model returns the loss model as the kernel holds it
+func (ge *GilbertElliott) model() *GEModel {
+	if ge == nil {
+		return nil
+	}
+	r, bad := ge.R, ge.BadLoss
+	if r == 0 {
+		r = 100
+	}
+	if bad == 0 {
+		bad = 100
+	}
+	return &GEModel{P: netemPercent(ge.P), R: netemPercent(r), H: math.MaxUint32 - netemPercent(bad), K1: netemPercent(ge.GoodLoss)}
+}
+
+// attribute returns the netem qdisc with the link conditions. The kernel reports the correlations,
+// reordering, corruption and rate even when they are not set, so they are always sent. The kernel
+// keeps the distribution of a replaced qdisc when none is sent, so the uniform distribution is
+// sent as a table as well.
+func (n Netem) attribute() tc.Attribute {
+	n = n.withDefaults()
+	delay, jitter := int64(n.Delay), int64(n.Jitter)
+	netem := &tc.Netem{
+		Qopt: tc.NetemQopt{
+			Latency:   netemTicks(n.Delay),
+			Limit:     n.Limit,
+			Loss:      netemPercent(n.Loss),
+			Gap:       n.Gap,
+			Duplicate: netemPercent(n.Duplicate),
+			Jitter:    netemTicks(n.Jitter),
+		},
+		Corr: &tc.NetemCorr{
+			Delay: netemPercent(n.DelayCorrelation),
+			Loss:  netemPercent(n.LossCorrelation),
+			Dup:   netemPercent(n.DuplicateCorrelation),
+		},
+		Reorder:   &tc.NetemReorder{Probability: netemPercent(n.Reorder), Correlation: netemPercent(n.ReorderCorrelation)},
+		Corrupt:   &tc.NetemCorrupt{Probability: netemPercent(n.Corrupt), Correlation: netemPercent(n.CorruptCorrelation)},
+		Rate:      &tc.NetemRate{},
+		Latency64: &delay,
+		Jitter64:  &jitter,
+	}
+	if bytes := n.Rate.BytesPerSecond(); bytes < 1<<32 {
+		netem.Rate.Rate = uint32(bytes)
+	} else {
+		netem.Rate.Rate = math.MaxUint32
+		netem.Rate64 = &bytes
+	}
+	if n.ECN {
+		ecn := uint32(1)
+		netem.Ecn = &ecn
+	}
+	if n.Jitter > 0 {
+		if table := netemTable(n.Distribution); table != nil {
+			netem.DelayDist = &table
+		}
+	}
+	return tc.Attribute{Kind: "netem", Netem: netem}
+}
+
+// netemFromAttribute returns the link conditions of a netem qdisc. The kernel does not report the
+// distribution, it is only known for the qdiscs of a config.
+func netemFromAttribute(netem *tc.Netem, loss *GEModel) Netem {
+	n := Netem{
+		Delay:     time.Duration(netem.Qopt.Latency) << 6,
+		Jitter:    time.Duration(netem.Qopt.Jitter) << 6,
+		Loss:      percentOf(netem.Qopt.Loss),
+		Duplicate: percentOf(netem.Qopt.Duplicate),
+		Gap:       netem.Qopt.Gap,
+		Limit:     netem.Qopt.Limit,
+		ECN:       netem.Ecn != nil && *netem.Ecn != 0,
+	}
+	if netem.Latency64 != nil {
+		n.Delay = time.Duration(*netem.Latency64)
+	}
+	if netem.Jitter64 != nil {
+		n.Jitter = time.Duration(*netem.Jitter64)
+	}
+	if c := netem.Corr; c != nil {
+		n.DelayCorrelation, n.LossCorrelation, n.DuplicateCorrelation = percentOf(c.Delay), percentOf(c.Loss), percentOf(c.Dup)
+	}
+	if r := netem.Reorder; r != nil {
+		n.Reorder, n.ReorderCorrelation = percentOf(r.Probability), percentOf(r.Correlation)
+	}
+	if c := netem.Corrupt; c != nil {
+		n.Corrupt, n.CorruptCorrelation = percentOf(c.Probability), percentOf(c.Correlation)
+	}
+	switch {
+	case netem.Rate64 != nil:
+		n.Rate = RateFromBytes(*netem.Rate64)
+	case netem.Rate != nil:
+		n.Rate = RateFromBytes(uint64(netem.Rate.Rate))
+	}
+	if netem.DelayDist != nil {
+		for _, name := range netemDistributions {
+			if reflect.DeepEqual(*netem.DelayDist, netemTable(name)) {
+				n.Distribution = name
+			}
+		}
+	}
+	if loss != nil {
+		n.Loss = 0
+		n.GilbertElliott = &GilbertElliott{
+			P:        percentOf(loss.P),
+			R:        percentOf(loss.R),
+			BadLoss:  percentOf(math.MaxUint32 - loss.H),
+			GoodLoss: percentOf(loss.K1),
+		}
+	}
+	return n
+}
+
+// equalNetem checks if the netem qdiscs a and b emulate the same link. The distribution is not
+// compared, as the kernel does not report it. The kernel only reports the 64 bit delay and jitter
+// when they are not a whole number of ticks, so the delays are compared in nanoseconds.
+func equalNetem(a, b *tc.Netem, lossA, lossB *GEModel) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	nsec := func(ticks uint32, ns *int64) int64 {
+		if ns != nil {
+			return *ns
+		}
+		return int64(ticks) << 6
+	}
+	x, y := *a, *b
+	if nsec(x.Qopt.Latency, x.Latency64) != nsec(y.Qopt.Latency, y.Latency64) ||
+		nsec(x.Qopt.Jitter, x.Jitter64) != nsec(y.Qopt.Jitter, y.Jitter64) {
+		return false
+	}
+	x.DelayDist, y.DelayDist = nil, nil
+	x.Qopt.Latency, x.Qopt.Jitter, x.Latency64, x.Jitter64 = 0, 0, nil, nil
+	y.Qopt.Latency, y.Qopt.Jitter, y.Latency64, y.Jitter64 = 0, 0, nil, nil
+	return reflect.DeepEqual(x, y) && reflect.DeepEqual(lossA, lossB)
+}
+
+// String renders the link conditions in the notation of the `tc` command-line tool
+func (n Netem) String() string {
+	pct := func(p float64) string {
+		return strconv.FormatFloat(p, 'f', -1, 64) + "%"
+	}
+	// withCorrelation renders a percentage and its correlation, if it is set
+	withCorrelation := func(name string, p, corr float64) string {
+		s := name + " " + pct(p)
+		if corr > 0 {
+			s += " " + pct(corr)
+		}
+		return s
+	}
+	var params []string
+	if n.Delay > 0 {
+		delay := "delay " + FmtTime(uint32(n.Delay/time.Microsecond))
+		if n.Jitter > 0 {
+			delay += " " + FmtTime(uint32(n.Jitter/time.Microsecond))
+			if n.DelayCorrelation > 0 {
+				delay += " " + pct(n.DelayCorrelation)
+			}
+		}
+		params = append(params, delay)
+		if n.Jitter > 0 && n.Distribution != "" && n.Distribution != "uniform" {
+			params = append(params, "distribution "+n.Distribution)
+		}
+	}
+	if ge := n.GilbertElliott; ge != nil {
+		params = append(params, fmt.Sprintf("loss gemodel %s %s %s %s", pct(ge.P), pct(ge.R), pct(ge.BadLoss), pct(ge.GoodLoss)))
+	} else if n.Loss > 0 {
+		params = append(params, withCorrelation("loss", n.Loss, n.LossCorrelation))
+	}
+	if n.ECN {
+		params = append(params, "ecn")
+	}
+	if n.Duplicate > 0 {
+		params = append(params, withCorrelation("duplicate", n.Duplicate, n.DuplicateCorrelation))
+	}
+	if n.Reorder > 0 {
+		params = append(params, withCorrelation("reorder", n.Reorder, n.ReorderCorrelation))
+		if n.Gap > 1 {
+			params = append(params, fmt.Sprintf("gap %d", n.Gap))
+		}
+	}
+	if n.Corrupt > 0 {
+		params = append(params, withCorrelation("corrupt", n.Corrupt, n.CorruptCorrelation))
+	}
+	if n.Rate > 0 {
+		params = append(params, "rate "+n.Rate.String())
+	}
+	if n.Limit != 0 && n.Limit != netemLimit {
+		params = append(params, fmt.Sprintf("limit %d", n.Limit))
+	}
+	return strings.Join(params, " ")
+}
+
+// MarshalText renders the link conditions in the notation of the `tc` command-line tool
+func (n Netem) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+// UnmarshalText parses link conditions in the notation of the `tc` command-line tool, without the
+// "netem" kind
+func (n *Netem) UnmarshalText(text []byte) error {
+	netem, err := parseNetem(&tcArgs{args: strings.Fields(string(text))})
+	if err != nil {
+		return err
+	}
+	*n = netem
+	return nil
+}
+
+// isNumber checks if the next argument of an option with optional values is one of its values
+func isNumber(arg string) bool {
+	return arg != "" && (arg[0] >= '0' && arg[0] <= '9' || arg[0] == '.')
+}
+
+// parsePercent parses a percentage, with or without the percent sign
+func parsePercent(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return p, nil
+}
+
+// parseNetem parses the options of a netem qdisc in the notation of the `tc` command-line tool.
+// Slots and the 4-state loss model are not supported.
+func parseNetem(args *tcArgs) (Netem, error) {
+	var n Netem
+	// percentages parses the percentages that follow an option, the first one is required
+	percentages := func(key string, values ...*float64) error {
+		for i, v := range values {
+			if i > 0 && !isNumber(args.peek()) {
+				break
+			}
+			s, err := args.value(key)
+			if err != nil {
+				return err
+			}
+			if *v, err = parsePercent(s); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		return nil
+	}
+	var err error
+	for err == nil {
+		arg, ok := args.next()
+		if !ok {
+			break
+		}
+		switch arg {
+		case "delay", "latency":
+			if n.Delay, err = parseDurationArg(args, arg); err != nil {
+				break
+			}
+			if isNumber(args.peek()) {
+				if n.Jitter, err = parseDurationArg(args, arg); err == nil && isNumber(args.peek()) {
+					err = percentages(arg, &n.DelayCorrelation)
+				}
+			}
+		case "distribution":
+			n.Distribution, err = args.value(arg)
+		case "loss", "drop":
+			switch args.peek() {
+			case "random":
+				args.next()
+			case "gemodel", "gmodel":
+				args.next()
+				ge := &GilbertElliott{}
+				err = percentages("gemodel", &ge.P, &ge.R, &ge.BadLoss, &ge.GoodLoss)
+				n.GilbertElliott = ge
+				continue
+			case "state":
+				err = errors.New("the 4-state loss model is not supported")
+				continue
+			}
+			err = percentages(arg, &n.Loss, &n.LossCorrelation)
+		case "ecn":
+			n.ECN = true
+		case "duplicate":
+			err = percentages(arg, &n.Duplicate, &n.DuplicateCorrelation)
+		case "reorder":
+			err = percentages(arg, &n.Reorder, &n.ReorderCorrelation)
+		case "gap":
+			var v uint64
+			v, err = parseUintArg(args, arg, 10, 32)
+			n.Gap = uint32(v)
+		case "corrupt":
+			err = percentages(arg, &n.Corrupt, &n.CorruptCorrelation)
+		case "rate":
+			n.Rate, err = parseRateArg(args, arg)
+		case "limit":
+			var v uint64
+			v, err = parseUintArg(args, arg, 10, 32)
+			n.Limit = uint32(v)
+		default:
+			err = unsupportedOption("netem", arg)
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, n.Validate()
+}
+
+// ParseQuery overrides the link conditions with the query parameters of an API call. The key
+// replaces all conditions in the notation of the `tc` command-line tool, eg.
+// `netem=delay 100ms 10ms`, the parameters under it override a single condition, eg.
+// `netem.delay=100ms&netem.loss=1&netem.ge.p=5`.
+func (n *Netem) ParseQuery(query url.Values, key string) error {
+	// the loss model of the config is shared, it is changed on a copy
+	if n.GilbertElliott != nil {
+		ge := *n.GilbertElliott
+		n.GilbertElliott = &ge
+	}
+	var keys []string
+	for k, values := range query {
+		if (k == key || strings.HasPrefix(k, key+".")) && len(values) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	// the key sorts before its parameters
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := n.set(strings.TrimPrefix(strings.TrimPrefix(k, key), "."), query.Get(k)); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", k, query.Get(k), err)
+		}
+	}
+	return nil
+}
+
+// set sets a single condition from its query parameter, an empty param replaces all conditions
+func (n *Netem) set(param, v string) error {
+	var err error
+	percent := func(p *float64) {
+		*p, err = parsePercent(v)
+	}
+	ge := func() *GilbertElliott {
+		if n.GilbertElliott == nil {
+			n.GilbertElliott = &GilbertElliott{}
+		}
+		return n.GilbertElliott
+	}
+	switch param {
+	case "":
+		err = n.UnmarshalText([]byte(v))
+	case "delay":
+		n.Delay, err = time.ParseDuration(v)
+	case "jitter":
+		n.Jitter, err = time.ParseDuration(v)
+	case "delaycorrelation":
+		percent(&n.DelayCorrelation)
+	case "distribution":
+		n.Distribution = v
+	case "loss":
+		percent(&n.Loss)
+	case "losscorrelation":
+		percent(&n.LossCorrelation)
+	case "ge":
+		// an empty value switches back to random loss
+		if v != "" {
+			return errors.New("only an empty value removes the gilbert-elliott model")
+		}
+		n.GilbertElliott = nil
+	case "ge.p":
+		percent(&ge().P)
+	case "ge.r":
+		percent(&ge().R)
+	case "ge.badloss":
+		percent(&ge().BadLoss)
+	case "ge.goodloss":
+		percent(&ge().GoodLoss)
+	case "ecn":
+		n.ECN, err = strconv.ParseBool(v)
+	case "duplicate":
+		percent(&n.Duplicate)
+	case "duplicatecorrelation":
+		percent(&n.DuplicateCorrelation)
+	case "reorder":
+		percent(&n.Reorder)
+	case "reordercorrelation":
+		percent(&n.ReorderCorrelation)
+	case "gap", "limit":
+		var u uint64
+		u, err = strconv.ParseUint(v, 10, 32)
+		if param == "gap" {
+			n.Gap = uint32(u)
+		} else {
+			n.Limit = uint32(u)
+		}
+	case "corrupt":
+		percent(&n.Corrupt)
+	case "corruptcorrelation":
+		percent(&n.CorruptCorrelation)
+	case "rate":
+		n.Rate, err = ParseRate(v)
+	default:
+		err = fmt.Errorf("unknown parameter")
+	}
+	return err
+}
+
+// setNetem sets the link conditions of the netem qdisc name and keeps them, so the loss model can
+// be applied
+func (conf *TcConfig) setNetem(name string, netem Netem) {
+	if conf.Netem == nil {
+		conf.Netem = make(map[string]Netem)
+	}
+	conf.Netem[name] = netem
+	qdisc := conf.Qdiscs[name]
+	qdisc.Attribute = netem.attribute()
+	conf.Qdiscs[name] = qdisc
+}
+
+// applyNetem sets the link conditions of the config on their qdiscs, replacing the options of the
+// TC objects
+func (conf *TcConfig) applyNetem() error {
+	for name, netem := range conf.Netem {
+		qdisc, ok := conf.Qdiscs[name]
+		if !ok {
+			return fmt.Errorf("netem for unknown qdisc %q", name)
+		}
+		if qdisc.Kind != "" && qdisc.Kind != "netem" {
+			return fmt.Errorf("qdisc %q is a %s qdisc, link conditions require a netem qdisc", name, qdisc.Kind)
+		}
+		if err := netem.Validate(); err != nil {
+			return fmt.Errorf("qdisc %q: %v", name, err)
+		}
+		conf.setNetem(name, netem)
+	}
+	return nil
+}
+
+// netem distribution tables, see netemTable
+const (
+	netemTableSize = 16384
+	netemDistScale = 8192
+)
+
+var (
+	netemTablesOnce sync.Once
+	netemTables     map[string][]int16
+)
+
+// netemTable returns the distribution table of the jitter, the same tables the `tc` command-line
+// tool reads from its normal.dist, pareto.dist and paretonormal.dist files. The uniform table
+// spreads the jitter evenly, like netem does without a table.
+func netemTable(name string) []int16 {
+	netemTablesOnce.Do(func() {
+		netemTables = map[string][]int16{
+			"uniform":      uniformTable(),
+			"normal":       normalTable(),
+			"pareto":       paretoTable(),
+			"paretonormal": paretoNormalTable(),
+		}
+	})
+	if name == "" {
+		name = "uniform"
+	}
+	return netemTables[name]
+}
+
+// normalInverse tabulates the inverse of the cumulative normal distribution, as iproute2's
+// netem/normal.c does
+func normalInverse() []float64 {
+	table := make([]float64, netemTableSize+1)
+	for x := -10.0; x < 10.05; x += .00005 {
+		i := int(math.RoundToEven(netemTableSize * (.5 + .5*math.Erf(x/math.Sqrt2))))
+		table[i] = x
+	}
+	return table
+}
+
+// clampInt16 rounds v to an entry of a distribution table
+func clampInt16(v float64) int16 {
+	return int16(math.Max(math.MinInt16, math.Min(math.MaxInt16, math.RoundToEven(v))))
+}
+
+func uniformTable() []int16 {
+	table := make([]int16, 0, netemTableSize/4)
+	for i := 0; i < netemTableSize/4; i++ {
+		table = append(table, int16(-netemDistScale+2+4*i))
+	}
+	return table
+}
+
+func normalTable() []int16 {
+	inverse := normalInverse()
+	table := make([]int16, 0, netemTableSize/4)
+	for i := 0; i < netemTableSize; i += 4 {
+		table = append(table, clampInt16(inverse[i]*netemDistScale))
+	}
+	return table
+}
+
+// paretoValue is the entry of iproute2's netem/pareto.c for i out of 65536
+func paretoValue(i int) int {
+	d := 1/math.Pow(float64(i)/65536, 1.0/3) - 1.5
+	d *= 4.0 / 3 * netemDistScale
+	return int(math.RoundToEven(math.Min(d, math.MaxInt16)))
+}
+
+func paretoTable() []int16 {
+	table := make([]int16, 0, netemTableSize/4)
+	for i := 65536; i > 0; i -= 16 {
+		table = append(table, int16(paretoValue(i)))
+	}
+	return table
+}
+
+// paretoNormalTable mixes a quarter of the normal and three quarters of the pareto distribution, as
+// iproute2's netem/paretonormal.c does
+func paretoNormalTable() []int16 {
+	inverse := normalInverse()
+	table := make([]int16, 0, netemTableSize/4)
+	for i := 0; i < netemTableSize; i += 4 {
+		normal := int(math.RoundToEven(inverse[i] * netemDistScale))
+		pareto := paretoValue(65536 - 4*i)
+		table = append(table, clampInt16(float64((normal+3*pareto)/4)))
+	}
+	return table
+}
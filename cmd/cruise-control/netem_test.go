@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/spf13/viper"
+)
+
+func TestNetemTables(t *testing.T) {
+	// the first, middle and last entries of the tables of iproute2
+	for name, expected := range map[string][]int16{
+		"normal":       {-32768, -28307, -5, 28858},
+		"pareto":       {-5461, -5460, -2625, 32767},
+		"paretonormal": {-12305, -11171, -1970, 31789},
+	} {
+		table := netemTable(name)
+		if len(table) != 4096 {
+			t.Fatalf("expected 4096 entries in the %s table, got %d", name, len(table))
+		}
+		if got := []int16{table[0], table[1], table[2047], table[4095]}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected the %s table to hold %v, got %v", name, expected, got)
+		}
+	}
+	uniform := netemTable("")
+	if len(uniform) != 4096 || uniform[0] != -8190 || uniform[4095] != 8190 {
+		t.Errorf("expected an even uniform table, got %d entries from %d to %d", len(uniform), uniform[0], uniform[len(uniform)-1])
+	}
+}
+
+func TestParseNetem(t *testing.T) {
+	var n Netem
+	spec := "delay 100ms 10ms 25% distribution normal loss gemodel 1% 10% 70% 0.1% duplicate 1 reorder 25% 50% gap 5 corrupt 0.1% rate 20mbit limit 2000"
+	if err := n.UnmarshalText([]byte(spec)); err != nil {
+		t.Fatal(err)
+	}
+	expected := Netem{
+		Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, DelayCorrelation: 25, Distribution: "normal",
+		GilbertElliott: &GilbertElliott{P: 1, R: 10, BadLoss: 70, GoodLoss: 0.1},
+		Duplicate:      1, Reorder: 25, ReorderCorrelation: 50, Gap: 5, Corrupt: 0.1, Rate: 20 * Mbit, Limit: 2000,
+	}
+	if !reflect.DeepEqual(n, expected) {
+		t.Errorf("expected %+v, got %+v", expected, n)
+	}
+	rendered := "delay 100ms 10ms 25% distribution normal loss gemodel 1% 10% 70% 0.1% duplicate 1% reorder 25% 50% gap 5 corrupt 0.1% rate 20Mbit limit 2000"
+	if s := n.String(); s != rendered {
+		t.Errorf("expected the conditions to render as %q, got %q", rendered, s)
+	}
+
+	// the model of the kernel holds the chance to not lose a packet in the bad state
+	ge := GilbertElliott{P: 5}
+	if m := ge.model(); m.R != 1<<32-1 || m.H != 0 || m.K1 != 0 {
+		t.Errorf("expected the defaults of the tc command-line tool, got %+v", m)
+	}
+
+	for spec, problem := range map[string]string{
+		"delay 10ms distribution normal": "requires jitter",
+		"delay 10ms 1ms distribution x":  "unknown distribution",
+		"reorder 10%":                    "requires a delay",
+		"loss 110%":                      "invalid percentage",
+		"loss state 1 2":                 "4-state",
+		"slot 10ms":                      "unsupported netem option",
+	} {
+		if err := n.UnmarshalText([]byte(spec)); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to fail with %q, got %v", spec, problem, err)
+		}
+	}
+}
+
+func TestNetemQdisc(t *testing.T) {
+	netem := Netem{Delay: 40 * time.Millisecond, Jitter: 5 * time.Millisecond, Distribution: "pareto", Loss: 2, ECN: true, Rate: 40 * Gbit}
+	obj := tc.Object{
+		Msg:       tc.Msg{Ifindex: 3, Handle: core.BuildHandle(1, 0), Parent: tc.HandleRoot},
+		Attribute: netem.attribute(),
+	}
+	obj.Stab = &tc.Stab{Base: &tc.SizeSpec{Overhead: 18, LinkLayer: linkLayerEthernet}}
+	desired := NewNodeWithObject("qdisc", obj)
+	if q := obj.Netem.Qopt; q.Latency != 625000 || q.Limit != 1000 || q.Loss != netemPercent(2) || obj.Netem.Rate64 == nil || obj.Netem.Rate.Rate != 1<<32-1 {
+		t.Errorf("unexpected netem options %+v", obj.Netem)
+	}
+
+	data, err := marshalNetemQdisc(obj, desired.Loss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := unmarshalQdisc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !desired.equalNode(*live) {
+		t.Errorf("expected the qdisc to read back equal, got %+v", live.Object.Netem)
+	}
+	// the kernel leaves out the 64 bit delay and jitter when they are a whole number of ticks
+	dumped := *live.Object.Netem
+	dumped.Latency64, dumped.Jitter64 = nil, nil
+	kernel := *live
+	kernel.Object.Netem = &dumped
+	if !desired.equalNode(kernel) {
+		t.Errorf("expected the qdisc without 64 bit delays to equal, got %+v", dumped)
+	}
+	dumped.Qopt.Jitter /= 2
+	if desired.equalNode(kernel) {
+		t.Error("expected a changed jitter to differ")
+	}
+
+	// the loss model is kept next to the qdisc
+	netem.Loss, netem.GilbertElliott = 0, &GilbertElliott{P: 2, R: 20}
+	desired.Object.Attribute = netem.attribute()
+	desired.Object.Stab = obj.Stab
+	if desired.equalNode(*live) {
+		t.Errorf("expected the random loss to differ from the gilbert-elliott model")
+	}
+	desired.Loss = netem.GilbertElliott.model()
+	if data, err = marshalNetemQdisc(desired.Object, desired.Loss); err != nil {
+		t.Fatal(err)
+	}
+	if live, err = unmarshalQdisc(data); err != nil || !desired.equalNode(*live) || live.Loss == nil {
+		t.Fatalf("expected the gilbert-elliott model to read back equal, got %+v (%v)", live.Loss, err)
+	}
+	details := strings.Join(nodeDetails(live), ", ")
+	if !strings.HasPrefix(details, "delay 40ms 5ms loss gemodel 2% 20% 100% 0% ecn rate 40Gbit") {
+		t.Errorf("unexpected details %q", details)
+	}
+}
+
+func TestNetemLeaf(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	conf := Config{Simple: SimpleProfile{Low: SimpleClass{Qdisc: "netem delay 50ms loss gemodel 5% 50%"}}}
+	conf.Hosts = []HostPolicy{{Name: "lab", Match: mustHostMatch(t, "192.168.1.10"), Class: "low"}}
+	tcConf, err := createQoS(context.Background(), conf, "simple", interf, Gbit, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, _ := NodesFromConfig(tcConf)
+	// the netem leaf moves to the rest class and is given to the host
+	for _, name := range []string{"low/rest", "low/lab"} {
+		var leaf *Node
+		for _, n := range nodes {
+			if n.Type == "qdisc" && n.Name == name {
+				leaf = n
+			}
+		}
+		if leaf == nil || leaf.Object.Kind != "netem" || leaf.Loss == nil || leaf.Loss.P != netemPercent(5) {
+			t.Fatalf("expected %s to have a netem leaf with its loss model, got %+v", name, leaf)
+		}
+		if parent := tcConf.Classes[name]; parent.Kind != "hfsc" || leaf.Object.Parent != parent.Handle {
+			t.Errorf("expected the leaf of %s under its hfsc class", name)
+		}
+	}
+	if _, ok := tcConf.Netem["low"]; ok {
+		t.Errorf("expected the leaf of low to be moved")
+	}
+
+	// the conditions of a class are stepped through the query
+	query, _ := url.ParseQuery("low.netem=delay+20ms&low.netem.loss=1&low.netem.jitter=5ms&low.qdisc=")
+	if err := conf.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	if n := conf.Simple.Low.Netem; n == nil || n.Delay != 20*time.Millisecond || n.Jitter != 5*time.Millisecond || n.Loss != 1 {
+		t.Errorf("unexpected conditions %+v", n)
+	}
+	low := conf.Simple.Low.Netem
+	query, _ = url.ParseQuery("low.netem.loss=3")
+	if err := conf.ParseQuery(query); err != nil || low.Loss != 1 || conf.Simple.Low.Netem.Loss != 3 {
+		t.Errorf("expected the conditions to be changed on a copy, got %v", err)
+	}
+	query, _ = url.ParseQuery("low.netem=")
+	if conf.ParseQuery(query); conf.Simple.Low.Netem != nil {
+		t.Errorf("expected the conditions to be removed")
+	}
+
+	conf.Simple.Low = SimpleClass{Netem: &Netem{Delay: time.Millisecond}, Fairness: HostFairness}
+	if err := conf.Simple.withDefaults().Validate(); err == nil || !strings.Contains(err.Error(), "not netem") {
+		t.Errorf("expected host fairness to require cake, got %v", err)
+	}
+}
+
+func TestNetemProfile(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[netem]
+delay = "80ms"
+jitter = "10ms"
+distribution = "paretonormal"
+[netem.gilbertElliott]
+p = 1
+r = 25
+
+[simple.prio]
+netem = "delay 5ms"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Simple.Prio.Netem == nil || conf.Simple.Prio.Netem.Delay != 5*time.Millisecond {
+		t.Errorf("expected the conditions of prio in tc notation, got %+v", conf.Simple.Prio.Netem)
+	}
+
+	query, _ := url.ParseQuery("netem.loss=0&netem.duplicate=2")
+	if err := conf.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	conf.Hosts = []HostPolicy{{Name: "lab", Match: mustHostMatch(t, "192.168.1.10")}}
+	tree, _, err := DesiredTree(context.Background(), conf, "netem", interf, 50*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := tree.Tree
+	if root.Object.Kind != "netem" || len(root.Children) != 0 || root.Loss == nil || root.Loss.R != netemPercent(25) {
+		t.Fatalf("expected a netem root with the loss model, got %+v", root)
+	}
+	netem := netemFromAttribute(root.Object.Netem, root.Loss)
+	if netem.Rate != 50*Mbit || netem.Duplicate != 2 || netem.Distribution != "paretonormal" {
+		t.Errorf("expected the link to be limited to the speed, got %s", netem)
+	}
+
+	query, _ = url.ParseQuery("netem.ge.p=1&netem.loss=2")
+	if err := conf.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DesiredTree(context.Background(), conf, "netem", interf, 50*Mbit); err == nil {
+		t.Errorf("expected random loss and the gilbert-elliott model to be refused")
+	}
+	query, _ = url.ParseQuery("netem.ge=&netem.corrupt=x")
+	if err := conf.ParseQuery(query); err == nil || !strings.Contains(err.Error(), "netem.corrupt") {
+		t.Errorf("expected the corruption to be refused, got %v", err)
+	}
+}
+
+func TestTcScriptNetem(t *testing.T) {
+	script := `
+tc qdisc add dev eth0 root handle 1: hfsc default 10
+tc class add dev eth0 parent 1: classid 1:10 hfsc sc rate 10mbit ul rate 10mbit
+tc qdisc add dev eth0 parent 1:10 handle 10: netem delay 30ms loss gemodel 2% 30%
+`
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	leaf := conf.Qdiscs["10:0"]
+	if leaf.Kind != "netem" || leaf.Netem.Qopt.Latency != netemTicks(30*time.Millisecond) {
+		t.Errorf("expected a netem leaf, got %+v", leaf.Attribute)
+	}
+	if ge := conf.Netem["10:0"].GilbertElliott; ge == nil || ge.P != 2 || ge.R != 30 {
+		t.Errorf("expected the loss model of the leaf, got %+v", conf.Netem)
+	}
+}
@@ -5,14 +5,27 @@ import (
 	"reflect"
 
 	"github.com/florianl/go-tc"
+	"golang.org/x/sys/unix"
 )
 
 // Node holds a node of the TC tree style structure.
 type Node struct {
 	Type     string
+	Name     string
 	Parent   string
 	Object   tc.Object
 	Children []*Node
+	// Actions of a filter run after the actions of its object, they are declared in the traffic file
+	Actions []Action
+	// Loss is the loss model of a netem qdisc, which go-tc can not encode
+	Loss *GEModel
+	// Damping is the table a red or choke qdisc ages its average queue with, which go-tc can not
+	// encode
+	Damping []byte
+	// FlowerExtra holds the keys of a flower filter that go-tc can not encode
+	FlowerExtra *FlowerExtra
+	// Notes explain how the properties of the node were chosen
+	Notes []string
 }
 
 // NewNode creates a new node with the TC object embedded and sets the type of the node
@@ -34,6 +47,39 @@ func NewNodeWithObject(typ string, object tc.Object) *Node {
 	}
 }
 
+// NodesFromConfig creates the nodes for all objects in the config, named after their key in the
+// config. The qdiscs and classes are returned separately from the filters, as filters are not part
+// of the tree.
+func NodesFromConfig(conf TcConfig) (nodes, filters []*Node) {
+	for name, class := range conf.Classes {
+		n := NewNodeWithObject("class", class)
+		n.Name = name
+		n.Notes = conf.Curves[name].notes()
+		nodes = append(nodes, n)
+	}
+	for name, qdisc := range conf.Qdiscs {
+		n := NewNodeWithObject("qdisc", qdisc)
+		n.Name = name
+		if netem, ok := conf.Netem[name]; ok {
+			n.Loss = netem.GilbertElliott.model()
+		}
+		if red, ok := conf.Red[name]; ok {
+			n.Damping = red.stab()
+		}
+		nodes = append(nodes, n)
+	}
+	for name, filter := range conf.Filters {
+		n := NewNodeWithObject("filter", filter)
+		n.Name = name
+		n.Actions = conf.Actions[name]
+		if extra, ok := conf.FlowerExtra[name]; ok {
+			n.FlowerExtra = &extra
+		}
+		filters = append(filters, n)
+	}
+	return nodes, filters
+}
+
 // addNode add node n to the current node tr
 func (tr *Node) addChild(n *Node) {
 	tr.Children = append(tr.Children, n)
@@ -53,11 +99,20 @@ func (tr *Node) deleteChild(index int) error {
 	return nil
 }
 
-// isChild checks if the node n is a child of the current node
+// isChild checks if the node n is a child of the current node. The qdiscs of the TX queues of a
+// multiqueue qdisc are its children, as the classes of the queues are left out of the tree.
 func (tr Node) isChild(n Node) bool {
+	if tr.isMultiqueue() {
+		return n.Type == "qdisc" && isQueueClass(n.Object.Parent, tr.Object.Handle)
+	}
 	return n.Object.Msg.Parent == tr.Object.Handle
 }
 
+// isMultiqueue checks if the node is a qdisc that attaches a qdisc to every TX queue
+func (tr Node) isMultiqueue() bool {
+	return tr.Type == "qdisc" && isMultiqueue(tr.Object.Kind)
+}
+
 // isChildOf checks if the current node is a child of node n
 func (tr Node) isChildOf(n Node) bool {
 	return tr.Object.Msg.Parent == n.Object.Handle
@@ -83,13 +138,36 @@ func CompareSC(a, b tc.ServiceCurve) bool {
 }
 
 func (tr Node) equalProperties(n Node) bool {
+	if tr.Type == "qdisc" && !equalStab(tr.Object.Stab, n.Object.Stab) {
+		return false
+	}
 	switch tr.Object.Kind {
 	case "fq_codel":
-		return reflect.DeepEqual(tr.Object.FqCodel, n.Object.FqCodel)
+		return equalFqCodel(tr.Object.FqCodel, n.Object.FqCodel)
+	case "fq":
+		return equalFq(tr.Object.Fq, n.Object.Fq)
+	case "sfq":
+		return equalSfq(tr.Object.Sfq, n.Object.Sfq)
+	case "pfifo":
+		return equalFifo(tr.Object.Pfifo, n.Object.Pfifo)
+	case "bfifo":
+		return equalFifo(tr.Object.Bfifo, n.Object.Bfifo)
+	case "red", "choke":
+		return equalRed(redOf(tr.Object), redOf(n.Object))
+	case "cake":
+		return equalCake(tr.Object.Cake, n.Object.Cake)
+	case "netem":
+		return equalNetem(tr.Object.Netem, n.Object.Netem, tr.Loss, n.Loss)
+	case "mq":
+		return true
+	case "mqprio":
+		return reflect.DeepEqual(tr.Object.MqPrio, n.Object.MqPrio)
+	case "htb":
+		return equalHtb(tr.Object.Htb, n.Object.Htb)
 	case "hfsc":
 		switch {
 		case tr.Object.Hfsc != nil:
-			return reflect.DeepEqual(tr.Object.Hfsc, n.Object.Hfsc)
+			return equalHfsc(tr.Object.Hfsc, n.Object.Hfsc)
 		case tr.Object.HfscQOpt != nil:
 			return reflect.DeepEqual(tr.Object.HfscQOpt, n.Object.HfscQOpt)
 		}
@@ -97,6 +175,114 @@ func (tr Node) equalProperties(n Node) bool {
 	return false
 }
 
+// equalCake checks if the options set in a are the same in b. The kernel reports all options of a
+// cake qdisc, including the defaults.
+func equalCake(a, b *tc.Cake) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.BaseRate != nil && (b.BaseRate == nil || *a.BaseRate != *b.BaseRate) {
+		return false
+	}
+	return equalOption(a.DiffServMode, b.DiffServMode) && equalOption(a.FlowMode, b.FlowMode) &&
+		equalOption(a.Rtt, b.Rtt) && equalOption(a.Nat, b.Nat) && equalOption(a.Wash, b.Wash) &&
+		equalOption(a.Ingress, b.Ingress)
+}
+
+// equalHtb checks if the options of an HTB qdisc or class are the same in b. The kernel reports
+// more than was set, like the version of a qdisc, and calculates the quantum of a class without one.
+func equalHtb(a, b *tc.Htb) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	switch {
+	case a.Init != nil:
+		return b.Init != nil && a.Init.Defcls == b.Init.Defcls && equalOption(a.DirectQlen, b.DirectQlen)
+	case a.Parms != nil:
+		x, y := a.Parms, b.Parms
+		return y != nil && htbRate(x.Rate.Rate, a.Rate64) == htbRate(y.Rate.Rate, b.Rate64) &&
+			htbRate(x.Ceil.Rate, a.Ceil64) == htbRate(y.Ceil.Rate, b.Ceil64) &&
+			x.Buffer == y.Buffer && x.Cbuffer == y.Cbuffer && x.Prio == y.Prio &&
+			(x.Quantum == 0 || x.Quantum == y.Quantum)
+	}
+	return false
+}
+
+// equalHfsc checks if the curves of an HFSC class are the same in b. The kernel leaves the curves
+// without rate out, the desired classes have zero curves for those.
+func equalHfsc(a, b *tc.Hfsc) bool {
+	curves := func(h *tc.Hfsc) [3]tc.ServiceCurve {
+		var c [3]tc.ServiceCurve
+		if h == nil {
+			return c
+		}
+		for i, sc := range []*tc.ServiceCurve{h.Rsc, h.Fsc, h.Usc} {
+			if sc != nil && (sc.M1 != 0 || sc.M2 != 0) {
+				c[i] = *sc
+			}
+		}
+		return c
+	}
+	return curves(a) == curves(b)
+}
+
+// equalOption checks if option x is unset or the same as y
+func equalOption(x, y *uint32) bool {
+	return x == nil || (y != nil && *x == *y)
+}
+
+// equalFqCodel checks if the options set in a are the same in b. The kernel reports all options of
+// a fq_codel qdisc and keeps its times in units of 1024ns, which rounds them down.
+func equalFqCodel(a, b *tc.FqCodel) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	equalTime := func(x, y *uint32) bool {
+		return x == nil || (y != nil && (*x == *y || codelTime(*x) == *y))
+	}
+	return equalTime(a.Target, b.Target) && equalTime(a.Interval, b.Interval) &&
+		equalTime(a.CEThreshold, b.CEThreshold) && equalOption(a.Limit, b.Limit) &&
+		equalOption(a.ECN, b.ECN) && equalOption(a.Flows, b.Flows) && equalOption(a.Quantum, b.Quantum) &&
+		equalOption(a.DropBatchSize, b.DropBatchSize) && equalOption(a.MemoryLimit, b.MemoryLimit)
+}
+
+// codelTime returns a time in microseconds as the kernel reports it back from its codel time
+func codelTime(usec uint32) uint32 {
+	return uint32(uint64(usec) * 1000 >> 10 << 10 / 1000)
+}
+
+// equalFq checks if the options set in a are the same in b
+func equalFq(a, b *tc.Fq) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equalOption(a.PLimit, b.PLimit) && equalOption(a.FlowPLimit, b.FlowPLimit) &&
+		equalOption(a.Quantum, b.Quantum) && equalOption(a.InitQuantum, b.InitQuantum) &&
+		equalOption(a.RateEnable, b.RateEnable) && equalOption(a.FlowDefaultRate, b.FlowDefaultRate) &&
+		equalOption(a.FlowMaxRate, b.FlowMaxRate) && equalOption(a.BucketsLog, b.BucketsLog) &&
+		equalOption(a.FlowRefillDelay, b.FlowRefillDelay) && equalOption(a.OrphanMask, b.OrphanMask) &&
+		equalOption(a.LowRateThreshold, b.LowRateThreshold) && equalOption(a.CEThreshold, b.CEThreshold)
+}
+
+// equalSfq checks if the options set in a are the same in b, unset options are zero
+func equalSfq(a, b *tc.Sfq) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	equal := func(x, y uint32) bool {
+		return x == 0 || x == y
+	}
+	return equal(a.V0.Quantum, b.V0.Quantum) && equal(uint32(a.V0.PerturbPeriod), uint32(b.V0.PerturbPeriod)) &&
+		equal(a.V0.Limit, b.V0.Limit) && equal(a.V0.Divisor, b.V0.Divisor) && equal(a.V0.Flows, b.V0.Flows) &&
+		equal(a.Depth, b.Depth) && equal(a.Headdrop, b.Headdrop)
+}
+
+// equalFifo checks if the limit of a pfifo or bfifo qdisc is the same in b, without a limit it is
+// the length of the TX queue of the device
+func equalFifo(a, b *tc.FifoOpt) bool {
+	return a == nil || (b != nil && a.Limit == b.Limit)
+}
+
 // equalNode checks if the header and object of the nodes are the same
 // it ignores the children, these should be check sperately with the
 // equalChildren function
@@ -134,7 +320,7 @@ func (tr *Node) AddChildren(nodes []*Node) {
 
 // FindChildren looks for the children of a node in a set of TC objects. It returns a slice of the
 // children, the leftover nodes (nodes that are not children) and a boolean to indicate if the node
-// has children or not in the set.
+// has children or not in the set. The classes of the TX queues of a multiqueue qdisc are neither.
 func (tr *Node) FindChildren(nodes []*Node) (children []*Node, leftover []*Node, hasChild bool) {
 	var left []*Node
 	hasChild = false
@@ -144,6 +330,9 @@ func (tr *Node) FindChildren(nodes []*Node) (children []*Node, leftover []*Node,
 			children = append(children, v)
 			continue
 		}
+		if tr.isMultiqueue() && v.Type == "class" && isQueueClass(v.Object.Handle, tr.Object.Handle) {
+			continue
+		}
 		left = append(left, v)
 	}
 	return children, left, hasChild
@@ -168,8 +357,29 @@ func (tr *Node) ComposeChildren(nodes []*Node) (leftover []*Node) {
 // ApplyNode applies the tc object contained in the node with the replace function. If the object
 // does not exists, creates it
 func (tr *Node) ApplyNode(tcnl *tc.Tc) error {
+	if err := tr.applyObject(tcnl); err != nil {
+		return err
+	}
+	for _, v := range tr.Children {
+		if err := v.ApplyNode(tcnl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyObject applies the tc object of the node without its children
+func (tr *Node) applyObject(tcnl *tc.Tc) error {
 	switch tr.Type {
 	case "qdisc":
+		// go-tc can not encode the loss models of netem, the idle damping of red and choke, fifo
+		// qdiscs without a limit nor mq
+		if encodedQdisc(tr.Object.Kind) {
+			if err := replaceQdisc(tr); err != nil {
+				return fmt.Errorf("could not assign qdisc to %d: %v", tr.Object.Ifindex, err)
+			}
+			return nil
+		}
 		if err := tcnl.Qdisc().Replace(&tr.Object); err != nil {
 			return fmt.Errorf("could not assign qdisc to %d: %v", tr.Object.Ifindex, err)
 		}
@@ -178,17 +388,34 @@ func (tr *Node) ApplyNode(tcnl *tc.Tc) error {
 			return fmt.Errorf("could not assign class to %d: %v", tr.Object.Ifindex, err)
 		}
 	case "filter":
-		if err := tcnl.Filter().Replace(&tr.Object); err != nil {
+		obj := tr.Object
+		// bpf filters hold the name of their program, which is loaded right before it is attached
+		if obj.BPF != nil && obj.BPF.FD == nil {
+			fd, err := loadBPFFilter(obj.BPF)
+			if err != nil {
+				return fmt.Errorf("could not load the program of the filter on %d: %v", obj.Ifindex, err)
+			}
+			defer unix.Close(fd)
+			bpf := *obj.BPF
+			bpf.FD, bpf.Tag = uint32Ptr(uint32(fd)), nil
+			obj.BPF = &bpf
+		}
+		// go-tc can not encode the rate tables of police actions, pedit actions nor the IPv6 and
+		// connection tracking keys of flower filters
+		if policeOf(obj) != nil || len(tr.Actions) > 0 || tr.FlowerExtra != nil {
+			n := *tr
+			n.Object = obj
+			if err := replaceFilter(&n); err != nil {
+				return fmt.Errorf("could not assign filter to %d: %v", tr.Object.Ifindex, err)
+			}
+			return nil
+		}
+		if err := tcnl.Filter().Replace(&obj); err != nil {
 			return fmt.Errorf("could not assign filter to %d: %v", tr.Object.Ifindex, err)
 		}
 	default:
 		return fmt.Errorf("unkown TC object type")
 	}
-	for _, v := range tr.Children {
-		if err := v.ApplyNode(tcnl); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
@@ -199,7 +426,11 @@ func (tr *Node) DeleteNode(tcnl *tc.Tc) error {
 	}
 	switch tr.Type {
 	case "qdisc":
-		if err := tcnl.Qdisc().Delete(&tr.Object); err != nil {
+		del := tcnl.Qdisc().Delete
+		if encodedQdisc(tr.Object.Kind) {
+			del = deleteQdisc
+		}
+		if err := del(&tr.Object); err != nil {
 			return fmt.Errorf("could not delete qdisc from %d: %v", tr.Object.Ifindex, err)
 		}
 	case "class":
@@ -219,7 +450,7 @@ func (tr *Node) DeleteNode(tcnl *tc.Tc) error {
 			return fmt.Errorf("could not delete class from %d: %v", tr.Object.Ifindex, err)
 		}
 	case "filter":
-		if err := tcnl.Filter().Delete(&tr.Object); err != nil {
+		if err := deleteFilter(nil, tr.Object.Msg, tr.Object.Kind); err != nil {
 			return fmt.Errorf("could not delete filter from %d: %v", tr.Object.Ifindex, err)
 		}
 	default:
@@ -236,10 +467,11 @@ func (tr *Node) FindPeer(child, n *Node) (*Node, bool) {
 	return nil, false
 }
 
-// FindRootNode finds the TC object with a root handle from a set of TC objects
+// FindRootNode finds the qdisc with a root handle from a set of TC objects. The classes of
+// multiqueue qdiscs report the root as their parent as well.
 func FindRootNode(nodes []*Node) (n *Node, index int) {
 	for i, v := range nodes {
-		if v.Object.Msg.Parent == tc.HandleRoot {
+		if v.Type != "class" && v.Object.Msg.Parent == tc.HandleRoot {
 			return v, i
 		}
 	}
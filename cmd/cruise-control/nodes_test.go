@@ -2,9 +2,11 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 )
 
@@ -296,3 +298,83 @@ func TestCompare(t *testing.T) {
 		}
 	})
 }
+
+func TestEqualCake(t *testing.T) {
+	desired, _ := leafQdisc("cake dual-srchost nat")
+	// the kernel reports the defaults of the options that were not set
+	live, _ := leafQdisc("cake dual-srchost nat diffserv3 rtt 100ms unlimited")
+	if !equalCake(desired.Cake, live.Cake) {
+		t.Error("expected the live qdisc to match the options that were set")
+	}
+	live, _ = leafQdisc("cake dual-dsthost nat diffserv3")
+	if equalCake(desired.Cake, live.Cake) {
+		t.Error("expected a different flow mode to be reported")
+	}
+}
+
+func TestEqualLeafs(t *testing.T) {
+	for _, c := range []struct {
+		desired, live string
+		equal         bool
+	}{
+		// the kernel reports the times of fq_codel rounded down to its codel time
+		{"", "fq_codel limit 1200 flows 65535 target 4999us interval 99999us noecn quantum 1514", true},
+		{"", "fq_codel limit 1200 flows 65535 target 5ms ecn", false},
+		{"fq_codel ecn ce_threshold 2ms memory_limit 4m", "fq_codel ecn ce_threshold 1999us memory_limit 4m target 4999us", true},
+		{"fq_codel ecn ce_threshold 2ms", "fq_codel ecn ce_threshold 3ms", false},
+		{"fq maxrate 10mbit nopacing buckets 1024", "fq limit 10000 flow_limit 100 maxrate 10mbit nopacing buckets 1024", true},
+		{"fq maxrate 10mbit", "fq maxrate 20mbit", false},
+		{"fq pacing", "fq nopacing", false},
+		{"sfq perturb 10 headdrop", "sfq perturb 10 headdrop limit 127 quantum 1514 divisor 1024", true},
+		{"sfq perturb 10", "sfq perturb 5", false},
+		{"pfifo", "pfifo limit 1000", true},
+		{"pfifo limit 100", "pfifo limit 1000", false},
+		{"bfifo limit 64k", "bfifo limit 65536", true},
+		{"red limit 400000 avpkt 1000", "red limit 400000 avpkt 1000 probability 0.02", true},
+		{"red limit 400000 avpkt 1000", "red limit 400000 avpkt 1000 ecn", false},
+		{"choke limit 1000 bandwidth 10mbit", "choke limit 1000 bandwidth 10mbit min 100", false},
+	} {
+		desired, err := leafQdisc(c.desired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live, err := leafQdisc(c.live)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, l := NewNodeWithObject("qdisc", tc.Object{Attribute: desired}), NewNodeWithObject("qdisc", tc.Object{Attribute: live})
+		if d.equalProperties(*l) != c.equal {
+			t.Errorf("expected %q and %q to be equal: %v", c.desired, c.live, c.equal)
+		}
+	}
+
+	// recent kernels report options of fq go-tc does not know, those are decoded here
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(tcaFqPLimit, 10000)
+	ae.Uint32(7, 1250000)
+	ae.Uint32(14, 10000000)
+	options, _ := ae.Encode()
+	data, err := marshalQdisc(tc.Object{Attribute: tc.Attribute{Kind: "fq"}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := unmarshalQdisc(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, _ := leafQdisc("fq limit 10000 maxrate 10mbit")
+	if !equalFq(desired.Fq, live.Object.Fq) {
+		t.Errorf("expected the decoded fq qdisc to match, got %+v", live.Object.Fq)
+	}
+	data, _ = marshalQdisc(tc.Object{Attribute: tc.Attribute{Kind: "bfifo"}}, marshalStruct(tc.FifoOpt{Limit: 65536}))
+	if live, err = unmarshalQdisc(data); err != nil || live.Object.Bfifo == nil || live.Object.Bfifo.Limit != 65536 {
+		t.Errorf("expected a bfifo qdisc with a limit of 64k, got %+v (%v)", live.Object.Bfifo, err)
+	}
+
+	if _, err := leafQdisc("tbf rate 1mbit"); err == nil || !strings.Contains(err.Error(), "unsupported leaf qdisc") {
+		t.Errorf("expected tbf to be refused as leaf, got %v", err)
+	}
+	if _, err := leafQdisc("pfifo quantum 1"); err == nil || !strings.Contains(err.Error(), "unsupported pfifo option") {
+		t.Errorf("expected an unknown pfifo option to fail, got %v", err)
+	}
+}
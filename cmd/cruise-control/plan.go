@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/florianl/go-tc"
+)
+
+// PlanAction is what a plan does with a node of the live tree
+type PlanAction string
+
+const (
+	// PlanAdd adds a desired node that is not configured on the system
+	PlanAdd PlanAction = "add"
+	// PlanChange replaces a node that is configured with different properties than desired
+	PlanChange PlanAction = "change"
+	// PlanDelete removes a node that is configured on the system, but is not desired
+	PlanDelete PlanAction = "delete"
+)
+
+// PlanStep is a single change of a plan
+type PlanStep struct {
+	Action PlanAction
+	Node   *Node
+}
+
+// Plan describes the changes that bring the live tree of an interface to the desired tree
+type Plan struct {
+	Steps   []PlanStep
+	Desired *Node
+	// Filters are the changes of the filters, they are listed after the qdiscs and classes
+	Filters []PlanStep
+}
+
+// BuildPlan compares the desired tree with the live tree and lists the changes that are needed.
+// Parents are added before their children, while deleted nodes are listed as they appear in the
+// live tree.
+func BuildPlan(desired, live *Node) Plan {
+	plan := Plan{Desired: desired}
+	drift := DiffTrees(desired, live)
+	if desired != nil {
+		desired.Walk(func(n *Node, _ int) {
+			switch drift[nodeKey(n)] {
+			case DriftMissing:
+				plan.Steps = append(plan.Steps, PlanStep{Action: PlanAdd, Node: n})
+			case DriftChanged:
+				plan.Steps = append(plan.Steps, PlanStep{Action: PlanChange, Node: n})
+			}
+		})
+	}
+	if live != nil {
+		live.Walk(func(n *Node, _ int) {
+			if drift[nodeKey(n)] == DriftExtra {
+				plan.Steps = append(plan.Steps, PlanStep{Action: PlanDelete, Node: n})
+			}
+		})
+	}
+	return plan
+}
+
+// applyPlan brings the live tree and filters of an interface to the desired ones by only touching
+// what differs. Qdiscs and classes are added and changed parents first, then the filters are
+// updated, so the nodes that are deleted afterwards are no longer referenced. Qdiscs the kernel
+// refuses, like the leaf qdisc of a class that only becomes a leaf class when its children are
+// deleted, are applied again at the end.
+func applyPlan(rtnl *tc.Tc, plan Plan, live *Node, filters, liveFilters []*Node) error {
+	liveNodes := make(map[string]*Node)
+	if live != nil {
+		live.Walk(func(n *Node, _ int) {
+			liveNodes[nodeKey(n)] = n
+		})
+	}
+	applied := make(map[*Node]bool)
+	deleted := make(map[*Node]bool)
+	var deferred []*Node
+	for _, step := range plan.Steps {
+		n := step.Node
+		if step.Action == PlanDelete || applied[n] {
+			continue
+		}
+		// replacing a qdisc with one of another kind or parent removes its classes, so they are
+		// applied with it
+		if peer, ok := liveNodes[nodeKey(n)]; ok && n.Type == "qdisc" && (peer.Object.Kind != n.Object.Kind || peer.Object.Parent != n.Object.Parent) {
+			n.Walk(func(c *Node, _ int) {
+				applied[c] = true
+			})
+			// the kernel does not change the kind of a qdisc that keeps its handle, it is deleted
+			// first
+			if peer.Object.Kind != n.Object.Kind {
+				if err := peer.DeleteNode(rtnl); err != nil {
+					return err
+				}
+				peer.Walk(func(c *Node, _ int) {
+					deleted[c] = true
+				})
+			}
+			if err := n.ApplyNode(rtnl); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := n.applyObject(rtnl); err != nil {
+			if n.Type != "qdisc" {
+				return err
+			}
+			deferred = append(deferred, n)
+		}
+	}
+
+	for _, l := range extraFilters(filters, liveFilters) {
+		if err := l.DeleteNode(rtnl); err != nil {
+			return err
+		}
+	}
+	for _, d := range filters {
+		current := false
+		for _, l := range liveFilters {
+			if sameFilter(d, l) && equalFilter(d, l) {
+				current = true
+				break
+			}
+		}
+		if !current {
+			// the kernel numbers the u32 filters of a priority itself and keeps the selector of a
+			// changed one, so a changed u32 filter is replaced by deleting it first
+			for _, l := range liveFilters {
+				if l.Object.Kind == "u32" && l.Object.U32 != nil && l.Object.U32.Sel != nil && sameFilter(d, l) {
+					if err := l.DeleteNode(rtnl); err != nil {
+						return err
+					}
+				}
+			}
+			if err := d.applyObject(rtnl); err != nil {
+				return err
+			}
+		}
+	}
+
+	// a qdisc that is added to a parent replaces the qdisc of the parent, which is gone already
+	grafted := make(map[uint32]bool)
+	for _, step := range plan.Steps {
+		if step.Action == PlanAdd && step.Node.Type == "qdisc" {
+			grafted[step.Node.Object.Parent] = true
+		}
+	}
+	for _, step := range plan.Steps {
+		if step.Action != PlanDelete || deleted[step.Node] {
+			continue
+		}
+		if step.Node.Type == "qdisc" && grafted[step.Node.Object.Parent] {
+			continue
+		}
+		// deleting a node deletes its children as well
+		step.Node.Walk(func(n *Node, _ int) {
+			deleted[n] = true
+		})
+		if err := step.Node.DeleteNode(rtnl); err != nil {
+			return err
+		}
+	}
+	for _, n := range deferred {
+		if err := n.applyObject(rtnl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extraFilters returns the live filters that are not desired. The filters of clsact hooks without
+// desired filters belong to other tools, they are left alone.
+func extraFilters(desired, live []*Node) (extra []*Node) {
+	for _, l := range live {
+		found, managed := false, !isClsactHook(l.Object.Parent)
+		for _, d := range desired {
+			if sameFilter(d, l) {
+				found = true
+				break
+			}
+			managed = managed || d.Object.Parent == l.Object.Parent
+		}
+		if !found && managed {
+			extra = append(extra, l)
+		}
+	}
+	return extra
+}
+
+// filterSteps lists the changes that bring the live filters to the desired filters
+func filterSteps(desired, live []*Node) []PlanStep {
+	var steps []PlanStep
+	for _, f := range missingFilters(desired, live) {
+		steps = append(steps, PlanStep{Action: PlanAdd, Node: f})
+	}
+	for _, f := range changedFilters(desired, live) {
+		steps = append(steps, PlanStep{Action: PlanChange, Node: f})
+	}
+	for _, f := range extraFilters(desired, live) {
+		steps = append(steps, PlanStep{Action: PlanDelete, Node: f})
+	}
+	return steps
+}
+
+// sameFilter reports whether the live filter l is the desired filter d. Filters are identified by
+// their kind, parent, priority and protocol. A filter without priority gets one from the kernel, it
+// is identified by the class it classifies into instead.
+func sameFilter(d, l *Node) bool {
+	if d.Object.Kind != l.Object.Kind || d.Object.Parent != l.Object.Parent {
+		return false
+	}
+	prio, protocol := splitInfo(d.Object.Info)
+	livePrio, liveProtocol := splitInfo(l.Object.Info)
+	if protocol != liveProtocol {
+		return false
+	}
+	if prio == 0 {
+		target, ok := filterTarget(d)
+		liveTarget, liveOk := filterTarget(l)
+		return ok == liveOk && target == liveTarget
+	}
+	return prio == livePrio
+}
+
+// equalFilter reports whether the live filter l classifies like the desired filter d
+func equalFilter(d, l *Node) bool {
+	target, ok := filterTarget(d)
+	liveTarget, liveOk := filterTarget(l)
+	if ok != liveOk || target != liveTarget || !equalActions(filterActions(d), filterActions(l)) {
+		return false
+	}
+	if u32 := d.Object.U32; u32 != nil && u32.Sel != nil {
+		if l.Object.U32 == nil || l.Object.U32.Sel == nil || len(u32.Sel.Keys) != len(l.Object.U32.Sel.Keys) {
+			return false
+		}
+		for i, key := range u32.Sel.Keys {
+			liveKey := l.Object.U32.Sel.Keys[i]
+			if key.Val != liveKey.Val || key.Mask != liveKey.Mask || key.Off != liveKey.Off {
+				return false
+			}
+		}
+	}
+	if d.Object.Flower != nil {
+		return l.Object.Flower != nil && equalFlower(d.Object.Flower, l.Object.Flower) && flowerExtraOf(d) == flowerExtraOf(l)
+	}
+	if d.Object.BPF != nil {
+		return equalBPF(d.Object.BPF, l.Object.BPF)
+	}
+	if police := policeOf(d.Object); police != nil {
+		return equalPolice(police, policeOf(l.Object))
+	}
+	return true
+}
+
+var planSymbols = map[PlanAction]string{PlanAdd: "+", PlanChange: "~", PlanDelete: "-"}
+
+// String renders the step as a single line, eg. "+ add hfsc class 1:21 prio [sc m2 4Mbit]" or
+// "~ change u32 prio 0 mark 0x1/0xf pedit dscp 46"
+func (s PlanStep) String() string {
+	if s.Node.Type == "filter" {
+		return fmt.Sprintf("%s %s %s", planSymbols[s.Action], s.Action, filterLabel(s.Node))
+	}
+	line := fmt.Sprintf("%s %s %s", planSymbols[s.Action], s.Action, nodeTitle(s.Node))
+	if details := nodeDetails(s.Node); len(details) > 0 {
+		line += " [" + strings.Join(details, ", ") + "]"
+	}
+	return line
+}
+
+// Write renders the plan, followed by the explanation of the curves of the desired tree
+func (p Plan) Write(w io.Writer) error {
+	var b strings.Builder
+	if len(p.Steps) == 0 && len(p.Filters) == 0 {
+		b.WriteString("no changes, the live tree matches the desired tree\n")
+	}
+	for _, steps := range [][]PlanStep{p.Steps, p.Filters} {
+		for _, step := range steps {
+			b.WriteString(step.String() + "\n")
+		}
+	}
+
+	header := false
+	var notes func(n *Node)
+	notes = func(n *Node) {
+		if len(n.Notes) > 0 {
+			if !header {
+				b.WriteString("\ncurves:\n")
+				header = true
+			}
+			b.WriteString("  " + nodeTitle(n) + "\n")
+			for _, note := range n.Notes {
+				b.WriteString("    " + note + "\n")
+			}
+		}
+		for _, child := range sortedChildren(n) {
+			notes(child)
+		}
+	}
+	if p.Desired != nil {
+		notes(p.Desired)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// PlanFor builds the plan for the interface, profile and speed of opts
+func PlanFor(ctx context.Context, conf Config, opts TreeOptions) (Plan, error) {
+	interf, err := net.InterfaceByName(opts.Interface)
+	if err != nil {
+		return Plan{}, err
+	}
+	result, filters, err := DesiredTree(ctx, conf, opts.Profile, *interf, opts.Speed)
+	if err != nil {
+		return Plan{}, err
+	}
+	rtnl, err := OpenTc()
+	if err != nil {
+		return Plan{}, err
+	}
+	defer rtnl.Close()
+	live, liveFilters := LiveTree(rtnl, *interf)
+	plan := BuildPlan(result.Tree, live)
+	plan.Filters = filterSteps(filters, liveFilters)
+	return plan, nil
+}
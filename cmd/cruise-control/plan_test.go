@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCurveForLatency(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   LatencyTarget
+		expected Curve
+	}{
+		// 1500b at 1mbit takes 12ms, which misses the 10ms target
+		{"Concave", LatencyTarget{1500, 10 * time.Millisecond, Mbit}, Curve{M1: 1200 * Kbit, D: 10 * time.Millisecond, M2: Mbit}},
+		// 1500b at 2mbit takes 6ms, so the service can be delayed by 4ms
+		{"Convex", LatencyTarget{1500, 10 * time.Millisecond, 2 * Mbit}, Curve{D: 4 * time.Millisecond, M2: 2 * Mbit}},
+		{"Linear", LatencyTarget{Rate: 2 * Mbit}, Curve{M2: 2 * Mbit}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := CurveForLatency(tt.target)
+			if c.M1 != tt.expected.M1 || c.D != tt.expected.D || c.M2 != tt.expected.M2 {
+				t.Errorf("expected %+v, got %+v", tt.expected, c)
+			}
+			if c.Target != tt.target {
+				t.Errorf("expected the curve to keep its target, got %+v", c.Target)
+			}
+		})
+	}
+}
+
+func TestCurveText(t *testing.T) {
+	for text, explanation := range map[string]string{
+		"umax 1500b dmax 10ms rate 1mbit": "1500b takes 12ms at 1Mbit, which misses dmax, so the curve is concave with m1 1.2Mbit for 10ms",
+		"umax 1500b dmax 10ms rate 2mbit": "1500b takes 6ms at 2Mbit, which meets dmax, so the curve is convex and delays the service by up to 4ms",
+		"m1 10mbit d 20ms m2 5mbit":       "concave curve, bursts of 25000b are served within 20ms",
+		"m2 5mbit":                        "linear curve",
+	} {
+		var c Curve
+		if err := c.UnmarshalText([]byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(c.Explain(), explanation) {
+			t.Errorf("expected the explanation of %q to contain %q, got %q", text, explanation, c.Explain())
+		}
+		var parsed Curve
+		if err := parsed.UnmarshalText([]byte(c.String())); err != nil || parsed != c {
+			t.Errorf("expected %q to parse back into %+v, got %+v (%v)", c.String(), c, parsed, err)
+		}
+	}
+	for _, text := range []string{"m2", "umax 1500b rate 1mbit", "m2 1mbit rate 1mbit", "m2 1mbit fast"} {
+		var c Curve
+		if err := c.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("expected %q to fail", text)
+		}
+	}
+}
+
+func TestApplyCurves(t *testing.T) {
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, SimpleProfile{})
+	target := CurveForLatency(LatencyTarget{Umax: 1500, Dmax: 5 * time.Millisecond, Rate: Mbit})
+	conf.Curves = map[string]ClassCurves{"prio": {RT: &target}}
+	if err := conf.applyCurves(); err != nil {
+		t.Fatal(err)
+	}
+	if rsc := conf.Classes["prio"].Hfsc.Rsc; rsc.M1 != 300000 || rsc.D != 5000 || rsc.M2 != 125000 {
+		t.Errorf("expected the rt curve to follow the latency target, got %+v", *rsc)
+	}
+
+	conf.Curves = map[string]ClassCurves{"missing": {RT: &target}}
+	if err := conf.applyCurves(); err == nil {
+		t.Error("expected curves for an unknown class to fail")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0"}
+	conf := Config{Simple: SimpleProfile{Latency: true}}
+	desired, _, err := DesiredTree(context.Background(), conf, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, _, err := DesiredTree(context.Background(), conf, "simple", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := BuildPlan(desired.Tree, live.Tree); len(plan.Steps) != 0 {
+		t.Errorf("expected no changes, got %+v", plan.Steps)
+	}
+
+	live.Tree.Walk(func(n *Node, _ int) {
+		switch {
+		case n.Type == "class" && n.Name == "low":
+			n.Object.Hfsc.Rsc.M2 = 1
+		case n.Type == "class" && n.Name == "prio":
+			n.Children = nil
+		}
+	})
+	extra := NewNode("qdisc")
+	extra.Object.Handle = 0x99 << 16
+	extra.Object.Kind = "sfq"
+	live.Tree.Children = append(live.Tree.Children, extra)
+
+	plan := BuildPlan(desired.Tree, live.Tree)
+	var b bytes.Buffer
+	if err := plan.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"+ add fq_codel qdisc 21:0 prio",
+		"~ change hfsc class 1:23 low",
+		"- delete sfq qdisc 99:0",
+		"curves:\n  hfsc class 1:21 prio\n    rt rate 38Mbit: linear curve without latency target",
+		"rt umax 1500b dmax 60ms rate 38Mbit: 1500b takes 316µs at 38Mbit, which meets dmax, so the curve is convex and delays the service by up to 59.685ms before m2 38Mbit",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestPlanHtb(t *testing.T) {
+	script := `
+tc qdisc add dev eth0 root handle 1: htb default 20
+tc class add dev eth0 parent 1: classid 1:1 htb rate 100mbit
+tc class add dev eth0 parent 1:1 classid 1:10 htb rate 40mbit ceil 100mbit prio 1
+tc class add dev eth0 parent 1:1 classid 1:20 htb rate 60mbit ceil 100mbit prio 2 quantum 3000
+`
+	tree := func() *Node {
+		configs, err := ParseTcScript(strings.NewReader(script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, _ := NodesFromConfig(configs["eth0"])
+		return ComposeTree(nodes).Tree
+	}
+	desired, live := tree(), tree()
+	// the kernel reports the quantum it calculated and the packets sent without a class
+	live.Walk(func(n *Node, _ int) {
+		switch {
+		case n.Object.Htb.Init != nil:
+			n.Object.Htb.Init.DirectPkts = 12
+		case n.Object.Htb.Parms.Quantum == 0:
+			n.Object.Htb.Parms.Quantum = 50000
+		}
+	})
+	if plan := BuildPlan(desired, live); len(plan.Steps) != 0 {
+		t.Errorf("expected no changes, got %+v", plan.Steps)
+	}
+
+	live.Walk(func(n *Node, _ int) {
+		switch n.Object.Handle {
+		case 1 << 16:
+			n.Object.Htb.Init.Defcls = 0x10
+		case 1<<16 | 0x10:
+			n.Object.Htb.Parms.Ceil.Rate /= 2
+		case 1<<16 | 0x20:
+			n.Object.Htb.Parms.Quantum = 1500
+		}
+	})
+	plan := BuildPlan(desired, live)
+	var b bytes.Buffer
+	if err := plan.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"~ change htb qdisc 1:0", "~ change htb class 1:10", "~ change htb class 1:20"} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("expected the plan to contain %q, got:\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "class 1:1 ") {
+		t.Errorf("expected the unchanged class 1:1 to be left alone, got:\n%s", b.String())
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// IngressMode is how the download speed of an interface is enforced
+type IngressMode string
+
+const (
+	// IngressShape redirects the ingress traffic to an IFB device and shapes it with the profile
+	IngressShape IngressMode = "shape"
+	// IngressPolice drops the ingress traffic above the download speed with police actions on the
+	// interface itself. It needs no IFB device and little CPU, but it does not queue traffic.
+	IngressPolice IngressMode = "police"
+)
+
+// UnmarshalText validates the ingress mode when it is read from the config
+func (m *IngressMode) UnmarshalText(text []byte) error {
+	switch mode := IngressMode(text); mode {
+	case "":
+		*m = IngressShape
+	case IngressShape, IngressPolice:
+		*m = mode
+	default:
+		return fmt.Errorf("unknown ingress mode %q, expected %q or %q", text, IngressShape, IngressPolice)
+	}
+	return nil
+}
+
+// Policer limits the ingress traffic that matches an address with a police action
+type Policer struct {
+	Name string
+	// Match is the address the traffic comes from, or the address it is sent to with Destination.
+	// A policer without address limits all traffic.
+	Match       HostMatch
+	Destination bool `json:",omitempty"`
+	Rate        Rate
+	// Burst is the size of the bucket, eg. "256k". It is 10ms of the rate by default, but at least
+	// 64k, as packets merged by GRO that do not fit the bucket are always dropped.
+	Burst string `json:",omitempty"`
+	// Conform and Exceed are the actions for the traffic within and above the rate: "ok",
+	// "continue", "drop", "pipe" or "reclassify". Traffic within the rate continues to the next
+	// policer and the traffic above it is dropped by default.
+	Conform string `json:",omitempty"`
+	Exceed  string `json:",omitempty"`
+}
+
+const (
+	// policePrioBase is the priority of the filter of the first policer, they come after the bpf
+	// filters of the classifiers
+	policePrioBase = 0xb000
+	// policeMTU is the largest packet a policer passes, the size of the packets merged by GRO
+	policeMTU = 0xffff
+	// policeBurstTime is the default burst of a policer at its rate
+	policeBurstTime = 10 * time.Millisecond
+	// actUnspec is TC_ACT_UNSPEC, which continues with the next filter
+	actUnspec = math.MaxUint32
+)
+
+// policers returns the policers of the ingress traffic of an interface in the police mode. The
+// download speed limits all traffic, after the policers of the interface.
+func (ic InterfaceConfig) policers() []Policer {
+	policers := append([]Policer(nil), ic.Police...)
+	if ic.DownloadSpeed != 0 {
+		policers = append(policers, Policer{Name: "download", Rate: ic.DownloadSpeed, Conform: "ok"})
+	}
+	return policers
+}
+
+// police returns the police action of the policer
+func (p Policer) police() (*tc.Police, error) {
+	rate, rate64 := p.Rate.rate64()
+	switch {
+	case p.Rate == 0:
+		return nil, errors.New("no rate")
+	case rate64 != nil:
+		return nil, fmt.Errorf("rate %s is too large to police", p.Rate)
+	}
+	burst := uint32(p.Rate.BytesPerSecond() * uint64(policeBurstTime) / uint64(time.Second))
+	if burst < policeMTU {
+		burst = policeMTU
+	}
+	if p.Burst != "" {
+		size, err := parseTcSize(p.Burst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid burst %q: %v", p.Burst, err)
+		}
+		burst = size
+	}
+	conform, exceed := "continue", "drop"
+	if p.Conform != "" {
+		conform = p.Conform
+	}
+	if p.Exceed != "" {
+		exceed = p.Exceed
+	}
+	result, ok := actionControls[conform]
+	if !ok {
+		return nil, fmt.Errorf("unknown conform action %q", conform)
+	}
+	action, ok := actionControls[exceed]
+	if !ok {
+		return nil, fmt.Errorf("unknown exceed action %q", exceed)
+	}
+	return &tc.Police{
+		Tbf: &tc.Policy{
+			Action: tc.PolicyAction(action),
+			Burst:  xmitTime(p.Rate, burst),
+			Mtu:    policeMTU,
+			Rate: tc.RateSpec{
+				CellLog:   rateCellLog(policeMTU),
+				Linklayer: linkLayerEthernet,
+				Rate:      rate,
+			},
+		},
+		Result: &result,
+	}, nil
+}
+
+// policeFilters returns the filters of the policers of an interface on its ingress hook, in the
+// order of the policers. Policers with an address use a u32 filter, the others a matchall filter.
+func policeFilters(ifindex uint32, policers []Policer) ([]*Node, error) {
+	hook := tc.Object{Msg: tc.Msg{Ifindex: ifindex, Handle: clsactIngress}}
+	var filters []*Node
+	for i, p := range policers {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		police, err := p.police()
+		if err != nil {
+			return nil, fmt.Errorf("policer %s: %v", name, err)
+		}
+		actions := []*tc.Action{{Kind: "police", Police: police}}
+		prio := uint32(policePrioBase + i)
+		if p.Match.IsZero() {
+			filters = append(filters, NewNodeWithObject("filter", tc.Object{
+				Msg: tc.Msg{
+					Family:  unix.AF_UNSPEC,
+					Ifindex: ifindex,
+					Parent:  clsactIngress,
+					Handle:  1,
+					Info:    core.BuildHandle(prio, uint32(htons(unix.ETH_P_ALL))),
+				},
+				Attribute: tc.Attribute{
+					Kind:     "matchall",
+					Matchall: &tc.Matchall{Actions: &actions},
+				},
+			}))
+			continue
+		}
+		obj, err := hostFilter(hook, p.Match, p.Destination, 0, prio)
+		if err != nil {
+			return nil, fmt.Errorf("policer %s: %v", name, err)
+		}
+		obj.U32.ClassID, obj.U32.Actions = nil, &actions
+		filters = append(filters, NewNodeWithObject("filter", obj))
+	}
+	return filters, nil
+}
+
+// policedOnly leaves out the live tree and the filters outside of the clsact hooks when an
+// interface is only policed, they belong to other tools
+func policedOnly(tree, live *Node, liveFilters []*Node) (*Node, []*Node) {
+	if tree != nil {
+		return live, liveFilters
+	}
+	var filters []*Node
+	for _, f := range liveFilters {
+		if isClsactHook(f.Object.Parent) {
+			filters = append(filters, f)
+		}
+	}
+	return nil, filters
+}
+
+// policeOf returns the police action of a filter
+func policeOf(obj tc.Object) *tc.Police {
+	var actions *[]*tc.Action
+	switch {
+	case obj.Matchall != nil:
+		actions = obj.Matchall.Actions
+	case obj.U32 != nil:
+		actions = obj.U32.Actions
+	}
+	if actions == nil {
+		return nil
+	}
+	for _, a := range *actions {
+		if a.Kind == "police" && a.Police != nil {
+			return a.Police
+		}
+	}
+	return nil
+}
+
+// equalPolice compares the parameters of a desired police action with a live one. The kernel only
+// reports the conform action when it is not "ok".
+func equalPolice(d, l *tc.Police) bool {
+	if l == nil || l.Tbf == nil || d.Tbf == nil {
+		return false
+	}
+	result := func(p *tc.Police) uint32 {
+		if p.Result == nil {
+			return tc.ActOk
+		}
+		return *p.Result
+	}
+	return d.Tbf.Rate.Rate == l.Tbf.Rate.Rate && d.Tbf.Burst == l.Tbf.Burst && d.Tbf.Mtu == l.Tbf.Mtu &&
+		d.Tbf.Action == l.Tbf.Action && result(d) == result(l)
+}
+
+// policeLabel describes a police action, eg. "police 100Mbit burst 125000b conform ok exceed drop"
+func policeLabel(p *tc.Police) string {
+	if p.Tbf == nil {
+		return "police"
+	}
+	rate := RateFromBytes(uint64(p.Tbf.Rate.Rate))
+	burst := math.Round(float64(p.Tbf.Burst) / ticksPerUsec * float64(p.Tbf.Rate.Rate) / 1e6)
+	result := uint32(tc.ActOk)
+	if p.Result != nil {
+		result = *p.Result
+	}
+	return fmt.Sprintf("police %s burst %.0fb conform %s exceed %s", rate, burst,
+		controlName(result), controlName(uint32(p.Tbf.Action)))
+}
+
+// rateCellLog is the cell log of the rate table of a maximum packet size, like tc_calc_rtable in
+// iproute2
+func rateCellLog(mtu uint32) uint8 {
+	var cellLog uint8
+	for mtu>>cellLog > 255 {
+		cellLog++
+	}
+	return cellLog
+}
+
+// rateTable is the transmission time of packets in the 256 cells of a rate table, in psched ticks
+func rateTable(spec tc.RateSpec) []byte {
+	table := make([]byte, tcRtabSize)
+	rate := RateFromBytes(uint64(spec.Rate))
+	for i := 0; i < tcRtabSize/4; i++ {
+		size := adjustSize(uint32(i+1)<<spec.CellLog, uint32(spec.Mpu), uint32(spec.Linklayer))
+		nlenc.NativeEndian().PutUint32(table[4*i:], xmitTime(rate, size))
+	}
+	return table
+}
+
+// Attributes of police actions, from include/uapi/linux/tc_act/tc_police.h
+const (
+	tcaPoliceTbf    = 1
+	tcaPoliceRate   = 2
+	tcaPoliceResult = 5
+	tcRtabSize      = 1024
+)
+
+// marshalPoliceFilter encodes the tcmsg and the attributes of a matchall or u32 filter with police
+// actions
+func marshalPoliceFilter(obj tc.Object) ([]byte, error) {
+	var actions *[]*tc.Action
+	switch {
+	case obj.Matchall != nil:
+		actions = obj.Matchall.Actions
+	case obj.U32 != nil && obj.U32.Sel != nil:
+		actions = obj.U32.Actions
+	}
+	if actions == nil {
+		return nil, fmt.Errorf("%s filter without police action", obj.Kind)
+	}
+	return marshalFilter(obj, nil, marshalPoliceActions(*actions))
+}
+
+// marshalPoliceActions encodes a list of police actions with the rate tables of their rates
+func marshalPoliceActions(actions []*tc.Action) func(*netlink.AttributeEncoder) error {
+	return func(ae *netlink.AttributeEncoder) error {
+		for i, a := range actions {
+			if a.Kind != "police" || a.Police == nil || a.Police.Tbf == nil {
+				return fmt.Errorf("can not encode %s action", a.Kind)
+			}
+			police := a.Police
+			ae.Nested(uint16(i+1), func(ae *netlink.AttributeEncoder) error {
+				ae.String(tcaActKind, a.Kind)
+				ae.Nested(tcaActOptions, func(ae *netlink.AttributeEncoder) error {
+					var tbf bytes.Buffer
+					if err := binary.Write(&tbf, nlenc.NativeEndian(), police.Tbf); err != nil {
+						return err
+					}
+					ae.Bytes(tcaPoliceTbf, tbf.Bytes())
+					ae.Bytes(tcaPoliceRate, rateTable(police.Tbf.Rate))
+					if police.Result != nil {
+						ae.Uint32(tcaPoliceResult, *police.Result)
+					}
+					return nil
+				})
+				return nil
+			})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/spf13/viper"
+	"golang.org/x/sys/unix"
+)
+
+func TestPoliceConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[[interfaces]]
+name = "wan"
+direction = "both"
+ingressMode = "police"
+downloadSpeed = "200mbit"
+uploadSpeed = "20mbit"
+
+[[interfaces.police]]
+name = "guests"
+match = "192.168.2.0/24"
+destination = true
+rate = "10mbit"
+burst = "128k"
+
+[[interfaces]]
+name = "lte"
+direction = "ingress"
+ingressMode = "police"
+downloadSpeed = "50mbit"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	interfaces := conf.ManagedInterfaces()
+	wan := interfaces[0].devices(conf)
+	if len(wan) != 1 || wan[0].Direction != Both || wan[0].Device != "wan" || wan[0].Profile.Speed != 20*Mbit {
+		t.Fatalf("expected the ingress of wan to be policed on the interface, got %+v", wan)
+	}
+	if police := wan[0].Profile.Police; len(police) != 2 || police[0].Name != "guests" || police[1].Rate != 200*Mbit {
+		t.Errorf("expected the guests policer and the download speed, got %+v", police)
+	}
+
+	lte := interfaces[1].devices(conf)
+	if len(lte) != 1 || lte[0].Direction != Ingress || lte[0].Device != "lte" || lte[0].Profile.Speed != 0 {
+		t.Fatalf("expected lte to be policed without a tree, got %+v", lte)
+	}
+	tree, filters, err := lte[0].Profile.desired(context.Background(), net.Interface{Name: "lte", Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree != nil || len(filters) != 1 || filters[0].Object.Kind != "matchall" || filters[0].Object.Ifindex != 3 {
+		t.Errorf("expected only the matchall filter of the download speed, got %v and %d filters", tree, len(filters))
+	}
+
+	if err := validateConfig(context.Background(), conf); err != nil {
+		t.Error(err)
+	}
+	conf.Interfaces[1].IngressMode = IngressShape
+	conf.Interfaces[1].Police = []Policer{{Rate: Mbit}}
+	if err := validateConfig(context.Background(), conf); err == nil || !strings.Contains(err.Error(), `lte: policers need the "police" ingress mode`) {
+		t.Errorf("expected the policers of the shape mode to be refused, got %v", err)
+	}
+
+	v.Set("interfaces", []map[string]interface{}{{"name": "eth0", "ingressMode": "drop"}})
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err == nil {
+		t.Error("expected an unknown ingress mode to fail")
+	}
+}
+
+func TestPoliceFilters(t *testing.T) {
+	guests, err := ParseHostMatch("2001:db8::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := policeFilters(2, []Policer{
+		{Name: "guests", Match: guests, Rate: 10 * Mbit, Burst: "256k", Exceed: "reclassify"},
+		{Name: "download", Rate: Gbit, Conform: "ok"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("expected 2 filters, got %d", len(filters))
+	}
+	u32, all := filters[0].Object, filters[1].Object
+	if prio, proto := splitInfo(u32.Info); u32.Kind != "u32" || prio != policePrioBase || proto != unix.ETH_P_IPV6 || u32.Parent != clsactIngress || u32.U32.ClassID != nil {
+		t.Errorf("unexpected guests filter %s", filterLabel(filters[0]))
+	}
+	if prio, proto := splitInfo(all.Info); all.Kind != "matchall" || prio != policePrioBase+1 || proto != unix.ETH_P_ALL {
+		t.Errorf("unexpected download filter %s", filterLabel(filters[1]))
+	}
+
+	police := policeOf(u32)
+	if police.Tbf.Rate.Rate != 1250000 || police.Tbf.Burst != xmitTime(10*Mbit, 256<<10) || police.Tbf.Rate.CellLog != 8 ||
+		police.Tbf.Action != tc.ActReclassify || *police.Result != actUnspec {
+		t.Errorf("unexpected guests police %+v", police.Tbf)
+	}
+	// 10ms at 1gbit is larger than the packets merged by GRO
+	if police := policeOf(all); police.Tbf.Burst != xmitTime(Gbit, 1250000) || *police.Result != tc.ActOk || police.Tbf.Action != tc.ActShot {
+		t.Errorf("unexpected download police %+v", police.Tbf)
+	}
+	if label := filterLabel(filters[1]); label != "matchall prio 45057 police 1Gbit burst 1250000b conform ok exceed drop" {
+		t.Errorf("unexpected label %q", label)
+	}
+	// at low rates the burst still fits a packet merged by GRO
+	if slow, _ := policeFilters(2, []Policer{{Rate: Mbit}}); policeOf(slow[0].Object).Tbf.Burst != xmitTime(Mbit, policeMTU) {
+		t.Errorf("expected the burst to fit %d bytes", policeMTU)
+	}
+
+	for _, c := range []struct {
+		policer Policer
+		problem string
+	}{
+		{Policer{Name: "idle"}, "policer idle: no rate"},
+		{Policer{Rate: 100 * Gbit}, "policer #1: rate 100Gbit is too large"},
+		{Policer{Rate: Mbit, Conform: "accept"}, `unknown conform action "accept"`},
+		{Policer{Rate: Mbit, Burst: "64q"}, `invalid burst "64q"`},
+	} {
+		if _, err := policeFilters(2, []Policer{c.policer}); err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("expected %q, got %v", c.problem, err)
+		}
+	}
+}
+
+func TestEqualPolice(t *testing.T) {
+	desired, err := policeFilters(2, []Policer{{Rate: 100 * Mbit, Conform: "ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kernel does not report the conform action "ok" and adds the time the action was used
+	live := func(change func(p *tc.Policy)) *Node {
+		tbf := *policeOf(desired[0].Object).Tbf
+		change(&tbf)
+		actions := []*tc.Action{{Kind: "police", Police: &tc.Police{Tbf: &tbf, Tm: &tc.Tcft{Install: 5}}}}
+		obj := desired[0].Object
+		obj.Matchall = &tc.Matchall{Actions: &actions}
+		return NewNodeWithObject("filter", obj)
+	}
+	if changed := changedFilters(desired, []*Node{live(func(*tc.Policy) {})}); len(changed) != 0 {
+		t.Errorf("expected the live police action to equal the desired one, got %d changes", len(changed))
+	}
+	for _, change := range []func(p *tc.Policy){
+		func(p *tc.Policy) { p.Rate.Rate /= 2 },
+		func(p *tc.Policy) { p.Burst *= 2 },
+		func(p *tc.Policy) { p.Action = tc.ActPipe },
+	} {
+		if changed := changedFilters(desired, []*Node{live(change)}); len(changed) != 1 {
+			t.Errorf("expected the changed police action to be reconciled, got %d changes", len(changed))
+		}
+	}
+
+	continued, _ := policeFilters(2, []Policer{{Rate: 100 * Mbit}})
+	if changed := changedFilters(continued, []*Node{live(func(*tc.Policy) {})}); len(changed) != 1 {
+		t.Error("expected the conform action to be compared")
+	}
+}
+
+func TestMarshalPoliceFilter(t *testing.T) {
+	host, _ := ParseHostMatch("10.1.2.3")
+	filters, err := policeFilters(2, []Policer{{Match: host, Rate: 8 * Mbit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := filters[0].Object
+	data, err := marshalPoliceFilter(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nlenc.NativeEndian().Uint32(data[4:]) != 2 || nlenc.NativeEndian().Uint32(data[12:]) != clsactIngress || nlenc.NativeEndian().Uint32(data[16:]) != obj.Info {
+		t.Errorf("unexpected tcmsg % x", data[:20])
+	}
+
+	var sel, tbf, rtab []byte
+	var result uint32
+	ad, err := netlink.NewAttributeDecoder(data[20:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kind string
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaKind:
+			kind = ad.String()
+		case tcaOptions:
+			ad.Nested(func(ad *netlink.AttributeDecoder) error {
+				for ad.Next() {
+					switch ad.Type() {
+					case tcaU32Sel:
+						sel = ad.Bytes()
+					case tcaU32Act:
+						ad.Nested(func(ad *netlink.AttributeDecoder) error {
+							ad.Next()
+							ad.Nested(func(ad *netlink.AttributeDecoder) error {
+								for ad.Next() {
+									if ad.Type() == tcaActOptions {
+										ad.Nested(func(ad *netlink.AttributeDecoder) error {
+											for ad.Next() {
+												switch ad.Type() {
+												case tcaPoliceTbf:
+													tbf = ad.Bytes()
+												case tcaPoliceRate:
+													rtab = ad.Bytes()
+												case tcaPoliceResult:
+													result = ad.Uint32()
+												}
+											}
+											return nil
+										})
+									}
+								}
+								return nil
+							})
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if kind != "u32" {
+		t.Errorf("unexpected kind %q", kind)
+	}
+	// struct tc_u32_sel is 16 bytes, followed by the key on the source address
+	if len(sel) != 32 || sel[2] != 1 || nlenc.NativeEndian().Uint32(sel[20:]) != htonl(0x0a010203) || nlenc.NativeEndian().Uint32(sel[24:]) != 12 {
+		t.Errorf("unexpected selector % x", sel)
+	}
+	// struct tc_police is 56 bytes, the rate table has 256 cells of 256 bytes at 1MB/s
+	if len(tbf) != 56 || nlenc.NativeEndian().Uint32(tbf[28:]) != 1000000 || nlenc.NativeEndian().Uint32(tbf[16:]) != policeMTU {
+		t.Errorf("unexpected police parameters % x", tbf)
+	}
+	if len(rtab) != tcRtabSize || nlenc.NativeEndian().Uint32(rtab) != xmitTime(8*Mbit, 256) || nlenc.NativeEndian().Uint32(rtab[1020:]) != xmitTime(8*Mbit, 256*256) {
+		t.Errorf("unexpected rate table of %d bytes", len(rtab))
+	}
+	if result != actUnspec {
+		t.Errorf("expected the conform action to continue, got %d", result)
+	}
+
+	obj.U32.Actions = nil
+	if _, err := marshalPoliceFilter(obj); err == nil {
+		t.Error("expected a filter without police action to be refused")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/florianl/go-tc"
+)
+
+// SimpleProfile holds the parameters of the simple profile. Unset parameters take the value of
+// DefaultSimpleProfile.
+type SimpleProfile struct {
+	// Headroom is the fraction of the internet speed that is shaped, the remainder keeps the queue
+	// of the modem empty
+	Headroom float64
+	// Latency builds the curves of the classes from latency targets: a full packet is sent within
+	// the delay of the class, while it gets its share. By default the class gets its share as m1
+	// of the curve, for the delay.
+	Latency bool
+	Prio    SimpleClass
+	Normal  SimpleClass
+	Low     SimpleClass
+
+	// ingress is set when the profile shapes the ingress traffic of an interface
+	ingress bool
+}
+
+// SimpleClass holds the parameters of a class of the simple profile
+type SimpleClass struct {
+	// Share is the fraction of the shaped internet speed the class gets
+	Share float64
+	// Delay is the d of the curve derived from the share, or its dmax with latency targets
+	Delay time.Duration
+	// RT, LS and UL replace the curves derived from the share and delay
+	RT Curve
+	LS Curve
+	UL Curve
+	// Qdisc is the leaf qdisc of the class in the notation of the `tc` command-line tool, eg.
+	// "sfq perturb 10", "fq_codel ecn ce_threshold 2ms" or "netem delay 50ms loss 1%". The default
+	// is fq_codel.
+	Qdisc string
+	// Netem replaces the leaf qdisc with netem, which emulates the conditions of a link behind the
+	// class
+	Netem *Netem
+	// Fairness is how the bandwidth of the class is shared, between flows by default
+	Fairness Fairness
+	// Match classifies the traffic that matches into the class with flower filters, next to the
+	// firewall marks
+	Match []FlowMatch
+	// DSCP rewrites the DSCP of the packets that leave through the class, eg. "ef" for prio and
+	// "cs1" for low. It is not rewritten on ingress.
+	DSCP string
+}
+
+// Fairness is how a class shares its bandwidth between the traffic in it
+type Fairness string
+
+const (
+	// FlowFairness shares the bandwidth between flows, a host with many flows gets a larger share
+	FlowFairness Fairness = "flows"
+	// HostFairness shares the bandwidth between the hosts of the LAN first and then between their
+	// flows. Hosts are the source addresses on egress and the destination addresses on ingress.
+	HostFairness Fairness = "hosts"
+	// SrcHostFairness shares the bandwidth between source addresses first
+	SrcHostFairness Fairness = "srchost"
+	// DstHostFairness shares the bandwidth between destination addresses first
+	DstHostFairness Fairness = "dsthost"
+)
+
+// UnmarshalText validates the fairness when it is read from the config
+func (f *Fairness) UnmarshalText(text []byte) error {
+	switch fairness := Fairness(text); fairness {
+	case "", FlowFairness, HostFairness, SrcHostFairness, DstHostFairness:
+		*f = fairness
+	default:
+		return fmt.Errorf("unknown fairness %q, expected %q, %q, %q or %q", text, FlowFairness, HostFairness, SrcHostFairness, DstHostFairness)
+	}
+	return nil
+}
+
+// cake flow isolation and diffserv modes from include/uapi/linux/pkt_sched.h
+const (
+	cakeFlowNone    = 0
+	cakeFlowSrcIP   = 1
+	cakeFlowDstIP   = 2
+	cakeFlowHosts   = 3
+	cakeFlowFlows   = 4
+	cakeFlowDualSrc = 5
+	cakeFlowDualDst = 6
+	cakeFlowTriple  = 7
+
+	cakeDiffserv3  = 0
+	cakeDiffserv4  = 1
+	cakeDiffserv8  = 2
+	cakeBestEffort = 3
+	cakePrecedence = 4
+)
+
+// DefaultSimpleProfile returns the parameters the simple profile uses by default
+func DefaultSimpleProfile() SimpleProfile {
+	return SimpleProfile{
+		Headroom: 0.95,
+		Prio:     SimpleClass{Share: 0.4},
+		Normal:   SimpleClass{Share: 0.4, Delay: 60 * time.Millisecond},
+		Low:      SimpleClass{Share: 0.2, Delay: 120 * time.Millisecond},
+	}
+}
+
+// classes returns the classes of the profile by name
+func (p *SimpleProfile) classes() map[string]*SimpleClass {
+	return map[string]*SimpleClass{"prio": &p.Prio, "normal": &p.Normal, "low": &p.Low}
+}
+
+// withDefaults fills in the unset parameters with the defaults
+func (p SimpleProfile) withDefaults() SimpleProfile {
+	def := DefaultSimpleProfile()
+	if p.Headroom == 0 {
+		p.Headroom = def.Headroom
+	}
+	defClasses := def.classes()
+	for name, class := range p.classes() {
+		if class.Share == 0 {
+			class.Share = defClasses[name].Share
+		}
+		if class.Delay == 0 {
+			class.Delay = defClasses[name].Delay
+		}
+	}
+	return p
+}
+
+// Validate checks the parameters of the profile
+func (p SimpleProfile) Validate() error {
+	var problems []string
+	if p.Headroom <= 0 || p.Headroom > 1 {
+		problems = append(problems, fmt.Sprintf("headroom %v is not between 0 and 1", p.Headroom))
+	}
+	sum := 0.0
+	for _, name := range []string{"prio", "normal", "low"} {
+		class := p.classes()[name]
+		if class.Share < 0 {
+			problems = append(problems, fmt.Sprintf("%s: share %v is negative", name, class.Share))
+		}
+		sum += class.Share
+		if class.Delay < 0 {
+			problems = append(problems, fmt.Sprintf("%s: delay %s is negative", name, class.Delay))
+		}
+		if _, err := class.leaf(false); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+		if class.DSCP != "" {
+			if _, err := parseDSCP(class.DSCP); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+		for i, m := range class.Match {
+			if _, err := m.keys(); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: match %d: %v", name, i+1, err))
+			}
+		}
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		problems = append(problems, fmt.Sprintf("the shares of the classes add up to %v instead of 1", sum))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid simple profile: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// ParseQuery overrides the parameters of the profile with the query parameters of an API call,
+// eg. `headroom=0.9&latency=true&prio.share=0.5&low.delay=200ms&low.qdisc=sfq&prio.dscp=ef`.
+// The link conditions of a netem leaf are set like those of the netem profile, eg.
+// `low.netem.delay=50ms`, an empty `low.netem` removes them.
+func (p *SimpleProfile) ParseQuery(query url.Values) error {
+	if v := query.Get("headroom"); v != "" {
+		headroom, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid headroom %q", v)
+		}
+		p.Headroom = headroom
+	}
+	if v := query.Get("latency"); v != "" {
+		latency, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid latency %q", v)
+		}
+		p.Latency = latency
+	}
+	for name, class := range p.classes() {
+		if err := class.parseNetemQuery(query, name+".netem"); err != nil {
+			return err
+		}
+		var err error
+		for key, values := range query {
+			param := strings.TrimPrefix(key, name+".")
+			if param == key || len(values) == 0 {
+				continue
+			}
+			if param == "netem" || strings.HasPrefix(param, "netem.") {
+				continue
+			}
+			v := values[0]
+			switch param {
+			case "share":
+				class.Share, err = strconv.ParseFloat(v, 64)
+			case "delay":
+				class.Delay, err = time.ParseDuration(v)
+			case "rt":
+				err = class.RT.UnmarshalText([]byte(v))
+			case "ls":
+				err = class.LS.UnmarshalText([]byte(v))
+			case "ul":
+				err = class.UL.UnmarshalText([]byte(v))
+			case "qdisc":
+				class.Qdisc = v
+			case "fairness":
+				err = class.Fairness.UnmarshalText([]byte(v))
+			case "dscp":
+				class.DSCP = v
+			default:
+				err = fmt.Errorf("unknown parameter")
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", key, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseNetemQuery overrides the link conditions of the class with the query parameters under key
+func (c *SimpleClass) parseNetemQuery(query url.Values, key string) error {
+	set := false
+	for k := range query {
+		set = set || k == key || strings.HasPrefix(k, key+".")
+	}
+	switch {
+	case !set:
+		return nil
+	case query.Get(key) == "" && query[key] != nil:
+		c.Netem = nil
+		return nil
+	}
+	// the link conditions of the config are shared, they are changed on a copy
+	var netem Netem
+	if c.Netem != nil {
+		netem = *c.Netem
+	}
+	if err := netem.ParseQuery(query, key); err != nil {
+		return err
+	}
+	c.Netem = &netem
+	return nil
+}
+
+// curves returns the curves of the class for the shaped speed. Unless they are replaced, the rt
+// and ls curve give the class its share for the delay. With latency, they guarantee the share of
+// the class and send a packet of umax bytes within the delay.
+func (c SimpleClass) curves(speed Rate, umax uint32, latency bool) ClassCurves {
+	sc := Curve{M1: speed.Scale(c.Share), D: c.Delay}
+	if latency {
+		sc = CurveForLatency(LatencyTarget{Umax: umax, Dmax: c.Delay, Rate: speed.Scale(c.Share)})
+	}
+	curves := ClassCurves{RT: &c.RT, LS: &c.LS}
+	if c.RT.IsZero() {
+		curves.RT = &sc
+	}
+	if c.LS.IsZero() {
+		curves.LS = &sc
+	}
+	if !c.UL.IsZero() {
+		curves.UL = &c.UL
+	}
+	return curves
+}
+
+// leafKinds are the kinds of leaf qdiscs, next to netem
+var leafKinds = []string{"fq_codel", "cake", "fq", "sfq", "pfifo", "bfifo", "red", "choke"}
+
+// leafQdisc builds the attribute of a leaf qdisc from its notation in the `tc` command-line tool.
+// An empty spec results in the default fq_codel qdisc.
+func leafQdisc(spec string) (tc.Attribute, error) {
+	if spec == "" {
+		ecn := uint32(0)
+		limit := uint32(1200)
+		flows := uint32(65535)
+		target := uint32(5000)
+		return tc.Attribute{
+			Kind: "fq_codel",
+			FqCodel: &tc.FqCodel{
+				ECN:    &ecn,
+				Limit:  &limit,
+				Flows:  &flows,
+				Target: &target,
+			},
+		}, nil
+	}
+	args := &tcArgs{args: strings.Fields(spec)}
+	kind, _ := args.next()
+	attr := tc.Attribute{Kind: kind}
+	if !isLeafKind(kind) {
+		return attr, fmt.Errorf("unsupported leaf qdisc %q, expected one of %v", kind, leafKinds)
+	}
+	if err := parseQdiscOptions(args, &attr); err != nil {
+		return attr, err
+	}
+	return attr, nil
+}
+
+// isLeafKind checks if a qdisc of kind can be a leaf qdisc
+func isLeafKind(kind string) bool {
+	for _, k := range leafKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// leafRed returns the options of a red or choke leaf qdisc, which are kept next to the qdisc, or
+// nil for other leafs
+func leafRed(spec string) *Red {
+	args := &tcArgs{args: strings.Fields(spec)}
+	kind, _ := args.next()
+	if kind != "red" && kind != "choke" {
+		return nil
+	}
+	red, err := parseRed(args, kind)
+	if err != nil {
+		return nil
+	}
+	return &red
+}
+
+// linkConditions returns the link conditions of a netem leaf, which are set with Netem or as Qdisc
+func (c SimpleClass) linkConditions() (*Netem, error) {
+	if c.Netem != nil {
+		if c.Qdisc != "" {
+			return nil, fmt.Errorf("netem replaces the leaf qdisc %q", c.Qdisc)
+		}
+		return c.Netem, c.Netem.Validate()
+	}
+	if args := strings.Fields(c.Qdisc); len(args) > 0 && args[0] == "netem" {
+		netem, err := parseNetem(&tcArgs{args: args[1:]})
+		return &netem, err
+	}
+	return nil, nil
+}
+
+// leaf returns the leaf qdisc of the class. Fairness between hosts uses a cake leaf that isolates
+// the hosts and then their flows. The addresses are looked up in conntrack, as they are rewritten
+// by NAT before egress and after ingress.
+func (c SimpleClass) leaf(ingress bool) (tc.Attribute, error) {
+	if netem, err := c.linkConditions(); err != nil || netem != nil {
+		if err != nil {
+			return tc.Attribute{}, err
+		}
+		if c.Fairness != "" && c.Fairness != FlowFairness {
+			return tc.Attribute{}, fmt.Errorf("%s fairness requires a cake leaf, not netem", c.Fairness)
+		}
+		return netem.attribute(), nil
+	}
+	if c.Fairness == "" || c.Fairness == FlowFairness {
+		return leafQdisc(c.Qdisc)
+	}
+	attr := tc.Attribute{Kind: "cake", Cake: &tc.Cake{}}
+	if c.Qdisc != "" {
+		var err error
+		if attr, err = leafQdisc(c.Qdisc); err != nil {
+			return attr, err
+		}
+		if attr.Kind != "cake" {
+			return attr, fmt.Errorf("%s fairness requires a cake leaf, not %s", c.Fairness, attr.Kind)
+		}
+	}
+	mode := uint32(cakeFlowDualSrc)
+	if c.Fairness == DstHostFairness || (c.Fairness == HostFairness && ingress) {
+		mode = cakeFlowDualDst
+	}
+	attr.Cake.FlowMode = &mode
+	if attr.Cake.DiffServMode == nil {
+		// the classes of the profile already prioritize the traffic
+		diffserv := uint32(cakeBestEffort)
+		attr.Cake.DiffServMode = &diffserv
+	}
+	if attr.Cake.Nat == nil {
+		nat := uint32(1)
+		attr.Cake.Nat = &nat
+	}
+	return attr, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"github.com/spf13/viper"
+)
+
+func TestSimpleProfileDefaults(t *testing.T) {
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, SimpleProfile{})
+	expected := map[string]tc.ServiceCurve{
+		"prio":   {M1: 4750000},
+		"normal": {M1: 4750000, D: 60000},
+		"low":    {M1: 2375000, D: 120000},
+	}
+	for name, sc := range expected {
+		hfsc := conf.Classes[name].Hfsc
+		if *hfsc.Rsc != sc || *hfsc.Fsc != sc || *hfsc.Usc != (tc.ServiceCurve{}) {
+			t.Errorf("expected class %s to have sc %+v, got rt %+v ls %+v ul %+v", name, sc, *hfsc.Rsc, *hfsc.Fsc, *hfsc.Usc)
+		}
+		if kind := conf.Qdiscs[name].Kind; kind != "fq_codel" {
+			t.Errorf("expected class %s to have a fq_codel leaf, got %s", name, kind)
+		}
+	}
+
+	conf = createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, SimpleProfile{Latency: true})
+	expected = map[string]tc.ServiceCurve{
+		// a full packet at 38Mbit takes 316us, so the curves are convex
+		"prio":   {M2: 4750000},
+		"normal": {D: 59685, M2: 4750000},
+		"low":    {D: 119369, M2: 2375000},
+	}
+	for name, sc := range expected {
+		if hfsc := conf.Classes[name].Hfsc; *hfsc.Rsc != sc || *hfsc.Fsc != sc {
+			t.Errorf("expected class %s to have the latency curve %+v, got rt %+v ls %+v", name, sc, *hfsc.Rsc, *hfsc.Fsc)
+		}
+	}
+}
+
+func TestSimpleProfileParams(t *testing.T) {
+	params := SimpleProfile{
+		Headroom: 0.9,
+		Prio:     SimpleClass{Share: 0.5, RT: Curve{M1: 20 * Mbit, D: 10 * time.Millisecond, M2: 10 * Mbit}},
+		Normal:   SimpleClass{Share: 0.3, UL: Curve{M2: 80 * Mbit}},
+		Low:      SimpleClass{Share: 0.2, Qdisc: "sfq perturb 10"},
+	}
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, params)
+
+	prio := conf.Classes["prio"].Hfsc
+	if *prio.Rsc != (tc.ServiceCurve{M1: 2500000, D: 10000, M2: 1250000}) {
+		t.Errorf("expected the rt curve of prio to be replaced, got %+v", *prio.Rsc)
+	}
+	if *prio.Fsc != (tc.ServiceCurve{M1: 5625000}) {
+		t.Errorf("expected the ls curve of prio to follow its share, got %+v", *prio.Fsc)
+	}
+	if normal := conf.Classes["normal"].Hfsc; *normal.Usc != (tc.ServiceCurve{M2: 10000000}) {
+		t.Errorf("expected normal to have an upper limit, got %+v", *normal.Usc)
+	}
+	if low := conf.Qdiscs["low"]; low.Kind != "sfq" || low.Sfq.V0.PerturbPeriod != 10 {
+		t.Errorf("expected low to have a sfq leaf, got %+v", low.Attribute)
+	}
+}
+
+func TestSimpleProfileValidate(t *testing.T) {
+	tests := map[string]SimpleProfile{
+		"add up to 1.2":    {Headroom: 0.95, Prio: SimpleClass{Share: 0.6}, Normal: SimpleClass{Share: 0.4}, Low: SimpleClass{Share: 0.2}},
+		"headroom 1.5":     {Headroom: 1.5, Prio: SimpleClass{Share: 0.4}, Normal: SimpleClass{Share: 0.4}, Low: SimpleClass{Share: 0.2}},
+		"unsupported leaf": {Headroom: 0.95, Prio: SimpleClass{Share: 0.4, Qdisc: "tbf"}, Normal: SimpleClass{Share: 0.4}, Low: SimpleClass{Share: 0.2}},
+		"delay -1s":        {Headroom: 0.95, Prio: SimpleClass{Share: 0.4, Delay: -time.Second}, Normal: SimpleClass{Share: 0.4}, Low: SimpleClass{Share: 0.2}},
+	}
+	for problem, params := range tests {
+		err := params.Validate()
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected an error about %q, got %v", problem, err)
+		}
+	}
+	if err := DefaultSimpleProfile().Validate(); err != nil {
+		t.Errorf("expected the defaults to be valid, got %v", err)
+	}
+}
+
+func TestSimpleProfileQuery(t *testing.T) {
+	query, _ := url.ParseQuery("interface=eth0&up=100&headroom=0.9&latency=true&prio.share=0.5&normal.share=0.3&low.delay=200ms&low.qdisc=sfq&prio.rt=m2+10mbit&low.dscp=cs1")
+	params := SimpleProfile{}
+	if err := params.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	expected := SimpleProfile{
+		Headroom: 0.9,
+		Latency:  true,
+		Prio:     SimpleClass{Share: 0.5, RT: Curve{M2: 10 * Mbit}},
+		Normal:   SimpleClass{Share: 0.3},
+		Low:      SimpleClass{Delay: 200 * time.Millisecond, Qdisc: "sfq", DSCP: "cs1"},
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("expected %+v, got %+v", expected, params)
+	}
+
+	for _, q := range []string{"headroom=lots", "latency=maybe", "prio.share=half", "low.rt=m2", "normal.color=blue"} {
+		query, _ := url.ParseQuery(q)
+		if err := (&SimpleProfile{}).ParseQuery(query); err == nil {
+			t.Errorf("expected query %q to fail", q)
+		}
+	}
+}
+
+func TestSimpleProfileConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+uploadSpeed = "2.5gbit"
+
+[simple]
+headroom = 0.9
+
+[simple.prio]
+share = 0.5
+rt = "umax 1500b dmax 10ms rate 1mbit"
+
+[simple.low]
+delay = "200ms"
+qdisc = "sfq perturb 10"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	if conf.UploadSpeed != 2500*Mbit {
+		t.Errorf("expected an upload speed of 2.5gbit, got %s", conf.UploadSpeed)
+	}
+	expected := SimpleProfile{
+		Headroom: 0.9,
+		Prio:     SimpleClass{Share: 0.5, RT: CurveForLatency(LatencyTarget{Umax: 1500, Dmax: 10 * time.Millisecond, Rate: Mbit})},
+		Low:      SimpleClass{Delay: 200 * time.Millisecond, Qdisc: "sfq perturb 10"},
+	}
+	if !reflect.DeepEqual(conf.Simple, expected) {
+		t.Errorf("expected %+v, got %+v", expected, conf.Simple)
+	}
+}
+
+func TestSimpleProfileFairness(t *testing.T) {
+	params := DefaultSimpleProfile()
+	params.Normal.Fairness = HostFairness
+	params.Low.Fairness = DstHostFairness
+	params.Low.Qdisc = "cake diffserv4 rtt 50ms"
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ingress := range []bool{false, true} {
+		params.ingress = ingress
+		conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, params)
+		if prio := conf.Qdiscs["prio"]; prio.Kind != "fq_codel" {
+			t.Errorf("expected prio to share between flows, got %s", prio.Kind)
+		}
+		// hosts are the source addresses on egress and the destination addresses on ingress
+		mode := uint32(cakeFlowDualSrc)
+		if ingress {
+			mode = cakeFlowDualDst
+		}
+		normal := conf.Qdiscs["normal"]
+		if normal.Kind != "cake" || *normal.Cake.FlowMode != mode || *normal.Cake.Nat != 1 || *normal.Cake.DiffServMode != cakeBestEffort {
+			t.Errorf("expected normal to share between hosts with ingress %v, got %+v", ingress, normal.Cake)
+		}
+		low := conf.Qdiscs["low"]
+		if low.Kind != "cake" || *low.Cake.FlowMode != cakeFlowDualDst || *low.Cake.DiffServMode != cakeDiffserv4 || *low.Cake.Rtt != 50000 {
+			t.Errorf("expected low to keep its cake options, got %+v", low.Cake)
+		}
+	}
+
+	params.Low.Qdisc = "sfq"
+	if err := params.Validate(); err == nil || !strings.Contains(err.Error(), "requires a cake leaf") {
+		t.Errorf("expected host fairness with a sfq leaf to fail, got %v", err)
+	}
+	query, _ := url.ParseQuery("low.fairness=everyone")
+	if err := params.ParseQuery(query); err == nil {
+		t.Error("expected an unknown fairness to fail")
+	}
+}
+
+func TestLanpartyProfile(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "cc-test0"}
+	var conf Config
+	query, _ := url.ParseQuery("lanparty.qdisc=fq_codel+ecn&lanparty.crew.qdisc=sfq+perturb+10&lanparty.thrash.qdisc=red+limit+400000+avpkt+1000")
+	if err := conf.ParseQuery(query); err != nil {
+		t.Fatal(err)
+	}
+	result, _, err := DesiredTree(context.Background(), conf, "lanparty", interf, 100*Mbit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafs := make(map[string]*Node)
+	result.Tree.Walk(func(n *Node, _ int) {
+		if n.Type == "qdisc" {
+			leafs[n.Name] = n
+		}
+	})
+	for _, name := range lanpartyLeafs {
+		n, ok := leafs[name]
+		if !ok {
+			t.Fatalf("expected the tree to hold leaf %s", name)
+		}
+		switch name {
+		case "crew":
+			if n.Object.Kind != "sfq" || n.Object.Sfq.V0.PerturbPeriod != 10 {
+				t.Errorf("expected crew to have a sfq leaf, got %s", nodeTitle(n))
+			}
+		case "thrash":
+			if n.Object.Kind != "red" || len(n.Damping) != redStabSize {
+				t.Errorf("expected thrash to have a red leaf with its idle damping, got %s", nodeTitle(n))
+			}
+		default:
+			if n.Object.Kind != "fq_codel" || *n.Object.FqCodel.ECN != 1 {
+				t.Errorf("expected %s to have a fq_codel leaf with ecn, got %s", name, nodeTitle(n))
+			}
+		}
+	}
+
+	for params, problem := range map[string]string{
+		"lanparty.qdisc=tbf":              `prio1: unsupported leaf qdisc "tbf"`,
+		"lanparty.guests.qdisc=sfq":       `unknown class "guests"`,
+		"lanparty.crew.qdisc=red+limit+1": "crew: red requires a limit and avpkt",
+	} {
+		conf := Config{}
+		query, _ := url.ParseQuery(params)
+		if err := conf.ParseQuery(query); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := createQoS(context.Background(), conf, "lanparty", interf, Gbit, 100*Mbit); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %s to fail with %q, got %v", params, problem, err)
+		}
+	}
+	if err := conf.Lanparty.ParseQuery(url.Values{"lanparty.crew.leaf": {"sfq"}}); err == nil {
+		t.Error("expected an unknown parameter to fail")
+	}
+
+	// the former name of the downloading leaf is still accepted
+	former := LanpartyProfile{Qdiscs: map[string]string{"dowloading": "sfq"}}
+	if err := former.Validate(); err != nil || former.leaf("downloading") != "sfq" {
+		t.Errorf("expected the former name to set the downloading leaf, got %q (%v)", former.leaf("downloading"), err)
+	}
+	if err := former.ParseQuery(url.Values{"lanparty.dowloading.qdisc": {"pfifo"}}); err != nil || former.Qdiscs["downloading"] != "pfifo" || former.leaf("downloading") != "pfifo" {
+		t.Errorf("expected the former name in the API to set the downloading leaf, got %+v (%v)", former.Qdiscs, err)
+	}
+
+	// the curves of the classes give their rate for the delay, unless latency targets are asked for
+	prio2 := createQoSLanparty(context.Background(), interf, Gbit, 100*Mbit, LanpartyProfile{}).Classes["prio2"]
+	if *prio2.Hfsc.Rsc != (tc.ServiceCurve{M1: 4750000, D: 60000}) {
+		t.Errorf("expected the default curve of prio2, got %+v", *prio2.Hfsc.Rsc)
+	}
+	if err := conf.Lanparty.ParseQuery(url.Values{"lanparty.latency": {"true"}}); err != nil || !conf.Lanparty.Latency {
+		t.Fatalf("expected latency to be enabled, got %v", err)
+	}
+	prio2 = createQoSLanparty(context.Background(), interf, Gbit, 100*Mbit, conf.Lanparty).Classes["prio2"]
+	if *prio2.Hfsc.Rsc != (tc.ServiceCurve{D: 59685, M2: 4750000}) {
+		t.Errorf("expected the latency curve of prio2, got %+v", *prio2.Hfsc.Rsc)
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[lanparty]
+qdisc = "fq_codel ecn"
+
+[lanparty.qdiscs]
+crew = "cake besteffort"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	conf = Config{}
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	expected := LanpartyProfile{Qdisc: "fq_codel ecn", Qdiscs: map[string]string{"crew": "cake besteffort"}}
+	if !reflect.DeepEqual(conf.Lanparty, expected) {
+		t.Errorf("expected %+v, got %+v", expected, conf.Lanparty)
+	}
+}
+
+func TestSimpleProfileRedLeaf(t *testing.T) {
+	params := DefaultSimpleProfile()
+	params.Low.Qdisc = "choke limit 1000 bandwidth 20mbit ecn"
+	if err := params.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 1}, Gbit, 100*Mbit, params)
+	if red, ok := conf.Red["low"]; !ok || red.Kind != "choke" || conf.Qdiscs["low"].Choke == nil {
+		t.Errorf("expected low to have a choke leaf with its options, got %+v", conf.Qdiscs["low"].Attribute)
+	}
+	if _, ok := conf.Red["prio"]; ok {
+		t.Error("expected only the choke leaf to keep red options")
+	}
+	params.Low.Fairness = HostFairness
+	if err := params.Validate(); err == nil || !strings.Contains(err.Error(), "requires a cake leaf, not choke") {
+		t.Errorf("expected host fairness to require cake, got %v", err)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of qdiscs, from include/uapi/linux/rtnetlink.h and pkt_sched.h. go-tc does not know
+// the loss models of netem and fails on the whole dump of the qdiscs when netem reports one, or
+// reports the seed of its random numbers as recent kernels do, mqprio reports its traffic classes,
+// or red and fq report their newer options. It can not encode mq at all, nor the tables red and
+// choke age their average queue with, nor fifo qdiscs without a limit. Those qdiscs are encoded
+// here, and the qdiscs are decoded here when go-tc fails.
+const (
+	tcaStab             = 8
+	tcaStabBase         = 1
+	tcaStabData         = 2
+	tcaNetemCorr        = 1
+	tcaNetemDelayDist   = 2
+	tcaNetemReorder     = 3
+	tcaNetemCorrupt     = 4
+	tcaNetemLoss        = 5
+	tcaNetemRate        = 6
+	tcaNetemEcn         = 7
+	tcaNetemRate64      = 8
+	tcaNetemLatency64   = 10
+	tcaNetemJitter64    = 11
+	netemLossGE         = 2
+	netemQoptSize       = 24
+	tcaHtbInit          = 2
+	tcaHtbDirectQlen    = 5
+	tcaFqCodelTarget    = 1
+	tcaFqPLimit         = 1
+	tcaRedParms         = 1
+	tcaRedStab          = 2
+	tcaRedMaxP          = 3
+	tcaCakeBaseRate64   = 2
+	tcaCakeDiffservMode = 3
+	tcaMqPrioMode       = 1
+	tcaMqPrioShaper     = 2
+	mqprioQoptSize      = 84
+)
+
+// marshalStruct encodes a struct of the kernel in native byte order
+func marshalStruct(v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, nlenc.NativeEndian(), v)
+	return b.Bytes()
+}
+
+// marshalNetemQdisc encodes the tcmsg and the attributes of a netem qdisc with its loss model
+func marshalNetemQdisc(obj tc.Object, loss *GEModel) ([]byte, error) {
+	netem := obj.Netem
+	if netem == nil {
+		return nil, errors.New("netem qdisc without options")
+	}
+	ae := netlink.NewAttributeEncoder()
+	if netem.Corr != nil {
+		ae.Bytes(tcaNetemCorr, marshalStruct(netem.Corr))
+	}
+	if netem.DelayDist != nil {
+		ae.Bytes(tcaNetemDelayDist, marshalStruct(*netem.DelayDist))
+	}
+	if netem.Reorder != nil {
+		ae.Bytes(tcaNetemReorder, marshalStruct(netem.Reorder))
+	}
+	if netem.Corrupt != nil {
+		ae.Bytes(tcaNetemCorrupt, marshalStruct(netem.Corrupt))
+	}
+	if loss != nil {
+		ae.Nested(tcaNetemLoss, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(netemLossGE, marshalStruct(loss))
+			return nil
+		})
+	}
+	if netem.Rate != nil {
+		ae.Bytes(tcaNetemRate, marshalStruct(netem.Rate))
+	}
+	if netem.Ecn != nil {
+		ae.Uint32(tcaNetemEcn, *netem.Ecn)
+	}
+	if netem.Rate64 != nil {
+		ae.Uint64(tcaNetemRate64, *netem.Rate64)
+	}
+	if netem.Latency64 != nil {
+		ae.Uint64(tcaNetemLatency64, uint64(*netem.Latency64))
+	}
+	if netem.Jitter64 != nil {
+		ae.Uint64(tcaNetemJitter64, uint64(*netem.Jitter64))
+	}
+	options, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	// the options of netem start with struct tc_netem_qopt, followed by its attributes
+	return marshalQdisc(obj, append(marshalStruct(netem.Qopt), options...))
+}
+
+// marshalQdisc encodes the tcmsg and the attributes of a qdisc with its encoded options
+func marshalQdisc(obj tc.Object, options []byte) ([]byte, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.String(tcaKind, obj.Kind)
+	if options != nil {
+		ae.Bytes(tcaOptions, options)
+	}
+	if stab := obj.Stab; stab != nil {
+		ae.Nested(tcaStab, func(nae *netlink.AttributeEncoder) error {
+			if stab.Base != nil {
+				nae.Bytes(tcaStabBase, marshalStruct(stab.Base))
+			}
+			if stab.Data != nil {
+				nae.Bytes(tcaStabData, *stab.Data)
+			}
+			return nil
+		})
+	}
+	attrs, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(marshalTcmsg(obj.Msg), attrs...), nil
+}
+
+// marshalRedQdisc encodes the tcmsg and the attributes of a red or choke qdisc with the table that
+// ages its average queue. The attributes of choke are numbered like those of red.
+func marshalRedQdisc(obj tc.Object, stab []byte) ([]byte, error) {
+	red := redOf(obj)
+	if red == nil || red.Parms == nil || red.MaxP == nil {
+		return nil, fmt.Errorf("%s qdisc without options", obj.Kind)
+	}
+	if len(stab) != redStabSize {
+		return nil, fmt.Errorf("%s qdisc without the table of its idle damping", obj.Kind)
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(tcaRedParms, marshalStruct(red.Parms))
+	ae.Bytes(tcaRedStab, stab)
+	ae.Uint32(tcaRedMaxP, *red.MaxP)
+	options, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return marshalQdisc(obj, options)
+}
+
+// encodedQdisc checks if a qdisc of kind is encoded here instead of by go-tc
+func encodedQdisc(kind string) bool {
+	switch kind {
+	case "netem", "mq", "red", "choke", "pfifo", "bfifo":
+		return true
+	}
+	return false
+}
+
+// replaceQdisc adds or replaces a netem qdisc with its loss model, a red or choke qdisc with its
+// idle damping, a fifo qdisc or a mq qdisc
+func replaceQdisc(n *Node) error {
+	var data []byte
+	var err error
+	switch n.Object.Kind {
+	case "netem":
+		data, err = marshalNetemQdisc(n.Object, n.Loss)
+	case "red", "choke":
+		data, err = marshalRedQdisc(n.Object, n.Damping)
+	case "pfifo", "bfifo":
+		// a fifo qdisc without options holds as many packets as the TX queue of the device, go-tc
+		// can not leave them out
+		fifo := n.Object.Pfifo
+		if n.Object.Kind == "bfifo" {
+			fifo = n.Object.Bfifo
+		}
+		var options []byte
+		if fifo != nil {
+			options = marshalStruct(fifo)
+		}
+		data, err = marshalQdisc(n.Object, options)
+	case "mq":
+		data, err = marshalQdisc(n.Object, nil)
+	default:
+		err = fmt.Errorf("can not encode %s qdiscs", n.Object.Kind)
+	}
+	if err != nil {
+		return err
+	}
+	return executeQdisc(netlink.Header{
+		Type:  unix.RTM_NEWQDISC,
+		Flags: netlink.Request | netlink.Acknowledge | netlink.Create | netlink.Replace,
+	}, data)
+}
+
+// deleteQdisc deletes a qdisc go-tc can not encode
+func deleteQdisc(obj *tc.Object) error {
+	data, err := marshalQdisc(tc.Object{Msg: obj.Msg, Attribute: tc.Attribute{Kind: obj.Kind}}, nil)
+	if err != nil {
+		return err
+	}
+	return executeQdisc(netlink.Header{Type: unix.RTM_DELQDISC, Flags: netlink.Request | netlink.Acknowledge}, data)
+}
+
+// executeQdisc sends a qdisc request to the kernel
+func executeQdisc(header netlink.Header, data []byte) error {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Execute(netlink.Message{Header: header, Data: data})
+	return err
+}
+
+// getQdiscNodes reads the qdiscs of an interface without go-tc. The options of the kinds that are
+// not decoded here are left out.
+func getQdiscNodes(ifindex uint32) ([]*Node, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	defer conn.Close()
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: unix.RTM_GETQDISC, Flags: netlink.Request | netlink.Dump},
+		Data:   marshalTcmsg(tc.Msg{Family: unix.AF_UNSPEC, Ifindex: ifindex}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*Node
+	for _, msg := range msgs {
+		n, err := unmarshalQdisc(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		// the kernel returns the qdiscs of all interfaces
+		if n.Object.Ifindex == ifindex {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// unmarshalQdisc decodes a qdisc of a dump the way go-tc does, so it compares equal with the qdiscs
+// of a config
+func unmarshalQdisc(data []byte) (*Node, error) {
+	if len(data) < tcmsgSize {
+		return nil, errors.New("qdisc message too short")
+	}
+	n := NewNodeWithObject("qdisc", tc.Object{Msg: tc.Msg{
+		Family:  uint32(data[0]),
+		Ifindex: nlenc.NativeEndian().Uint32(data[4:]),
+		Handle:  nlenc.NativeEndian().Uint32(data[8:]),
+		Parent:  nlenc.NativeEndian().Uint32(data[12:]),
+		Info:    nlenc.NativeEndian().Uint32(data[16:]),
+	}})
+	ad, err := netlink.NewAttributeDecoder(data[tcmsgSize:])
+	if err != nil {
+		return nil, err
+	}
+	var options []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaKind:
+			n.Object.Kind = ad.String()
+		case tcaOptions:
+			options = ad.Bytes()
+		case tcaStab:
+			stab := &tc.Stab{}
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case tcaStabBase:
+						stab.Base = &tc.SizeSpec{}
+						unmarshalStruct(nad.Bytes(), stab.Base)
+					case tcaStabData:
+						data := nad.Bytes()
+						stab.Data = &data
+					}
+				}
+				return nil
+			})
+			n.Object.Stab = stab
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	if len(options) == 0 {
+		return n, nil
+	}
+	if err := unmarshalQdiscOptions(n, options); err != nil {
+		return nil, fmt.Errorf("%s qdisc %s: %v", n.Object.Kind, FmtHandle(n.Object.Handle), err)
+	}
+	return n, nil
+}
+
+// unmarshalStruct decodes a struct of the kernel in native byte order
+func unmarshalStruct(data []byte, v interface{}) error {
+	return binary.Read(bytes.NewReader(data), nlenc.NativeEndian(), v)
+}
+
+// unmarshalQdiscOptions decodes the options of the qdiscs the trees are built from
+func unmarshalQdiscOptions(n *Node, options []byte) error {
+	attr := &n.Object.Attribute
+	// u32Attrs decodes the attributes of 32 bit values, like those of fq_codel and cake. The fields
+	// are in the order of their attributes, starting at the attribute first.
+	u32Attrs := func(first uint16, fields ...**uint32) error {
+		ad, err := netlink.NewAttributeDecoder(options)
+		if err != nil {
+			return err
+		}
+		for ad.Next() {
+			switch i := int(ad.Type()) - int(first); {
+			case i >= 0 && i < len(fields):
+				v := ad.Uint32()
+				*fields[i] = &v
+			case attr.Cake != nil && ad.Type() == tcaCakeBaseRate64:
+				v := ad.Uint64()
+				attr.Cake.BaseRate = &v
+			}
+		}
+		return ad.Err()
+	}
+	switch n.Object.Kind {
+	case "hfsc":
+		if len(options) < 2 {
+			return errors.New("options too short")
+		}
+		attr.HfscQOpt = &tc.HfscQOpt{DefCls: nlenc.NativeEndian().Uint16(options)}
+	case "htb":
+		attr.Htb = &tc.Htb{}
+		ad, err := netlink.NewAttributeDecoder(options)
+		if err != nil {
+			return err
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case tcaHtbInit:
+				attr.Htb.Init = &tc.HtbGlob{}
+				if err := unmarshalStruct(ad.Bytes(), attr.Htb.Init); err != nil {
+					return err
+				}
+			case tcaHtbDirectQlen:
+				v := ad.Uint32()
+				attr.Htb.DirectQlen = &v
+			}
+		}
+		return ad.Err()
+	case "fq_codel":
+		q := &tc.FqCodel{}
+		attr.FqCodel = q
+		return u32Attrs(tcaFqCodelTarget, &q.Target, &q.Limit, &q.Interval, &q.ECN, &q.Flows, &q.Quantum,
+			&q.CEThreshold, &q.DropBatchSize, &q.MemoryLimit)
+	case "cake":
+		c := &tc.Cake{}
+		attr.Cake = c
+		return u32Attrs(tcaCakeDiffservMode, &c.DiffServMode, &c.Atm, &c.FlowMode, &c.Overhead, &c.Rtt,
+			&c.Target, &c.Autorate, &c.Memory, &c.Nat, &c.Raw, &c.Wash, &c.Mpu, &c.Ingress, &c.AckFilter,
+			&c.SplitGso, &c.FwMark)
+	case "fq":
+		q := &tc.Fq{}
+		attr.Fq = q
+		return u32Attrs(tcaFqPLimit, &q.PLimit, &q.FlowPLimit, &q.Quantum, &q.InitQuantum, &q.RateEnable,
+			&q.FlowDefaultRate, &q.FlowMaxRate, &q.BucketsLog, &q.FlowRefillDelay, &q.OrphanMask,
+			&q.LowRateThreshold, &q.CEThreshold)
+	case "sfq":
+		attr.Sfq = &tc.Sfq{}
+		return unmarshalStruct(options, attr.Sfq)
+	case "pfifo", "bfifo":
+		fifo := &tc.FifoOpt{}
+		if n.Object.Kind == "pfifo" {
+			attr.Pfifo = fifo
+		} else {
+			attr.Bfifo = fifo
+		}
+		return unmarshalStruct(options, fifo)
+	case "red", "choke":
+		return unmarshalRedOptions(n, options)
+	case "prio":
+		attr.Prio = &tc.Prio{}
+		return unmarshalStruct(options, attr.Prio)
+	case "netem":
+		return unmarshalNetemOptions(n, options)
+	case "mqprio":
+		return unmarshalMqPrioOptions(n, options)
+	}
+	return nil
+}
+
+// unmarshalRedOptions decodes the parameters of a red or choke qdisc, the flags and blocks of recent
+// kernels are left out
+func unmarshalRedOptions(n *Node, options []byte) error {
+	red := &tc.Red{}
+	ad, err := netlink.NewAttributeDecoder(options)
+	if err != nil {
+		return err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaRedParms:
+			red.Parms = &tc.RedQOpt{}
+			if err := unmarshalStruct(ad.Bytes(), red.Parms); err != nil {
+				return err
+			}
+		case tcaRedMaxP:
+			v := ad.Uint32()
+			red.MaxP = &v
+		}
+	}
+	if n.Object.Kind == "choke" {
+		n.Object.Choke = &tc.Choke{Parms: red.Parms, MaxP: red.MaxP}
+	} else {
+		n.Object.Red = red
+	}
+	return ad.Err()
+}
+
+// unmarshalMqPrioOptions decodes the options of a mqprio qdisc. The rates of its shaper and the
+// traffic classes that recent kernels report for frame preemption are left out.
+func unmarshalMqPrioOptions(n *Node, options []byte) error {
+	if len(options) < mqprioQoptSize {
+		return errors.New("options too short")
+	}
+	mqprio := &tc.MqPrio{Opt: &tc.MqPrioQopt{}}
+	n.Object.MqPrio = mqprio
+	if err := unmarshalStruct(options, mqprio.Opt); err != nil {
+		return err
+	}
+	ad, err := netlink.NewAttributeDecoder(options[mqprioQoptSize:])
+	if err != nil {
+		return err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaMqPrioMode:
+			v := ad.Uint16()
+			mqprio.Mode = &v
+		case tcaMqPrioShaper:
+			v := ad.Uint16()
+			mqprio.Shaper = &v
+		}
+	}
+	return ad.Err()
+}
+
+// unmarshalNetemOptions decodes the options of a netem qdisc with its loss model
+func unmarshalNetemOptions(n *Node, options []byte) error {
+	if len(options) < netemQoptSize {
+		return errors.New("options too short")
+	}
+	netem := &tc.Netem{}
+	n.Object.Netem = netem
+	if err := unmarshalStruct(options[:netemQoptSize], &netem.Qopt); err != nil {
+		return err
+	}
+	ad, err := netlink.NewAttributeDecoder(options[netemQoptSize:])
+	if err != nil {
+		return err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case tcaNetemCorr:
+			netem.Corr = &tc.NetemCorr{}
+			err = unmarshalStruct(ad.Bytes(), netem.Corr)
+		case tcaNetemReorder:
+			netem.Reorder = &tc.NetemReorder{}
+			err = unmarshalStruct(ad.Bytes(), netem.Reorder)
+		case tcaNetemCorrupt:
+			netem.Corrupt = &tc.NetemCorrupt{}
+			err = unmarshalStruct(ad.Bytes(), netem.Corrupt)
+		case tcaNetemRate:
+			netem.Rate = &tc.NetemRate{}
+			err = unmarshalStruct(ad.Bytes(), netem.Rate)
+		case tcaNetemEcn:
+			v := ad.Uint32()
+			netem.Ecn = &v
+		case tcaNetemRate64:
+			v := ad.Uint64()
+			netem.Rate64 = &v
+		case tcaNetemLatency64:
+			v := int64(ad.Uint64())
+			netem.Latency64 = &v
+		case tcaNetemJitter64:
+			v := int64(ad.Uint64())
+			netem.Jitter64 = &v
+		case tcaNetemLoss:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == netemLossGE {
+						n.Loss = &GEModel{}
+						err = unmarshalStruct(nad.Bytes(), n.Loss)
+					}
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ad.Err()
+}
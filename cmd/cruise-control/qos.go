@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
-	"math"
+	"fmt"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/florianl/go-tc"
 	"github.com/florianl/go-tc/core"
@@ -12,13 +16,89 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed, internetSpeed int) TcConfig {
+// createQoS creates the TC config for the requested profile with the classes of the hosts. The
+// "traffic" profile loads the traffic file from the config, the "netem" profile emulates the link
+// conditions of the config and the "multiqueue" profile attaches a leaf qdisc to every TX queue of
+// the interface. The overhead of the link is applied to
+// the root qdisc, traffic files keep their own size table when no overhead is configured.
+func createQoS(ctx context.Context, conf Config, profile string, interf net.Interface, interfaceSpeed, internetSpeed Rate) (TcConfig, error) {
+	stab, err := conf.Overhead.Stab(interf)
+	if err != nil {
+		return TcConfig{}, err
+	}
+
+	var tcConf TcConfig
+	switch profile {
+	case "", "simple":
+		params := conf.Simple.withDefaults()
+		if err := params.Validate(); err != nil {
+			return TcConfig{}, err
+		}
+		tcConf = createQoSSimple(ctx, interf, interfaceSpeed, internetSpeed, params)
+	case "lanparty":
+		if err := conf.Lanparty.Validate(); err != nil {
+			return TcConfig{}, err
+		}
+		tcConf = createQoSLanparty(ctx, interf, interfaceSpeed, internetSpeed, conf.Lanparty)
+	case "netem":
+		if err := conf.Netem.Validate(); err != nil {
+			return TcConfig{}, err
+		}
+		// the emulated link has no classes to add hosts to
+		tcConf = createQoSNetem(interf, internetSpeed, conf.Netem)
+		tcConf.applyStab(stab)
+		return tcConf, nil
+	case "multiqueue":
+		queues := conf.Multiqueue.Queues
+		if queues == 0 {
+			if queues, err = txQueues(interf); err != nil {
+				return TcConfig{}, err
+			}
+		}
+		// the queues have no classes to add hosts to
+		if tcConf, err = createQoSMultiqueue(interf, queues, conf.Multiqueue); err != nil {
+			return TcConfig{}, err
+		}
+		tcConf.applyStab(stab)
+		return tcConf, nil
+	case "traffic":
+		ln.Log(ctx, ln.Action("loading traffic file"), ln.F{"file": conf.TrafficFile})
+		tcConf, err = parseTrafficFile(conf.TrafficFile)
+		if err != nil {
+			return tcConf, err
+		}
+		tcConf.updateInterface(interf)
+	default:
+		return TcConfig{}, fmt.Errorf("unknown profile %q", profile)
+	}
+	if err := tcConf.addHosts(conf.Hosts); err != nil {
+		return tcConf, err
+	}
+	// host classes keep the DSCP of their class, so it is rewritten after they are added
+	if err := tcConf.applyDSCP(); err != nil {
+		return tcConf, err
+	}
+	if profile == "traffic" && conf.Overhead == (Overhead{}) {
+		return tcConf, nil
+	}
+	tcConf.applyStab(stab)
+	return tcConf, nil
+}
+
+// packetSize is the size of the largest packet sent on interf
+func packetSize(interf net.Interface) uint32 {
+	if interf.MTU > 0 {
+		return uint32(interf.MTU)
+	}
+	return 1500
+}
+
+func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed, internetSpeed Rate, params SimpleProfile) TcConfig {
 	ln.Log(ctx, ln.Action("qos_setup"))
 
-	internetspeed := math.Ceil(float64(internetSpeed) * 0.95)
-	priospeed := math.Ceil(internetspeed * 0.4)
-	normalspeed := math.Ceil(internetspeed * 0.4)
-	lowspeed := math.Ceil(internetspeed * 0.2)
+	params = params.withDefaults()
+	internetspeed := internetSpeed.Scale(params.Headroom)
+	umax := packetSize(interf)
 
 	template := TcConfig{
 		Qdiscs:  make(map[string]tc.Object),
@@ -26,21 +106,6 @@ func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed,
 		Filters: make(map[string]tc.Object),
 	}
 
-	// qdisc setup
-	ecn := uint32(0)
-	limit := uint32(1200)
-	flows := uint32(65535)
-	target := uint32(5000)
-	defaultFqCodel := tc.Attribute{
-		Kind: "fq_codel",
-		FqCodel: &tc.FqCodel{
-			ECN:    &ecn,
-			Limit:  &limit,
-			Flows:  &flows,
-			Target: &target,
-		},
-	}
-
 	template.Qdiscs["root"] = tc.Object{
 		Msg: tc.Msg{
 			Family:  unix.AF_UNSPEC,
@@ -51,43 +116,11 @@ func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed,
 		Attribute: tc.Attribute{
 			Kind: "hfsc",
 			HfscQOpt: &tc.HfscQOpt{
-				DefCls: 2,
-			},
-			Stab: &tc.Stab{
-				Base: &tc.SizeSpec{
-					LinkLayer: 1,
-					MTU:       1500,
-				},
+				// unclassified traffic is handled as normal traffic
+				DefCls: 0x22,
 			},
 		},
 	}
-	template.Qdiscs["prio"] = tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x21, 0x0),
-			Parent:  core.BuildHandle(0x1, 0x21),
-		},
-		Attribute: defaultFqCodel,
-	}
-	template.Qdiscs["normal"] = tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x22, 0x0),
-			Parent:  core.BuildHandle(0x1, 0x22),
-		},
-		Attribute: defaultFqCodel,
-	}
-	template.Qdiscs["low"] = tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x23, 0x0),
-			Parent:  core.BuildHandle(0x1, 0x23),
-		},
-		Attribute: defaultFqCodel,
-	}
 
 	// limit the interface to the speed determined by interfaceSpeed
 	interfaceClass := tc.Object{
@@ -106,8 +139,8 @@ func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed,
 			},
 		},
 	}
-	SetSC(interfaceClass.Attribute.Hfsc, uint32(interfaceSpeed), 0, 0)
-	SetUL(interfaceClass.Attribute.Hfsc, uint32(interfaceSpeed), 0, 0)
+	SetSC(interfaceClass.Attribute.Hfsc, 0, 0, interfaceSpeed)
+	SetUL(interfaceClass.Attribute.Hfsc, 0, 0, interfaceSpeed)
 	template.Classes["interface"] = interfaceClass
 
 	// set an upper limit that is determined by the ISP link
@@ -127,69 +160,82 @@ func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed,
 			},
 		},
 	}
-	SetSC(internetClass.Attribute.Hfsc, uint32(internetSpeed), 0, 0)
-	SetUL(interfaceClass.Attribute.Hfsc, uint32(internetSpeed), 0, 0)
+	SetSC(internetClass.Attribute.Hfsc, 0, 0, internetSpeed)
+	SetUL(internetClass.Attribute.Hfsc, 0, 0, internetSpeed)
 	template.Classes["internet"] = internetClass
 
-	// give the high prio traffic low latency and high bandwidth assurance
-	prioClass := tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x1, 0x21),
-			Parent:  core.BuildHandle(0x1, 0x2),
-		},
-		Attribute: tc.Attribute{
-			Kind: "hfsc",
-			Hfsc: &tc.Hfsc{
-				Rsc: &tc.ServiceCurve{},
-				Usc: &tc.ServiceCurve{},
-				Fsc: &tc.ServiceCurve{},
+	// high prio traffic gets low latency and high bandwidth assurance, normal traffic will still be
+	// able to talk with less latency assurance and low prio traffic has lower bandwidth and even
+	// less latency assurances
+	for _, c := range []struct {
+		name   string
+		minor  uint32
+		params SimpleClass
+	}{
+		{"prio", 0x21, params.Prio},
+		{"normal", 0x22, params.Normal},
+		{"low", 0x23, params.Low},
+	} {
+		class := tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: uint32(interf.Index),
+				Handle:  core.BuildHandle(0x1, c.minor),
+				Parent:  core.BuildHandle(0x1, 0x2),
 			},
-		},
-	}
-	SetSC(prioClass.Attribute.Hfsc, uint32(priospeed), 0, 0)
-	template.Classes["prio"] = prioClass
-
-	// normal traffic will still be able to talk, with less latency assurance
-	normalClass := tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x1, 0x22),
-			Parent:  core.BuildHandle(0x1, 0x2),
-		},
-		Attribute: tc.Attribute{
-			Kind: "hfsc",
-			Hfsc: &tc.Hfsc{
-				Rsc: &tc.ServiceCurve{},
-				Usc: &tc.ServiceCurve{},
-				Fsc: &tc.ServiceCurve{},
+			Attribute: tc.Attribute{
+				Kind: "hfsc",
+				Hfsc: &tc.Hfsc{
+					Rsc: &tc.ServiceCurve{},
+					Usc: &tc.ServiceCurve{},
+					Fsc: &tc.ServiceCurve{},
+				},
 			},
-		},
-	}
-	SetSC(normalClass.Attribute.Hfsc, uint32(normalspeed), 60000, 0)
-	template.Classes["normal"] = normalClass
-
-	// low prio traffic has lower bandwidth and even less latency assurances
-	lowClass := tc.Object{
-		Msg: tc.Msg{
-			Family:  unix.AF_UNSPEC,
-			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x1, 0x23),
-			Parent:  core.BuildHandle(0x1, 0x2),
-		},
-		Attribute: tc.Attribute{
-			Kind: "hfsc",
-			Hfsc: &tc.Hfsc{
-				Rsc: &tc.ServiceCurve{},
-				Usc: &tc.ServiceCurve{},
-				Fsc: &tc.ServiceCurve{},
+		}
+		template.Classes[c.name] = class
+		template.setCurves(c.name, c.params.curves(internetspeed, umax, params.Latency))
+
+		// the parameters are validated before the profile is created
+		leaf, _ := c.params.leaf(params.ingress)
+		template.Qdiscs[c.name] = tc.Object{
+			Msg: tc.Msg{
+				Family:  unix.AF_UNSPEC,
+				Ifindex: uint32(interf.Index),
+				Handle:  core.BuildHandle(c.minor, 0x0),
+				Parent:  core.BuildHandle(0x1, c.minor),
 			},
-		},
+			Attribute: leaf,
+		}
+		if netem, _ := c.params.linkConditions(); netem != nil {
+			template.setNetem(c.name, *netem)
+		}
+		if red := leafRed(c.params.Qdisc); red != nil {
+			template.setRed(c.name, *red)
+		}
+		if c.params.DSCP != "" && !params.ingress {
+			if template.DSCP == nil {
+				template.DSCP = make(map[string]string)
+			}
+			template.DSCP[c.name] = c.params.DSCP
+		}
+	}
+
+	// classify the flows of the classes before the marks
+	prio := uint16(flowPrioBase)
+	for _, name := range []string{"prio", "normal", "low"} {
+		for i, m := range params.classes()[name].Match {
+			// the matches are validated with the parameters
+			filters, extra, _ := flowerFilters(m, uint32(interf.Index), core.BuildHandle(0x1, 0x0), template.Classes[name].Handle, false, prio)
+			for j, f := range filters {
+				key := fmt.Sprintf("%s/match%d/%d", name, i, j)
+				template.Filters[key] = f
+				if extra != nil {
+					template.setFlowerExtra(key, *extra)
+				}
+			}
+			prio += uint16(len(filters))
+		}
 	}
-	SetSC(lowClass.Attribute.Hfsc, uint32(lowspeed), 120000, 0)
-	template.Classes["low"] = lowClass
 
 	// set the filter for high prio traffic
 	prioHandle := template.Classes["prio"].Msg.Handle
@@ -262,37 +308,154 @@ func createQoSSimple(ctx context.Context, interf net.Interface, interfaceSpeed,
 	return template
 }
 
-func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed, internetSpeed int) TcConfig {
+// createQoSNetem emulates a link with a netem root qdisc. Unless the link conditions set a rate,
+// the link is limited to the internet speed.
+func createQoSNetem(interf net.Interface, internetSpeed Rate, params Netem) TcConfig {
+	template := TcConfig{
+		Qdiscs:  make(map[string]tc.Object),
+		Classes: make(map[string]tc.Object),
+		Filters: make(map[string]tc.Object),
+	}
+	if params.Rate == 0 {
+		params.Rate = internetSpeed
+	}
+	template.Qdiscs["root"] = tc.Object{
+		Msg: tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: uint32(interf.Index),
+			Handle:  core.BuildHandle(0x1, 0x0),
+			Parent:  tc.HandleRoot,
+		},
+	}
+	template.setNetem("root", params)
+	return template
+}
+
+// LanpartyProfile holds the parameters of the lanparty profile
+type LanpartyProfile struct {
+	// Qdisc is the leaf qdisc of every class in the notation of the `tc` command-line tool, the
+	// default is fq_codel
+	Qdisc string
+	// Qdiscs replaces the leaf qdisc of the classes by name, eg. `crew = "cake besteffort"`
+	Qdiscs map[string]string
+	// Latency builds the curves of the classes from latency targets, like the simple profile
+	Latency bool
+}
+
+// lanpartyLeafs are the names of the leaf qdiscs of the lanparty profile
+var lanpartyLeafs = []string{"prio1", "prio2", "browsing", "downloading", "thrash", "crew", "routing"}
+
+// lanpartyAliases are the former names of the leaf qdiscs of the lanparty profile, which are still
+// accepted
+var lanpartyAliases = map[string]string{"dowloading": "downloading"}
+
+// leaf returns the leaf qdisc of the class name, set with its name or a former name
+func (p LanpartyProfile) leaf(name string) string {
+	if qdisc, ok := p.Qdiscs[name]; ok {
+		return qdisc
+	}
+	for alias, leaf := range lanpartyAliases {
+		if qdisc, ok := p.Qdiscs[alias]; ok && leaf == name {
+			return qdisc
+		}
+	}
+	return p.Qdisc
+}
+
+// Validate checks the leaf qdiscs of the profile
+func (p LanpartyProfile) Validate() error {
+	var problems []string
+	for name := range p.Qdiscs {
+		_, known := lanpartyAliases[name]
+		for _, leaf := range lanpartyLeafs {
+			known = known || leaf == name
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("unknown class %q, expected one of %v", name, lanpartyLeafs))
+		}
+	}
+	for _, name := range lanpartyLeafs {
+		if _, err := leafQdisc(p.leaf(name)); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid lanparty profile: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// ParseQuery overrides the parameters of the profile with the query parameters of an API call, eg.
+// `lanparty.qdisc=cake&lanparty.crew.qdisc=sfq&lanparty.latency=true`
+func (p *LanpartyProfile) ParseQuery(query url.Values) error {
+	// the leaf qdiscs of the config are shared, they are changed on a copy
+	qdiscs := make(map[string]string)
+	for name, qdisc := range p.Qdiscs {
+		qdiscs[name] = qdisc
+	}
+	for key, values := range query {
+		param := strings.TrimPrefix(key, "lanparty.")
+		if param == key || len(values) == 0 {
+			continue
+		}
+		switch {
+		case param == "qdisc":
+			p.Qdisc = values[0]
+		case param == "latency":
+			latency, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", key, values[0])
+			}
+			p.Latency = latency
+		case strings.HasSuffix(param, ".qdisc"):
+			name := strings.TrimSuffix(param, ".qdisc")
+			if leaf, ok := lanpartyAliases[name]; ok {
+				name = leaf
+			}
+			qdiscs[name] = values[0]
+		default:
+			return fmt.Errorf("invalid %s %q: unknown parameter", key, values[0])
+		}
+	}
+	if len(qdiscs) > 0 {
+		p.Qdiscs = qdiscs
+	}
+	return nil
+}
+
+func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed, internetSpeed Rate, params LanpartyProfile) TcConfig {
 	// Enable logging and serve the website
 	ln.Log(ctx, ln.Action("qos_setup"))
 
-	internetspeed := math.Ceil(float64(internetSpeed) * 0.95)
-	reservedspeed := math.Ceil(float64(interfaceSpeed) * 0.2)
+	internetspeed := internetSpeed.Scale(0.95)
+	reservedspeed := interfaceSpeed.Scale(0.2)
 
-	prio1speed := math.Ceil(internetspeed * 0.4)
-	prio2speed := math.Ceil(internetspeed * 0.4)
-	otherspeed := math.Ceil(internetspeed * 0.2)
+	prio1speed := internetspeed.Scale(0.4)
+	prio2speed := internetspeed.Scale(0.4)
+	otherspeed := internetspeed.Scale(0.2)
 
-	httpspeed := math.Ceil(otherspeed * 0.7)
-	browserspeed := math.Ceil(httpspeed * 0.7)
-	downloadspeed := math.Ceil(httpspeed * 0.3)
+	httpspeed := otherspeed.Scale(0.7)
+	browserspeed := httpspeed.Scale(0.7)
+	downloadspeed := httpspeed.Scale(0.3)
 
-	thrashspeed := math.Ceil(otherspeed * 0.1)
-	crewspeed := math.Ceil(otherspeed * 0.2)
+	thrashspeed := otherspeed.Scale(0.1)
+	crewspeed := otherspeed.Scale(0.2)
 
-	ecn := uint32(0)
-	limit := uint32(1200)
-	flows := uint32(65535)
-	target := uint32(5000)
+	// curve builds a curve that gives the class rate for d. With latency, it guarantees rate and
+	// sends a full packet within d.
+	umax := packetSize(interf)
+	curve := func(d time.Duration, rate Rate) *Curve {
+		c := Curve{M1: rate, D: d}
+		if params.Latency {
+			c = CurveForLatency(LatencyTarget{Umax: umax, Dmax: d, Rate: rate})
+		}
+		return &c
+	}
 
-	defaultFqCodel := tc.Attribute{
-		Kind: "fq_codel",
-		FqCodel: &tc.FqCodel{
-			ECN:    &ecn,
-			Limit:  &limit,
-			Flows:  &flows,
-			Target: &target,
-		},
+	// the parameters are validated before the profile is created
+	leaf := func(name string) tc.Attribute {
+		attr, _ := leafQdisc(params.leaf(name))
+		return attr
 	}
 
 	template := TcConfig{
@@ -313,12 +476,6 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			HfscQOpt: &tc.HfscQOpt{
 				DefCls: 3,
 			},
-			Stab: &tc.Stab{
-				Base: &tc.SizeSpec{
-					LinkLayer: 1,
-					MTU:       1500,
-				},
-			},
 		},
 	}
 	template.Qdiscs["prio1"] = tc.Object{
@@ -328,7 +485,7 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x11, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x11),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("prio1"),
 	}
 	template.Qdiscs["prio2"] = tc.Object{
 		Msg: tc.Msg{
@@ -337,7 +494,7 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x12, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x12),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("prio2"),
 	}
 	template.Qdiscs["browsing"] = tc.Object{
 		Msg: tc.Msg{
@@ -346,16 +503,16 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x31, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x31),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("browsing"),
 	}
-	template.Qdiscs["dowloading"] = tc.Object{
+	template.Qdiscs["downloading"] = tc.Object{
 		Msg: tc.Msg{
 			Family:  unix.AF_UNSPEC,
 			Ifindex: uint32(interf.Index),
 			Handle:  core.BuildHandle(0x32, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x32),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("downloading"),
 	}
 	template.Qdiscs["thrash"] = tc.Object{
 		Msg: tc.Msg{
@@ -364,7 +521,7 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x22, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x22),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("thrash"),
 	}
 	template.Qdiscs["crew"] = tc.Object{
 		Msg: tc.Msg{
@@ -373,7 +530,7 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x23, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x23),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("crew"),
 	}
 	template.Qdiscs["routing"] = tc.Object{
 		Msg: tc.Msg{
@@ -382,7 +539,7 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			Handle:  core.BuildHandle(0x3, 0x0),
 			Parent:  core.BuildHandle(0x1, 0x3),
 		},
-		Attribute: defaultFqCodel,
+		Attribute: leaf("routing"),
 	}
 
 	interfaceClass := tc.Object{
@@ -401,8 +558,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetSC(interfaceClass.Attribute.Hfsc, uint32(interfaceSpeed), 0, 0)
-	SetUL(interfaceClass.Attribute.Hfsc, uint32(interfaceSpeed), 0, 0)
+	SetSC(interfaceClass.Attribute.Hfsc, 0, 0, interfaceSpeed)
+	SetUL(interfaceClass.Attribute.Hfsc, 0, 0, interfaceSpeed)
 	template.Classes["interface"] = interfaceClass
 
 	internetClass := tc.Object{
@@ -421,8 +578,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetSC(internetClass.Attribute.Hfsc, uint32(internetSpeed), 0, 0)
-	SetUL(interfaceClass.Attribute.Hfsc, uint32(internetSpeed), 0, 0)
+	SetSC(internetClass.Attribute.Hfsc, 0, 0, internetSpeed)
+	SetUL(internetClass.Attribute.Hfsc, 0, 0, internetSpeed)
 	template.Classes["internet"] = internetClass
 
 	prio1Class := tc.Object{
@@ -441,8 +598,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetSC(prio1Class.Attribute.Hfsc, uint32(prio1speed), 0, 0)
 	template.Classes["prio1"] = prio1Class
+	template.setCurves("prio1", ClassCurves{SC: curve(0, prio1speed)})
 
 	prio2Class := tc.Object{
 		Msg: tc.Msg{
@@ -460,8 +617,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetSC(prio2Class.Attribute.Hfsc, uint32(prio2speed), 60000, 0)
 	template.Classes["prio2"] = prio2Class
+	template.setCurves("prio2", ClassCurves{SC: curve(60*time.Millisecond, prio2speed)})
 
 	otherClass := tc.Object{
 		Msg: tc.Msg{
@@ -479,8 +636,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(otherClass.Attribute.Hfsc, uint32(otherspeed), 100000, 0)
 	template.Classes["other"] = otherClass
+	template.setCurves("other", ClassCurves{LS: curve(100*time.Millisecond, otherspeed)})
 
 	httpClass := tc.Object{
 		Msg: tc.Msg{
@@ -498,8 +655,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(httpClass.Attribute.Hfsc, uint32(httpspeed), 0, 0)
 	template.Classes["http"] = httpClass
+	template.setCurves("http", ClassCurves{LS: curve(0, httpspeed)})
 
 	browseClass := tc.Object{
 		Msg: tc.Msg{
@@ -517,8 +674,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetSC(browseClass.Attribute.Hfsc, uint32(browserspeed), 0, 0)
 	template.Classes["browse"] = browseClass
+	template.setCurves("browse", ClassCurves{SC: curve(0, browserspeed)})
 
 	downloadClass := tc.Object{
 		Msg: tc.Msg{
@@ -536,8 +693,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(downloadClass.Attribute.Hfsc, uint32(downloadspeed), 10000, 0)
 	template.Classes["download"] = downloadClass
+	template.setCurves("download", ClassCurves{LS: curve(10*time.Millisecond, downloadspeed)})
 
 	crewClass := tc.Object{
 		Msg: tc.Msg{
@@ -555,14 +712,14 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(crewClass.Attribute.Hfsc, uint32(crewspeed), 0, 0)
 	template.Classes["crew"] = crewClass
+	template.setCurves("crew", ClassCurves{LS: curve(0, crewspeed)})
 
 	thrashClass := tc.Object{
 		Msg: tc.Msg{
 			Family:  unix.AF_UNSPEC,
 			Ifindex: uint32(interf.Index),
-			Handle:  core.BuildHandle(0x1, 0x23),
+			Handle:  core.BuildHandle(0x1, 0x22),
 			Parent:  core.BuildHandle(0x1, 0x13),
 		},
 		Attribute: tc.Attribute{
@@ -574,8 +731,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(thrashClass.Attribute.Hfsc, uint32(thrashspeed), 50000, 0)
 	template.Classes["thrash"] = thrashClass
+	template.setCurves("thrash", ClassCurves{LS: curve(50*time.Millisecond, thrashspeed)})
 
 	reservedClass := tc.Object{
 		Msg: tc.Msg{
@@ -593,8 +750,8 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 			},
 		},
 	}
-	SetLS(reservedClass.Attribute.Hfsc, uint32(reservedspeed), 0, 0)
 	template.Classes["reserved"] = reservedClass
+	template.setCurves("reserved", ClassCurves{LS: curve(0, reservedspeed)})
 
 	prio1Handle := template.Classes["prio1"].Msg.Handle
 	template.Filters["prio1"] = tc.Object{
@@ -736,5 +893,10 @@ func createQoSLanparty(ctx context.Context, interf net.Interface, interfaceSpeed
 		},
 	}
 
+	for _, name := range lanpartyLeafs {
+		if red := leafRed(params.leaf(name)); red != nil {
+			template.setRed(name, *red)
+		}
+	}
 	return template
 }
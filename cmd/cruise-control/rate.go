@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Rate is a bandwidth in bits per second. The kernel expects most rates in bytes per second, the
+// conversion to the kernel representation happens when the TC objects are built.
+type Rate uint64
+
+// Common rates, using the SI prefixes like the `tc` command-line tool does
+const (
+	Bit  Rate = 1
+	Kbit      = 1000 * Bit
+	Mbit      = 1000 * Kbit
+	Gbit      = 1000 * Mbit
+	Tbit      = 1000 * Gbit
+)
+
+// rateUnits maps the units known to the `tc` command-line tool on their size in bits per second.
+// A number without a unit is a rate in bits per second.
+var rateUnits = map[string]float64{
+	"": 1, "bit": 1, "bps": 8,
+	"kbit": 1e3, "mbit": 1e6, "gbit": 1e9, "tbit": 1e12,
+	"kbps": 8e3, "mbps": 8e6, "gbps": 8e9, "tbps": 8e12,
+	"kibit": 1 << 10, "mibit": 1 << 20, "gibit": 1 << 30, "tibit": 1 << 40,
+	"kibps": 8 << 10, "mibps": 8 << 20, "gibps": 8 << 30, "tibps": 8 << 40,
+}
+
+// ParseRate parses a rate with a unit, like "500mbit", "2.5gbit" or "100kbps". It follows the
+// conventions of the `tc` command-line tool: "bit" units are bits and "bps" units are bytes per
+// second.
+func ParseRate(s string) (Rate, error) {
+	v, unit, err := splitUnit(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %v", s, err)
+	}
+	factor, ok := rateUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: unknown unit %q", s, unit)
+	}
+	bits := math.Round(v * factor)
+	if bits > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid rate %q: too large", s)
+	}
+	return Rate(bits), nil
+}
+
+// RateFromBytes creates a rate from a number of bytes per second, as used by the kernel
+func RateFromBytes(bytes uint64) Rate {
+	return Rate(bytes * 8)
+}
+
+// BytesPerSecond returns the rate in bytes per second, rounded up
+func (r Rate) BytesPerSecond() uint64 {
+	return (uint64(r) + 7) / 8
+}
+
+// Scale multiplies the rate with a factor, rounding up to the next bit per second
+func (r Rate) Scale(factor float64) Rate {
+	return Rate(math.Ceil(float64(r) * factor))
+}
+
+// String renders the rate like the `tc` command-line tool does
+func (r Rate) String() string {
+	for _, unit := range []struct {
+		rate Rate
+		name string
+	}{{Tbit, "Tbit"}, {Gbit, "Gbit"}, {Mbit, "Mbit"}, {Kbit, "Kbit"}} {
+		if r >= unit.rate {
+			return strconv.FormatFloat(float64(r)/float64(unit.rate), 'f', -1, 64) + unit.name
+		}
+	}
+	return strconv.FormatUint(uint64(r), 10) + "bit"
+}
+
+// MarshalText renders the rate with its unit, so it can be used in the config and JSON
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a rate with its unit
+func (r *Rate) UnmarshalText(text []byte) error {
+	rate, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// hfsc converts the rate into the representation of the HFSC service curves, which is in bytes per
+// second. The service curves only have 32 bit fields, so rates above ~34.3Gbit saturate.
+func (r Rate) hfsc() uint32 {
+	bytes := r.BytesPerSecond()
+	if bytes > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(bytes)
+}
+
+// rate64 converts the rate into the representation of HTB and police. Rates that do not fit the
+// legacy 32 bit field (in bytes per second) saturate the legacy field and are returned as 64 bit
+// rate attribute, which the kernel supports since 3.13.
+func (r Rate) rate64() (uint32, *uint64) {
+	bytes := r.BytesPerSecond()
+	if bytes < math.MaxUint32 {
+		return uint32(bytes), nil
+	}
+	return math.MaxUint32, &bytes
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	rates := map[string]Rate{
+		"8":        8,
+		"8bit":     8,
+		"1kbit":    Kbit,
+		"500mbit":  500 * Mbit,
+		"2.5gbit":  2500 * Mbit,
+		"25Gbit":   25 * Gbit,
+		"100kbps":  800 * Kbit,
+		"1mibit":   1 << 20,
+		"12500bps": 100 * Kbit,
+	}
+	for s, want := range rates {
+		got, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", s, err)
+		} else if got != want {
+			t.Errorf("expected %q to be %d bit/s, got %d", s, want, got)
+		}
+	}
+	for _, s := range []string{"", "fast", "10furlong", "-1mbit", "1e30tbit"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Errorf("expected ParseRate(%q) to fail", s)
+		}
+	}
+}
+
+func TestRateString(t *testing.T) {
+	rates := map[Rate]string{
+		0:             "0bit",
+		999:           "999bit",
+		Kbit:          "1Kbit",
+		2500 * Mbit:   "2.5Gbit",
+		25 * Gbit:     "25Gbit",
+		3 * Tbit:      "3Tbit",
+		1500*Mbit + 1: "1.500000001Gbit",
+	}
+	for rate, want := range rates {
+		if got := rate.String(); got != want {
+			t.Errorf("expected %d bit/s to render as %q, got %q", rate, want, got)
+		}
+		parsed, err := ParseRate(rate.String())
+		if err != nil || parsed != rate {
+			t.Errorf("expected %q to parse back into %d bit/s, got %d (%v)", rate.String(), rate, parsed, err)
+		}
+	}
+}
+
+func TestRateJSON(t *testing.T) {
+	var conf struct{ Speed Rate }
+	if err := json.Unmarshal([]byte(`{"Speed": "2.5gbit"}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Speed != 2500*Mbit {
+		t.Errorf("expected 2.5gbit, got %s", conf.Speed)
+	}
+	out, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"Speed":"2.5Gbit"}` {
+		t.Errorf("unexpected JSON %s", out)
+	}
+}
+
+func TestRateKernel(t *testing.T) {
+	// 100mbit fits the legacy 32 bit fields
+	if got := (100 * Mbit).hfsc(); got != 12500000 {
+		t.Errorf("expected 100mbit to be 12500000 bytes/s, got %d", got)
+	}
+	legacy, rate64 := (100 * Mbit).rate64()
+	if legacy != 12500000 || rate64 != nil {
+		t.Errorf("expected 100mbit to fit 32 bits, got %d and %v", legacy, rate64)
+	}
+
+	// 40gbit does not fit the legacy fields anymore
+	if got := (40 * Gbit).hfsc(); got != math.MaxUint32 {
+		t.Errorf("expected 40gbit to saturate the HFSC rate, got %d", got)
+	}
+	legacy, rate64 = (40 * Gbit).rate64()
+	if legacy != math.MaxUint32 || rate64 == nil || *rate64 != 5e9 {
+		t.Errorf("expected 40gbit to use the 64 bit rate, got %d and %v", legacy, rate64)
+	}
+
+	// rates are rounded up to the next byte, so they never end up as 0
+	if got := Rate(1).BytesPerSecond(); got != 1 {
+		t.Errorf("expected 1bit to round up to 1 byte/s, got %d", got)
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	speeds := map[string]Rate{
+		"100":     100 * Mbit,
+		"2.5gbit": 2500 * Mbit,
+		"10Gbit":  10 * Gbit,
+	}
+	for s, want := range speeds {
+		if got, err := parseSpeed(s); err != nil || got != want {
+			t.Errorf("expected speed %q to be %s, got %s (%v)", s, want, got, err)
+		}
+	}
+	if _, err := parseSpeed(""); err == nil {
+		t.Error("expected an empty speed to fail")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-tc"
+)
+
+// Red holds the options of a red or choke qdisc, which the parameters of the kernel are derived
+// from like the `tc` command-line tool does. The kernel requires a table to age the average queue
+// after the link was idle, which it does not report and go-tc can not encode, so the options are
+// kept next to the qdisc. It is written in the notation of the `tc` command-line tool in traffic
+// files, eg. "red limit 400000 avpkt 1000 bandwidth 10Mbit ecn".
+type Red struct {
+	// Kind is "red" or "choke"
+	Kind string
+	// Limit is the size of the queue, Min and Max the average queue at which packets are dropped at
+	// random and all packets are dropped. They are in bytes for red and in packets for choke.
+	Limit uint32
+	Min   uint32
+	Max   uint32
+	// Avpkt is the average packet size and Burst the number of packets that pass a full queue
+	Avpkt uint32
+	Burst uint32
+	// Probability is the chance to drop a packet when the average queue reaches Max
+	Probability float64
+	// Bandwidth ages the average queue after the link was idle, it is the bandwidth of the class
+	Bandwidth Rate
+	// ECN marks packets instead of dropping them, Harddrop drops them anyway above Max. Adaptive red
+	// adjusts the probability to the load.
+	ECN      bool
+	Harddrop bool
+	Adaptive bool
+}
+
+// flags of red and choke from include/uapi/linux/pkt_sched.h
+const (
+	redECN      = 1
+	redHarddrop = 2
+	redAdaptive = 4
+)
+
+// red defaults of the `tc` command-line tool
+const (
+	redProbability = 0.02
+	redAvpkt       = 1000
+	redBandwidth   = 10 * Mbit
+	// redStabSize is the number of cells in the table that ages the average queue
+	redStabSize = 256
+)
+
+// parseRed parses the options of a red or choke qdisc in the notation of the `tc` command-line
+// tool and fills in its defaults
+func parseRed(args *tcArgs, kind string) (Red, error) {
+	r := Red{Kind: kind, Probability: redProbability}
+	if kind == "choke" {
+		r.Avpkt = redAvpkt
+	}
+	// the thresholds of choke are in packets
+	threshold := func(key string) (uint32, error) {
+		if kind == "choke" {
+			v, err := parseUintArg(args, key, 0, 32)
+			return uint32(v), err
+		}
+		return parseSizeArg(args, key)
+	}
+	var err error
+	for err == nil {
+		arg, ok := args.next()
+		if !ok {
+			break
+		}
+		switch arg {
+		case "limit":
+			r.Limit, err = threshold(arg)
+		case "min":
+			r.Min, err = threshold(arg)
+		case "max":
+			r.Max, err = threshold(arg)
+		case "avpkt":
+			r.Avpkt, err = parseSizeArg(args, arg)
+		case "burst":
+			var v uint64
+			v, err = parseUintArg(args, arg, 0, 32)
+			r.Burst = uint32(v)
+		case "probability":
+			var s string
+			if s, err = args.value(arg); err == nil {
+				r.Probability, err = strconv.ParseFloat(s, 64)
+				if err != nil || r.Probability <= 0 || r.Probability > 1 {
+					err = fmt.Errorf("invalid probability %q, expected a chance between 0 and 1", s)
+				}
+			}
+		case "bandwidth":
+			r.Bandwidth, err = parseRateArg(args, arg)
+		case "ecn":
+			r.ECN = true
+		case "harddrop", "adaptive", "adaptative":
+			if kind != "red" {
+				err = unsupportedOption(kind, arg)
+			}
+			r.Harddrop = r.Harddrop || arg == "harddrop"
+			r.Adaptive = r.Adaptive || arg != "harddrop"
+		default:
+			err = unsupportedOption(kind, arg)
+		}
+	}
+	if err != nil {
+		return r, err
+	}
+	if r, err = r.withDefaults(); err != nil {
+		return r, err
+	}
+	_, _, _, err = r.parameters()
+	return r, err
+}
+
+// withDefaults derives the thresholds and burst that are not set from the limit, following the
+// recommendations of Sally Floyd like the `tc` command-line tool does
+func (r Red) withDefaults() (Red, error) {
+	switch {
+	case r.Kind == "red" && (r.Limit == 0 || r.Avpkt == 0):
+		return r, errors.New("red requires a limit and avpkt")
+	case r.Kind == "choke" && (r.Limit == 0 || r.Bandwidth == 0):
+		return r, errors.New("choke requires a limit and bandwidth")
+	}
+	if r.Max == 0 {
+		r.Max = r.Limit / 4
+		if r.Kind == "red" && r.Min != 0 {
+			r.Max = r.Min * 3
+		}
+	}
+	if r.Min == 0 {
+		r.Min = r.Max / 3
+	}
+	if r.Burst == 0 {
+		r.Burst = (2*r.Min + r.Max) / 3
+		if r.Kind == "red" {
+			r.Burst /= r.Avpkt
+		}
+	}
+	if r.Bandwidth == 0 {
+		r.Bandwidth = redBandwidth
+	}
+	switch {
+	case r.Max > r.Limit:
+		return r, fmt.Errorf("%s max %d exceeds the limit %d", r.Kind, r.Max, r.Limit)
+	case r.Min >= r.Max:
+		return r, fmt.Errorf("%s min %d must be below max %d", r.Kind, r.Min, r.Max)
+	}
+	return r, nil
+}
+
+// parameters derives the parameters of the kernel: the weight of the average queue, the drop
+// probability, the table that ages the average queue after an idle period and max_P
+func (r Red) parameters() (tc.RedQOpt, uint32, []byte, error) {
+	opt := tc.RedQOpt{Limit: r.Limit, QthMin: r.Min, QthMax: r.Max}
+	qmin := r.Min
+	if r.Kind == "choke" {
+		qmin *= r.Avpkt
+	}
+	wlog, err := redEwma(qmin, r.Burst, r.Avpkt)
+	if err != nil {
+		return opt, 0, nil, err
+	}
+	plog, err := redProbabilityLog(r.Min, r.Max, r.Probability)
+	if err != nil {
+		return opt, 0, nil, err
+	}
+	scellLog, stab, err := redIdleDamping(wlog, r.Avpkt, r.Bandwidth)
+	if err != nil {
+		return opt, 0, nil, err
+	}
+	opt.Wlog, opt.Plog, opt.ScellLog = wlog, plog, scellLog
+	if r.ECN {
+		opt.Flags |= redECN
+	}
+	if r.Harddrop {
+		opt.Flags |= redHarddrop
+	}
+	if r.Adaptive {
+		opt.Flags |= redAdaptive
+	}
+	maxP := math.Min(r.Probability*(1<<32), math.MaxUint32)
+	return opt, uint32(maxP), stab, nil
+}
+
+// redEwma returns the log of the weight of the average queue, so that burst packets of avpkt bytes
+// pass a queue of qmin bytes
+func redEwma(qmin, burst, avpkt uint32) (uint8, error) {
+	a := float64(burst) + 1 - float64(qmin)/float64(avpkt)
+	if a < 1 {
+		return 0, fmt.Errorf("burst %d is too small, try burst %d", burst, 1+qmin/avpkt)
+	}
+	w := 0.5
+	for wlog := 1; wlog < 32; wlog, w = wlog+1, w/2 {
+		if a <= (1-math.Pow(1-w, float64(burst)))/w {
+			return uint8(wlog), nil
+		}
+	}
+	return 0, fmt.Errorf("burst %d is too large", burst)
+}
+
+// redProbabilityLog returns the log of the range of the average queue that the drop probability
+// grows over
+func redProbabilityLog(qmin, qmax uint32, probability float64) (uint8, error) {
+	if qmax == qmin {
+		return 0, nil
+	}
+	p := probability / float64(qmax-qmin)
+	for plog := 0; plog < 32; plog++ {
+		if p > 1 {
+			return uint8(plog), nil
+		}
+		p *= 2
+	}
+	return 0, fmt.Errorf("probability %v is too small", probability)
+}
+
+// redIdleDamping returns the table that ages the average queue after the link was idle, in cells of
+// 2^scellLog psched ticks. A cell holds how often the average is halved.
+func redIdleDamping(wlog uint8, avpkt uint32, bandwidth Rate) (uint8, []byte, error) {
+	xmit := 1e6 * float64(avpkt) / float64(bandwidth.BytesPerSecond()) * ticksPerUsec
+	lw := -math.Log(1-1/math.Exp2(float64(wlog))) / xmit
+	maxTime := 31 / lw
+	scellLog := 0
+	for ; scellLog < 32 && maxTime/math.Exp2(float64(scellLog)) >= 512; scellLog++ {
+	}
+	if scellLog == 32 {
+		return 0, nil, fmt.Errorf("bandwidth %s is too low for avpkt %d", bandwidth, avpkt)
+	}
+	stab := make([]byte, redStabSize)
+	for i := 1; i < redStabSize-1; i++ {
+		stab[i] = byte(math.Min(float64(i)*math.Exp2(float64(scellLog))*lw, 31))
+	}
+	stab[redStabSize-1] = 31
+	return uint8(scellLog), stab, nil
+}
+
+// attribute returns the attribute of the red or choke qdisc. The options are validated when they
+// are parsed.
+func (r Red) attribute() tc.Attribute {
+	opt, maxP, _, _ := r.parameters()
+	if r.Kind == "choke" {
+		return tc.Attribute{Kind: r.Kind, Choke: &tc.Choke{Parms: &opt, MaxP: &maxP}}
+	}
+	return tc.Attribute{Kind: r.Kind, Red: &tc.Red{Parms: &opt, MaxP: &maxP}}
+}
+
+// stab returns the table that ages the average queue, nil if the options are invalid
+func (r Red) stab() []byte {
+	_, _, stab, err := r.parameters()
+	if err != nil {
+		return nil
+	}
+	return stab
+}
+
+// String renders the options in the notation of the `tc` command-line tool
+func (r Red) String() string {
+	params := []string{r.Kind, fmt.Sprintf("limit %d min %d max %d avpkt %d burst %d", r.Limit, r.Min, r.Max, r.Avpkt, r.Burst)}
+	params = append(params, "probability "+strconv.FormatFloat(r.Probability, 'f', -1, 64), "bandwidth "+r.Bandwidth.String())
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{{r.ECN, "ecn"}, {r.Harddrop, "harddrop"}, {r.Adaptive, "adaptive"}} {
+		if flag.set {
+			params = append(params, flag.name)
+		}
+	}
+	return strings.Join(params, " ")
+}
+
+// MarshalText renders the options in the notation of the `tc` command-line tool
+func (r Red) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses the options in the notation of the `tc` command-line tool, with the kind
+func (r *Red) UnmarshalText(text []byte) error {
+	args := &tcArgs{args: strings.Fields(string(text))}
+	kind, _ := args.next()
+	if kind != "red" && kind != "choke" {
+		return fmt.Errorf("unknown kind %q, expected red or choke", kind)
+	}
+	red, err := parseRed(args, kind)
+	if err != nil {
+		return err
+	}
+	*r = red
+	return nil
+}
+
+// redOf returns the parameters of a red or choke qdisc
+func redOf(obj tc.Object) *tc.Red {
+	if obj.Choke != nil {
+		return &tc.Red{Parms: obj.Choke.Parms, MaxP: obj.Choke.MaxP}
+	}
+	return obj.Red
+}
+
+// equalRed checks if the red or choke qdiscs a and b drop the same. The max_P of adaptive red
+// follows the load, it is not compared.
+func equalRed(a, b *tc.Red) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Parms == nil {
+		return true
+	}
+	if b.Parms == nil || *a.Parms != *b.Parms {
+		return false
+	}
+	return a.MaxP == nil || a.Parms.Flags&redAdaptive != 0 || (b.MaxP != nil && *a.MaxP == *b.MaxP)
+}
+
+// setRed sets the options of the red or choke qdisc name and keeps them, so the table that ages
+// its average queue can be applied
+func (conf *TcConfig) setRed(name string, red Red) {
+	if conf.Red == nil {
+		conf.Red = make(map[string]Red)
+	}
+	conf.Red[name] = red
+	qdisc := conf.Qdiscs[name]
+	qdisc.Attribute = red.attribute()
+	conf.Qdiscs[name] = qdisc
+}
+
+// applyRed sets the options of the red and choke qdiscs of the config, replacing the options of
+// the TC objects
+func (conf *TcConfig) applyRed() error {
+	for name, red := range conf.Red {
+		qdisc, ok := conf.Qdiscs[name]
+		if !ok {
+			return fmt.Errorf("red for unknown qdisc %q", name)
+		}
+		if qdisc.Kind != "" && qdisc.Kind != red.Kind {
+			return fmt.Errorf("qdisc %q is a %s qdisc, not %s", name, qdisc.Kind, red.Kind)
+		}
+		conf.setRed(name, red)
+	}
+	return nil
+}
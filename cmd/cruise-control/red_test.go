@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+)
+
+func TestRedParameters(t *testing.T) {
+	var r Red
+	if err := r.UnmarshalText([]byte("red limit 400000 min 30000 max 90000 avpkt 1000 burst 55 bandwidth 10mbit ecn")); err != nil {
+		t.Fatal(err)
+	}
+	opt, maxP, stab, err := r.parameters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the values the `tc` command-line tool derives for the same options
+	expected := tc.RedQOpt{Limit: 400000, QthMin: 30000, QthMax: 90000, Wlog: 5, Plog: 22, ScellLog: 15, Flags: redECN}
+	if opt != expected || maxP != 85899345 {
+		t.Errorf("expected %+v and max_P 85899345, got %+v and %d", expected, opt, maxP)
+	}
+	if len(stab) != redStabSize || stab[12] != 0 || stab[13] != 1 || stab[254] != 21 || stab[255] != 31 {
+		t.Errorf("unexpected idle damping table %v", stab)
+	}
+	for i := 1; i < len(stab); i++ {
+		if stab[i] < stab[i-1] {
+			t.Fatalf("expected the idle damping to grow, got %d after %d", stab[i], stab[i-1])
+		}
+	}
+	if text, _ := r.MarshalText(); string(text) != "red limit 400000 min 30000 max 90000 avpkt 1000 burst 55 probability 0.02 bandwidth 10Mbit ecn" {
+		t.Errorf("unexpected rendering %q", text)
+	}
+
+	// the thresholds and burst default to the recommendations of Sally Floyd
+	choke, err := parseRed(&tcArgs{args: strings.Fields("limit 1000 bandwidth 100mbit")}, "choke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if choke.Max != 250 || choke.Min != 83 || choke.Burst != 138 || choke.Avpkt != 1000 {
+		t.Errorf("unexpected choke defaults %+v", choke)
+	}
+	if attr := choke.attribute(); attr.Choke == nil || attr.Choke.Parms.QthMax != 250 || attr.Red != nil {
+		t.Errorf("expected a choke attribute, got %+v", attr)
+	}
+
+	for spec, problem := range map[string]string{
+		"red limit 1000":                                "requires a limit and avpkt",
+		"choke limit 1000":                              "requires a limit and bandwidth",
+		"red limit 1000 avpkt 100 min 500 max 400":      "must be below max",
+		"red limit 1000 avpkt 100 max 2000":             "exceeds the limit",
+		"red limit 100000 avpkt 1000 min 30000 burst 1": "burst 1 is too small",
+		"red limit 1000 avpkt 100 probability 2":        "invalid probability",
+		"choke limit 1000 bandwidth 10mbit harddrop":    "unsupported choke option",
+		"sfq limit 1000":                                "unknown kind",
+	} {
+		if err := r.UnmarshalText([]byte(spec)); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q to fail with %q, got %v", spec, problem, err)
+		}
+	}
+}
+
+func TestTcScriptRed(t *testing.T) {
+	script := `
+tc qdisc add dev eth0 root handle 1: hfsc default 20
+tc class add dev eth0 parent 1: classid 1:10 hfsc sc rate 10mbit
+tc class add dev eth0 parent 1: classid 1:20 hfsc sc rate 10mbit
+tc qdisc add dev eth0 parent 1:10 handle 10: red limit 400000 avpkt 1000 bandwidth 10mbit adaptive
+tc qdisc add dev eth0 parent 1:20 handle 20: choke limit 1000 bandwidth 10mbit ecn
+`
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	if red := conf.Red["10:0"]; red.Kind != "red" || !red.Adaptive || conf.Qdiscs["10:0"].Red == nil {
+		t.Errorf("expected the options of the red qdisc to be kept, got %+v", red)
+	}
+	if choke := conf.Red["20:0"]; choke.Kind != "choke" || !choke.ECN || conf.Qdiscs["20:0"].Choke == nil {
+		t.Errorf("expected the options of the choke qdisc to be kept, got %+v", choke)
+	}
+
+	nodes, _ := NodesFromConfig(conf)
+	for _, n := range nodes {
+		if n.Type != "qdisc" || redOf(n.Object) == nil {
+			continue
+		}
+		if len(n.Damping) != redStabSize {
+			t.Fatalf("expected %s to have its idle damping, got %v", nodeTitle(n), n.Damping)
+		}
+		data, err := marshalRedQdisc(n.Object, n.Damping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live, err := unmarshalQdisc(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !n.equalNode(*live) {
+			t.Errorf("expected %s to equal its decoded qdisc, got %+v", nodeTitle(n), redOf(live.Object))
+		}
+		// adaptive red changes its max_P with the load
+		*redOf(live.Object).MaxP /= 2
+		if adaptive := n.Object.Kind == "red"; n.equalNode(*live) != adaptive {
+			t.Errorf("expected a changed max_P of %s to differ unless it is adaptive", nodeTitle(n))
+		}
+	}
+	if _, err := marshalRedQdisc(conf.Qdiscs["10:0"], nil); err == nil {
+		t.Error("expected red without its idle damping to fail")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// reloadSettle is how long the reloader waits for changes to files to settle, editors often write a
+// file in multiple steps
+const reloadSettle = 500 * time.Millisecond
+
+// ReloadResult is the outcome of loading the config
+type ReloadResult struct {
+	Time time.Time
+	// Trigger is what caused the reload: startup, config, traffic file, SIGHUP or api
+	Trigger string
+	// Accepted is false when the config was rejected and the previous config is still active
+	Accepted   bool
+	Error      string            `json:",omitempty"`
+	Interfaces []InterfaceResult `json:",omitempty"`
+}
+
+// Reloader holds the active config. It validates new versions of the config and the traffic files
+// and reconciles the configured interfaces when they are accepted.
+type Reloader struct {
+	// mu serializes reloads, confMu protects the active config and the last result
+	mu      sync.Mutex
+	confMu  sync.RWMutex
+	conf    Config
+	last    ReloadResult
+	devices map[string]bool
+	timer   *time.Timer
+	// reloaded is called after a config was activated
+	reloaded func()
+	// hosts were added to the host table through the API, they are kept across reloads and replace
+	// the discovered hosts with the same name
+	hosts      map[string]HostPolicy
+	discovered map[string]HostPolicy
+	neighbors  func() ([]lease, error)
+
+	monitor   *DriftMonitor
+	load      func() (Config, error)
+	validate  func(ctx context.Context, conf Config) error
+	reconcile func(ctx context.Context, conf Config) []InterfaceResult
+}
+
+// NewReloader creates a reloader with an active config
+func NewReloader(conf Config, monitor *DriftMonitor) *Reloader {
+	return &Reloader{
+		conf:      conf,
+		devices:   make(map[string]bool),
+		monitor:   monitor,
+		load:      loadConfig,
+		validate:  validateConfig,
+		neighbors: neighborTable,
+		reconcile: func(ctx context.Context, conf Config) []InterfaceResult {
+			return ReconcileInterfaces(ctx, conf, monitor)
+		},
+	}
+}
+
+// Config returns the active config with the discovered hosts and the hosts added through the API
+func (r *Reloader) Config() Config {
+	r.confMu.RLock()
+	defer r.confMu.RUnlock()
+	return r.conf.withHosts(mergeHosts(r.discovered, r.hosts))
+}
+
+// active returns the active config without the discovered hosts and the hosts added through the
+// API
+func (r *Reloader) active() Config {
+	r.confMu.RLock()
+	defer r.confMu.RUnlock()
+	return r.conf
+}
+
+// Last returns the result of the last reload
+func (r *Reloader) Last() ReloadResult {
+	r.confMu.RLock()
+	defer r.confMu.RUnlock()
+	return r.last
+}
+
+// Start reconciles the interfaces of the active config
+func (r *Reloader) Start(ctx context.Context) ReloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.activate(ctx, r.active(), "startup")
+}
+
+// Reload loads and validates the config and the traffic files. A valid config becomes the active
+// config and the interfaces are reconciled with it, otherwise the previous config stays active.
+func (r *Reloader) Reload(ctx context.Context, trigger string) ReloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx = opname.With(ctx, "Reload")
+
+	conf, err := r.load()
+	if err == nil {
+		err = r.validate(ctx, conf.withHosts(r.hostTable()))
+	}
+	if err != nil {
+		result := ReloadResult{Time: time.Now(), Trigger: trigger, Error: err.Error()}
+		ln.Error(ctx, err, ln.F{"trigger": trigger}, ln.Info("rejected the config, keeping the previous config"))
+		r.confMu.Lock()
+		r.last = result
+		r.confMu.Unlock()
+		return result
+	}
+	if conf.Port != r.Config().Port {
+		ln.Log(ctx, ln.Info("the port can not be changed without a restart"))
+	}
+	return r.activate(ctx, conf, trigger)
+}
+
+// activate makes conf the active config and reconciles its interfaces. Devices that are no longer
+// configured are not monitored anymore. The caller must hold mu.
+func (r *Reloader) activate(ctx context.Context, conf Config, trigger string) ReloadResult {
+	r.confMu.Lock()
+	r.conf = conf
+	conf = conf.withHosts(mergeHosts(r.discovered, r.hosts))
+	r.confMu.Unlock()
+
+	result := ReloadResult{Time: time.Now(), Trigger: trigger, Accepted: true}
+	scheduled, err := conf.scheduled(result.Time)
+	if err != nil {
+		// entries are validated with the config, this only happens to the startup config
+		ln.Error(ctx, err, ln.Info("ignoring the schedules"))
+		result.Error = err.Error()
+		scheduled = conf
+	}
+	result.Interfaces = r.reconcile(ctx, scheduled)
+
+	devices := make(map[string]bool)
+	for _, ic := range conf.ManagedInterfaces() {
+		for _, dev := range ic.devices(conf) {
+			devices[dev.Device] = true
+		}
+	}
+	for device := range r.devices {
+		if !devices[device] {
+			r.monitor.Forget(device)
+		}
+	}
+	r.devices = devices
+	ln.Log(ctx, ln.F{"trigger": trigger}, ln.Info("reconciled %d devices", len(result.Interfaces)))
+
+	r.confMu.Lock()
+	r.last = result
+	r.confMu.Unlock()
+	if r.reloaded != nil {
+		r.reloaded()
+	}
+	return result
+}
+
+// validateConfig composes the desired trees of all configured interfaces and their schedule
+// entries, which parses their traffic files and validates the trees
+func validateConfig(ctx context.Context, conf Config) error {
+	var errs []string
+	if err := validateHosts(conf.Hosts); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := conf.Discovery.validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	seen := make(map[string]bool)
+	for _, ic := range conf.ManagedInterfaces() {
+		if ic.Name == "" {
+			errs = append(errs, "interface without name")
+			continue
+		}
+		if seen[ic.Name] {
+			errs = append(errs, fmt.Sprintf("%s: configured more than once", ic.Name))
+		}
+		seen[ic.Name] = true
+		if len(ic.Police) > 0 && ic.IngressMode != IngressPolice {
+			errs = append(errs, fmt.Sprintf("%s: policers need the %q ingress mode", ic.Name, IngressPolice))
+		}
+		errs = append(errs, validateDevices(ctx, conf, ic, ic.Name)...)
+		for _, e := range ic.Schedule {
+			scheduled, err := e.apply(ic, conf)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", ic.Name, err))
+				continue
+			}
+			errs = append(errs, validateDevices(ctx, conf, scheduled, fmt.Sprintf("%s schedule %s", ic.Name, e.Name))...)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// validateDevices composes the desired trees of the devices of an interface
+func validateDevices(ctx context.Context, conf Config, ic InterfaceConfig, name string) []string {
+	var errs []string
+	for _, dev := range ic.devices(conf) {
+		if dev.Profile.Speed == 0 && len(dev.Profile.Police) == 0 {
+			// reported when the interface is reconciled
+			continue
+		}
+		interf := net.Interface{Name: dev.Device}
+		if live, err := net.InterfaceByName(dev.Device); err == nil {
+			interf = *live
+		}
+		if _, _, err := dev.Profile.desired(ctx, interf); err != nil {
+			errs = append(errs, fmt.Sprintf("%s (%s): %v", name, dev.Direction, err))
+		}
+	}
+	return errs
+}
+
+// trafficFiles returns the traffic files the config refers to
+func (c Config) trafficFiles() []string {
+	files := make(map[string]bool)
+	if c.TrafficFile != "" {
+		files[c.TrafficFile] = true
+	}
+	for _, ic := range c.ManagedInterfaces() {
+		if ic.TrafficFile != "" {
+			files[ic.TrafficFile] = true
+		}
+	}
+	var list []string
+	for file := range files {
+		list = append(list, file)
+	}
+	return list
+}
+
+// schedule reloads the config once changes settled
+func (r *Reloader) schedule(ctx context.Context, trigger string) {
+	r.confMu.Lock()
+	defer r.confMu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(reloadSettle, func() {
+		r.Reload(ctx, trigger)
+	})
+}
+
+// Watch reloads the config when the config file or a traffic file changes and on SIGHUP, until ctx
+// is done
+func (r *Reloader) Watch(ctx context.Context) error {
+	viper.OnConfigChange(func(fsnotify.Event) {
+		r.schedule(ctx, "config")
+	})
+	viper.WatchConfig()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// traffic files are watched through their directory, as editors replace files on save
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch the traffic files: %v", err)
+	}
+	var watchedMu sync.Mutex
+	watched := make(map[string]bool)
+	watchTrafficFiles := func() {
+		watchedMu.Lock()
+		defer watchedMu.Unlock()
+		for _, file := range r.Config().trafficFiles() {
+			dir := filepath.Dir(file)
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				ln.Error(ctx, err, ln.F{"file": file}, ln.Info("could not watch the traffic file"))
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watchTrafficFiles()
+	r.mu.Lock()
+	r.reloaded = watchTrafficFiles
+	r.mu.Unlock()
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				r.Reload(ctx, "SIGHUP")
+			case ev := <-watcher.Events:
+				for _, file := range r.Config().trafficFiles() {
+					if filepath.Clean(ev.Name) == filepath.Clean(file) {
+						r.schedule(ctx, "traffic file")
+					}
+				}
+			case err := <-watcher.Errors:
+				ln.Error(ctx, err, ln.Info("watching the traffic files failed"))
+			}
+		}
+	}()
+	return nil
+}
+
+// ReloadHandler returns the result of the last reload, a POST reloads the config first
+func ReloadHandler(r *Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		result := r.Last()
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			ctx := opname.With(context.Background(), "ReloadHandler")
+			result = r.Reload(ctx, "api")
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !result.Accepted {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+}
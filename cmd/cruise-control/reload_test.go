@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	m := NewDriftMonitor()
+	r := NewReloader(Config{Port: 8080, Interfaces: []InterfaceConfig{{Name: "eth0"}, {Name: "eth1"}}}, m)
+	var reconciled []Config
+	r.reconcile = func(ctx context.Context, conf Config) []InterfaceResult {
+		reconciled = append(reconciled, conf)
+		return []InterfaceResult{{Interface: conf.Interfaces[0].Name}}
+	}
+	r.validate = func(ctx context.Context, conf Config) error { return nil }
+	ctx := context.Background()
+
+	if result := r.Start(ctx); !result.Accepted || result.Trigger != "startup" || len(reconciled) != 1 {
+		t.Fatalf("expected the startup config to be reconciled, got %+v", result)
+	}
+	m.Manage(net.Interface{Name: "eth1"}, ManagedProfile{}, nil, nil)
+
+	// a broken config is rejected and the previous config stays active
+	r.load = func() (Config, error) { return Config{}, errors.New("toml: line 3: expected a value") }
+	if result := r.Reload(ctx, "config"); result.Accepted || !strings.Contains(result.Error, "line 3") {
+		t.Errorf("expected the config to be rejected, got %+v", result)
+	}
+	if r.Config().Port != 8080 || len(reconciled) != 1 || r.Last().Accepted {
+		t.Errorf("expected the previous config to stay active, got %+v", r.Config())
+	}
+
+	// a valid config is reconciled and removed interfaces are no longer monitored
+	r.load = func() (Config, error) {
+		return Config{Port: 8080, Interfaces: []InterfaceConfig{{Name: "eth0", UploadSpeed: Mbit}}}, nil
+	}
+	if result := r.Reload(ctx, "SIGHUP"); !result.Accepted || len(result.Interfaces) != 1 {
+		t.Errorf("expected the config to be accepted, got %+v", result)
+	}
+	if r.Config().Interfaces[0].UploadSpeed != Mbit || len(reconciled) != 2 {
+		t.Errorf("expected the new config to be active, got %+v", r.Config())
+	}
+	if _, ok := m.managed["eth1"]; ok {
+		t.Error("expected eth1 to be forgotten")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{Interfaces: []InterfaceConfig{
+		{Name: "eth0", UploadSpeed: 100 * Mbit},
+		{Name: "eth1", UploadSpeed: 100 * Mbit, Profile: "traffic", TrafficFile: broken},
+		{Name: "eth0", UploadSpeed: 100 * Mbit},
+	}}
+	err := validateConfig(context.Background(), conf)
+	if err == nil || !strings.Contains(err.Error(), "eth1 (egress)") || !strings.Contains(err.Error(), "eth0: configured more than once") {
+		t.Errorf("expected the broken traffic file and the duplicate interface to be reported, got %v", err)
+	}
+	if files := conf.trafficFiles(); len(files) != 1 || files[0] != broken {
+		t.Errorf("expected the traffic file to be watched, got %v", files)
+	}
+
+	conf.Interfaces = conf.Interfaces[:1]
+	if err := validateConfig(context.Background(), conf); err != nil {
+		t.Errorf("expected the config to be valid, got %v", err)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	r := NewReloader(Config{}, NewDriftMonitor())
+	r.load = func() (Config, error) { return Config{}, errors.New("broken") }
+	handler := ReloadHandler(r)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"Trigger": "api"`) {
+		t.Errorf("expected the reload to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/config/reload", nil))
+	if !strings.Contains(rec.Body.String(), `"Error": "broken"`) {
+		t.Errorf("expected the last result, got %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/florianl/go-tc"
+)
+
+// RenderFormats are the formats a tree can be rendered in
+var RenderFormats = []string{"ascii", "dot", "mermaid"}
+
+// RenderTree renders a tree and its filters in the requested format. Filters are drawn as edges from
+// the node they are attached to towards the class they classify into. If drift is not nil, the nodes
+// that drifted are highlighted.
+func RenderTree(w io.Writer, format string, tree *Node, filters []*Node, drift map[string]DriftStatus) error {
+	if tree == nil {
+		return fmt.Errorf("there is no tree to render")
+	}
+	switch format {
+	case "", "ascii":
+		return renderASCII(w, tree, filters, drift)
+	case "dot":
+		return renderDOT(w, tree, filters, drift)
+	case "mermaid":
+		return renderMermaid(w, tree, filters, drift)
+	}
+	return fmt.Errorf("unknown format %q, expected one of %v", format, RenderFormats)
+}
+
+// TreeOptions selects the tree that is rendered by WriteTree
+type TreeOptions struct {
+	Interface string
+	// Profile and Speed determine the desired tree
+	Profile string
+	Speed   Rate
+	// Source is either "desired" or "live"
+	Source string
+	Format string
+	// Drift highlights the differences between the desired and the live tree
+	Drift bool
+}
+
+// WriteTree renders the desired or live tree of an interface
+func WriteTree(ctx context.Context, conf Config, opts TreeOptions, w io.Writer) error {
+	interf, err := net.InterfaceByName(opts.Interface)
+	if err != nil {
+		return err
+	}
+
+	var desired, live *Node
+	var desiredFilters, liveFilters []*Node
+	if opts.Source == "" || opts.Source == "desired" || opts.Drift {
+		var result ComposeResult
+		result, desiredFilters, err = DesiredTree(ctx, conf, opts.Profile, *interf, opts.Speed)
+		if err != nil {
+			return err
+		}
+		desired = result.Tree
+	}
+	if opts.Source == "live" || opts.Drift {
+		rtnl, err := OpenTc()
+		if err != nil {
+			return err
+		}
+		defer rtnl.Close()
+		live, liveFilters = LiveTree(rtnl, *interf)
+	}
+
+	var drift map[string]DriftStatus
+	if opts.Drift {
+		drift = DiffTrees(desired, live)
+	}
+	switch opts.Source {
+	case "", "desired":
+		return RenderTree(w, opts.Format, desired, desiredFilters, drift)
+	case "live":
+		if live == nil {
+			return fmt.Errorf("%s has no root qdisc configured", opts.Interface)
+		}
+		return RenderTree(w, opts.Format, live, liveFilters, drift)
+	}
+	return fmt.Errorf("unknown source %q, expected desired or live", opts.Source)
+}
+
+// nodeTitle describes a node with its kind, type, handle and name
+func nodeTitle(n *Node) string {
+	title := fmt.Sprintf("%s %s %s", n.Object.Kind, n.Type, FmtHandle(n.Object.Handle))
+	if n.Name != "" {
+		title += " " + n.Name
+	}
+	return title
+}
+
+// nodeDetails describes the rate, service curves or parameters of a node
+func nodeDetails(n *Node) []string {
+	var details []string
+	attr := n.Object.Attribute
+	switch {
+	case attr.HfscQOpt != nil:
+		details = append(details, fmt.Sprintf("default %x", attr.HfscQOpt.DefCls))
+	case attr.Hfsc != nil:
+		rsc, fsc, usc := attr.Hfsc.Rsc, attr.Hfsc.Fsc, attr.Hfsc.Usc
+		if rsc != nil && fsc != nil && *rsc == *fsc && (rsc.M1 != 0 || rsc.M2 != 0) {
+			details = append(details, "sc "+FmtSC(*rsc))
+		} else {
+			if rsc != nil && (rsc.M1 != 0 || rsc.M2 != 0) {
+				details = append(details, "rt "+FmtSC(*rsc))
+			}
+			if fsc != nil && (fsc.M1 != 0 || fsc.M2 != 0) {
+				details = append(details, "ls "+FmtSC(*fsc))
+			}
+		}
+		if usc != nil && (usc.M1 != 0 || usc.M2 != 0) {
+			details = append(details, "ul "+FmtSC(*usc))
+		}
+	case attr.Htb != nil && attr.Htb.Init != nil:
+		details = append(details, fmt.Sprintf("default %x", attr.Htb.Init.Defcls))
+	case attr.Htb != nil && attr.Htb.Parms != nil:
+		rate, ceil := uint64(attr.Htb.Parms.Rate.Rate), uint64(attr.Htb.Parms.Ceil.Rate)
+		if attr.Htb.Rate64 != nil {
+			rate = *attr.Htb.Rate64
+		}
+		if attr.Htb.Ceil64 != nil {
+			ceil = *attr.Htb.Ceil64
+		}
+		details = append(details, fmt.Sprintf("rate %s ceil %s prio %d", FmtRate(rate), FmtRate(ceil), attr.Htb.Parms.Prio))
+	case attr.FqCodel != nil:
+		var params []string
+		if attr.FqCodel.Target != nil {
+			params = append(params, "target "+FmtTime(*attr.FqCodel.Target))
+		}
+		if attr.FqCodel.Limit != nil {
+			params = append(params, fmt.Sprintf("limit %d", *attr.FqCodel.Limit))
+		}
+		if attr.FqCodel.ECN != nil && *attr.FqCodel.ECN == 1 {
+			params = append(params, "ecn")
+		}
+		if len(params) > 0 {
+			details = append(details, strings.Join(params, " "))
+		}
+	case attr.Cake != nil:
+		if mode := cakeFlowMode(attr.Cake); mode != "" {
+			details = append(details, mode)
+		}
+	case attr.MqPrio != nil:
+		if classes := fmtMqPrio(attr.MqPrio); classes != "" {
+			details = append(details, classes)
+		}
+	case attr.Netem != nil:
+		if conditions := netemFromAttribute(attr.Netem, n.Loss).String(); conditions != "" {
+			details = append(details, conditions)
+		}
+	}
+	if stab := FmtStab(attr.Stab); stab != "" {
+		details = append(details, stab)
+	}
+	return details
+}
+
+// cakeFlowMode returns the flow isolation of a cake qdisc in the notation of the `tc` command-line
+// tool
+func cakeFlowMode(cake *tc.Cake) string {
+	if cake.FlowMode == nil {
+		return ""
+	}
+	modes := []string{"flowblind", "srchost", "dsthost", "hosts", "flows", "dual-srchost", "dual-dsthost", "triple-isolate"}
+	if int(*cake.FlowMode) < len(modes) {
+		return modes[*cake.FlowMode]
+	}
+	return fmt.Sprintf("flowmode %d", *cake.FlowMode)
+}
+
+// filterTarget returns the class a filter classifies into
+func filterTarget(f *Node) (uint32, bool) {
+	attr := f.Object.Attribute
+	switch {
+	case attr.U32 != nil && attr.U32.ClassID != nil:
+		return *attr.U32.ClassID, true
+	case attr.Fw != nil && attr.Fw.ClassID != nil:
+		return *attr.Fw.ClassID, true
+	case attr.BPF != nil && attr.BPF.ClassID != nil:
+		return *attr.BPF.ClassID, true
+	case attr.Flower != nil && attr.Flower.ClassID != nil:
+		return *attr.Flower.ClassID, true
+	}
+	// packets get the priority of a class from skbedit
+	for _, a := range filterActions(f) {
+		if h, err := StrHandle(a.Priority); a.Kind == "skbedit" && a.Priority != "" && err == nil {
+			return h, true
+		}
+	}
+	return 0, false
+}
+
+// filterLabel describes the match of a filter
+func filterLabel(f *Node) string {
+	prio, _ := splitInfo(f.Object.Info)
+	label := fmt.Sprintf("%s prio %d", f.Object.Kind, prio)
+	attr := f.Object.Attribute
+	switch {
+	case attr.U32 != nil && attr.U32.Mark != nil:
+		label += fmt.Sprintf(" mark 0x%x/0x%x", attr.U32.Mark.Val, attr.U32.Mark.Mask)
+	case attr.U32 != nil && attr.U32.Sel != nil:
+		label += fmt.Sprintf(" %d keys", len(attr.U32.Sel.Keys))
+	case attr.Fw != nil:
+		label += fmt.Sprintf(" handle 0x%x", f.Object.Handle)
+		if attr.Fw.Mask != nil {
+			label += fmt.Sprintf("/0x%x", *attr.Fw.Mask)
+		}
+	case attr.Flower != nil:
+		if keys := flowerLabel(attr.Flower); keys != "" {
+			label += " " + keys
+		}
+		if f.FlowerExtra != nil {
+			label += " " + f.FlowerExtra.label()
+		}
+	case attr.BPF != nil:
+		if program := bpfLabel(attr.BPF); program != "" {
+			label += " " + program
+		}
+	}
+	if actions := filterActions(f); len(actions) > 0 {
+		label += " " + actionsLabel(actions)
+	}
+	if police := policeOf(f.Object); police != nil {
+		label += " " + policeLabel(police)
+	}
+	return label
+}
+
+// splitInfo splits the info field of a filter message in the priority and the protocol
+func splitInfo(info uint32) (prio uint16, protocol uint16) {
+	return uint16(info >> 16), htons(uint16(info))
+}
+
+// renderedEdge is a filter drawn between two rendered nodes
+type renderedEdge struct {
+	from, to, label string
+}
+
+// filterEdges resolves the filters to edges between the ids of the nodes in the tree
+func filterEdges(tree *Node, filters []*Node, id func(n *Node) string) []renderedEdge {
+	qdiscs := make(map[uint32]*Node)
+	classes := make(map[uint32]*Node)
+	tree.Walk(func(n *Node, _ int) {
+		if n.Type == "qdisc" {
+			qdiscs[n.Object.Handle] = n
+		} else {
+			classes[n.Object.Handle] = n
+		}
+	})
+
+	var edges []renderedEdge
+	for _, f := range filters {
+		target, ok := filterTarget(f)
+		if !ok {
+			continue
+		}
+		to, ok := classes[target]
+		if !ok {
+			continue
+		}
+		from, ok := qdiscs[f.Object.Parent]
+		if !ok {
+			from, ok = classes[f.Object.Parent]
+		}
+		if f.Object.Parent == tc.HandleRoot {
+			from, ok = tree, true
+		}
+		if !ok {
+			continue
+		}
+		edges = append(edges, renderedEdge{from: id(from), to: id(to), label: filterLabel(f)})
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].label < edges[j].label
+	})
+	return edges
+}
+
+// renderID creates an identifier for a node that is safe to use in DOT and Mermaid
+func renderID(n *Node) string {
+	return strings.NewReplacer(" ", "_", ":", "_").Replace(nodeKey(n))
+}
+
+func renderASCII(w io.Writer, tree *Node, filters []*Node, drift map[string]DriftStatus) error {
+	var b strings.Builder
+	var walk func(n *Node, prefix string, last, root bool)
+	walk = func(n *Node, prefix string, last, root bool) {
+		line := nodeTitle(n)
+		if details := nodeDetails(n); len(details) > 0 {
+			line += " [" + strings.Join(details, ", ") + "]"
+		}
+		if status, ok := drift[nodeKey(n)]; ok {
+			line += " (" + string(status) + ")"
+		}
+		childPrefix := prefix
+		switch {
+		case root:
+			b.WriteString(line + "\n")
+		case last:
+			b.WriteString(prefix + "`-- " + line + "\n")
+			childPrefix += "    "
+		default:
+			b.WriteString(prefix + "|-- " + line + "\n")
+			childPrefix += "|   "
+		}
+		children := sortedChildren(n)
+		for i, child := range children {
+			walk(child, childPrefix, i == len(children)-1, false)
+		}
+	}
+	walk(tree, "", true, true)
+
+	edges := filterEdges(tree, filters, func(n *Node) string {
+		return FmtHandle(n.Object.Handle)
+	})
+	if len(edges) > 0 {
+		b.WriteString("filters:\n")
+		for _, e := range edges {
+			fmt.Fprintf(&b, "  %s -> %s: %s\n", e.from, e.to, e.label)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func renderDOT(w io.Writer, tree *Node, filters []*Node, drift map[string]DriftStatus) error {
+	colors := map[DriftStatus]string{
+		DriftMissing: "red",
+		DriftChanged: "orange",
+		DriftExtra:   "purple",
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph tc {\n\tnode [shape=box fontname=monospace];\n")
+	tree.Walk(func(n *Node, _ int) {
+		label := strings.Join(append([]string{nodeTitle(n)}, nodeDetails(n)...), "\n")
+		attrs := "label=" + strconv.Quote(label)
+		if status, ok := drift[nodeKey(n)]; ok {
+			attrs += fmt.Sprintf(" color=%s penwidth=2 xlabel=%q", colors[status], status)
+		}
+		fmt.Fprintf(&b, "\t%s [%s];\n", renderID(n), attrs)
+		for _, child := range sortedChildren(n) {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", renderID(n), renderID(child))
+		}
+	})
+	for _, e := range filterEdges(tree, filters, renderID) {
+		fmt.Fprintf(&b, "\t%s -> %s [style=dashed label=%s];\n", e.from, e.to, strconv.Quote(e.label))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func renderMermaid(w io.Writer, tree *Node, filters []*Node, drift map[string]DriftStatus) error {
+	escape := strings.NewReplacer(`"`, "#quot;")
+
+	var b strings.Builder
+	b.WriteString("graph TD\n")
+	statuses := make(map[DriftStatus][]string)
+	tree.Walk(func(n *Node, _ int) {
+		label := strings.Join(append([]string{nodeTitle(n)}, nodeDetails(n)...), "<br/>")
+		fmt.Fprintf(&b, "\t%s[\"%s\"]\n", renderID(n), escape.Replace(label))
+		for _, child := range sortedChildren(n) {
+			fmt.Fprintf(&b, "\t%s --> %s\n", renderID(n), renderID(child))
+		}
+		if status, ok := drift[nodeKey(n)]; ok {
+			statuses[status] = append(statuses[status], renderID(n))
+		}
+	})
+	for _, e := range filterEdges(tree, filters, renderID) {
+		fmt.Fprintf(&b, "\t%s -. \"%s\" .-> %s\n", e.from, escape.Replace(e.label), e.to)
+	}
+	if len(statuses) > 0 {
+		b.WriteString("\tclassDef missing stroke:red,stroke-width:3px\n")
+		b.WriteString("\tclassDef changed stroke:orange,stroke-width:3px\n")
+		b.WriteString("\tclassDef extra stroke:purple,stroke-width:3px\n")
+		for _, status := range []DriftStatus{DriftMissing, DriftChanged, DriftExtra} {
+			if ids := statuses[status]; len(ids) > 0 {
+				fmt.Fprintf(&b, "\tclass %s %s\n", strings.Join(ids, ","), status)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sortedChildren returns the children of a node sorted on their handle, so renders are stable
+func sortedChildren(n *Node) []*Node {
+	children := append([]*Node{}, n.Children...)
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Object.Handle == children[j].Object.Handle {
+			return children[i].Type < children[j].Type
+		}
+		return children[i].Object.Handle < children[j].Object.Handle
+	})
+	return children
+}
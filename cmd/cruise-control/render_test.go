@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTree(t *testing.T) (*Node, []*Node) {
+	t.Helper()
+	conf := createQoSSimple(context.Background(), net.Interface{Index: 4, Name: "test-01"}, 1e9, 100e6, SimpleProfile{})
+	nodes, filters := NodesFromConfig(conf)
+	tree := ComposeTree(nodes).Tree
+	if tree == nil {
+		t.Fatalf("failed to compose the simple profile")
+	}
+	return tree, filters
+}
+
+func TestRenderTree(t *testing.T) {
+	tree, filters := testTree(t)
+	tests := []struct {
+		format   string
+		contains []string
+	}{
+		{"ascii", []string{
+			"hfsc qdisc 1:0 root [default 22]\n",
+			"`-- hfsc class 1:1 interface",
+			"    `-- hfsc class 1:2 internet",
+			"fq_codel qdisc 21:0 prio [target 5ms limit 1200]",
+			"filters:\n  1:0 -> 1:21: u32 prio 0 mark 0x1/0xf\n",
+		}},
+		{"dot", []string{
+			"digraph tc {",
+			"qdisc_1_0 -> class_1_1;",
+			`qdisc_1_0 -> class_1_21 [style=dashed label="u32 prio 0 mark 0x1/0xf"];`,
+		}},
+		{"mermaid", []string{
+			"graph TD\n",
+			"class_1_2 --> class_1_23",
+			`qdisc_1_0 -. "u32 prio 0 mark 0x3/0xf" .-> class_1_23`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := RenderTree(&b, tt.format, tree, filters, nil); err != nil {
+				t.Fatalf("failed to render: %v", err)
+			}
+			for _, c := range tt.contains {
+				if !strings.Contains(b.String(), c) {
+					t.Errorf("render does not contain %q:\n%s", c, b.String())
+				}
+			}
+		})
+	}
+
+	if err := RenderTree(&bytes.Buffer{}, "svg", tree, filters, nil); err == nil {
+		t.Errorf("expected an unknown format to fail")
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	desired, _ := testTree(t)
+	live, _ := testTree(t)
+
+	if drift := DiffTrees(desired, live); len(drift) != 0 {
+		t.Errorf("expected equal trees to have no drift, got %v", drift)
+	}
+
+	// change the low class, remove the prio qdisc and add an unknown qdisc
+	live.Walk(func(n *Node, _ int) {
+		switch {
+		case n.Type == "class" && n.Name == "low":
+			n.Object.Hfsc.Rsc.M1 = 1
+		case n.Type == "class" && n.Name == "prio":
+			n.Children = nil
+		}
+	})
+	extra := NewNode("qdisc")
+	extra.Object.Handle = 0x99 << 16
+	live.Children = append(live.Children, extra)
+
+	drift := DiffTrees(desired, live)
+	expected := map[string]DriftStatus{
+		"class 1:23": DriftChanged,
+		"qdisc 21:0": DriftMissing,
+		"qdisc 99:0": DriftExtra,
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("expected drift %v, got %v", expected, drift)
+	}
+
+	var b bytes.Buffer
+	if err := RenderTree(&b, "ascii", desired, nil, drift); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "hfsc class 1:23 low [sc m1 19Mbit d 120ms m2 0bit] (changed)") {
+		t.Errorf("drift is not highlighted:\n%s", b.String())
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"within.website/ln"
+	"within.website/ln/opname"
+)
+
+// CronSpec is a cron expression with the fields minute, hour, day of month, month and day of week.
+// Fields are lists of values, ranges and steps (*/15, 1-5, mon-fri).
+type CronSpec struct {
+	text                          string
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+}
+
+var cronNames = map[string]string{
+	"jan": "1", "feb": "2", "mar": "3", "apr": "4", "may": "5", "jun": "6",
+	"jul": "7", "aug": "8", "sep": "9", "oct": "10", "nov": "11", "dec": "12",
+	"sun": "0", "mon": "1", "tue": "2", "wed": "3", "thu": "4", "fri": "5", "sat": "6",
+}
+
+// ParseCron parses a cron expression
+func ParseCron(s string) (CronSpec, error) {
+	spec := CronSpec{text: s}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return spec, fmt.Errorf("invalid cron expression %q, expected 5 fields", s)
+	}
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&spec.minute, 0, 59},
+		{&spec.hour, 0, 23},
+		{&spec.dom, 1, 31},
+		{&spec.month, 1, 12},
+		{&spec.dow, 0, 7},
+	}
+	for i, field := range fields {
+		set, err := parseCronField(strings.ToLower(field), bounds[i].min, bounds[i].max)
+		if err != nil {
+			return spec, fmt.Errorf("invalid cron expression %q: %v", s, err)
+		}
+		*bounds[i].set = set
+	}
+	// 7 is sunday as well
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domRestricted, spec.dowRestricted = fields[2] != "*", fields[4] != "*"
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = cronValue(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = cronValue(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func cronValue(s string) (int, error) {
+	if name, ok := cronNames[s]; ok {
+		s = name
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// String returns the cron expression
+func (c CronSpec) String() string {
+	return c.text
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (c CronSpec) MarshalText() ([]byte, error) {
+	return []byte(c.text), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (c *CronSpec) UnmarshalText(text []byte) error {
+	spec, err := ParseCron(string(text))
+	if err != nil {
+		return err
+	}
+	*c = spec
+	return nil
+}
+
+func (c CronSpec) matchDay(t time.Time) bool {
+	dom, dow := c.dom&(1<<uint(t.Day())) != 0, c.dow&(1<<uint(t.Weekday())) != 0
+	// like cron, a day matches either field when both are restricted
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// cronSearch limits how far Next and Prev look for a matching time
+const cronSearch = 5 * 366 * 24 * time.Hour
+
+// Next returns the first time after t the expression matches, or the zero time if it never does
+func (c CronSpec) Next(t time.Time) time.Time {
+	end := t.Add(cronSearch)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Prev returns the last time at or before t the expression matched, or the zero time if it never
+// did
+func (c CronSpec) Prev(t time.Time) time.Time {
+	end := t.Add(-cronSearch)
+	t = t.Truncate(time.Minute)
+	for t.After(end) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(-time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ScheduleEntry switches the profile, speeds or parameters of the simple profile of an interface
+// from the time its cron expression matches until the next entry starts. An entry without
+// overrides switches back to the configured interface.
+type ScheduleEntry struct {
+	Name string
+	Cron CronSpec
+
+	Profile       string
+	DownloadSpeed Rate
+	UploadSpeed   Rate
+	// Params overrides parameters of the simple profile like the API does, eg.
+	// "low.share=0.4&normal.share=0.4"
+	Params string
+}
+
+// apply returns the interface config with the overrides of the entry
+func (e ScheduleEntry) apply(ic InterfaceConfig, conf Config) (InterfaceConfig, error) {
+	if e.Profile != "" {
+		ic.Profile = e.Profile
+	}
+	if e.DownloadSpeed != 0 {
+		ic.DownloadSpeed = e.DownloadSpeed
+	}
+	if e.UploadSpeed != 0 {
+		ic.UploadSpeed = e.UploadSpeed
+	}
+	if e.Params != "" {
+		params, err := url.ParseQuery(e.Params)
+		if err != nil {
+			return ic, fmt.Errorf("schedule %s: %v", e.Name, err)
+		}
+		simple := conf.Simple
+		if ic.simple != nil {
+			simple = *ic.simple
+		}
+		if err := simple.ParseQuery(params); err != nil {
+			return ic, fmt.Errorf("schedule %s: %v", e.Name, err)
+		}
+		ic.simple = &simple
+	}
+	return ic, nil
+}
+
+// ScheduleState is the active entry of the schedule of an interface and the next transition
+type ScheduleState struct {
+	Interface string
+	// Active is the name of the active entry, empty when no entry started yet
+	Active string
+	Since  time.Time `json:",omitempty"`
+	Next   string
+	At     time.Time `json:",omitempty"`
+}
+
+// scheduleAt returns the state of the schedule of an interface at t
+func (ic InterfaceConfig) scheduleAt(t time.Time) (state ScheduleState, active *ScheduleEntry) {
+	state.Interface = ic.Name
+	for i, e := range ic.Schedule {
+		if prev := e.Cron.Prev(t); !prev.IsZero() && prev.After(state.Since) {
+			state.Active, state.Since, active = e.Name, prev, &ic.Schedule[i]
+		}
+		if next := e.Cron.Next(t); !next.IsZero() && (state.At.IsZero() || next.Before(state.At)) {
+			state.Next, state.At = e.Name, next
+		}
+	}
+	return state, active
+}
+
+// scheduled returns the config with the active schedule entries applied to the interfaces
+func (c Config) scheduled(t time.Time) (Config, error) {
+	if len(c.Interfaces) == 0 {
+		return c, nil
+	}
+	interfaces := make([]InterfaceConfig, len(c.Interfaces))
+	for i, ic := range c.Interfaces {
+		interfaces[i] = ic
+		if _, active := ic.scheduleAt(t); active != nil {
+			var err error
+			if interfaces[i], err = active.apply(ic, c); err != nil {
+				return c, fmt.Errorf("%s: %v", ic.Name, err)
+			}
+		}
+	}
+	c.Interfaces = interfaces
+	return c, nil
+}
+
+// nextTransition returns the first time a schedule entry of the config starts after t
+func (c Config) nextTransition(t time.Time) time.Time {
+	var next time.Time
+	for _, ic := range c.Interfaces {
+		if state, _ := ic.scheduleAt(t); !state.At.IsZero() && (next.IsZero() || state.At.Before(next)) {
+			next = state.At
+		}
+	}
+	return next
+}
+
+// Schedule reconciles the interfaces whenever an entry of their schedule starts, until ctx is done.
+// The schedule is checked every minute so changes to the config are picked up.
+func (r *Reloader) Schedule(ctx context.Context) {
+	ctx = opname.With(ctx, "Schedule")
+	go func() {
+		last := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(last.Truncate(time.Minute).Add(time.Minute))):
+			}
+			now := time.Now()
+			if next := r.Config().nextTransition(last); !next.IsZero() && !next.After(now) {
+				ln.Log(ctx, ln.Info("schedule transition at %s", next.Format(time.RFC3339)))
+				r.Reschedule(ctx)
+			}
+			last = now
+		}
+	}()
+}
+
+// Reschedule reconciles the interfaces of the active config with their active schedule entries
+func (r *Reloader) Reschedule(ctx context.Context) ReloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.activate(ctx, r.active(), "schedule")
+}
+
+// ScheduleHandler lists the active schedule entry and the next transition of every interface
+func ScheduleHandler(config func() Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		states := []ScheduleState{}
+		for _, ic := range config().ManagedInterfaces() {
+			if len(ic.Schedule) == 0 {
+				continue
+			}
+			state, _ := ic.scheduleAt(now)
+			states = append(states, state)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(states)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"0 7 * * *", "*/15 8-18 * * mon-fri", "30 22 1,15 * 7", "0 0 * jan-mar 1-5/2"} {
+		if _, err := ParseCron(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{"", "0 7 * *", "60 * * * *", "0 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "0 7 * * someday"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestCronNextPrev(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2026-10-19 is a monday
+	now := at("2026-10-19 12:34")
+	for _, c := range []struct {
+		expr       string
+		prev, next string
+	}{
+		{"0 7 * * *", "2026-10-19 07:00", "2026-10-20 07:00"},
+		{"*/15 * * * *", "2026-10-19 12:30", "2026-10-19 12:45"},
+		{"34 12 * * *", "2026-10-19 12:34", "2026-10-20 12:34"},
+		{"0 18 * * fri", "2026-10-16 18:00", "2026-10-23 18:00"},
+		{"0 0 1 * *", "2026-10-01 00:00", "2026-11-01 00:00"},
+		{"0 0 29 2 *", "2024-02-29 00:00", "2028-02-29 00:00"},
+		// day of month and day of week match either when both are restricted
+		{"0 9 1 * sun", "2026-10-18 09:00", "2026-10-25 09:00"},
+		{"0 9 * * 7", "2026-10-18 09:00", "2026-10-25 09:00"},
+	} {
+		spec, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev := spec.Prev(now); !prev.Equal(at(c.prev)) {
+			t.Errorf("%q: expected the previous match at %s, got %s", c.expr, c.prev, prev)
+		}
+		if next := spec.Next(now); !next.Equal(at(c.next)) {
+			t.Errorf("%q: expected the next match at %s, got %s", c.expr, c.next, next)
+		}
+	}
+
+	never, _ := ParseCron("0 0 31 2 *")
+	if !never.Next(now).IsZero() || !never.Prev(now).IsZero() {
+		t.Error("expected an expression that never matches to return the zero time")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("toml")
+	config := `
+[[interfaces]]
+name = "eth0"
+uploadSpeed = "100mbit"
+
+[[interfaces.schedule]]
+name = "backups"
+cron = "0 1 * * *"
+params = "prio.share=0.1&normal.share=0.3&low.share=0.6"
+uploadSpeed = "200mbit"
+
+[[interfaces.schedule]]
+name = "evening"
+cron = "0 18 * * mon-fri"
+params = "prio.share=0.6&normal.share=0.3&low.share=0.1"
+
+[[interfaces.schedule]]
+name = "day"
+cron = "0 7 * * *"
+`
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	var conf Config
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err != nil {
+		t.Fatal(err)
+	}
+	eth0 := conf.Interfaces[0]
+	if len(eth0.Schedule) != 3 {
+		t.Fatalf("expected 3 schedule entries, got %+v", eth0.Schedule)
+	}
+
+	// monday evening
+	now := time.Date(2026, 10, 19, 20, 0, 0, 0, time.Local)
+	state, _ := eth0.scheduleAt(now)
+	if state.Active != "evening" || state.Next != "backups" || !state.At.Equal(time.Date(2026, 10, 20, 1, 0, 0, 0, time.Local)) {
+		t.Errorf("unexpected schedule state %+v", state)
+	}
+	scheduled, err := conf.scheduled(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := scheduled.Interfaces[0].devices(scheduled)[0]
+	if dev.Profile.Conf.Simple.Prio.Share != 0.6 || dev.Profile.Speed != 100*Mbit || conf.Simple.Prio.Share != 0 {
+		t.Errorf("expected the evening parameters on eth0 only, got %+v", dev.Profile)
+	}
+
+	// during the backups
+	scheduled, _ = conf.scheduled(time.Date(2026, 10, 20, 3, 0, 0, 0, time.Local))
+	dev = scheduled.Interfaces[0].devices(scheduled)[0]
+	if dev.Profile.Conf.Simple.Low.Share != 0.6 || dev.Profile.Speed != 200*Mbit {
+		t.Errorf("expected the backups parameters, got %+v", dev.Profile)
+	}
+	if next := conf.nextTransition(time.Date(2026, 10, 20, 3, 0, 0, 0, time.Local)); !next.Equal(time.Date(2026, 10, 20, 7, 0, 0, 0, time.Local)) {
+		t.Errorf("expected the next transition at 07:00, got %s", next)
+	}
+
+	// entries are validated with the config
+	if err := validateConfig(context.Background(), conf); err != nil {
+		t.Errorf("expected the schedule to be valid, got %v", err)
+	}
+	conf.Interfaces[0].Schedule[1].Params = "prio.share=lots"
+	if err := validateConfig(context.Background(), conf); err == nil || !strings.Contains(err.Error(), "schedule evening") {
+		t.Errorf("expected the invalid parameters to be reported, got %v", err)
+	}
+	conf.Interfaces[0].Schedule[1].Params = "prio.share=0.9"
+	if err := validateConfig(context.Background(), conf); err == nil || !strings.Contains(err.Error(), "eth0 schedule evening (egress)") {
+		t.Errorf("expected the invalid profile to be reported, got %v", err)
+	}
+
+	v.Set("interfaces", []map[string]interface{}{{"name": "eth0", "schedule": []map[string]interface{}{{"cron": "at noon"}}}})
+	if err := v.Unmarshal(&conf, viper.DecodeHook(configDecodeHook)); err == nil {
+		t.Error("expected an invalid cron expression to fail")
+	}
+}
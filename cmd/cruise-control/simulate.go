@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fbegyn/cruise-control/simulator"
+	"github.com/florianl/go-tc"
+)
+
+// simulationTree converts a composed tree into the hierarchy of the simulator. Flows can refer to
+// the leaf classes by name or handle, aliases maps both on the name in the simulation.
+func simulationTree(tree *Node) (root *simulator.Class, discipline simulator.Discipline, aliases map[string]string, err error) {
+	if tree == nil || tree.Type != "qdisc" {
+		return nil, "", nil, fmt.Errorf("the tree has no root qdisc")
+	}
+	switch tree.Object.Kind {
+	case "hfsc":
+		discipline = simulator.HFSC
+	case "htb":
+		discipline = simulator.HTB
+	default:
+		return nil, "", nil, fmt.Errorf("can not simulate a %s root qdisc, expected hfsc or htb", tree.Object.Kind)
+	}
+
+	aliases = make(map[string]string)
+	var convert func(n *Node) *simulator.Class
+	convert = func(n *Node) *simulator.Class {
+		c := &simulator.Class{Name: FmtHandle(n.Object.Handle)}
+		if n.Name != "" {
+			c.Name = n.Name
+		}
+		aliases[c.Name] = c.Name
+		aliases[FmtHandle(n.Object.Handle)] = c.Name
+
+		if hfsc := n.Object.Hfsc; hfsc != nil {
+			c.RT, c.LS, c.UL = simulationCurve(hfsc.Rsc), simulationCurve(hfsc.Fsc), simulationCurve(hfsc.Usc)
+		}
+		if htb := n.Object.Htb; htb != nil && htb.Parms != nil {
+			rate, ceil := uint64(htb.Parms.Rate.Rate), uint64(htb.Parms.Ceil.Rate)
+			if htb.Rate64 != nil {
+				rate = *htb.Rate64
+			}
+			if htb.Ceil64 != nil {
+				ceil = *htb.Ceil64
+			}
+			c.Rate, c.Ceil = float64(rate), float64(ceil)
+			c.Burst = float64(htb.Parms.Buffer) / ticksPerUsec / 1e6 * c.Rate
+			c.CBurst = float64(htb.Parms.Cbuffer) / ticksPerUsec / 1e6 * c.Ceil
+			c.Prio = int(htb.Parms.Prio)
+			c.Quantum = float64(htb.Parms.Quantum)
+		}
+		for _, child := range sortedChildren(n) {
+			if child.Type == "class" {
+				c.Children = append(c.Children, convert(child))
+			}
+		}
+		return c
+	}
+	return convert(tree), discipline, aliases, nil
+}
+
+func simulationCurve(sc *tc.ServiceCurve) *simulator.Curve {
+	if sc == nil || (sc.M1 == 0 && sc.M2 == 0) {
+		return nil
+	}
+	return &simulator.Curve{
+		M1: float64(sc.M1),
+		D:  time.Duration(sc.D) * time.Microsecond,
+		M2: float64(sc.M2),
+	}
+}
+
+// parseFlow parses the description of a flow: the class, the rate and optionally the packet size,
+// an initial burst and when the flow starts and stops, eg. "web=20mbit,size=1500b,start=1s"
+func parseFlow(s string) (simulator.Flow, error) {
+	var flow simulator.Flow
+	for i, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return flow, fmt.Errorf("invalid flow %q, expected class=rate[,size=..][,burst=..][,start=..][,stop=..]", s)
+		}
+		key, v := kv[0], kv[1]
+		var err error
+		switch {
+		case i == 0:
+			var rate Rate
+			rate, err = ParseRate(v)
+			flow.Class, flow.Rate = key, float64(rate.BytesPerSecond())
+		case key == "size" || key == "burst":
+			var size uint32
+			size, err = parseTcSize(v)
+			if key == "size" {
+				flow.PacketSize = int(size)
+			} else {
+				flow.Burst = int(size)
+			}
+		case key == "start":
+			flow.Start, err = time.ParseDuration(v)
+		case key == "stop":
+			flow.Stop, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return flow, fmt.Errorf("invalid flow %q: %s: %v", s, key, err)
+		}
+	}
+	return flow, nil
+}
+
+// SimulationOptions select the tree and the traffic of a simulation
+type SimulationOptions struct {
+	Interface string
+	Profile   string
+	Speed     Rate
+	// Link is the speed of the simulated link
+	Link     Rate
+	Duration time.Duration
+	Flows    []string
+}
+
+// Simulate predicts how the desired tree of a profile divides the link between the flows
+func Simulate(ctx context.Context, conf Config, opts SimulationOptions) (*simulator.Result, error) {
+	result, _, err := DesiredTree(ctx, conf, opts.Profile, net.Interface{Name: opts.Interface}, opts.Speed)
+	if err != nil {
+		return nil, err
+	}
+	if problems := result.Problems(); len(problems) > 0 {
+		return nil, fmt.Errorf("tree could not be composed:\n%s", strings.Join(problems, "\n"))
+	}
+	root, discipline, aliases, err := simulationTree(result.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	var flows []simulator.Flow
+	for _, s := range opts.Flows {
+		flow, err := parseFlow(s)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := aliases[flow.Class]
+		if !ok {
+			return nil, fmt.Errorf("flow into unknown class %q", flow.Class)
+		}
+		flow.Class = name
+		flows = append(flows, flow)
+	}
+	return simulator.Simulate(root, flows, simulator.Options{
+		Discipline: discipline,
+		LinkRate:   float64(opts.Link.BytesPerSecond()),
+		Duration:   opts.Duration,
+	})
+}
+
+// writeSimulation renders the result of a simulation over duration as a table
+func writeSimulation(w io.Writer, res *simulator.Result, duration time.Duration) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLASS\tOFFERED\tTHROUGHPUT\tSHARE\tDROPPED\tMEAN DELAY\tMAX DELAY")
+	for _, c := range res.Classes {
+		var dropped float64
+		if c.Offered > 0 {
+			dropped = c.Dropped / c.Offered
+		}
+		fmt.Fprintf(tw, "%s%s\t%s\t%s\t%.1f%%\t%.1f%%\t%s\t%s\n",
+			strings.Repeat("  ", c.Depth), c.Name,
+			RateFromBytes(uint64(c.Offered/duration.Seconds())), RateFromBytes(uint64(c.Throughput)),
+			100*c.Share, 100*dropped, c.MeanDelay, c.MaxDelay)
+	}
+	fmt.Fprintf(tw, "\nlink utilization: %.1f%%\n", 100*res.Utilization)
+	return tw.Flush()
+}
+
+// simulateCommand simulates a profile with synthetic traffic
+func simulateCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	opts := SimulationOptions{Link: Gbit}
+	fs.StringVar(&opts.Interface, "interface", "sim0", "interface the profile is created for")
+	fs.StringVar(&opts.Profile, "profile", "simple", "profile to simulate")
+	fs.Func("up", "upload speed of the profile, in Mbit or with a unit (2.5gbit)", func(s string) (err error) {
+		opts.Speed, err = parseSpeed(s)
+		return err
+	})
+	fs.Func("link", "speed of the simulated link (default 1gbit)", func(s string) (err error) {
+		opts.Link, err = ParseRate(s)
+		return err
+	})
+	fs.DurationVar(&opts.Duration, "duration", 10*time.Second, "simulated time")
+	fs.Func("flow", "traffic into a class, eg. prio=5mbit,size=200b or low=100mbit,burst=1mb,start=2s (repeatable)", func(s string) error {
+		opts.Flows = append(opts.Flows, s)
+		return nil
+	})
+	fs.Parse(args)
+	if len(opts.Flows) == 0 {
+		fs.Usage()
+		return fmt.Errorf("simulate requires at least one flow")
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	res, err := Simulate(ctx, conf, opts)
+	if err != nil {
+		return err
+	}
+	return writeSimulation(os.Stdout, res, opts.Duration)
+}
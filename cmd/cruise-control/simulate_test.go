@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFlow(t *testing.T) {
+	flow, err := parseFlow("prio=5mbit,size=200b,burst=64kb,start=1s,stop=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.Class != "prio" || flow.Rate != 625000 || flow.PacketSize != 200 || flow.Burst != 64*1024 ||
+		flow.Start != time.Second || flow.Stop != 2*time.Second {
+		t.Errorf("unexpected flow %+v", flow)
+	}
+	for _, s := range []string{"prio", "prio=fast", "prio=1mbit,size=big", "prio=1mbit,color=red"} {
+		if _, err := parseFlow(s); err == nil {
+			t.Errorf("expected %q to fail", s)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	opts := SimulationOptions{
+		Interface: "eth0",
+		Profile:   "simple",
+		Speed:     10 * Mbit,
+		Link:      Gbit,
+		Duration:  5 * time.Second,
+		Flows:     []string{"prio=1mbit,size=200b", "normal=20mbit", "1:23=20mbit"},
+	}
+	// latency targets give the classes a sustained rate to share
+	conf := Config{Simple: SimpleProfile{Latency: true}}
+	res, err := Simulate(context.Background(), conf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares := make(map[string]float64)
+	for _, c := range res.Classes {
+		shares[c.Name] = c.Share
+	}
+	// prio gets all of its traffic, the rest is shared 2:1 between normal and low
+	if shares["prio"] < 0.1 || shares["normal"] < 0.55 || shares["low"] < 0.27 || shares["low"] > 0.33 {
+		t.Errorf("unexpected shares %v", shares)
+	}
+
+	var b bytes.Buffer
+	if err := writeSimulation(&b, res, opts.Duration); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "\n  internet ") {
+		t.Errorf("expected the table to indent the classes, got\n%s", b.String())
+	}
+
+	opts.Flows = []string{"missing=1mbit"}
+	if _, err := Simulate(context.Background(), Config{}, opts); err == nil {
+		t.Error("expected a flow into an unknown class to fail")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Link layers of the size table, as defined by the kernel (enum tc_link_layer)
+const (
+	linkLayerEthernet = 1
+	linkLayerATM      = 2
+)
+
+// ATM cells carry 48 bytes of payload in 53 bytes
+const (
+	atmCellPayload = 48
+	atmCellSize    = 53
+)
+
+// ethernetHeaderLen is the length of the Ethernet header, which the kernel already accounts for
+// in the length of the packets handed to the qdiscs of an Ethernet device
+const ethernetHeaderLen = 14
+
+// Overhead describes the per packet overhead of the link behind the shaped interface. It is either
+// a preset or the raw values of the `tc ... stab` command-line options.
+type Overhead struct {
+	// Preset is the name of one of the overheadPresets
+	Preset string
+	// Overhead is added to every packet, it can be negative to strip headers
+	Overhead int32
+	// MPU is the minimal packet size of the link
+	MPU uint32
+	// LinkLayer is either "ethernet" or "atm" (also known as "adsl")
+	LinkLayer string
+}
+
+// overheadPreset is the overhead of an access technology. Like the keywords of cake(8), the
+// overhead is relative to the IP packet.
+type overheadPreset struct {
+	overhead  int32
+	mpu       uint32
+	linkLayer uint32
+}
+
+// overheadPresets are the known access technologies. The 64b/65b encoding of PTM can not be
+// expressed in a size table, the headroom of the profiles covers it.
+var overheadPresets = map[string]overheadPreset{
+	// ADSL, the overhead depends on the encapsulation the ISP uses
+	"ipoa-vcmux":      {8, 0, linkLayerATM},
+	"ipoa-llcsnap":    {16, 0, linkLayerATM},
+	"bridged-vcmux":   {24, 0, linkLayerATM},
+	"bridged-llcsnap": {32, 0, linkLayerATM},
+	"pppoa-vcmux":     {10, 0, linkLayerATM},
+	"pppoa-llc":       {14, 0, linkLayerATM},
+	"pppoe-vcmux":     {32, 0, linkLayerATM},
+	"pppoe-llcsnap":   {40, 0, linkLayerATM},
+	// the worst case of all ADSL encapsulations
+	"adsl": {48, 0, linkLayerATM},
+	// VDSL2
+	"bridged-ptm": {22, 0, linkLayerEthernet},
+	"pppoe-ptm":   {30, 0, linkLayerEthernet},
+	// DOCSIS cable modems shape on the Ethernet frame without preamble and inter frame gap
+	"docsis": {18, 64, linkLayerEthernet},
+	// GPON carries the Ethernet frame (with FCS) in GEM frames with a 5 byte header
+	"gpon": {23, 0, linkLayerEthernet},
+	// Ethernet (preamble, inter frame gap and FCS), with and without VLAN tag and PPPoE
+	"ethernet":       {38, 84, linkLayerEthernet},
+	"ether-vlan":     {42, 84, linkLayerEthernet},
+	"pppoe-ethernet": {46, 84, linkLayerEthernet},
+}
+
+// OverheadPresets returns the names of the known presets
+func OverheadPresets() []string {
+	names := make([]string, 0, len(overheadPresets))
+	for name := range overheadPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stab builds the size table that makes the qdiscs of interf account for the overhead. The
+// presets are converted from the IP packet to the packet the qdisc sees, which includes the
+// Ethernet header on Ethernet devices.
+func (o Overhead) Stab(interf net.Interface) (*tc.Stab, error) {
+	spec := tc.SizeSpec{LinkLayer: linkLayerEthernet}
+	switch {
+	case o.Preset != "" && (o.Overhead != 0 || o.MPU != 0 || o.LinkLayer != ""):
+		return nil, fmt.Errorf("overhead preset %q can not be combined with raw overhead values", o.Preset)
+	case o.Preset != "":
+		preset, ok := overheadPresets[strings.ToLower(o.Preset)]
+		if !ok {
+			return nil, fmt.Errorf("unknown overhead preset %q, expected one of %v", o.Preset, OverheadPresets())
+		}
+		spec.Overhead = preset.overhead
+		if len(interf.HardwareAddr) == 6 {
+			spec.Overhead -= ethernetHeaderLen
+		}
+		spec.MPU = preset.mpu
+		spec.LinkLayer = preset.linkLayer
+	default:
+		linkLayer, err := parseLinkLayer(o.LinkLayer)
+		if err != nil {
+			return nil, err
+		}
+		spec.Overhead, spec.MPU, spec.LinkLayer = o.Overhead, o.MPU, linkLayer
+	}
+	return newStab(spec), nil
+}
+
+func parseLinkLayer(s string) (uint32, error) {
+	switch strings.ToLower(s) {
+	case "", "ethernet":
+		return linkLayerEthernet, nil
+	case "atm", "adsl":
+		return linkLayerATM, nil
+	}
+	return 0, fmt.Errorf("unknown link layer %q, expected ethernet or atm", s)
+}
+
+// newStab builds the size table for spec the same way the `tc` command-line tool does. The table
+// is only needed for ATM and for an MPU, the kernel adds the overhead by itself.
+func newStab(spec tc.SizeSpec) *tc.Stab {
+	if spec.LinkLayer <= linkLayerEthernet && spec.MPU == 0 {
+		spec.MTU, spec.TSize, spec.CellLog, spec.CellAlign = 0, 0, 0, 0
+		return &tc.Stab{Base: &spec}
+	}
+	if spec.MTU == 0 {
+		spec.MTU = 2047
+	}
+	if spec.TSize == 0 {
+		spec.TSize = 512
+	}
+	spec.CellLog = 0
+	for spec.MTU>>spec.CellLog > spec.TSize-1 {
+		spec.CellLog++
+	}
+
+	sizes := make([]uint32, spec.TSize)
+	for i := range sizes {
+		sizes[i] = adjustSize(uint32(i+1)<<spec.CellLog, spec.MPU, spec.LinkLayer)
+		for sizes[i]>>spec.SizeLog > math.MaxUint16 {
+			spec.SizeLog++
+		}
+	}
+	data := make([]byte, 0, 2*len(sizes))
+	for _, size := range sizes {
+		data = append(data, nlenc.Uint16Bytes(uint16(size>>spec.SizeLog))...)
+	}
+	spec.CellAlign = -1
+	return &tc.Stab{Base: &spec, Data: &data}
+}
+
+// adjustSize calculates the size a packet of size bytes takes on the link
+func adjustSize(size, mpu, linkLayer uint32) uint32 {
+	if size < mpu {
+		size = mpu
+	}
+	if linkLayer == linkLayerATM {
+		cells := (size + atmCellPayload - 1) / atmCellPayload
+		return cells * atmCellSize
+	}
+	return size
+}
+
+// equalStab compares the size tables of two qdiscs. The kernel only reports the base of a size
+// table, so the table itself is not compared. A missing size table equals a size table that does
+// not change the packet sizes.
+func equalStab(a, b *tc.Stab) bool {
+	var baseA, baseB tc.SizeSpec
+	if a != nil && a.Base != nil {
+		baseA = *a.Base
+	}
+	if b != nil && b.Base != nil {
+		baseB = *b.Base
+	}
+	// an unspecified link layer behaves as Ethernet
+	for _, base := range []*tc.SizeSpec{&baseA, &baseB} {
+		if base.LinkLayer == 0 {
+			base.LinkLayer = linkLayerEthernet
+		}
+	}
+	return baseA == baseB
+}
+
+// FmtStab renders a size table in the notation of the `tc` command-line tool
+func FmtStab(stab *tc.Stab) string {
+	if stab == nil || stab.Base == nil {
+		return ""
+	}
+	var parts []string
+	if stab.Base.Overhead != 0 {
+		parts = append(parts, fmt.Sprintf("overhead %d", stab.Base.Overhead))
+	}
+	if stab.Base.MPU != 0 {
+		parts = append(parts, fmt.Sprintf("mpu %d", stab.Base.MPU))
+	}
+	if stab.Base.LinkLayer == linkLayerATM {
+		parts = append(parts, "linklayer atm")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "stab " + strings.Join(parts, " ")
+}
+
+// applyStab sets the size table on the root qdiscs of conf. The packets of a multiqueue root are
+// enqueued in the qdiscs of its TX queues, which get the size table instead.
+func (conf *TcConfig) applyStab(stab *tc.Stab) {
+	var mq *tc.Object
+	for _, qdisc := range conf.Qdiscs {
+		if qdisc.Parent == tc.HandleRoot && isMultiqueue(qdisc.Kind) {
+			q := qdisc
+			mq = &q
+		}
+	}
+	for name, qdisc := range conf.Qdiscs {
+		if mq == nil && qdisc.Parent == tc.HandleRoot || mq != nil && isQueueClass(qdisc.Parent, mq.Handle) {
+			qdisc.Stab = stab
+			conf.Qdiscs[name] = qdisc
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+func TestOverheadStab(t *testing.T) {
+	eth := net.Interface{Index: 1, Name: "eth0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	ppp := net.Interface{Index: 2, Name: "ppp0"}
+
+	tests := []struct {
+		name     string
+		overhead Overhead
+		interf   net.Interface
+		expected tc.SizeSpec
+		table    bool
+	}{
+		{"Default", Overhead{}, eth, tc.SizeSpec{LinkLayer: linkLayerEthernet}, false},
+		{"Raw", Overhead{Overhead: 18, LinkLayer: "ethernet"}, eth, tc.SizeSpec{Overhead: 18, LinkLayer: linkLayerEthernet}, false},
+		{"VDSL", Overhead{Preset: "pppoe-ptm"}, eth, tc.SizeSpec{Overhead: 16, LinkLayer: linkLayerEthernet}, false},
+		{"VDSLOnPPP", Overhead{Preset: "pppoe-ptm"}, ppp, tc.SizeSpec{Overhead: 30, LinkLayer: linkLayerEthernet}, false},
+		{"DOCSIS", Overhead{Preset: "docsis"}, eth, tc.SizeSpec{Overhead: 4, MPU: 64, LinkLayer: linkLayerEthernet,
+			MTU: 2047, TSize: 512, CellLog: 2, CellAlign: -1}, true},
+		{"ADSL", Overhead{Preset: "PPPoE-VCMux"}, ppp, tc.SizeSpec{Overhead: 32, LinkLayer: linkLayerATM,
+			MTU: 2047, TSize: 512, CellLog: 2, CellAlign: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stab, err := tt.overhead.Stab(tt.interf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stab.Base != tt.expected {
+				t.Errorf("expected size spec %+v, got %+v", tt.expected, *stab.Base)
+			}
+			if (stab.Data != nil) != tt.table {
+				t.Errorf("expected a size table: %v, got %v", tt.table, stab.Data != nil)
+			}
+		})
+	}
+
+	for _, o := range []Overhead{{Preset: "carrier-pigeon"}, {Preset: "adsl", MPU: 64}, {LinkLayer: "token-ring"}} {
+		if _, err := o.Stab(eth); err == nil {
+			t.Errorf("expected overhead %+v to fail", o)
+		}
+	}
+}
+
+func TestATMSizeTable(t *testing.T) {
+	stab := newStab(tc.SizeSpec{LinkLayer: linkLayerATM})
+	data := *stab.Data
+	if len(data) != 2*512 {
+		t.Fatalf("expected 512 entries, got %d bytes", len(data))
+	}
+	entry := func(i int) uint16 {
+		return nlenc.Uint16(data[2*i : 2*i+2])
+	}
+	// every slot covers 4 bytes, up to 48 bytes fit in a single cell
+	for slot, size := range map[int]uint16{0: 53, 11: 53, 12: 106, 23: 106, 24: 159, 374: 1696} {
+		if got := entry(slot); got != size {
+			t.Errorf("expected slot %d (%d bytes) to take %d bytes on the link, got %d", slot, 4*(slot+1), size, got)
+		}
+	}
+}
+
+func TestEqualStab(t *testing.T) {
+	ethernet := &tc.Stab{Base: &tc.SizeSpec{LinkLayer: linkLayerEthernet}}
+	atm := newStab(tc.SizeSpec{Overhead: 40, LinkLayer: linkLayerATM})
+	// the kernel does not report the table itself
+	atmLive := &tc.Stab{Base: &tc.SizeSpec{}}
+	*atmLive.Base = *atm.Base
+
+	if !equalStab(nil, ethernet) || !equalStab(ethernet, &tc.Stab{}) {
+		t.Error("expected a missing size table to equal an Ethernet table without overhead")
+	}
+	if !equalStab(atm, atmLive) {
+		t.Error("expected the size table data to be ignored")
+	}
+	if equalStab(atm, ethernet) || equalStab(nil, atm) {
+		t.Error("expected different overheads to differ")
+	}
+}
+
+func TestOverheadProfile(t *testing.T) {
+	interf := net.Interface{Index: 1, Name: "eth0", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	conf := Config{Overhead: Overhead{Preset: "adsl"}}
+	for _, profile := range []string{"simple", "lanparty"} {
+		tcConf, err := createQoS(context.Background(), conf, profile, interf, Gbit, 16*Mbit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := tcConf.Qdiscs["root"]
+		if root.Stab == nil || root.Stab.Base.Overhead != 34 || root.Stab.Base.LinkLayer != linkLayerATM {
+			t.Errorf("expected the %s profile to apply the overhead to the root qdisc, got %+v", profile, root.Stab)
+		}
+	}
+}
+
+func TestParseStab(t *testing.T) {
+	script := "tc qdisc add dev eth0 root handle 1: stab overhead 40 linklayer atm hfsc default 1\n"
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := configs["eth0"].Qdiscs["1:0"]
+	if root.Kind != "hfsc" || root.Stab == nil || root.Stab.Base.Overhead != 40 || root.Stab.Data == nil {
+		t.Errorf("expected an hfsc qdisc with an ATM size table, got %+v", root)
+	}
+	if FmtStab(root.Stab) != "stab overhead 40 linklayer atm" {
+		t.Errorf("unexpected rendering %q", FmtStab(root.Stab))
+	}
+}
@@ -5,13 +5,33 @@ import (
 	"os"
 
 	"github.com/florianl/go-tc"
+	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 )
 
+// OpenTc opens a go-tc socket with extended acknowledgements enabled, so errors returned by the
+// kernel carry a description
+func OpenTc() (*tc.Tc, error) {
+	rtnl, err := tc.Open(&tc.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("could not open rtnetlink socket: %v", err)
+	}
+	if err := rtnl.SetOption(netlink.ExtendedAcknowledge, true); err != nil {
+		rtnl.Close()
+		return nil, fmt.Errorf("could not enable extended acknowledgements: %v", err)
+	}
+	return rtnl, nil
+}
+
 func GetInterfaceNodes(tcnl *tc.Tc, interf uint32) (tr, filterNodes []*Node) {
 	qdiscs, err := tcnl.Qdisc().Get()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get qdiscs")
+		// go-tc fails on the whole dump when a netem qdisc reports an attribute it does not know
+		nodes, err := getQdiscNodes(interf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get qdiscs: %v", err)
+		}
+		tr = append(tr, nodes...)
 	}
 	classes, err := tcnl.Class().Get(&tc.Msg{
 		Family:  unix.AF_UNSPEC,
@@ -20,15 +40,12 @@ func GetInterfaceNodes(tcnl *tc.Tc, interf uint32) (tr, filterNodes []*Node) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get classes")
 	}
-	filters, err := tcnl.Class().Get(&tc.Msg{
-		Family:  unix.AF_UNSPEC,
-		Ifindex: interf,
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get filters")
-	}
 
 	for _, qd := range qdiscs {
+		// the kernel returns the qdiscs of all interfaces
+		if qd.Ifindex != interf {
+			continue
+		}
 		n := NewNodeWithObject("qdisc", qd)
 		tr = append(tr, n)
 	}
@@ -37,9 +54,39 @@ func GetInterfaceNodes(tcnl *tc.Tc, interf uint32) (tr, filterNodes []*Node) {
 		tr = append(tr, n)
 	}
 
-	for _, fl := range filters {
-		n := NewNodeWithObject("filter", fl)
-		filterNodes = append(filterNodes, n)
+	// filters are requested per parent they are attached to, the filters of clsact per hook
+	var parents []uint32
+	for _, n := range tr {
+		if n.Object.Kind == "clsact" {
+			parents = append(parents, clsactIngress, clsactEgress)
+			continue
+		}
+		parents = append(parents, n.Object.Handle)
+	}
+	for _, parent := range parents {
+		filters, err := tcnl.Filter().Get(&tc.Msg{
+			Family:  unix.AF_UNSPEC,
+			Ifindex: interf,
+			Parent:  parent,
+		})
+		flower := false
+		for _, fl := range filters {
+			flower = flower || fl.Kind == "flower"
+		}
+		if err != nil || flower {
+			// go-tc fails on the whole dump when a filter has an action it does not know, eg. pedit,
+			// and drops the IPv6 and connection tracking keys of flower filters
+			nodes, err := getFilterNodes(tcnl, interf, parent)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get filters of %s: %v", FmtHandle(parent), err)
+			}
+			filterNodes = append(filterNodes, nodes...)
+			continue
+		}
+		for _, fl := range filters {
+			n := NewNodeWithObject("filter", fl)
+			filterNodes = append(filterNodes, n)
+		}
 	}
 	return
 }
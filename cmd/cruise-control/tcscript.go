@@ -0,0 +1,1425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// ScriptError is returned when a statement in a tc script can not be imported. It carries the line
+// number the statement started on, so the user can easily find the offending statement.
+type ScriptError struct {
+	Line int
+	Err  error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	assignmentRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)=(.*)$`)
+	variableRe   = regexp.MustCompile(`\$(\{[A-Za-z_][A-Za-z0-9_]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// ParseTcScript parses a (wondershaper style) shell script that sets up TC through the `tc`
+// command-line tool and returns the TC objects it creates for every device it touches. Only a
+// subset of the `tc qdisc|class|filter add|replace|change` syntax is supported, next to simple
+// variable assignments. Delete and show statements are skipped, as the reconciler takes care of
+// removing stale objects. The returned objects have no interface index set, see TcConfig.updateInterface.
+func ParseTcScript(r io.Reader) (map[string]TcConfig, error) {
+	configs := make(map[string]TcConfig)
+	vars := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	lineNr, stmtLine := 0, 0
+	stmt := ""
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimSpace(scanner.Text())
+		if stmt == "" {
+			stmtLine = lineNr
+		}
+		if strings.HasSuffix(line, "\\") {
+			stmt += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		stmt += line
+
+		tokens, err := splitStatement(stmt, vars)
+		stmt = ""
+		if err != nil {
+			return nil, &ScriptError{Line: stmtLine, Err: err}
+		}
+		if err := parseStatement(tokens, vars, configs); err != nil {
+			return nil, &ScriptError{Line: stmtLine, Err: err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if stmt != "" {
+		return nil, &ScriptError{Line: stmtLine, Err: errors.New("unterminated line continuation")}
+	}
+	return configs, nil
+}
+
+// splitStatement splits a statement into shell words. Comments are stripped, quotes are removed and
+// variables are expanded.
+func splitStatement(stmt string, vars map[string]string) ([]string, error) {
+	var tokens []string
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+	for _, c := range stmt {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+				continue
+			}
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == '#' && !inWord:
+			quote = -1
+		case c == ' ' || c == '\t':
+			if inWord {
+				tokens = append(tokens, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+		if quote == -1 {
+			break
+		}
+	}
+	if quote > 0 {
+		return nil, fmt.Errorf("unterminated quote %q", quote)
+	}
+	if inWord {
+		tokens = append(tokens, word.String())
+	}
+
+	for i, tok := range tokens {
+		var err error
+		tokens[i] = variableRe.ReplaceAllStringFunc(tok, func(v string) string {
+			name := strings.Trim(v, "${}")
+			val, ok := vars[name]
+			if !ok {
+				err = fmt.Errorf("variable %s is not defined in the script", name)
+			}
+			return val
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// parseStatement handles a single statement of the script and stores the resulting TC objects in
+// configs
+func parseStatement(tokens []string, vars map[string]string, configs map[string]TcConfig) error {
+	// strip output redirection, it does not influence the resulting TC setup
+	var args []string
+	for i := 0; i < len(tokens); i++ {
+		switch tok := tokens[i]; {
+		case tok == ">" || tok == ">>" || tok == "2>" || tok == "2>>":
+			i++
+		case strings.HasPrefix(tok, ">") || strings.HasPrefix(tok, "2>") || strings.HasPrefix(tok, "&>"):
+		case tok == "||" && i == len(tokens)-2 && (tokens[i+1] == "true" || tokens[i+1] == ":"):
+			// `|| true` only ignores the failure of the command
+			i++
+		case tok == "||" || tok == "&&" || tok == ";" || tok == "|":
+			return fmt.Errorf("command lists (%s) are not supported", tok)
+		default:
+			args = append(args, tok)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	switch cmd := args[0]; {
+	case cmd == "tc" || strings.HasSuffix(cmd, "/tc"):
+		return parseTcCommand(&tcArgs{args: args[1:]}, configs)
+	case cmd == "set":
+		return nil
+	case cmd == "export" && len(args) == 2 && assignmentRe.MatchString(args[1]):
+		args = args[1:]
+		fallthrough
+	case len(args) == 1 && assignmentRe.MatchString(cmd):
+		m := assignmentRe.FindStringSubmatch(args[0])
+		vars[m[1]] = m[2]
+		return nil
+	default:
+		return fmt.Errorf("unsupported command %q", cmd)
+	}
+}
+
+// tcArgs is a cursor over the arguments of a `tc` invocation
+type tcArgs struct {
+	args []string
+	pos  int
+}
+
+func (a *tcArgs) next() (string, bool) {
+	if a.pos >= len(a.args) {
+		return "", false
+	}
+	a.pos++
+	return a.args[a.pos-1], true
+}
+
+func (a *tcArgs) value(key string) (string, error) {
+	v, ok := a.next()
+	if !ok {
+		return "", fmt.Errorf("missing value for %q", key)
+	}
+	return v, nil
+}
+
+func (a *tcArgs) peek() string {
+	if a.pos >= len(a.args) {
+		return ""
+	}
+	return a.args[a.pos]
+}
+
+func parseTcCommand(args *tcArgs, configs map[string]TcConfig) error {
+	obj, ok := args.next()
+	if !ok {
+		return errors.New("missing tc object")
+	}
+	if strings.HasPrefix(obj, "-") {
+		return fmt.Errorf("unsupported tc option %q", obj)
+	}
+	verb, ok := args.next()
+	if !ok {
+		return fmt.Errorf("missing command for tc %s", obj)
+	}
+	switch verb {
+	case "add", "replace", "change":
+	case "del", "delete", "show", "list", "ls":
+		return nil
+	default:
+		return fmt.Errorf("unsupported command tc %s %s", obj, verb)
+	}
+
+	var dev, name string
+	var object tc.Object
+	var netem *Netem
+	var red *Red
+	var extra *FlowerExtra
+	var err error
+	switch obj {
+	case "qdisc":
+		dev, object, netem, red, err = parseTcQdisc(args)
+	case "class":
+		dev, object, err = parseTcClass(args)
+		name = FmtHandle(object.Handle)
+	case "filter":
+		dev, object, extra, err = parseTcFilter(args)
+		name = fmt.Sprintf("%s-%s-%x", object.Kind, FmtHandle(object.Parent), object.Info)
+	default:
+		return fmt.Errorf("unsupported tc object %q", obj)
+	}
+	if err != nil {
+		return err
+	}
+	if dev == "" {
+		return fmt.Errorf("tc %s %s requires a device", obj, verb)
+	}
+	if obj == "qdisc" && object.Kind == "clsact" {
+		// the clsact qdisc is added with the filters of its hooks
+		return nil
+	}
+
+	conf, ok := configs[dev]
+	if !ok {
+		conf = TcConfig{
+			Qdiscs:  make(map[string]tc.Object),
+			Classes: make(map[string]tc.Object),
+			Filters: make(map[string]tc.Object),
+		}
+		configs[dev] = conf
+	}
+	if obj == "qdisc" {
+		if object.Handle == 0 {
+			object.Handle = qdiscHandle(conf, object.Parent)
+		}
+		name = FmtHandle(object.Handle)
+	}
+	objects := map[string]map[string]tc.Object{
+		"qdisc":  conf.Qdiscs,
+		"class":  conf.Classes,
+		"filter": conf.Filters,
+	}[obj]
+	if obj == "filter" {
+		name = filterName(objects, name, verb, object)
+	}
+	if _, exists := objects[name]; exists && verb == "add" {
+		return fmt.Errorf("%s %s already exists on %s", obj, name, dev)
+	}
+	objects[name] = object
+	if netem != nil {
+		conf.setNetem(name, *netem)
+		configs[dev] = conf
+	} else if obj == "qdisc" {
+		delete(conf.Netem, name)
+	}
+	if red != nil {
+		conf.setRed(name, *red)
+		configs[dev] = conf
+	} else if obj == "qdisc" {
+		delete(conf.Red, name)
+	}
+	if extra != nil {
+		conf.setFlowerExtra(name, *extra)
+		configs[dev] = conf
+	} else if obj == "filter" {
+		delete(conf.FlowerExtra, name)
+	}
+	return nil
+}
+
+// filterName returns the name of a filter. A replaced or changed filter keeps the name of the filter
+// with the same parent, priority and protocol. Added filters without an explicit handle or priority
+// are not unique, the kernel assigns those, so they get a name of their own.
+func filterName(filters map[string]tc.Object, name, verb string, filter tc.Object) string {
+	if verb != "add" {
+		for n, f := range filters {
+			if f.Parent == filter.Parent && f.Info == filter.Info && (filter.Handle == 0 || f.Handle == filter.Handle) {
+				return n
+			}
+		}
+	}
+	for i := 2; ; i++ {
+		if _, exists := filters[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s-%s-%x-%d", filter.Kind, FmtHandle(filter.Parent), filter.Info, i)
+	}
+}
+
+// qdiscHandle returns the handle of a qdisc added without one. Like the kernel it replaces the qdisc
+// already attached to its parent, otherwise it gets the first free handle from 8001: up.
+func qdiscHandle(conf TcConfig, parent uint32) uint32 {
+	used := make(map[uint32]bool)
+	for _, q := range conf.Qdiscs {
+		if q.Parent == parent {
+			return q.Handle
+		}
+		used[q.Handle] = true
+	}
+	handle := core.BuildHandle(0x8001, 0)
+	for used[handle] {
+		handle += core.BuildHandle(1, 0)
+	}
+	return handle
+}
+
+// parseTcQdisc parses the arguments of `tc qdisc add`. The link conditions of netem qdiscs and the
+// options of red and choke qdiscs are returned as well, as their loss model and idle damping are
+// kept next to the qdisc.
+func parseTcQdisc(args *tcArgs) (dev string, obj tc.Object, netem *Netem, red *Red, err error) {
+	obj.Family = unix.AF_UNSPEC
+	for {
+		arg, ok := args.next()
+		if !ok {
+			return dev, obj, nil, nil, errors.New("missing qdisc kind")
+		}
+		switch arg {
+		case "dev":
+			dev, err = args.value(arg)
+		case "root":
+			obj.Parent = tc.HandleRoot
+		case "stab":
+			obj.Stab, err = parseStab(args)
+		case "parent", "handle":
+			var h string
+			if h, err = args.value(arg); err == nil {
+				var handle uint32
+				handle, err = StrHandle(h)
+				if arg == "parent" {
+					obj.Parent = handle
+				} else {
+					obj.Handle = handle
+				}
+			}
+		case "netem":
+			var n Netem
+			n, err = parseNetem(args)
+			obj.Attribute = n.attribute()
+			return dev, obj, &n, nil, err
+		case "red", "choke":
+			var r Red
+			if r, err = parseRed(args, arg); err != nil {
+				return dev, obj, nil, nil, err
+			}
+			obj.Attribute = r.attribute()
+			return dev, obj, nil, &r, nil
+		default:
+			obj.Kind = arg
+			err = parseQdiscOptions(args, &obj.Attribute)
+			return dev, obj, nil, nil, err
+		}
+		if err != nil {
+			return dev, obj, nil, nil, err
+		}
+	}
+}
+
+// parseStab parses the size table options of a qdisc
+func parseStab(args *tcArgs) (*tc.Stab, error) {
+	spec := tc.SizeSpec{LinkLayer: linkLayerEthernet}
+	for {
+		var v string
+		var n uint64
+		var err error
+		switch key := args.peek(); key {
+		case "overhead":
+			args.next()
+			if v, err = args.value(key); err == nil {
+				var overhead int64
+				overhead, err = strconv.ParseInt(v, 10, 32)
+				spec.Overhead = int32(overhead)
+			}
+		case "mpu", "mtu", "tsize":
+			args.next()
+			if v, err = args.value(key); err == nil {
+				n, err = strconv.ParseUint(v, 10, 32)
+				switch key {
+				case "mpu":
+					spec.MPU = uint32(n)
+				case "mtu":
+					spec.MTU = uint32(n)
+				case "tsize":
+					spec.TSize = uint32(n)
+				}
+			}
+		case "linklayer":
+			args.next()
+			if v, err = args.value(key); err == nil {
+				spec.LinkLayer, err = parseLinkLayer(v)
+			}
+		default:
+			return newStab(spec), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stab: %v", err)
+		}
+	}
+}
+
+// parseTcClass parses the arguments of `tc class add`
+func parseTcClass(args *tcArgs) (dev string, obj tc.Object, err error) {
+	obj.Family = unix.AF_UNSPEC
+	for {
+		arg, ok := args.next()
+		if !ok {
+			return dev, obj, errors.New("missing class kind")
+		}
+		switch arg {
+		case "dev":
+			dev, err = args.value(arg)
+		case "root":
+			obj.Parent = tc.HandleRoot
+		case "parent", "classid":
+			var h string
+			if h, err = args.value(arg); err == nil {
+				var handle uint32
+				handle, err = StrHandle(h)
+				if arg == "parent" {
+					obj.Parent = handle
+				} else {
+					obj.Handle = handle
+				}
+			}
+		default:
+			obj.Kind = arg
+			err = parseClassOptions(args, &obj.Attribute)
+			return dev, obj, err
+		}
+		if err != nil {
+			return dev, obj, err
+		}
+	}
+}
+
+// parseTcFilter parses the arguments of `tc filter add`. The keys of flower filters go-tc can not
+// hold are returned separately.
+func parseTcFilter(args *tcArgs) (dev string, obj tc.Object, extra *FlowerExtra, err error) {
+	obj.Family = unix.AF_UNSPEC
+	protocol := uint32(unix.ETH_P_ALL)
+	prio := uint32(0)
+	handle := ""
+	for {
+		arg, ok := args.next()
+		if !ok {
+			return dev, obj, extra, errors.New("missing filter kind")
+		}
+		var val string
+		switch arg {
+		case "dev":
+			dev, err = args.value(arg)
+		case "root":
+			obj.Parent = tc.HandleRoot
+		case "parent":
+			if val, err = args.value(arg); err == nil {
+				obj.Parent, err = StrHandle(val)
+			}
+		case "ingress":
+			obj.Parent = clsactIngress
+		case "egress":
+			obj.Parent = clsactEgress
+		case "protocol":
+			if val, err = args.value(arg); err == nil {
+				protocol, err = parseProtocol(val)
+			}
+		case "prio", "pref", "priority":
+			if val, err = args.value(arg); err == nil {
+				var p uint64
+				p, err = strconv.ParseUint(val, 0, 16)
+				prio = uint32(p)
+			}
+		case "handle":
+			handle, err = args.value(arg)
+		default:
+			obj.Kind = arg
+			obj.Info = core.BuildHandle(prio, uint32(htons(uint16(protocol))))
+			if obj.Kind == "flower" {
+				extra, err = parseFlowerOptions(args, &obj, handle)
+				return dev, obj, extra, err
+			}
+			err = parseFilterOptions(args, &obj, handle)
+			return dev, obj, extra, err
+		}
+		if err != nil {
+			return dev, obj, extra, err
+		}
+	}
+}
+
+func parseProtocol(proto string) (uint32, error) {
+	switch proto {
+	case "all":
+		return unix.ETH_P_ALL, nil
+	case "ip":
+		return unix.ETH_P_IP, nil
+	case "ipv6":
+		return unix.ETH_P_IPV6, nil
+	case "arp":
+		return unix.ETH_P_ARP, nil
+	case "802.1q", "802.1Q":
+		return unix.ETH_P_8021Q, nil
+	}
+	p, err := strconv.ParseUint(proto, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported protocol %q", proto)
+	}
+	return uint32(p), nil
+}
+
+func parseQdiscOptions(args *tcArgs, attr *tc.Attribute) error {
+	var err error
+	switch attr.Kind {
+	case "hfsc":
+		attr.HfscQOpt = &tc.HfscQOpt{}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			switch arg {
+			case "default":
+				var v uint64
+				v, err = parseUintArg(args, arg, 16, 16)
+				attr.HfscQOpt.DefCls = uint16(v)
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "htb":
+		attr.Htb = &tc.Htb{
+			Init: &tc.HtbGlob{Version: 3, Rate2Quantum: 10},
+		}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint64
+			switch arg {
+			case "default":
+				v, err = parseUintArg(args, arg, 16, 32)
+				attr.Htb.Init.Defcls = uint32(v)
+			case "r2q":
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Htb.Init.Rate2Quantum = uint32(v)
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "fq_codel":
+		attr.FqCodel = &tc.FqCodel{}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint32
+			switch arg {
+			case "limit", "flows", "drop_batch":
+				var u uint64
+				u, err = parseUintArg(args, arg, 0, 32)
+				v = uint32(u)
+				switch arg {
+				case "limit":
+					attr.FqCodel.Limit = &v
+				case "flows":
+					attr.FqCodel.Flows = &v
+				case "drop_batch":
+					attr.FqCodel.DropBatchSize = &v
+				}
+			case "target", "interval", "ce_threshold":
+				v, err = parseTimeArg(args, arg)
+				switch arg {
+				case "target":
+					attr.FqCodel.Target = &v
+				case "interval":
+					attr.FqCodel.Interval = &v
+				case "ce_threshold":
+					attr.FqCodel.CEThreshold = &v
+				}
+			case "quantum", "memory_limit":
+				v, err = parseSizeArg(args, arg)
+				if arg == "quantum" {
+					attr.FqCodel.Quantum = &v
+				} else {
+					attr.FqCodel.MemoryLimit = &v
+				}
+			case "ecn", "noecn":
+				if arg == "ecn" {
+					v = 1
+				}
+				attr.FqCodel.ECN = &v
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "sfq":
+		attr.Sfq = &tc.Sfq{}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint64
+			switch arg {
+			case "limit":
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Sfq.V0.Limit = uint32(v)
+				attr.Sfq.Limit = uint32(v)
+			case "perturb":
+				v, err = parseUintArg(args, arg, 0, 31)
+				attr.Sfq.V0.PerturbPeriod = int32(v)
+			case "quantum":
+				var size uint32
+				size, err = parseSizeArg(args, arg)
+				attr.Sfq.V0.Quantum = size
+			case "divisor":
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Sfq.V0.Divisor = uint32(v)
+			case "flows":
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Sfq.V0.Flows = uint32(v)
+			case "depth":
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Sfq.Depth = uint32(v)
+			case "headdrop":
+				attr.Sfq.Headdrop = 1
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "fq":
+		attr.Fq = &tc.Fq{}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint32
+			switch arg {
+			case "limit", "flow_limit", "orphanmask":
+				var u uint64
+				u, err = parseUintArg(args, arg, 0, 32)
+				v = uint32(u)
+				switch arg {
+				case "limit":
+					attr.Fq.PLimit = &v
+				case "flow_limit":
+					attr.Fq.FlowPLimit = &v
+				case "orphanmask":
+					attr.Fq.OrphanMask = &v
+				}
+			case "buckets":
+				// the kernel takes the log of the number of buckets
+				var u uint64
+				if u, err = parseUintArg(args, arg, 0, 32); err == nil && bits.OnesCount32(uint32(u)) != 1 {
+					err = fmt.Errorf("invalid fq buckets %d, expected a power of two", u)
+				}
+				v = uint32(bits.TrailingZeros32(uint32(u)))
+				attr.Fq.BucketsLog = &v
+			case "quantum", "initial_quantum":
+				v, err = parseSizeArg(args, arg)
+				if arg == "quantum" {
+					attr.Fq.Quantum = &v
+				} else {
+					attr.Fq.InitQuantum = &v
+				}
+			case "maxrate", "defrate", "low_rate_threshold":
+				var rate Rate
+				rate, err = parseRateArg(args, arg)
+				// rates above 32 bit are unlimited
+				v, _ = rate.rate64()
+				switch arg {
+				case "maxrate":
+					attr.Fq.FlowMaxRate = &v
+				case "defrate":
+					attr.Fq.FlowDefaultRate = &v
+				case "low_rate_threshold":
+					attr.Fq.LowRateThreshold = &v
+				}
+			case "refill_delay", "ce_threshold":
+				v, err = parseTimeArg(args, arg)
+				if arg == "refill_delay" {
+					attr.Fq.FlowRefillDelay = &v
+				} else {
+					attr.Fq.CEThreshold = &v
+				}
+			case "pacing", "nopacing":
+				if arg == "pacing" {
+					v = 1
+				}
+				attr.Fq.RateEnable = &v
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "pfifo", "bfifo":
+		var fifo *tc.FifoOpt
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			if arg != "limit" {
+				err = unsupportedOption(attr.Kind, arg)
+				break
+			}
+			// the limit of pfifo is in packets, the one of bfifo in bytes
+			fifo = &tc.FifoOpt{}
+			if attr.Kind == "pfifo" {
+				var v uint64
+				v, err = parseUintArg(args, arg, 0, 32)
+				fifo.Limit = uint32(v)
+			} else {
+				fifo.Limit, err = parseSizeArg(args, arg)
+			}
+		}
+		if attr.Kind == "pfifo" {
+			attr.Pfifo = fifo
+		} else {
+			attr.Bfifo = fifo
+		}
+	case "red", "choke":
+		var red Red
+		if red, err = parseRed(args, attr.Kind); err == nil {
+			*attr = red.attribute()
+		}
+	case "cake":
+		attr.Cake = &tc.Cake{}
+		flowModes := map[string]uint32{
+			"flowblind": cakeFlowNone, "srchost": cakeFlowSrcIP, "dsthost": cakeFlowDstIP,
+			"hosts": cakeFlowHosts, "flows": cakeFlowFlows, "dual-srchost": cakeFlowDualSrc,
+			"dual-dsthost": cakeFlowDualDst, "triple-isolate": cakeFlowTriple,
+		}
+		diffservModes := map[string]uint32{
+			"diffserv3": cakeDiffserv3, "diffserv4": cakeDiffserv4, "diffserv8": cakeDiffserv8,
+			"besteffort": cakeBestEffort, "precedence": cakePrecedence,
+		}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			if mode, ok := flowModes[arg]; ok {
+				attr.Cake.FlowMode = &mode
+				continue
+			}
+			if mode, ok := diffservModes[arg]; ok {
+				attr.Cake.DiffServMode = &mode
+				continue
+			}
+			var v uint32
+			switch arg {
+			case "bandwidth":
+				var rate Rate
+				rate, err = parseRateArg(args, arg)
+				bytes := rate.BytesPerSecond()
+				attr.Cake.BaseRate = &bytes
+			case "unlimited":
+				bytes := uint64(0)
+				attr.Cake.BaseRate = &bytes
+			case "rtt":
+				v, err = parseTimeArg(args, arg)
+				attr.Cake.Rtt = &v
+			case "nat", "nonat":
+				if arg == "nat" {
+					v = 1
+				}
+				attr.Cake.Nat = &v
+			case "wash", "nowash":
+				if arg == "wash" {
+					v = 1
+				}
+				attr.Cake.Wash = &v
+			case "ingress", "egress":
+				if arg == "ingress" {
+					v = 1
+				}
+				attr.Cake.Ingress = &v
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "prio":
+		attr.Prio = &tc.Prio{
+			Bands:   3,
+			PrioMap: [16]uint8{1, 2, 2, 2, 1, 2, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1},
+		}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			switch arg {
+			case "bands":
+				var v uint64
+				v, err = parseUintArg(args, arg, 0, 32)
+				attr.Prio.Bands = uint32(v)
+			case "priomap":
+				for i := range attr.Prio.PrioMap {
+					var v uint64
+					if v, err = parseUintArg(args, arg, 0, 8); err != nil {
+						break
+					}
+					attr.Prio.PrioMap[i] = uint8(v)
+				}
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+	case "mqprio":
+		// the defaults of the tc command-line tool, which offloads the traffic classes to the NIC
+		opt := &tc.MqPrioQopt{NumTc: 8, PrioTcMap: [16]uint8{0, 1, 2, 3, 4, 5, 6, 7}, Hw: 1}
+		attr.MqPrio = &tc.MqPrio{Opt: opt}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint64
+			switch arg {
+			case "num_tc":
+				v, err = parseUintArg(args, arg, 0, 8)
+				opt.NumTc = uint8(v)
+			case "map":
+				// the priorities that are left out map to traffic class 0
+				opt.PrioTcMap = [16]uint8{}
+				for i := 0; i < len(opt.PrioTcMap) && err == nil && isNumber(args.peek()); i++ {
+					v, err = parseUintArg(args, arg, 0, 8)
+					opt.PrioTcMap[i] = uint8(v)
+				}
+			case "queues":
+				for i := 0; i < len(opt.Count) && err == nil && strings.Contains(args.peek(), "@"); i++ {
+					queues, _ := args.next()
+					if _, err = fmt.Sscanf(queues, "%d@%d", &opt.Count[i], &opt.Offset[i]); err != nil {
+						err = fmt.Errorf("invalid queues %q, expected count@offset", queues)
+					}
+				}
+			case "hw":
+				v, err = parseUintArg(args, arg, 0, 8)
+				opt.Hw = uint8(v)
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+		if err == nil && (opt.NumTc == 0 || int(opt.NumTc) > len(opt.Count)) {
+			err = fmt.Errorf("invalid num_tc %d for mqprio, expected 1 to %d traffic classes", opt.NumTc, len(opt.Count))
+		}
+		for i := 0; err == nil && i < len(opt.PrioTcMap); i++ {
+			if opt.PrioTcMap[i] >= opt.NumTc {
+				err = fmt.Errorf("priority %d of mqprio maps to traffic class %d, but there are %d", i, opt.PrioTcMap[i], opt.NumTc)
+			}
+		}
+	case "mq", "clsact":
+		if arg, ok := args.next(); ok {
+			err = unsupportedOption(attr.Kind, arg)
+		}
+	default:
+		return fmt.Errorf("unsupported qdisc kind %q", attr.Kind)
+	}
+	return err
+}
+
+func parseClassOptions(args *tcArgs, attr *tc.Attribute) error {
+	var err error
+	switch attr.Kind {
+	case "hfsc":
+		attr.Hfsc = &tc.Hfsc{
+			Rsc: &tc.ServiceCurve{},
+			Usc: &tc.ServiceCurve{},
+			Fsc: &tc.ServiceCurve{},
+		}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var c Curve
+			switch arg {
+			case "sc", "rt", "ls", "ul":
+				c, err = parseServiceCurve(args, arg)
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+			switch arg {
+			case "sc":
+				ClassCurves{SC: &c}.apply(attr.Hfsc)
+			case "rt":
+				ClassCurves{RT: &c}.apply(attr.Hfsc)
+			case "ls":
+				ClassCurves{LS: &c}.apply(attr.Hfsc)
+			case "ul":
+				ClassCurves{UL: &c}.apply(attr.Hfsc)
+			}
+		}
+	case "htb":
+		var rate, ceil Rate
+		var burst, cburst uint32
+		parms := &tc.HtbOpt{}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			var v uint64
+			switch arg {
+			case "rate":
+				rate, err = parseRateArg(args, arg)
+			case "ceil":
+				ceil, err = parseRateArg(args, arg)
+			case "burst", "buffer":
+				burst, err = parseSizeArg(args, arg)
+			case "cburst", "cbuffer":
+				cburst, err = parseSizeArg(args, arg)
+			case "prio":
+				v, err = parseUintArg(args, arg, 0, 32)
+				parms.Prio = uint32(v)
+			case "quantum":
+				var size uint32
+				size, err = parseSizeArg(args, arg)
+				parms.Quantum = size
+			default:
+				err = unsupportedOption(attr.Kind, arg)
+			}
+		}
+		if err != nil {
+			break
+		}
+		if rate == 0 {
+			return errors.New("htb class requires a rate")
+		}
+		attr.Htb = newHtbClass(rate, ceil, burst, cburst, parms.Prio)
+		attr.Htb.Parms.Quantum = parms.Quantum
+	default:
+		return fmt.Errorf("unsupported class kind %q", attr.Kind)
+	}
+	return err
+}
+
+// parseServiceCurve parses an HFSC service curve in either the `[m1 BPS d SEC] m2 BPS` or the
+// `[umax BYTES dmax SEC] rate BPS` notation
+func parseServiceCurve(args *tcArgs, curve string) (Curve, error) {
+	var c Curve
+	var target LatencyTarget
+	var err error
+	seen := map[string]bool{}
+	for err == nil {
+		key := args.peek()
+		switch key {
+		case "m1":
+			args.next()
+			c.M1, err = parseRateArg(args, key)
+		case "d":
+			args.next()
+			c.D, err = parseDurationArg(args, key)
+		case "m2":
+			args.next()
+			c.M2, err = parseRateArg(args, key)
+		case "umax":
+			args.next()
+			target.Umax, err = parseSizeArg(args, key)
+		case "dmax":
+			args.next()
+			target.Dmax, err = parseDurationArg(args, key)
+		case "rate":
+			args.next()
+			target.Rate, err = parseRateArg(args, key)
+		default:
+			switch {
+			case (seen["m1"] || seen["d"] || seen["m2"]) && (seen["umax"] || seen["dmax"] || seen["rate"]):
+				return Curve{}, fmt.Errorf("%s: can not mix m1/d/m2 and umax/dmax/rate", curve)
+			case seen["rate"]:
+				if target.Umax != 0 && target.Dmax == 0 {
+					return Curve{}, fmt.Errorf("%s: umax requires dmax", curve)
+				}
+				c = CurveForLatency(target)
+			case !seen["m2"]:
+				return Curve{}, fmt.Errorf("%s: missing m2 or rate", curve)
+			}
+			if c.M1.BytesPerSecond() > math.MaxUint32 || c.M2.BytesPerSecond() > math.MaxUint32 {
+				return Curve{}, fmt.Errorf("%s: rate exceeds the 32 bit HFSC limit", curve)
+			}
+			return c, nil
+		}
+		seen[key] = true
+	}
+	return Curve{}, err
+}
+
+func parseFilterOptions(args *tcArgs, obj *tc.Object, handle string) error {
+	var classID *uint32
+	parseClassID := func(arg string) error {
+		h, err := args.value(arg)
+		if err != nil {
+			return err
+		}
+		id, err := StrHandle(h)
+		classID = &id
+		return err
+	}
+
+	var err error
+	switch obj.Kind {
+	case "u32":
+		if handle != "" {
+			return fmt.Errorf("u32 filter handles are not supported")
+		}
+		u32 := &tc.U32{Sel: &tc.U32Sel{}}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			switch arg {
+			case "match":
+				err = parseU32Match(args, u32)
+			case "classid", "flowid":
+				err = parseClassID(arg)
+				u32.Sel.Flags |= u32Terminal
+			default:
+				err = unsupportedOption(obj.Kind, arg)
+			}
+		}
+		u32.ClassID = classID
+		u32.Sel.NKeys = uint8(len(u32.Sel.Keys))
+		obj.U32 = u32
+	case "fw":
+		fw := &tc.Fw{}
+		if handle != "" {
+			parts := strings.SplitN(handle, "/", 2)
+			mark, err := strconv.ParseUint(parts[0], 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid fw handle %q", handle)
+			}
+			obj.Handle = uint32(mark)
+			if len(parts) == 2 {
+				mask, err := strconv.ParseUint(parts[1], 0, 32)
+				if err != nil {
+					return fmt.Errorf("invalid fw mask %q", handle)
+				}
+				m := uint32(mask)
+				fw.Mask = &m
+			}
+		}
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			switch arg {
+			case "classid", "flowid":
+				err = parseClassID(arg)
+			case "indev":
+				var dev string
+				dev, err = args.value(arg)
+				fw.InDev = &dev
+			default:
+				err = unsupportedOption(obj.Kind, arg)
+			}
+		}
+		fw.ClassID = classID
+		obj.Fw = fw
+	case "bpf":
+		object, section, da := "", "classifier", false
+		for err == nil {
+			arg, ok := args.next()
+			if !ok {
+				break
+			}
+			switch arg {
+			case "obj", "object-file":
+				object, err = args.value(arg)
+			case "sec", "section":
+				section, err = args.value(arg)
+			case "da", "direct-action":
+				da = true
+			case "classid", "flowid":
+				err = parseClassID(arg)
+			default:
+				err = unsupportedOption(obj.Kind, arg)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if object == "" {
+			return errors.New("bpf filters need an object file, bytecode is not supported")
+		}
+		prio, _ := splitInfo(obj.Info)
+		f, err := bpfFilter(object, section, obj.Ifindex, obj.Parent, classID, da, prio)
+		if err != nil {
+			return err
+		}
+		f.Info = obj.Info
+		obj.Handle, obj.Attribute = 1, f.Attribute
+		return nil
+	default:
+		return fmt.Errorf("unsupported filter kind %q", obj.Kind)
+	}
+	return err
+}
+
+// newHtbClass returns the options of an HTB class. The ceil defaults to the rate and the burst
+// buffers default to the ones `tc` would calculate.
+func newHtbClass(rate, ceil Rate, burst, cburst, prio uint32) *tc.Htb {
+	if ceil == 0 {
+		ceil = rate
+	}
+	if burst == 0 {
+		burst = uint32(rate.BytesPerSecond()/1e9) + 1600
+	}
+	if cburst == 0 {
+		cburst = uint32(ceil.BytesPerSecond()/1e9) + 1600
+	}
+	parms := &tc.HtbOpt{Prio: prio}
+	htb := &tc.Htb{Parms: parms}
+	parms.Rate.Rate, htb.Rate64 = rate.rate64()
+	parms.Ceil.Rate, htb.Ceil64 = ceil.rate64()
+	parms.Rate.Linklayer, parms.Ceil.Linklayer = 1, 1
+	parms.Buffer = xmitTime(rate, burst)
+	parms.Cbuffer = xmitTime(ceil, cburst)
+	return htb
+}
+
+// u32Terminal is the TC_U32_TERMINAL selector flag, which makes a matching u32 filter return its
+// classid
+const u32Terminal = 1
+
+// parseU32Match parses a single u32 `match` selector and adds it to the filter
+func parseU32Match(args *tcArgs, u32 *tc.U32) error {
+	typ, err := args.value("match")
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case "mark":
+		val, err := parseUintArg(args, typ, 0, 32)
+		if err != nil {
+			return err
+		}
+		mask, err := parseUintArg(args, typ, 0, 32)
+		if err != nil {
+			return err
+		}
+		u32.Mark = &tc.U32Mark{Val: uint32(val), Mask: uint32(mask)}
+		return nil
+	case "u32", "u16", "u8":
+		bits := map[string]int{"u32": 32, "u16": 16, "u8": 8}[typ]
+		val, err := parseUintArg(args, typ, 0, bits)
+		if err != nil {
+			return err
+		}
+		mask, err := parseUintArg(args, typ, 0, bits)
+		if err != nil {
+			return err
+		}
+		if at, _ := args.next(); at != "at" {
+			return fmt.Errorf("match %s requires an offset", typ)
+		}
+		offStr, err := args.value("at")
+		if err != nil {
+			return err
+		}
+		off, err := strconv.ParseInt(offStr, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid offset %q", offStr)
+		}
+		return packU32Key(u32.Sel, uint32(val), uint32(mask), bits, int32(off))
+	case "ip":
+		field, err := args.value(typ)
+		if err != nil {
+			return err
+		}
+		switch field {
+		case "src", "dst":
+			prefix, err := args.value(field)
+			if err != nil {
+				return err
+			}
+			val, mask, err := parseIPv4Prefix(prefix)
+			if err != nil {
+				return err
+			}
+			off := int32(12)
+			if field == "dst" {
+				off = 16
+			}
+			return packU32Key(u32.Sel, val, mask, 32, off)
+		case "sport", "dport", "protocol", "tos", "dsfield":
+			bits, off := 16, int32(20)
+			switch field {
+			case "dport":
+				off = 22
+			case "protocol":
+				bits, off = 8, 9
+			case "tos", "dsfield":
+				bits, off = 8, 1
+			}
+			val, err := parseUintArg(args, field, 0, bits)
+			if err != nil {
+				return err
+			}
+			mask, err := parseUintArg(args, field, 0, bits)
+			if err != nil {
+				return err
+			}
+			return packU32Key(u32.Sel, uint32(val), uint32(mask), bits, off)
+		}
+		return fmt.Errorf("unsupported u32 match ip %s", field)
+	}
+	return fmt.Errorf("unsupported u32 match %q", typ)
+}
+
+// packU32Key adds a match of bits wide at offset off to the selector. u32 only matches on 32 bit
+// words, so smaller matches are shifted into their word and merged with other matches on the same
+// word. Keys are stored in network byte order, like the kernel expects them.
+func packU32Key(sel *tc.U32Sel, val, mask uint32, bits int, off int32) error {
+	if bits < 32 && off%int32(bits/8) != 0 {
+		return fmt.Errorf("offset %d is not aligned to %d bits", off, bits)
+	}
+	word := off &^ 3
+	shift := uint32(32 - bits - 8*int(off-word))
+	val, mask = (val&mask)<<shift, mask<<shift
+
+	for i, key := range sel.Keys {
+		if key.Off != uint32(word) {
+			continue
+		}
+		existingVal, existingMask := ntohl(key.Val), ntohl(key.Mask)
+		if (existingVal^val)&existingMask&mask != 0 {
+			return fmt.Errorf("match at offset %d conflicts with an earlier match", off)
+		}
+		sel.Keys[i].Val = htonl(existingVal | val)
+		sel.Keys[i].Mask = htonl(existingMask | mask)
+		return nil
+	}
+	sel.Keys = append(sel.Keys, tc.U32Key{
+		Val:  htonl(val),
+		Mask: htonl(mask),
+		Off:  uint32(word),
+	})
+	return nil
+}
+
+func parseIPv4Prefix(prefix string) (val, mask uint32, err error) {
+	if !strings.Contains(prefix, "/") {
+		prefix += "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() == nil {
+		return 0, 0, fmt.Errorf("invalid IPv4 prefix %q", prefix)
+	}
+	return binary.BigEndian.Uint32(ipnet.IP.To4()), binary.BigEndian.Uint32(ipnet.Mask), nil
+}
+
+func unsupportedOption(kind, option string) error {
+	return fmt.Errorf("unsupported %s option %q", kind, option)
+}
+
+func parseUintArg(args *tcArgs, key string, base, bits int) (uint64, error) {
+	s, err := args.value(key)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(s, base, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s", s, key)
+	}
+	return v, nil
+}
+
+func parseRateArg(args *tcArgs, key string) (Rate, error) {
+	s, err := args.value(key)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := ParseRate(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return rate, nil
+}
+
+func parseTimeArg(args *tcArgs, key string) (uint32, error) {
+	s, err := args.value(key)
+	if err != nil {
+		return 0, err
+	}
+	t, err := parseTcTime(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q for %s: %v", s, key, err)
+	}
+	return t, nil
+}
+
+func parseDurationArg(args *tcArgs, key string) (time.Duration, error) {
+	usec, err := parseTimeArg(args, key)
+	return time.Duration(usec) * time.Microsecond, err
+}
+
+func parseSizeArg(args *tcArgs, key string) (uint32, error) {
+	s, err := args.value(key)
+	if err != nil {
+		return 0, err
+	}
+	size, err := parseTcSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q for %s: %v", s, key, err)
+	}
+	return size, nil
+}
+
+// splitUnit splits a value like "10mbit" in its numeric part and its unit
+func splitUnit(s string) (float64, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.')
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || v < 0 {
+		return 0, "", fmt.Errorf("not a positive number")
+	}
+	return v, strings.ToLower(s[i:]), nil
+}
+
+// parseTcTime parses a time as the `tc` tool does and returns it in microseconds
+func parseTcTime(s string) (uint32, error) {
+	v, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	usec := map[string]float64{
+		"": 1, "us": 1, "usec": 1, "usecs": 1,
+		"ms": 1e3, "msec": 1e3, "msecs": 1e3,
+		"s": 1e6, "sec": 1e6, "secs": 1e6,
+	}
+	factor, ok := usec[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	t := math.Round(v * factor)
+	if t > math.MaxUint32 {
+		return 0, fmt.Errorf("time too large")
+	}
+	return uint32(t), nil
+}
+
+// parseTcSize parses a size as the `tc` tool does and returns it in bytes
+func parseTcSize(s string) (uint32, error) {
+	v, unit, err := splitUnit(s)
+	if err != nil {
+		return 0, err
+	}
+	bytes := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30,
+		"kbit": 1 << 10 / 8, "mbit": 1 << 20 / 8, "gbit": 1 << 30 / 8,
+	}
+	factor, ok := bytes[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	size := math.Round(v * factor)
+	if size > math.MaxUint32 {
+		return 0, fmt.Errorf("size too large")
+	}
+	return uint32(size), nil
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return nlenc.Uint16(b)
+}
+
+func htonl(v uint32) uint32 {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return nlenc.Uint32(b)
+}
+
+func ntohl(v uint32) uint32 {
+	b := make([]byte, 4)
+	nlenc.PutUint32(b, v)
+	return binary.BigEndian.Uint32(b)
+}
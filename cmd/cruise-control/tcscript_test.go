@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+)
+
+const testScript = `#!/bin/sh
+set -e
+DEV=eth0
+UP="10mbit"
+
+tc qdisc del dev $DEV root 2> /dev/null > /dev/null
+tc qdisc del dev $DEV ingress 2> /dev/null || true
+tc qdisc add dev $DEV root handle 1: hfsc default 20
+tc class add dev $DEV parent 1: classid 1:1 hfsc sc rate ${UP} ul rate ${UP}
+tc class add dev $DEV parent 1:1 classid 1:10 hfsc \
+	rt umax 1500b dmax 10ms rate 1mbit ls m2 4mbit
+tc class add dev $DEV parent 1:1 classid 1:20 hfsc ls m1 0 d 100ms m2 6mbit
+tc qdisc add dev $DEV parent 1:10 handle 10: fq_codel limit 1200 target 5ms noecn
+tc qdisc add dev $DEV parent 1:20 handle 20: sfq perturb 10
+tc filter add dev $DEV parent 1: protocol ip prio 1 u32 match ip dport 22 0xffff flowid 1:10
+tc filter add dev $DEV parent 1: protocol ip prio 2 u32 match mark 0x2 0xf flowid 1:20
+tc filter add dev $DEV parent 1: protocol ip prio 3 handle 5/0xff fw classid 1:20
+
+tc qdisc add dev ifb0 root handle 1: htb default 10
+tc class add dev ifb0 parent 1: classid 1:10 htb rate 50mbit ceil 100mbit prio 1
+`
+
+func TestParseTcScript(t *testing.T) {
+	configs, err := ParseTcScript(strings.NewReader(testScript))
+	if err != nil {
+		t.Fatalf("failed to parse script: %v", err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(configs))
+	}
+
+	eth0 := configs["eth0"]
+	if len(eth0.Qdiscs) != 3 || len(eth0.Classes) != 3 || len(eth0.Filters) != 3 {
+		t.Fatalf("unexpected amount of objects: %d qdiscs, %d classes, %d filters",
+			len(eth0.Qdiscs), len(eth0.Classes), len(eth0.Filters))
+	}
+
+	root := eth0.Qdiscs["1:0"]
+	if root.Parent != tc.HandleRoot || root.Kind != "hfsc" || root.HfscQOpt.DefCls != 0x20 {
+		t.Errorf("unexpected root qdisc: %+v", root)
+	}
+
+	interactive := eth0.Classes["1:10"].Hfsc
+	if *interactive.Rsc != (tc.ServiceCurve{M1: 150000, D: 10000, M2: 125000}) {
+		t.Errorf("unexpected rt curve for umax/dmax/rate: %+v", *interactive.Rsc)
+	}
+	if *interactive.Fsc != (tc.ServiceCurve{M2: 500000}) {
+		t.Errorf("unexpected ls curve: %+v", *interactive.Fsc)
+	}
+	bulk := eth0.Classes["1:20"].Hfsc
+	if *bulk.Fsc != (tc.ServiceCurve{D: 100000, M2: 750000}) {
+		t.Errorf("unexpected ls curve: %+v", *bulk.Fsc)
+	}
+
+	fqCodel := eth0.Qdiscs["10:0"]
+	if fqCodel.Parent != core.BuildHandle(1, 0x10) || *fqCodel.FqCodel.Target != 5000 || *fqCodel.FqCodel.ECN != 0 {
+		t.Errorf("unexpected fq_codel qdisc: %+v", fqCodel)
+	}
+
+	for _, filter := range eth0.Filters {
+		switch filter.Kind {
+		case "u32":
+			if filter.U32.Sel.Flags&u32Terminal == 0 {
+				t.Errorf("u32 filter with a flowid should be terminal")
+			}
+		case "fw":
+			if filter.Handle != 5 || *filter.Fw.Mask != 0xff || *filter.Fw.ClassID != core.BuildHandle(1, 0x20) {
+				t.Errorf("unexpected fw filter: %+v", filter)
+			}
+		}
+	}
+
+	htb := configs["ifb0"].Classes["1:10"].Htb
+	if htb.Parms.Rate.Rate != 6250000 || htb.Parms.Ceil.Rate != 12500000 || htb.Parms.Prio != 1 {
+		t.Errorf("unexpected htb class: %+v", htb.Parms)
+	}
+}
+
+func TestParseTcScriptErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		line   int
+	}{
+		{"unsupported command", "DEV=eth0\nip link set dev $DEV up", 2},
+		{"undefined variable", "\n\ntc qdisc add dev $DEV root handle 1: hfsc", 3},
+		{"unsupported qdisc", "tc qdisc add dev eth0 root handle 1: cbq", 1},
+		{"unsupported option", "tc qdisc add dev eth0 root handle 1: hfsc\n\ntc class add dev eth0 parent 1: \\\n\thfsc foo 1", 3},
+		{"duplicate add", "tc qdisc add dev eth0 root handle 1: hfsc\ntc qdisc add dev eth0 root handle 1: hfsc", 2},
+		{"missing device", "tc qdisc add root handle 1: hfsc", 1},
+		{"missing rate", "tc class add dev eth0 parent 1: classid 1:1 htb ceil 10mbit", 1},
+		{"fq buckets 0", "tc qdisc add dev eth0 root fq buckets 0", 1},
+		{"fq buckets not a power of two", "tc qdisc add dev eth0 root fq buckets 1000", 1},
+		{"occupied parent", "tc qdisc add dev eth0 parent 1:10 pfifo\ntc qdisc add dev eth0 parent 1:10 sfq", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTcScript(strings.NewReader(tt.script))
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("expected a script error, got %v", err)
+			}
+			if scriptErr.Line != tt.line {
+				t.Errorf("expected error on line %d, got %v", tt.line, err)
+			}
+		})
+	}
+}
+
+func TestParseTcScriptHandles(t *testing.T) {
+	script := `
+tc qdisc add dev eth0 root handle 1: hfsc default 20
+tc class add dev eth0 parent 1: classid 1:10 hfsc sc rate 10mbit
+tc class add dev eth0 parent 1: classid 1:20 hfsc sc rate 10mbit
+tc qdisc add dev eth0 parent 1:10 fq_codel
+tc qdisc add dev eth0 parent 1:20 pfifo
+tc qdisc replace dev eth0 parent 1:20 sfq
+`
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := configs["eth0"]
+	if len(conf.Qdiscs) != 3 || conf.Qdiscs["8001:0"].Kind != "fq_codel" || conf.Qdiscs["8002:0"].Kind != "sfq" {
+		t.Errorf("expected the qdiscs without handle to get a free handle, got %v", conf.Qdiscs)
+	}
+	nodes, _ := NodesFromConfig(conf)
+	if result := ComposeTree(nodes); result.Tree == nil || len(result.Leftover) != 0 {
+		t.Errorf("expected the qdiscs without handle to be part of the tree, got %+v", result)
+	}
+}
+
+func TestParseTcScriptReplaceFilter(t *testing.T) {
+	script := `
+tc qdisc add dev eth0 root handle 1: hfsc default 20
+tc filter add dev eth0 parent 1: protocol ip prio 1 u32 match ip dport 22 0xffff flowid 1:10
+tc filter add dev eth0 parent 1: protocol ip prio 1 u32 match ip dport 53 0xffff flowid 1:10
+tc filter replace dev eth0 parent 1: protocol ip prio 2 u32 match mark 0x2 0xf flowid 1:10
+tc filter replace dev eth0 parent 1: protocol ip prio 2 u32 match mark 0x2 0xf flowid 1:20
+tc filter change dev eth0 parent 1: protocol ip prio 2 u32 match mark 0x3 0xf flowid 1:20
+`
+	configs, err := ParseTcScript(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := configs["eth0"].Filters
+	if len(filters) != 3 {
+		t.Fatalf("expected the replaced filter to be overwritten, got %d filters", len(filters))
+	}
+	for name, f := range filters {
+		if f.Info>>16 != 2 {
+			continue
+		}
+		if *f.U32.ClassID != 0x10020 || f.U32.Mark.Val != 3 {
+			t.Errorf("expected %s to be changed, got %+v", name, f.U32)
+		}
+	}
+}
+
+func TestPackU32Key(t *testing.T) {
+	sel := &tc.U32Sel{}
+	// protocol (offset 9) and the source address (offset 12) are in different words
+	if err := packU32Key(sel, 6, 0xff, 8, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := packU32Key(sel, 0x0a000000, 0xff000000, 32, 12); err != nil {
+		t.Fatal(err)
+	}
+	// the source and destination port share a word
+	if err := packU32Key(sel, 80, 0xffff, 16, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := packU32Key(sel, 443, 0xffff, 16, 22); err != nil {
+		t.Fatal(err)
+	}
+	if len(sel.Keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(sel.Keys))
+	}
+	ports := sel.Keys[2]
+	if ntohl(ports.Val) != 80<<16|443 || ntohl(ports.Mask) != 0xffffffff || ports.Off != 20 {
+		t.Errorf("ports are not merged in a single key: %+v", ports)
+	}
+	if ntohl(sel.Keys[0].Val) != 6<<16 || ntohl(sel.Keys[0].Mask) != 0xff<<16 {
+		t.Errorf("protocol is not shifted in its word: %+v", sel.Keys[0])
+	}
+	if err := packU32Key(sel, 81, 0xffff, 16, 20); err == nil {
+		t.Errorf("expected a conflicting match to fail")
+	}
+}
+
+func TestParseTcUnits(t *testing.T) {
+	times := map[string]uint32{"10": 10, "5ms": 5000, "1.5s": 1500000}
+	for s, want := range times {
+		if got, err := parseTcTime(s); err != nil || got != want {
+			t.Errorf("parseTcTime(%q) = %d, %v; expected %d", s, got, err, want)
+		}
+	}
+	sizes := map[string]uint32{"1500": 1500, "1500b": 1500, "2k": 2048, "8kbit": 1024}
+	for s, want := range sizes {
+		if got, err := parseTcSize(s); err != nil || got != want {
+			t.Errorf("parseTcSize(%q) = %d, %v; expected %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"fast", "10furlong", "-1ms"} {
+		if _, err := parseTcTime(s); err == nil {
+			t.Errorf("expected parseTcTime(%q) to fail", s)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+; Test classifiers of cruise-control, compiled with
+;   llc -march=bpf -filetype=obj -o classifier.o classifier.ll
+
+target datalayout = "e-m:e-p:64:64-i64:64-i128:128-n32:64-S128"
+target triple = "bpf"
+
+%struct.bpf_map_def = type { i32, i32, i32, i32, i32 }
+
+; BPF_MAP_TYPE_ARRAY counting the classified packets
+@packets = global %struct.bpf_map_def { i32 2, i32 4, i32 8, i32 1, i32 0 }, section "maps", align 4
+@_license = global [4 x i8] c"GPL\00", section "license", align 1
+
+; classify counts the packets and returns -1, so they go to the class of the filter
+define i32 @classify(i8* %skb) nounwind section "classifier" {
+  %key = alloca i32, align 4
+  store i32 0, i32* %key, align 4
+  %k = bitcast i32* %key to i8*
+  %m = bitcast %struct.bpf_map_def* @packets to i8*
+  %lookup = inttoptr i64 1 to i8* (i8*, i8*)*
+  %v = call i8* %lookup(i8* %m, i8* %k)
+  %null = icmp eq i8* %v, null
+  br i1 %null, label %out, label %count
+count:
+  %p = bitcast i8* %v to i64*
+  %old = load i64, i64* %p, align 8
+  %new = add i64 %old, 1
+  store i64 %new, i64* %p, align 8
+  br label %out
+out:
+  ret i32 -1
+}
+
+; prioritize sets the priority of the packets to 1:21 in direct-action mode
+define i32 @prioritize(i8* %skb) nounwind section "action" {
+  %p = getelementptr i8, i8* %skb, i64 32
+  %priority = bitcast i8* %p to i32*
+  store i32 65569, i32* %priority, align 4
+  ret i32 0
+}
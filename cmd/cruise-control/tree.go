@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
 	"github.com/florianl/go-tc"
+	"within.website/ln"
 )
 
 // CompareTree validates if tr matches the tree of argument n
@@ -48,10 +54,153 @@ func (tr *Node) UpdateTree(n *Node, tcnl *tc.Tc) {
 	}
 }
 
-// ComposeTree composes the tree based on an array of tree nodes
-func ComposeTree(nodes []*Node) (tr *Node) {
-	tr, index := FindRootNode(nodes)
-	nodes = append(nodes[:index], nodes[index+1:]...)
-	tr.ComposeChildren(nodes)
-	return
+// Orphan is a node that can not be added to the tree as its parent is not in the set of nodes
+type Orphan struct {
+	Node          *Node
+	MissingParent uint32
+}
+
+// ComposeResult is the result of composing a tree from a set of nodes. Next to the tree, it holds
+// the problems that prevented nodes from being added to the tree.
+type ComposeResult struct {
+	Tree *Node
+	// Duplicates holds the nodes that share their handle with a node in the tree
+	Duplicates []*Node
+	// Orphans holds the nodes whose parent is missing, their children are not listed
+	Orphans []Orphan
+	// Cycles holds the nodes that are each others ancestors
+	Cycles [][]*Node
+	// Leftover holds all nodes that are not part of the tree
+	Leftover []*Node
+}
+
+// Problems describes the problems found while composing the tree
+func (r ComposeResult) Problems() []string {
+	var problems []string
+	if r.Tree == nil {
+		problems = append(problems, "there is no root qdisc")
+	}
+	for _, n := range r.Duplicates {
+		problems = append(problems, fmt.Sprintf("%s: duplicate handle", nodeTitle(n)))
+	}
+	for _, o := range r.Orphans {
+		problems = append(problems, fmt.Sprintf("%s: parent %s does not exist", nodeTitle(o.Node), FmtHandle(o.MissingParent)))
+	}
+	for _, cycle := range r.Cycles {
+		var titles []string
+		for _, n := range cycle {
+			titles = append(titles, nodeTitle(n))
+		}
+		problems = append(problems, "cycle: "+strings.Join(titles, " -> "))
+	}
+	return problems
+}
+
+// ComposeTree composes the tree based on an array of tree nodes. Nodes that share a handle with an
+// earlier node are left out of the tree. The tree of the result is nil if there is no root node.
+func ComposeTree(nodes []*Node) (result ComposeResult) {
+	handles := make(map[uint32]*Node)
+	var unique []*Node
+	for _, n := range nodes {
+		if _, ok := handles[n.Object.Handle]; ok {
+			result.Duplicates = append(result.Duplicates, n)
+			continue
+		}
+		handles[n.Object.Handle] = n
+		unique = append(unique, n)
+	}
+
+	tr, index := FindRootNode(unique)
+	leftover := unique
+	if tr != nil {
+		leftover = tr.ComposeChildren(append(unique[:index:index], unique[index+1:]...))
+	}
+	result.Tree = tr
+	result.Leftover = append(leftover, result.Duplicates...)
+
+	// walk up the parents of the leftover nodes to find the orphans and cycles
+	left := make(map[uint32]*Node)
+	for _, n := range leftover {
+		left[n.Object.Handle] = n
+	}
+	done := make(map[*Node]bool)
+	for _, n := range leftover {
+		var path []*Node
+		onPath := make(map[*Node]int)
+		for cur := n; cur != nil && !done[cur]; cur = left[cur.Object.Parent] {
+			if i, ok := onPath[cur]; ok {
+				result.Cycles = append(result.Cycles, path[i:])
+				break
+			}
+			onPath[cur] = len(path)
+			path = append(path, cur)
+			if _, ok := handles[cur.Object.Parent]; !ok {
+				result.Orphans = append(result.Orphans, Orphan{Node: cur, MissingParent: cur.Object.Parent})
+				break
+			}
+		}
+		for _, p := range path {
+			done[p] = true
+		}
+	}
+	return result
+}
+
+// DesiredTree composes the tree and the filters of a profile for an interface
+func DesiredTree(ctx context.Context, conf Config, profile string, interf net.Interface, speed Rate) (ComposeResult, []*Node, error) {
+	tcConf, err := createQoS(ctx, conf, profile, interf, conf.linkSpeed(interf, speed), speed)
+	if err != nil {
+		return ComposeResult{}, nil, err
+	}
+	nodes, filters := NodesFromConfig(tcConf)
+	result := ComposeTree(nodes)
+	if result.Tree == nil {
+		return result, nil, fmt.Errorf("profile %q has no root qdisc", profile)
+	}
+	return result, filters, nil
+}
+
+// LiveTree composes the tree and the filters currently configured on an interface. The tree is nil
+// if the interface has no root qdisc.
+func LiveTree(tcnl *tc.Tc, interf net.Interface) (*Node, []*Node) {
+	nodes, filters := GetInterfaceNodes(tcnl, uint32(interf.Index))
+	return ComposeTree(nodes).Tree, filters
+}
+
+// applyTree brings an interface to the desired tree and filters. A tree is applied as a whole to
+// an interface without a tree or with another root qdisc, otherwise only the nodes and filters that
+// differ are changed.
+func applyTree(ctx context.Context, rtnl *tc.Tc, interf net.Interface, tree *Node, filters []*Node) error {
+	if err := attachClsact(rtnl, uint32(interf.Index), filters); err != nil {
+		return err
+	}
+	ln.Log(ctx, ln.Action("Fetching current TC state"))
+	systemTree, systemFilters := LiveTree(rtnl, interf)
+	systemTree, systemFilters = policedOnly(tree, systemTree, systemFilters)
+
+	// the kernel can not change a mqprio qdisc, a changed one is deleted and applied with its queues
+	if tree != nil && systemTree != nil && tree.Object.Kind == "mqprio" && tree.equalMsg(*systemTree) && tree.equalKind(*systemTree) && !tree.equalProperties(*systemTree) {
+		ln.Log(ctx, ln.Info("deleting the changed mqprio qdisc"))
+		if err := deleteQdisc(&systemTree.Object); err != nil {
+			return fmt.Errorf("could not delete qdisc from %d: %v", interf.Index, err)
+		}
+		systemTree = nil
+	}
+	if tree == nil || systemTree != nil && systemTree.Object.Kind == tree.Object.Kind && systemTree.Object.Handle == tree.Object.Handle {
+		plan := BuildPlan(tree, systemTree)
+		ln.Log(ctx, ln.Info("applying %d changes to the qdiscs and classes", len(plan.Steps)))
+		return applyPlan(rtnl, plan, systemTree, filters, systemFilters)
+	}
+
+	ln.Log(ctx, ln.Info("updating the current interfaces qdiscs and classes"))
+	if err := tree.ApplyNode(rtnl); err != nil {
+		return err
+	}
+	ln.Log(ctx, ln.Action("Applying filters"))
+	for _, filt := range filters {
+		if err := filt.ApplyNode(rtnl); err != nil {
+			return err
+		}
+	}
+	return nil
 }
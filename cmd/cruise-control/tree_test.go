@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+)
+
+func testNode(typ string, handle, parent uint32) *Node {
+	return NewNodeWithObject(typ, tc.Object{
+		Msg: tc.Msg{Handle: handle, Parent: parent},
+	})
+}
+
+func TestComposeTree(t *testing.T) {
+	root := testNode("qdisc", core.BuildHandle(1, 0), tc.HandleRoot)
+	class := testNode("class", core.BuildHandle(1, 1), core.BuildHandle(1, 0))
+	duplicate := testNode("class", core.BuildHandle(1, 1), core.BuildHandle(1, 0))
+	orphan := testNode("class", core.BuildHandle(1, 2), core.BuildHandle(1, 0x99))
+	orphanChild := testNode("qdisc", core.BuildHandle(2, 0), core.BuildHandle(1, 2))
+	cycleA := testNode("class", core.BuildHandle(1, 3), core.BuildHandle(1, 4))
+	cycleB := testNode("class", core.BuildHandle(1, 4), core.BuildHandle(1, 3))
+	cycleChild := testNode("qdisc", core.BuildHandle(3, 0), core.BuildHandle(1, 3))
+
+	t.Run("valid", func(t *testing.T) {
+		result := ComposeTree([]*Node{class, root})
+		if result.Tree != root || len(root.Children) != 1 || len(result.Leftover) != 0 {
+			t.Errorf("failed to compose a valid tree: %+v", result)
+		}
+		if problems := result.Problems(); len(problems) != 0 {
+			t.Errorf("expected no problems, got %v", problems)
+		}
+		root.Children = nil
+	})
+
+	t.Run("problems", func(t *testing.T) {
+		result := ComposeTree([]*Node{cycleChild, orphanChild, root, class, duplicate, orphan, cycleA, cycleB})
+		if result.Tree != root || len(root.Children) != 1 {
+			t.Errorf("failed to compose the valid part of the tree: %+v", result)
+		}
+		if len(result.Duplicates) != 1 || result.Duplicates[0] != duplicate {
+			t.Errorf("expected the duplicate to be found, got %v", result.Duplicates)
+		}
+		if len(result.Orphans) != 1 || result.Orphans[0].Node != orphan || result.Orphans[0].MissingParent != core.BuildHandle(1, 0x99) {
+			t.Errorf("expected the orphan to be found, got %v", result.Orphans)
+		}
+		if len(result.Cycles) != 1 || len(result.Cycles[0]) != 2 {
+			t.Errorf("expected the cycle to be found, got %v", result.Cycles)
+		}
+		if len(result.Leftover) != 6 {
+			t.Errorf("expected 6 leftover nodes, got %d", len(result.Leftover))
+		}
+		if problems := result.Problems(); len(problems) != 3 {
+			t.Errorf("expected 3 problems, got %v", problems)
+		}
+		root.Children = nil
+	})
+
+	t.Run("no root", func(t *testing.T) {
+		result := ComposeTree([]*Node{class})
+		if result.Tree != nil || len(result.Leftover) != 1 {
+			t.Errorf("expected no tree, got %+v", result)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+)
+
+// ValidationError describes a problem in a tree that would make the kernel reject it, or that would
+// make it behave differently than intended
+type ValidationError struct {
+	Node    string
+	Problem string
+}
+
+func (e ValidationError) Error() string {
+	return e.Node + ": " + e.Problem
+}
+
+// ValidationErrors is the list of problems found in a tree
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, err := range e {
+		problems[i] = err.Error()
+	}
+	return strings.Join(problems, "\n")
+}
+
+// ValidateTree runs static checks on a composed tree and its filters before it is applied. It checks
+// that handles are unique, that every leaf class has a qdisc, that default classes and filters point
+// to existing (leaf) classes and that the HFSC service curves are consistent.
+func ValidateTree(tree *Node, filters []*Node) ValidationErrors {
+	var errs ValidationErrors
+	report := func(n *Node, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Node: nodeTitle(n), Problem: fmt.Sprintf(format, args...)})
+	}
+
+	handles := make(map[uint32]*Node)
+	classes := make(map[uint32]*Node)
+	tree.Walk(func(n *Node, _ int) {
+		if other, ok := handles[n.Object.Handle]; ok {
+			report(n, "handle is already used by %s, give every qdisc and class a unique handle", nodeTitle(other))
+			return
+		}
+		handles[n.Object.Handle] = n
+		if n.Type == "class" {
+			classes[n.Object.Handle] = n
+		}
+	})
+
+	tree.Walk(func(n *Node, _ int) {
+		switch n.Type {
+		case "qdisc":
+			validateDefaultClass(n, classes, report)
+		case "class":
+			if len(n.Children) == 0 {
+				report(n, "leaf class has no qdisc, attach a leaf qdisc to it")
+			}
+		}
+	})
+	validateHfsc(tree, 0, report)
+
+	for _, f := range filters {
+		target, ok := filterTarget(f)
+		if !ok {
+			continue
+		}
+		class, ok := classes[target]
+		switch {
+		case !ok:
+			report(f, "classifies into class %s, which does not exist", FmtHandle(target))
+		case !isLeafClass(class):
+			report(f, "classifies into class %s, which is not a leaf class", FmtHandle(target))
+		}
+	}
+	return errs
+}
+
+// isLeafClass checks if a class has no child classes
+func isLeafClass(n *Node) bool {
+	for _, child := range n.Children {
+		if child.Type == "class" {
+			return false
+		}
+	}
+	return true
+}
+
+// validateDefaultClass checks that the default class of a classful qdisc is an existing leaf class
+func validateDefaultClass(n *Node, classes map[uint32]*Node, report func(*Node, string, ...interface{})) {
+	var defcls uint32
+	switch {
+	case n.Object.HfscQOpt != nil:
+		defcls = uint32(n.Object.HfscQOpt.DefCls)
+	case n.Object.Htb != nil && n.Object.Htb.Init != nil:
+		defcls = n.Object.Htb.Init.Defcls
+	default:
+		return
+	}
+	if defcls == 0 {
+		return
+	}
+	maj, _ := core.SplitHandle(n.Object.Handle)
+	handle := core.BuildHandle(maj, defcls)
+	class, ok := classes[handle]
+	switch {
+	case !ok:
+		report(n, "default class %s does not exist", FmtHandle(handle))
+	case !isLeafClass(class):
+		report(n, "default class %s is not a leaf class, unclassified traffic would be dropped", FmtHandle(class.Object.Handle))
+	}
+}
+
+// validateHfsc checks that the upper limit of the HFSC classes is not lower than their link-share
+// curve and that the real-time curves of their children fit in their upper limit. When a class has
+// no upper limit, the upper limit of the closest ancestor applies. Only the long-term rate (m2) of
+// the curves is compared.
+func validateHfsc(n *Node, limit uint64, report func(*Node, string, ...interface{})) {
+	if hfsc := n.Object.Hfsc; n.Type == "class" && hfsc != nil {
+		for _, sc := range []*tc.ServiceCurve{hfsc.Rsc, hfsc.Fsc, hfsc.Usc} {
+			if sc != nil && (sc.M1 == math.MaxUint32 || sc.M2 == math.MaxUint32) {
+				report(n, "service curve %s saturates the 32 bit HFSC rate, HFSC can not shape above %s", FmtSC(*sc), FmtRate(math.MaxUint32))
+				break
+			}
+		}
+		if hfsc.Usc != nil && hfsc.Usc.M2 != 0 {
+			if hfsc.Fsc != nil && hfsc.Fsc.M2 > hfsc.Usc.M2 {
+				report(n, "ls m2 %s exceeds ul m2 %s, lower the ls curve or raise the ul curve",
+					FmtRate(uint64(hfsc.Fsc.M2)), FmtRate(uint64(hfsc.Usc.M2)))
+			}
+			limit = uint64(hfsc.Usc.M2)
+		}
+
+		sum := uint64(0)
+		for _, child := range n.Children {
+			if child.Type == "class" && child.Object.Hfsc != nil && child.Object.Hfsc.Rsc != nil {
+				sum += uint64(child.Object.Hfsc.Rsc.M2)
+			}
+		}
+		if limit != 0 && sum > limit {
+			report(n, "the rt m2 of its children add up to %s, which exceeds the upper limit of %s, lower the rt curves of the children",
+				FmtRate(sum), FmtRate(limit))
+		}
+	}
+	for _, child := range n.Children {
+		validateHfsc(child, limit, report)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/florianl/go-tc"
+	"github.com/florianl/go-tc/core"
+)
+
+func hfscTestClass(name string, handle, parent uint32, rt, ls, ul uint32) *Node {
+	n := NewNodeWithObject("class", tc.Object{
+		Msg: tc.Msg{Handle: handle, Parent: parent},
+		Attribute: tc.Attribute{
+			Kind: "hfsc",
+			Hfsc: &tc.Hfsc{
+				Rsc: &tc.ServiceCurve{M2: rt},
+				Fsc: &tc.ServiceCurve{M2: ls},
+				Usc: &tc.ServiceCurve{M2: ul},
+			},
+		},
+	})
+	n.Name = name
+	return n
+}
+
+func leafTestQdisc(handle, parent uint32) *Node {
+	return NewNodeWithObject("qdisc", tc.Object{
+		Msg:       tc.Msg{Handle: handle, Parent: parent},
+		Attribute: tc.Attribute{Kind: "fq_codel", FqCodel: &tc.FqCodel{}},
+	})
+}
+
+func TestValidateProfiles(t *testing.T) {
+	profiles := map[string]TcConfig{
+		"simple":   createQoSSimple(context.Background(), net.Interface{Index: 1}, 1e9, 100e6, SimpleProfile{}),
+		"lanparty": createQoSLanparty(context.Background(), net.Interface{Index: 1}, 1e9, 100e6, LanpartyProfile{}),
+	}
+	for name, conf := range profiles {
+		nodes, filters := NodesFromConfig(conf)
+		result := ComposeTree(nodes)
+		if problems := result.Problems(); len(problems) != 0 {
+			t.Errorf("expected the %s profile to compose, got:\n%v", name, problems)
+		}
+		if errs := ValidateTree(result.Tree, filters); len(errs) != 0 {
+			t.Errorf("expected the %s profile to be valid, got:\n%v", name, errs)
+		}
+	}
+}
+
+func TestValidateMultiGigabit(t *testing.T) {
+	// the interface class of a device without link speed is raised to the internet speed
+	interf := net.Interface{Index: 1, Name: "cc-nonexistent"}
+	for _, profile := range []string{"simple", "lanparty"} {
+		result, filters, err := DesiredTree(context.Background(), Config{}, profile, interf, 10*Gbit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := ValidateTree(result.Tree, filters); len(errs) != 0 {
+			t.Errorf("expected the %s profile to shape 10Gbit, got:\n%v", profile, errs)
+		}
+	}
+}
+
+func TestValidateTree(t *testing.T) {
+	root := NewNodeWithObject("qdisc", tc.Object{
+		Msg: tc.Msg{Handle: core.BuildHandle(1, 0), Parent: tc.HandleRoot},
+		Attribute: tc.Attribute{
+			Kind:     "hfsc",
+			HfscQOpt: &tc.HfscQOpt{DefCls: 0x1},
+		},
+	})
+	nodes := []*Node{
+		root,
+		hfscTestClass("top", core.BuildHandle(1, 1), core.BuildHandle(1, 0), 0, 2000, 1000),
+		hfscTestClass("a", core.BuildHandle(1, 0x10), core.BuildHandle(1, 1), 600, 600, 0),
+		hfscTestClass("b", core.BuildHandle(1, 0x11), core.BuildHandle(1, 1), 600, 600, 0),
+		hfscTestClass("c", core.BuildHandle(1, 0x12), core.BuildHandle(1, 1), 0, 100, 0),
+		leafTestQdisc(core.BuildHandle(0x10, 0), core.BuildHandle(1, 0x10)),
+		leafTestQdisc(core.BuildHandle(0x11, 0), core.BuildHandle(1, 0x11)),
+		leafTestQdisc(core.BuildHandle(0x12, 0), core.BuildHandle(1, 0x12)),
+	}
+	top := core.BuildHandle(1, 1)
+	missing := core.BuildHandle(1, 0x99)
+	filters := []*Node{
+		NewNodeWithObject("filter", tc.Object{
+			Msg:       tc.Msg{Parent: core.BuildHandle(1, 0)},
+			Attribute: tc.Attribute{Kind: "fw", Fw: &tc.Fw{ClassID: &top}},
+		}),
+		NewNodeWithObject("filter", tc.Object{
+			Msg:       tc.Msg{Parent: core.BuildHandle(1, 0)},
+			Attribute: tc.Attribute{Kind: "fw", Fw: &tc.Fw{ClassID: &missing}},
+		}),
+	}
+
+	// composing drops duplicate handles, so add the duplicate afterwards
+	tree := ComposeTree(nodes).Tree
+	tree.Children[0].addChild(hfscTestClass("dup", core.BuildHandle(1, 0x12), core.BuildHandle(1, 1), 0, 100, 0))
+	tree.Children[0].addChild(hfscTestClass("fast", core.BuildHandle(1, 0x13), core.BuildHandle(1, 1), 0, math.MaxUint32, 0))
+
+	errs := ValidateTree(tree, filters)
+	expected := []string{
+		"handle is already used by",
+		"dup: leaf class has no qdisc",
+		"fast: leaf class has no qdisc",
+		"default class 1:1 is not a leaf class",
+		"ls m2 16Kbit exceeds ul m2 8Kbit",
+		"the rt m2 of its children add up to 9.6Kbit, which exceeds the upper limit of 8Kbit",
+		"classifies into class 1:1, which is not a leaf class",
+		"service curve m2 34.35973836Gbit saturates the 32 bit HFSC rate",
+		"classifies into class 1:99, which does not exist",
+	}
+	for _, e := range expected {
+		if !strings.Contains(errs.Error(), e) {
+			t.Errorf("expected a validation error containing %q, got:\n%v", e, errs)
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d validation errors, got %d:\n%v", len(expected), len(errs), errs)
+	}
+}
@@ -6,20 +6,20 @@ replace github.com/florianl/go-tc => /home/francis/Documents/projects/personal/g
 
 require (
 	github.com/florianl/go-tc v0.4.2
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/mdlayher/netlink v1.7.1
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/spf13/viper v1.15.0
 	golang.org/x/sys v0.4.0
 	within.website/ln v0.9.1
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mdlayher/socket v0.4.0 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/pelletier/go-toml/v2 v2.0.6 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -0,0 +1,256 @@
+package simulator
+
+import "math"
+
+// runtimeCurve is a service curve anchored at a point in time (x, in seconds) and service (y, in
+// bytes), like the runtime_sc of the kernel
+type runtimeCurve struct {
+	x, y     float64
+	sm1, sm2 float64
+	dx, dy   float64
+}
+
+func newRuntimeCurve(c *Curve) runtimeCurve {
+	d := c.D.Seconds()
+	return runtimeCurve{sm1: c.M1, dx: d, dy: c.M1 * d, sm2: c.M2}
+}
+
+// x2y returns the service the curve guarantees at time x
+func (r runtimeCurve) x2y(x float64) float64 {
+	switch {
+	case x <= r.x:
+		return r.y
+	case x <= r.x+r.dx:
+		return r.y + (x-r.x)*r.sm1
+	}
+	return r.y + r.dy + (x-r.x-r.dx)*r.sm2
+}
+
+// y2x returns the time at which the curve reaches service y
+func (r runtimeCurve) y2x(y float64) float64 {
+	switch {
+	case y < r.y:
+		return r.x
+	case y <= r.y+r.dy:
+		if r.dy == 0 {
+			return r.x + r.dx
+		}
+		return r.x + (y-r.y)/r.sm1
+	case r.sm2 == 0:
+		return math.Inf(1)
+	}
+	return r.x + r.dx + (y-r.y-r.dy)/r.sm2
+}
+
+// min updates the curve to the minimum of itself and the service curve isc anchored at (x, y)
+func (r *runtimeCurve) min(isc runtimeCurve, x, y float64) {
+	if isc.sm1 <= isc.sm2 {
+		// the service curve is convex
+		if r.x2y(x) < y {
+			return
+		}
+		r.x, r.y = x, y
+		return
+	}
+	// the service curve is concave, find the intersections
+	y1 := r.x2y(x)
+	if y1 <= y {
+		return
+	}
+	if r.x2y(x+isc.dx) >= y+isc.dy {
+		r.x, r.y, r.dx, r.dy = x, y, isc.dx, isc.dy
+		return
+	}
+	dx := (y1 - y) / (isc.sm1 - isc.sm2)
+	if r.x+r.dx > x {
+		dx += r.x + r.dx - x
+	}
+	r.x, r.y, r.dx, r.dy = x, y, dx, dx*isc.sm1
+}
+
+// hfscState is the HFSC state of a class
+type hfscState struct {
+	rsc, fsc, usc                       runtimeCurve
+	deadline, eligible, virtual, ulimit runtimeCurve
+	// cumul is the service received through the real-time criterion, total all service
+	cumul, total  float64
+	e, d, vt, myf float64
+	nactive       int
+	active        bool
+}
+
+type hfsc struct {
+	root   *class
+	leaves []*class
+}
+
+func newHfsc(root *class, classes []*class) *hfsc {
+	h := &hfsc{root: root}
+	for _, cl := range classes {
+		if cl.RT != nil {
+			cl.rsc = newRuntimeCurve(cl.RT)
+			cl.deadline = cl.rsc
+		}
+		if cl.LS != nil {
+			cl.fsc = newRuntimeCurve(cl.LS)
+			cl.virtual = cl.fsc
+		}
+		if cl.UL != nil {
+			cl.usc = newRuntimeCurve(cl.UL)
+			cl.ulimit = cl.usc
+		}
+		cl.myf = math.Inf(-1)
+		if len(cl.children) == 0 && cl != root {
+			h.leaves = append(h.leaves, cl)
+		}
+	}
+	return h
+}
+
+// activate is called when a leaf class gets a backlog
+func (h *hfsc) activate(cl *class, now float64) {
+	if cl.RT != nil {
+		cl.deadline.min(cl.rsc, now, cl.cumul)
+		cl.eligible = cl.deadline
+		if cl.rsc.sm1 <= cl.rsc.sm2 {
+			cl.eligible.dx, cl.eligible.dy = 0, 0
+		}
+		h.updateED(cl)
+	}
+	for ; cl.parent != nil; cl = cl.parent {
+		if cl.active {
+			break
+		}
+		cl.active = true
+		wasActive := cl.parent.nactive > 0
+		cl.parent.nactive++
+		if cl.LS != nil {
+			// start at the average virtual time of the active siblings, so the class can not claim
+			// the service it missed while it was idle
+			lo, hi, ok := siblingVT(cl)
+			if ok && (lo+hi)/2 > cl.vt {
+				cl.vt = (lo + hi) / 2
+			}
+			cl.virtual.min(cl.fsc, cl.vt, cl.total)
+		}
+		if cl.UL != nil {
+			cl.ulimit.min(cl.usc, now, cl.total)
+			cl.myf = cl.ulimit.y2x(cl.total)
+		}
+		if wasActive {
+			break
+		}
+	}
+}
+
+func siblingVT(cl *class) (lo, hi float64, ok bool) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, sibling := range cl.parent.children {
+		if sibling != cl && sibling.active && sibling.LS != nil {
+			lo, hi, ok = math.Min(lo, sibling.vt), math.Max(hi, sibling.vt), true
+		}
+	}
+	return lo, hi, ok
+}
+
+func (h *hfsc) updateED(cl *class) {
+	cl.e = cl.eligible.y2x(cl.cumul)
+	cl.d = cl.deadline.y2x(cl.cumul + cl.queue[0].size)
+}
+
+func (h *hfsc) dequeue(now float64) (*class, float64) {
+	wake := math.Inf(1)
+
+	// the real-time criterion serves the eligible class with the earliest deadline
+	var rt *class
+	for _, cl := range h.leaves {
+		if len(cl.queue) == 0 || cl.RT == nil {
+			continue
+		}
+		if cl.e <= now {
+			if rt == nil || cl.d < rt.d {
+				rt = cl
+			}
+		} else {
+			wake = math.Min(wake, cl.e)
+		}
+	}
+	if rt != nil {
+		rt.cumul += rt.queue[0].size
+		return rt, now
+	}
+
+	// the link-sharing criterion picks the child with the smallest virtual time that is within its
+	// upper limit, from the root down to a leaf
+	cl, fit := h.linkShare(h.root, now)
+	if cl == nil {
+		return nil, math.Min(wake, fit)
+	}
+	return cl, now
+}
+
+// linkShare selects a leaf with a backlog below cl through the link-sharing criterion. When no leaf
+// can be selected it returns when the first upper limit allows a class to be served again.
+func (h *hfsc) linkShare(cl *class, now float64) (*class, float64) {
+	if len(cl.children) == 0 {
+		if len(cl.queue) == 0 {
+			return nil, math.Inf(1)
+		}
+		return cl, now
+	}
+	fit := math.Inf(1)
+	var candidates []*class
+	for _, child := range cl.children {
+		if !child.active || child.LS == nil {
+			continue
+		}
+		if child.myf > now {
+			fit = math.Min(fit, child.myf)
+			continue
+		}
+		candidates = append(candidates, child)
+	}
+	// try the children in order of their virtual time, a child can be blocked by upper limits of
+	// its own children
+	for len(candidates) > 0 {
+		best := 0
+		for i, c := range candidates {
+			if c.vt < candidates[best].vt {
+				best = i
+			}
+		}
+		leaf, childFit := h.linkShare(candidates[best], now)
+		if leaf != nil {
+			return leaf, now
+		}
+		fit = math.Min(fit, childFit)
+		candidates = append(candidates[:best], candidates[best+1:]...)
+	}
+	return nil, fit
+}
+
+func (h *hfsc) sent(leaf *class, size, now float64) {
+	for cl := leaf; cl.parent != nil; cl = cl.parent {
+		cl.total += size
+		if cl.LS != nil {
+			cl.vt = cl.virtual.y2x(cl.total)
+		}
+		if cl.UL != nil {
+			cl.myf = cl.ulimit.y2x(cl.total)
+		}
+	}
+	if len(leaf.queue) > 0 {
+		if leaf.RT != nil {
+			h.updateED(leaf)
+		}
+		return
+	}
+	// the leaf is idle, deactivate it and the parents that have no other active children
+	for cl := leaf; cl.parent != nil && cl.active; cl = cl.parent {
+		cl.active = false
+		cl.parent.nactive--
+		if cl.parent.nactive > 0 {
+			break
+		}
+	}
+}
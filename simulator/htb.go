@@ -0,0 +1,146 @@
+package simulator
+
+import "math"
+
+// htbState is the HTB state of a class. The token buckets are in bytes and can go negative.
+type htbState struct {
+	tokens, ctokens float64
+	// served counts the bytes a leaf sent, relative to its quantum, to share between leaves of the
+	// same priority
+	served float64
+	// lend is the level of the class a leaf borrows from for the packet it sends
+	lend int
+}
+
+type htb struct {
+	classes []*class
+	leaves  []*class
+	last    float64
+}
+
+func newHtb(root *class, classes []*class) *htb {
+	h := &htb{}
+	for _, cl := range classes {
+		if cl == root {
+			continue
+		}
+		if cl.Ceil == 0 {
+			cl.Ceil = cl.Rate
+		}
+		// the defaults of the `tc` command-line tool
+		if cl.Burst == 0 {
+			cl.Burst = cl.Rate/1000 + 1600
+		}
+		if cl.CBurst == 0 {
+			cl.CBurst = cl.Ceil/1000 + 1600
+		}
+		if cl.Quantum == 0 {
+			cl.Quantum = math.Max(1000, math.Min(200000, cl.Rate/10))
+		}
+		cl.tokens, cl.ctokens = cl.Burst, cl.CBurst
+		h.classes = append(h.classes, cl)
+		if len(cl.children) == 0 {
+			h.leaves = append(h.leaves, cl)
+		}
+	}
+	return h
+}
+
+func (h *htb) activate(cl *class, now float64) {
+	// leaves that were idle do not get credit for the time they did not send
+	min := math.Inf(1)
+	for _, leaf := range h.leaves {
+		if leaf != cl && len(leaf.queue) > 0 && leaf.Prio == cl.Prio {
+			min = math.Min(min, leaf.served)
+		}
+	}
+	if !math.IsInf(min, 1) && cl.served < min {
+		cl.served = min
+	}
+}
+
+// refill adds the tokens the classes earned since the last update
+func (h *htb) refill(now float64) {
+	elapsed := now - h.last
+	h.last = now
+	for _, cl := range h.classes {
+		cl.tokens = math.Min(cl.Burst, cl.tokens+elapsed*cl.Rate)
+		cl.ctokens = math.Min(cl.CBurst, cl.ctokens+elapsed*cl.Ceil)
+	}
+}
+
+// level returns how many levels up a leaf has to borrow to send, or -1 when it can not send
+func (h *htb) level(leaf *class) int {
+	level := 0
+	for cl := leaf; cl.parent != nil; cl = cl.parent {
+		if cl.ctokens < 0 {
+			return -1
+		}
+		if cl.tokens >= 0 {
+			return level
+		}
+		level++
+	}
+	return -1
+}
+
+// wait returns when the path of a leaf gets tokens again
+func (h *htb) wait(leaf *class, now float64) float64 {
+	wake := math.Inf(1)
+	for cl := leaf; cl.parent != nil; cl = cl.parent {
+		if cl.ctokens < 0 && cl.Ceil > 0 {
+			wake = math.Min(wake, now-cl.ctokens/cl.Ceil)
+		}
+		if cl.tokens < 0 && cl.Rate > 0 {
+			wake = math.Min(wake, now-cl.tokens/cl.Rate)
+		}
+	}
+	return wake
+}
+
+func (h *htb) dequeue(now float64) (*class, float64) {
+	h.refill(now)
+	var best *class
+	bestLevel := 0
+	wake := math.Inf(1)
+	for _, leaf := range h.leaves {
+		if len(leaf.queue) == 0 {
+			continue
+		}
+		level := h.level(leaf)
+		if level < 0 {
+			wake = math.Min(wake, h.wait(leaf, now))
+			continue
+		}
+		switch {
+		case best == nil, level < bestLevel:
+		case level > bestLevel:
+			continue
+		case leaf.Prio < best.Prio:
+		case leaf.Prio > best.Prio:
+			continue
+		case leaf.served >= best.served:
+			continue
+		}
+		best, bestLevel = leaf, level
+	}
+	if best == nil {
+		return nil, wake
+	}
+	best.lend = bestLevel
+	return best, now
+}
+
+func (h *htb) sent(leaf *class, size, now float64) {
+	h.refill(now)
+	leaf.served += size / leaf.Quantum
+	// the classes below the lending class borrow, so they only pay with their ceil tokens
+	level := 0
+	for cl := leaf; cl.parent != nil; cl = cl.parent {
+		if level >= leaf.lend {
+			cl.tokens -= size
+		}
+		cl.ctokens -= size
+		level++
+	}
+}
@@ -0,0 +1,311 @@
+// Package simulator predicts how an HFSC or HTB hierarchy divides a link between its classes. It
+// runs a packet level simulation of the scheduling disciplines entirely in Go, so profiles can be
+// compared before they are rolled out. The simulation follows the algorithms of the kernel, but it
+// simplifies the parts that only matter for fairness on very short time scales: HFSC virtual times
+// are not re-based between backlog periods and HTB picks between classes of the same priority by
+// their weighted service instead of a deficit round robin.
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Discipline is the scheduling discipline of the simulated hierarchy
+type Discipline string
+
+// The supported disciplines
+const (
+	HFSC Discipline = "hfsc"
+	HTB  Discipline = "htb"
+)
+
+// Curve is an HFSC service curve with a slope of M1 (bytes per second) for the first D and a slope
+// of M2 (bytes per second) afterwards
+type Curve struct {
+	M1 float64
+	D  time.Duration
+	M2 float64
+}
+
+// Class is a class of the simulated hierarchy. Classes without children are leaf classes, which
+// hold the queues traffic arrives in.
+type Class struct {
+	Name     string
+	Children []*Class
+
+	// RT, LS and UL are the real-time, link-sharing and upper limit curves of an HFSC class
+	RT, LS, UL *Curve
+
+	// Rate and Ceil (bytes per second), Burst and CBurst (bytes), Prio and Quantum (bytes) are the
+	// parameters of an HTB class
+	Rate, Ceil    float64
+	Burst, CBurst float64
+	Prio          int
+	Quantum       float64
+}
+
+// Flow is synthetic traffic that arrives in a leaf class. Packets of PacketSize arrive at Rate
+// between Start and Stop, Burst bytes arrive at once on Start.
+type Flow struct {
+	Class      string
+	Rate       float64
+	PacketSize int
+	Burst      int
+	Start      time.Duration
+	// Stop ends the flow, it runs until the end of the simulation when it is 0
+	Stop time.Duration
+}
+
+// Options configure a simulation
+type Options struct {
+	Discipline Discipline
+	// LinkRate is the speed of the link in bytes per second
+	LinkRate float64
+	// Duration is the simulated time
+	Duration time.Duration
+	// QueueLimit is the amount of packets a leaf class queues before it drops, 1000 by default
+	QueueLimit int
+}
+
+// ClassStats are the results of a single class. Inner classes report the totals of their leaf
+// classes.
+type ClassStats struct {
+	Name  string
+	Depth int
+	// Offered, Sent and Dropped are amounts of bytes
+	Offered, Sent, Dropped float64
+	// Throughput is the average rate the class was served at in bytes per second
+	Throughput float64
+	// Share is the fraction of all sent bytes that belong to the class
+	Share float64
+	// MaxDelay and MeanDelay measure the time between the arrival of a packet and the end of its
+	// transmission
+	MaxDelay, MeanDelay time.Duration
+}
+
+// Result holds the statistics of all classes, parents before their children
+type Result struct {
+	Classes []ClassStats
+	// Utilization is the fraction of the link that was used
+	Utilization float64
+}
+
+type packet struct {
+	arrival float64
+	size    float64
+}
+
+// class is the simulation state of a Class
+type class struct {
+	*Class
+	parent   *class
+	children []*class
+	depth    int
+	queue    []packet
+
+	offered, sent, dropped float64
+	delaySum, delayMax     float64
+	packets                float64
+
+	hfscState
+	htbState
+}
+
+// scheduler is a scheduling discipline. dequeue returns the leaf class that sends next, or the
+// time it has to be asked again when no class can send yet.
+type scheduler interface {
+	activate(cl *class, now float64)
+	dequeue(now float64) (cl *class, wake float64)
+	sent(cl *class, size, now float64)
+}
+
+// Simulate runs the flows through the hierarchy below root. root itself represents the link and
+// its parameters are ignored.
+func Simulate(root *Class, flows []Flow, opts Options) (*Result, error) {
+	if root == nil {
+		return nil, errors.New("no hierarchy to simulate")
+	}
+	if opts.LinkRate <= 0 {
+		return nil, errors.New("link rate must be positive")
+	}
+	if opts.Duration <= 0 {
+		return nil, errors.New("duration must be positive")
+	}
+	if opts.QueueLimit == 0 {
+		opts.QueueLimit = 1000
+	}
+
+	var classes []*class
+	leaves := make(map[string]*class)
+	var build func(c *Class, parent *class, depth int) *class
+	build = func(c *Class, parent *class, depth int) *class {
+		cl := &class{Class: c, parent: parent, depth: depth}
+		classes = append(classes, cl)
+		for _, child := range c.Children {
+			cl.children = append(cl.children, build(child, cl, depth+1))
+		}
+		if len(c.Children) == 0 && parent != nil {
+			leaves[c.Name] = cl
+		}
+		return cl
+	}
+	top := build(root, nil, 0)
+	if len(leaves) == 0 {
+		return nil, errors.New("the hierarchy has no leaf classes")
+	}
+
+	var sched scheduler
+	switch opts.Discipline {
+	case HFSC:
+		sched = newHfsc(top, classes)
+	case HTB:
+		sched = newHtb(top, classes)
+	default:
+		return nil, fmt.Errorf("unknown discipline %q", opts.Discipline)
+	}
+
+	arrivals, err := generate(flows, leaves, opts.Duration.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	end := opts.Duration.Seconds()
+	now, next, busy := 0.0, 0, 0.0
+	for now < end {
+		for ; next < len(arrivals) && arrivals[next].arrival <= now; next++ {
+			a := arrivals[next]
+			a.class.offered += a.size
+			if len(a.class.queue) >= opts.QueueLimit {
+				a.class.dropped += a.size
+				continue
+			}
+			a.class.queue = append(a.class.queue, a.packet)
+			if len(a.class.queue) == 1 {
+				sched.activate(a.class, now)
+			}
+		}
+
+		cl, wake := sched.dequeue(now)
+		if cl == nil {
+			// idle until the next arrival or until the scheduler allows a class to send
+			if next < len(arrivals) && arrivals[next].arrival < wake {
+				wake = arrivals[next].arrival
+			}
+			if math.IsInf(wake, 1) || wake <= now {
+				if next >= len(arrivals) {
+					break
+				}
+				wake = arrivals[next].arrival
+			}
+			now = wake
+			continue
+		}
+
+		p := cl.queue[0]
+		cl.queue = cl.queue[1:]
+		xmit := p.size / opts.LinkRate
+		now += xmit
+		busy += xmit
+		delay := now - p.arrival
+		cl.sent += p.size
+		cl.delaySum += delay
+		cl.packets++
+		if delay > cl.delayMax {
+			cl.delayMax = delay
+		}
+		sched.sent(cl, p.size, now)
+	}
+
+	return report(top, end, busy/end), nil
+}
+
+type arrival struct {
+	packet
+	class *class
+}
+
+// generate creates the arrivals of all flows, ordered by time
+func generate(flows []Flow, leaves map[string]*class, end float64) ([]arrival, error) {
+	var arrivals []arrival
+	for _, f := range flows {
+		cl, ok := leaves[f.Class]
+		if !ok {
+			return nil, fmt.Errorf("flow into %q, which is not a leaf class", f.Class)
+		}
+		size := float64(f.PacketSize)
+		if size <= 0 {
+			size = 1500
+		}
+		start, stop := f.Start.Seconds(), f.Stop.Seconds()
+		if stop == 0 || stop > end {
+			stop = end
+		}
+		for burst := float64(f.Burst); burst > 0; burst -= size {
+			arrivals = append(arrivals, arrival{packet{start, math.Min(size, burst)}, cl})
+		}
+		if f.Rate > 0 {
+			for t := start; t < stop; t += size / f.Rate {
+				arrivals = append(arrivals, arrival{packet{t, size}, cl})
+			}
+		}
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return arrivals[i].arrival < arrivals[j].arrival
+	})
+	return arrivals, nil
+}
+
+// report collects the statistics of the classes, inner classes sum up their children
+func report(top *class, end, utilization float64) *Result {
+	res := &Result{Utilization: utilization}
+	var total float64
+	var sum func(cl *class)
+	sum = func(cl *class) {
+		for _, child := range cl.children {
+			sum(child)
+			cl.offered += child.offered
+			cl.sent += child.sent
+			cl.dropped += child.dropped
+			cl.delaySum += child.delaySum
+			cl.packets += child.packets
+			cl.delayMax = math.Max(cl.delayMax, child.delayMax)
+		}
+	}
+	sum(top)
+	total = top.sent
+
+	var walk func(cl *class)
+	walk = func(cl *class) {
+		if cl != top {
+			stats := ClassStats{
+				Name:       cl.Name,
+				Depth:      cl.depth - 1,
+				Offered:    cl.offered,
+				Sent:       cl.sent,
+				Dropped:    cl.dropped,
+				Throughput: cl.sent / end,
+				MaxDelay:   seconds(cl.delayMax),
+			}
+			if total > 0 {
+				stats.Share = cl.sent / total
+			}
+			if cl.packets > 0 {
+				stats.MeanDelay = seconds(cl.delaySum / cl.packets)
+			}
+			res.Classes = append(res.Classes, stats)
+		}
+		for _, child := range cl.children {
+			walk(child)
+		}
+	}
+	walk(top)
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
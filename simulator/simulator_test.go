@@ -0,0 +1,157 @@
+package simulator
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const mbit = 1e6 / 8
+
+func stats(t *testing.T, res *Result, name string) ClassStats {
+	t.Helper()
+	for _, s := range res.Classes {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("no statistics for class %s", name)
+	return ClassStats{}
+}
+
+func near(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance*want
+}
+
+func hfscTree() *Class {
+	return &Class{
+		Name: "root",
+		Children: []*Class{{
+			Name: "internet",
+			LS:   &Curve{M2: 10 * mbit},
+			UL:   &Curve{M2: 10 * mbit},
+			Children: []*Class{
+				{Name: "voip", RT: &Curve{M1: 2 * mbit, D: 5 * time.Millisecond, M2: 500e3 / 8}, LS: &Curve{M2: 1 * mbit}},
+				{Name: "web", LS: &Curve{M2: 6 * mbit}},
+				{Name: "bulk", LS: &Curve{M2: 3 * mbit}, UL: &Curve{M2: 2 * mbit}},
+			},
+		}},
+	}
+}
+
+func TestHfscLinkSharing(t *testing.T) {
+	flows := []Flow{
+		{Class: "web", Rate: 20 * mbit, PacketSize: 1500},
+		{Class: "bulk", Rate: 20 * mbit, PacketSize: 1500},
+	}
+	res, err := Simulate(hfscTree(), flows, Options{Discipline: HFSC, LinkRate: 100 * mbit, Duration: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upper limit of internet caps the link, bulk is capped by its own upper limit and web gets
+	// the remainder
+	if internet := stats(t, res, "internet"); !near(internet.Throughput, 10*mbit, 0.02) {
+		t.Errorf("expected internet to be limited to 10mbit, got %.0f bytes/s", internet.Throughput)
+	}
+	if bulk := stats(t, res, "bulk"); !near(bulk.Throughput, 2*mbit, 0.02) {
+		t.Errorf("expected bulk to be limited to 2mbit, got %.0f bytes/s", bulk.Throughput)
+	}
+	if web := stats(t, res, "web"); !near(web.Throughput, 8*mbit, 0.02) || !near(web.Share, 0.8, 0.02) {
+		t.Errorf("expected web to get the remaining 8mbit, got %.0f bytes/s (%.2f)", web.Throughput, web.Share)
+	}
+	if web := stats(t, res, "web"); web.Dropped == 0 {
+		t.Error("expected web to drop the traffic above its share")
+	}
+}
+
+func TestHfscProportionalShare(t *testing.T) {
+	tree := hfscTree()
+	tree.Children[0].Children[2].UL = nil
+	flows := []Flow{
+		{Class: "web", Rate: 20 * mbit, PacketSize: 1500},
+		{Class: "bulk", Rate: 20 * mbit, PacketSize: 1500},
+	}
+	res, err := Simulate(tree, flows, Options{Discipline: HFSC, LinkRate: 100 * mbit, Duration: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without upper limit, the link is shared 6:3
+	if web, bulk := stats(t, res, "web"), stats(t, res, "bulk"); !near(web.Share, 2.0/3, 0.03) || !near(bulk.Share, 1.0/3, 0.03) {
+		t.Errorf("expected a 2:1 split, got %.2f and %.2f", web.Share, bulk.Share)
+	}
+}
+
+func TestHfscRealTime(t *testing.T) {
+	flows := []Flow{
+		{Class: "voip", Rate: 200e3 / 8, PacketSize: 200},
+		{Class: "web", Rate: 20 * mbit, PacketSize: 1500, Burst: 1 << 20},
+	}
+	res, err := Simulate(hfscTree(), flows, Options{Discipline: HFSC, LinkRate: 10 * mbit, Duration: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	voip := stats(t, res, "voip")
+	if !near(voip.Throughput, 200e3/8, 0.05) {
+		t.Errorf("expected voip to get its full rate, got %.0f bytes/s", voip.Throughput)
+	}
+	// the real-time curve serves a packet within its deadline, on top of the 1.2ms a full size web
+	// packet occupies the link
+	if voip.MaxDelay > 6*time.Millisecond {
+		t.Errorf("expected the voip delay to stay below 6ms, got %s", voip.MaxDelay)
+	}
+	if web := stats(t, res, "web"); web.MaxDelay < 100*time.Millisecond {
+		t.Errorf("expected web to queue, got a maximum delay of %s", web.MaxDelay)
+	}
+}
+
+func TestHtb(t *testing.T) {
+	tree := &Class{
+		Name: "root",
+		Children: []*Class{{
+			Name: "internet",
+			Rate: 10 * mbit,
+			Children: []*Class{
+				{Name: "web", Rate: 7 * mbit, Ceil: 10 * mbit, Prio: 1},
+				{Name: "bulk", Rate: 3 * mbit, Ceil: 10 * mbit, Prio: 1},
+			},
+		}},
+	}
+	opts := Options{Discipline: HTB, LinkRate: 100 * mbit, Duration: 5 * time.Second}
+
+	res, err := Simulate(tree, []Flow{{Class: "bulk", Rate: 20 * mbit}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk := stats(t, res, "bulk"); !near(bulk.Throughput, 10*mbit, 0.02) {
+		t.Errorf("expected bulk to borrow up to its ceil, got %.0f bytes/s", bulk.Throughput)
+	}
+
+	res, err = Simulate(tree, []Flow{{Class: "web", Rate: 20 * mbit}, {Class: "bulk", Rate: 20 * mbit}}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web, bulk := stats(t, res, "web"), stats(t, res, "bulk"); !near(web.Share, 0.7, 0.03) || !near(bulk.Share, 0.3, 0.05) {
+		t.Errorf("expected a 7:3 split, got %.2f and %.2f", web.Share, bulk.Share)
+	}
+	if internet := stats(t, res, "internet"); !near(internet.Throughput, 10*mbit, 0.02) || !near(res.Utilization, 0.1, 0.02) {
+		t.Errorf("expected internet to be limited to 10mbit, got %.0f bytes/s", internet.Throughput)
+	}
+}
+
+func TestSimulateErrors(t *testing.T) {
+	opts := Options{Discipline: HFSC, LinkRate: mbit, Duration: time.Second}
+	if _, err := Simulate(hfscTree(), []Flow{{Class: "internet", Rate: mbit}}, opts); err == nil {
+		t.Error("expected a flow into an inner class to fail")
+	}
+	if _, err := Simulate(hfscTree(), nil, Options{Discipline: "cbq", LinkRate: mbit, Duration: time.Second}); err == nil {
+		t.Error("expected an unknown discipline to fail")
+	}
+	if _, err := Simulate(hfscTree(), nil, Options{Discipline: HFSC, Duration: time.Second}); err == nil {
+		t.Error("expected a missing link rate to fail")
+	}
+	for _, discipline := range []Discipline{HFSC, HTB} {
+		if _, err := Simulate(&Class{Name: "root"}, nil, Options{Discipline: discipline, LinkRate: mbit, Duration: time.Second}); err == nil {
+			t.Errorf("%s: expected a hierarchy without leaf classes to fail", discipline)
+		}
+	}
+}